@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adminUsage = `Usage: vps_manager admin <command>
+  list                                   list admins and balances
+  add <name> <role> [system_user]        create an admin and print its API token
+  remove <name>                          delete an admin
+  limits <name> <max_users> [plan,...]   set a reseller's account limit and plans
+  credit <name> <amount> [reason]        add (or with a negative amount, deduct) credits
+  ledger [name]                          show credit ledger entries`
+
+// runAdminCommand manages admins from the command line. Everything except
+// viewing one's own ledger requires the owner role.
+func runAdminCommand(manager *VPSManager, actor *Actor, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w\n%s", ErrInvalidInput, adminUsage)
+	}
+
+	if args[0] == "ledger" {
+		name := ""
+		if len(args) > 1 {
+			name = args[1]
+		}
+		if !actor.isOwner() {
+			name = actor.Admin.Name
+		}
+		entries, err := manager.Admins.Ledger(name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-20s %-15s %8s %8s  %s\n", "Time", "Admin", "Amount", "Balance", "Reason")
+		for _, entry := range entries {
+			reason := entry.Reason
+			if entry.Username != "" {
+				reason += " (" + entry.Username + ")"
+			}
+			fmt.Printf("%-20s %-15s %8d %8d  %s\n",
+				entry.Time.Format("2006-01-02 15:04:05"), entry.Admin, entry.Amount, entry.Balance, reason)
+		}
+		return nil
+	}
+
+	if err := actor.require(RoleOwner); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		admins, err := manager.Admins.Admins()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-15s %-10s %-12s %8s %9s  %s\n", "Name", "Role", "System User", "Credits", "Max Users", "Plans")
+		for _, admin := range admins {
+			fmt.Printf("%-15s %-10s %-12s %8d %9d  %s\n",
+				admin.Name, admin.Role, admin.SystemUser, admin.Credits, admin.MaxUsers, strings.Join(admin.Plans, ","))
+		}
+
+	case "add":
+		if len(args) < 3 {
+			return fmt.Errorf("%w: usage: admin add <name> <role> [system_user]", ErrInvalidInput)
+		}
+		admin := Admin{Name: args[1], Role: args[2]}
+		if len(args) > 3 {
+			admin.SystemUser = args[3]
+		}
+		token, err := manager.Admins.Create(admin)
+		manager.audit(actor.Admin.Name, "admin.add", admin.Name, nil, err, "role "+admin.Role)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Admin %s created. API token (shown only once): %s\n", admin.Name, token)
+
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf("%w: usage: admin remove <name>", ErrInvalidInput)
+		}
+		err := manager.Admins.Remove(args[1])
+		manager.audit(actor.Admin.Name, "admin.remove", args[1], nil, err, "")
+		if err != nil {
+			return err
+		}
+
+	case "limits":
+		if len(args) < 3 {
+			return fmt.Errorf("%w: usage: admin limits <name> <max_users> [plan,...]", ErrInvalidInput)
+		}
+		maxUsers, err := strconv.Atoi(args[2])
+		if err != nil || maxUsers < 0 {
+			return fmt.Errorf("%w: max_users must be a non-negative number", ErrInvalidInput)
+		}
+		var plans []string
+		if len(args) > 3 {
+			for _, plan := range strings.Split(args[3], ",") {
+				if !manager.hasPlan(plan) {
+					return fmt.Errorf("%w: unknown plan %s", ErrInvalidInput, plan)
+				}
+				plans = append(plans, plan)
+			}
+		}
+		err = manager.Admins.SetLimits(args[1], maxUsers, plans)
+		manager.audit(actor.Admin.Name, "admin.limits", args[1], nil, err,
+			fmt.Sprintf("max %d users, plans %v", maxUsers, plans))
+		if err != nil {
+			return err
+		}
+
+	case "credit":
+		if len(args) < 3 {
+			return fmt.Errorf("%w: usage: admin credit <name> <amount> [reason]", ErrInvalidInput)
+		}
+		amount, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || amount == 0 {
+			return fmt.Errorf("%w: amount must be a non-zero number", ErrInvalidInput)
+		}
+		reason := "manual adjustment"
+		if len(args) > 3 {
+			reason = strings.Join(args[3:], " ")
+		}
+		balance, err := manager.Admins.Credit(args[1], amount, reason)
+		manager.audit(actor.Admin.Name, "admin.credit", args[1], nil, err,
+			fmt.Sprintf("%+d (%s), balance %d", amount, reason, balance))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Balance of %s is now %d\n", args[1], balance)
+
+	default:
+		return fmt.Errorf("%w\n%s", ErrInvalidInput, adminUsage)
+	}
+	return nil
+}
+
+// hasPlan reports whether a plan with the given name is configured
+func (vm *VPSManager) hasPlan(name string) bool {
+	for _, plan := range vm.Config.Plans {
+		if plan.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+const auditUsage = `Usage: vps_manager audit <command>
+  verify                                         check the audit log's hash chain
+  query [-user u] [-actor a] [-since t] [-until t] [-json]
+                                                 list records; times are RFC 3339 or YYYY-MM-DD`
+
+// runAuditCommand verifies and queries the audit log. Resellers may only
+// query their own actions.
+func runAuditCommand(manager *VPSManager, actor *Actor, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w\n%s", ErrInvalidInput, auditUsage)
+	}
+
+	switch args[0] {
+	case "verify":
+		if err := actor.require(RoleOwner, RoleSupport); err != nil {
+			return err
+		}
+		count, head, err := manager.Audit.Verify()
+		if err != nil {
+			return fmt.Errorf("audit log verification failed after %d records: %v", count, err)
+		}
+		fmt.Printf("Audit log OK: %d records, head %s\n", count, head)
+
+	case "query":
+		flags := flag.NewFlagSet("audit query", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		var filter AuditFilter
+		var since, until string
+		asJSON := flags.Bool("json", false, "")
+		flags.StringVar(&filter.User, "user", "", "")
+		flags.StringVar(&filter.Actor, "actor", "", "")
+		flags.StringVar(&since, "since", "", "")
+		flags.StringVar(&until, "until", "", "")
+		if err := flags.Parse(args[1:]); err != nil {
+			return fmt.Errorf("%w: %v\n%s", ErrInvalidInput, err, auditUsage)
+		}
+		var err error
+		if filter.Since, err = parseAuditTime(since); err != nil {
+			return err
+		}
+		if filter.Until, err = parseAuditTime(until); err != nil {
+			return err
+		}
+
+		records, err := manager.Audit.Query(actor.AuditFilter(filter))
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			for _, rec := range records {
+				if err := enc.Encode(rec); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		fmt.Printf("%-20s %-20s %-14s %-15s %-8s %s\n", "Time", "Actor", "Action", "Target", "Result", "Details")
+		for _, rec := range records {
+			details := rec.Details
+			if rec.Error != "" {
+				details = rec.Error
+			}
+			fmt.Printf("%-20s %-20s %-14s %-15s %-8s %s\n",
+				rec.Time.Local().Format("2006-01-02 15:04:05"), rec.Actor, rec.Action, rec.Target, rec.Result, details)
+		}
+
+	default:
+		return fmt.Errorf("%w\n%s", ErrInvalidInput, auditUsage)
+	}
+	return nil
+}
+
+// parseAuditTime accepts RFC 3339 timestamps or dates in local time
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid time %q", ErrInvalidInput, value)
+	}
+	return t, nil
+}
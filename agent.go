@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"./config"
+)
+
+// nodeRPCTimeout bounds a call to an agent. Provisioning may request a
+// certificate, so it is generous.
+const nodeRPCTimeout = 2 * time.Minute
+
+// nodeRequest is the body of an agent RPC
+type nodeRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	XrayUUID string `json:"xray_uuid,omitempty"`
+}
+
+// nodeResponse is the result of an agent RPC. Operations that ran but
+// failed are reported in Error with a 200 status.
+type nodeResponse struct {
+	Account  *NodeAccount    `json:"account,omitempty"`
+	Services []ServiceStatus `json:"services,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// AgentServer serves this server's protocol managers to a controller over
+// mutually authenticated TLS
+type AgentServer struct {
+	manager  *VPSManager
+	cfg      config.AgentConfig
+	server   *http.Server
+	listener net.Listener
+	// mu serializes changes, as the protocol managers rewrite shared
+	// config files
+	mu sync.Mutex
+}
+
+// NewAgentServer creates an agent for the given manager
+func NewAgentServer(manager *VPSManager, cfg config.AgentConfig) (*AgentServer, error) {
+	if cfg.CertPath == "" || cfg.KeyPath == "" || cfg.ClientCAPath == "" {
+		return nil, fmt.Errorf("agent cert_path, key_path and client_ca_path must be configured")
+	}
+	clientCAs, err := loadCertPool(cfg.ClientCAPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &AgentServer{manager: manager, cfg: cfg}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/node/provision", s.handleProvision)
+	mux.HandleFunc("/node/remove", s.handleRemove)
+	mux.HandleFunc("/node/suspend", s.handleSuspend)
+	mux.HandleFunc("/node/resume", s.handleResume)
+	mux.HandleFunc("/node/status", s.handleStatus)
+
+	s.server = &http.Server{
+		Addr:    cfg.Listen,
+		Handler: s.authorize(mux),
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+			MinVersion: tls.VersionTLS12,
+		},
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: nodeRPCTimeout,
+	}
+	return s, nil
+}
+
+// Start listens and serves the agent in the background
+func (s *AgentServer) Start() error {
+	ln, err := net.Listen("tcp", s.cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen for agent: %v", err)
+	}
+	s.listener = ln
+
+	go func() {
+		if err := s.server.ServeTLS(ln, s.cfg.CertPath, s.cfg.KeyPath); err != nil && err != http.ErrServerClosed {
+			log.Printf("Agent stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the agent is listening on
+func (s *AgentServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Shutdown gracefully stops the agent
+func (s *AgentServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// authorize restricts callers to the allowed client certificate names, if
+// any are configured. The TLS handshake has already verified the chain.
+func (s *AgentServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			writeError(w, http.StatusUnauthorized, "client certificate required")
+			return
+		}
+		name := r.TLS.PeerCertificates[0].Subject.CommonName
+		if len(s.cfg.AllowedClients) > 0 && !containsString(s.cfg.AllowedClients, name) {
+			log.Printf("Agent rejected client %q from %s", name, r.RemoteAddr)
+			writeError(w, http.StatusForbidden, "client not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// agentActor is the audit actor for calls from a controller
+func agentActor(r *http.Request) string {
+	return "agent:" + r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// decodeNodeRequest parses a POSTed RPC body and checks the username
+func decodeNodeRequest(w http.ResponseWriter, r *http.Request) (nodeRequest, bool) {
+	var req nodeRequest
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return req, false
+	}
+	if !decodeRequest(w, r, &req) {
+		return req, false
+	}
+	if !usernamePattern.MatchString(req.Username) {
+		writeError(w, http.StatusBadRequest, "invalid username")
+		return req, false
+	}
+	return req, true
+}
+
+func (s *AgentServer) handleProvision(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeNodeRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := validateUser(req.Username, req.Password, 1); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	account, err := s.manager.provisionLocal(req.Username, req.Password, req.XrayUUID)
+	s.mu.Unlock()
+	s.manager.audit(agentActor(r), "node.provision", req.Username, account.Protocols, err, "")
+	writeNodeResult(w, nodeResponse{Account: &account}, err)
+}
+
+func (s *AgentServer) handleRemove(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeNodeRequest(w, r)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	err := s.manager.removeLocal(req.Username)
+	s.mu.Unlock()
+	s.manager.audit(agentActor(r), "node.remove", req.Username, nil, err, "")
+	writeNodeResult(w, nodeResponse{}, err)
+}
+
+func (s *AgentServer) handleSuspend(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeNodeRequest(w, r)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	err := s.manager.suspendLocal(req.Username)
+	s.mu.Unlock()
+	s.manager.audit(agentActor(r), "node.suspend", req.Username, suspendProtocols, err, "")
+	writeNodeResult(w, nodeResponse{}, err)
+}
+
+func (s *AgentServer) handleResume(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeNodeRequest(w, r)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	err := s.manager.resumeLocal(req.Username, req.XrayUUID)
+	s.mu.Unlock()
+	s.manager.audit(agentActor(r), "node.resume", req.Username, suspendProtocols, err, "")
+	writeNodeResult(w, nodeResponse{}, err)
+}
+
+func (s *AgentServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeNodeResult(w, nodeResponse{Services: s.manager.ProtocolStatus()}, nil)
+}
+
+func writeNodeResult(w http.ResponseWriter, resp nodeResponse, err error) {
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// remoteNode calls an agent on another server
+type remoteNode struct {
+	name    string
+	baseURL string
+	client  *http.Client
+}
+
+// newRemoteNodes creates clients for the configured agents
+func newRemoteNodes(cfg config.NodesConfig) (map[string]NodeClient, error) {
+	nodes := make(map[string]NodeClient)
+	if len(cfg.Nodes) == 0 {
+		return nodes, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertPath, cfg.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load node client certificate: %v", err)
+	}
+	rootCAs, err := loadCertPool(cfg.CAPath)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Timeout: nodeRPCTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				RootCAs:      rootCAs,
+				MinVersion:   tls.VersionTLS12,
+			},
+		},
+	}
+
+	for _, node := range cfg.Nodes {
+		if node.Name == "" || node.Name == localNodeName || node.Address == "" {
+			return nil, fmt.Errorf("node %q needs a name other than %q and an address", node.Name, localNodeName)
+		}
+		if _, dup := nodes[node.Name]; dup {
+			return nil, fmt.Errorf("node %s is configured twice", node.Name)
+		}
+		nodes[node.Name] = &remoteNode{name: node.Name, baseURL: "https://" + node.Address, client: client}
+	}
+	return nodes, nil
+}
+
+func (n *remoteNode) Provision(username, password, xrayUUID string) (NodeAccount, error) {
+	resp, err := n.call(http.MethodPost, "/node/provision", nodeRequest{Username: username, Password: password, XrayUUID: xrayUUID})
+	var account NodeAccount
+	if resp.Account != nil {
+		account = *resp.Account
+	}
+	return account, err
+}
+
+func (n *remoteNode) Remove(username string) error {
+	_, err := n.call(http.MethodPost, "/node/remove", nodeRequest{Username: username})
+	return err
+}
+
+func (n *remoteNode) Suspend(username string) error {
+	_, err := n.call(http.MethodPost, "/node/suspend", nodeRequest{Username: username})
+	return err
+}
+
+func (n *remoteNode) Resume(username, xrayUUID string) error {
+	_, err := n.call(http.MethodPost, "/node/resume", nodeRequest{Username: username, XrayUUID: xrayUUID})
+	return err
+}
+
+func (n *remoteNode) Status() ([]ServiceStatus, error) {
+	resp, err := n.call(http.MethodGet, "/node/status", nil)
+	return resp.Services, err
+}
+
+// call performs one RPC. The response is returned along with the
+// operation's error so partial results, such as the protocols touched by a
+// failed provisioning, are not lost.
+func (n *remoteNode) call(method, path string, body interface{}) (nodeResponse, error) {
+	var resp nodeResponse
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return resp, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, n.baseURL+path, reader)
+	if err != nil {
+		return resp, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := n.client.Do(req)
+	if err != nil {
+		return resp, fmt.Errorf("node %s unreachable: %v", n.name, err)
+	}
+	defer httpResp.Body.Close()
+
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return resp, fmt.Errorf("failed to read response from node %s: %v", n.name, err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(data, &apiErr)
+		if apiErr.Error == "" {
+			apiErr.Error = httpResp.Status
+		}
+		return resp, fmt.Errorf("node %s rejected request: %s", n.name, apiErr.Error)
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return resp, fmt.Errorf("invalid response from node %s: %v", n.name, err)
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// loadCertPool reads PEM certificates to trust from path
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// runAgent serves the node agent until SIGINT or SIGTERM
+func runAgent(manager *VPSManager) error {
+	agent, err := NewAgentServer(manager, manager.Config.Agent)
+	if err != nil {
+		return err
+	}
+	if err := agent.Start(); err != nil {
+		return err
+	}
+	log.Printf("Agent listening on %s", agent.Addr())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %v, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return agent.Shutdown(ctx)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"./config"
+)
+
+// testCA issues certificates for agent tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, dir: dir}
+	writePEM(t, ca.path(name+".crt"), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) path(name string) string { return filepath.Join(ca.dir, name) }
+
+// issue writes a leaf certificate and key named name.crt and name.key
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, ca.path(name+".crt"), "CERTIFICATE", der)
+	writePEM(t, ca.path(name+".key"), "EC PRIVATE KEY", keyDER)
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestCluster starts an agent backed by stub managers and returns it
+// with a controller that has it registered as node "edge", along with the
+// CA both trust
+func newTestCluster(t *testing.T) (controller, agent *testManager, ca *testCA) {
+	t.Helper()
+	dir := t.TempDir()
+	ca = newTestCA(t, dir, "ca")
+	ca.issue(t, "agent", x509.ExtKeyUsageServerAuth)
+	ca.issue(t, "controller", x509.ExtKeyUsageClientAuth)
+
+	agent = newTestManager(t)
+	server, err := NewAgentServer(agent.VPSManager, config.AgentConfig{
+		Listen:         "127.0.0.1:0",
+		CertPath:       ca.path("agent.crt"),
+		KeyPath:        ca.path("agent.key"),
+		ClientCAPath:   ca.path("ca.crt"),
+		AllowedClients: []string{"controller"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	controller = newTestManager(t)
+	controller.Nodes, err = newRemoteNodes(config.NodesConfig{
+		CertPath: ca.path("controller.crt"),
+		KeyPath:  ca.path("controller.key"),
+		CAPath:   ca.path("ca.crt"),
+		Nodes:    []config.NodeConfig{{Name: "edge", Address: server.Addr()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return controller, agent, ca
+}
+
+func TestProvisionOnRemoteNode(t *testing.T) {
+	controller, agent, _ := newTestCluster(t)
+
+	err := controller.OwnerActor("root").AddUser("alice", "secret1", "", 30, Contact{}, []string{"local", "edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := controller.GetUser("alice")
+	if user.Nodes["local"].Status != NodeActive || user.Nodes["edge"].Status != NodeActive {
+		t.Fatalf("unexpected node states: %+v", user.Nodes)
+	}
+	if strings.Join(agent.xray.calls, ",") != "AddUserWithID" {
+		t.Fatalf("agent should reuse the controller's Xray ID, got %v", agent.xray.calls)
+	}
+
+	if err := controller.SuspendUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	user, _ = controller.GetUser("alice")
+	if !user.Suspended || user.Nodes["edge"].Status != NodeSuspended {
+		t.Fatalf("edge not suspended: %+v", user)
+	}
+
+	if err := controller.RemoveUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := strings.Join(agent.ssh.calls, ","); calls != "AddUser,LockUser,RemoveUser" {
+		t.Fatalf("unexpected agent SSH calls: %s", calls)
+	}
+
+	records, err := agent.Audit.Query(AuditFilter{Actor: "agent:controller"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected the agent to audit 3 calls, got %+v", records)
+	}
+}
+
+func TestNodeFailuresTrackedOnUser(t *testing.T) {
+	controller, agent, _ := newTestCluster(t)
+
+	agent.ssh.fail["AddUser"] = true
+	err := controller.OwnerActor("root").AddUser("alice", "secret1", "", 30, Contact{}, []string{"local", "edge"})
+	if err != nil {
+		t.Fatalf("add should succeed on the healthy node: %v", err)
+	}
+	user, _ := controller.GetUser("alice")
+	if user.Nodes["local"].Status != NodeActive || user.Nodes["edge"].Status != NodeFailed || user.Nodes["edge"].Error == "" {
+		t.Fatalf("unexpected node states: %+v", user.Nodes)
+	}
+
+	// The failed node is skipped from then on
+	if err := controller.SuspendUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.ResumeUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := controller.OwnerActor("root").AddUser("bobby", "secret1", "", 30, Contact{}, []string{"edge"}); err == nil {
+		t.Fatal("expected add on the failing node alone to fail")
+	}
+	if _, err := controller.GetUser("bobby"); err == nil {
+		t.Fatal("user stored although provisioning failed everywhere")
+	}
+
+	agent.ssh.fail["AddUser"] = false
+	if err := controller.OwnerActor("root").AddUser("carol", "secret1", "", 30, Contact{}, []string{"local", "edge"}); err != nil {
+		t.Fatal(err)
+	}
+	agent.ssh.fail["LockUser"] = true
+	if err := controller.SuspendUser("carol"); err == nil || !strings.Contains(err.Error(), "edge") {
+		t.Fatalf("expected suspend to fail on edge, got %v", err)
+	}
+	user, _ = controller.GetUser("carol")
+	if user.Suspended || user.Nodes["local"].Status != NodeSuspended || user.Nodes["edge"].Error == "" {
+		t.Fatalf("unexpected state after partial suspend: %+v", user)
+	}
+}
+
+func TestFailedRemoteRemovalKeepsUser(t *testing.T) {
+	controller, agent, _ := newTestCluster(t)
+	err := controller.OwnerActor("root").AddUser("alice", "secret1", "", 30, Contact{}, []string{"local", "edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent.ssh.fail["RemoveUser"] = true
+	if err := controller.RemoveUser("alice"); err == nil || !strings.Contains(err.Error(), "edge") {
+		t.Fatalf("expected the removal to fail on edge, got %v", err)
+	}
+	user, err := controller.GetUser("alice")
+	if err != nil {
+		t.Fatalf("user dropped while still on edge: %v", err)
+	}
+	if _, ok := user.Nodes["local"]; ok || user.Nodes["edge"].Status != NodeRemoving || user.Nodes["edge"].Error == "" {
+		t.Fatalf("unexpected node states: %+v", user.Nodes)
+	}
+
+	// Removing again retries only the node that failed
+	agent.ssh.fail["RemoveUser"] = false
+	controller.ssh.calls = nil
+	if err := controller.RemoveUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if len(controller.ssh.calls) != 0 {
+		t.Fatalf("local account removed twice: %v", controller.ssh.calls)
+	}
+	if _, err := controller.GetUser("alice"); err == nil {
+		t.Fatal("user kept after every node removed the account")
+	}
+}
+
+func TestAgentRejectsUntrustedClient(t *testing.T) {
+	controller, _, ca := newTestCluster(t)
+	edge := controller.Nodes["edge"].(*remoteNode)
+
+	rogue := newTestCA(t, t.TempDir(), "rogue")
+	rogue.issue(t, "controller", x509.ExtKeyUsageClientAuth)
+	nodes, err := newRemoteNodes(config.NodesConfig{
+		CertPath: rogue.path("controller.crt"),
+		KeyPath:  rogue.path("controller.key"),
+		CAPath:   ca.path("ca.crt"),
+		Nodes:    []config.NodeConfig{{Name: "edge", Address: strings.TrimPrefix(edge.baseURL, "https://")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes["edge"].Status(); err == nil {
+		t.Fatal("agent accepted a certificate from an untrusted CA")
+	}
+
+	if _, err := edge.Status(); err != nil {
+		t.Fatalf("trusted controller rejected: %v", err)
+	}
+}
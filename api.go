@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"./config"
+)
+
+// APIServer exposes VPSManager operations as an HTTP JSON API
+type APIServer struct {
+	manager *VPSManager
+	token   string
+	server  *http.Server
+}
+
+// userResponse is the public view of a User, without the password hash
+type userResponse struct {
+	Username   string               `json:"username"`
+	ExpireDate time.Time            `json:"expire_date"`
+	Expired    bool                 `json:"expired"`
+	Suspended  bool                 `json:"suspended"`
+	Protocols  []string             `json:"protocols"`
+	Owner      string               `json:"owner,omitempty"`
+	Email      string               `json:"email,omitempty"`
+	Language   string               `json:"language,omitempty"`
+	Nodes      map[string]NodeState `json:"nodes,omitempty"`
+	Traffic    TrafficUsage         `json:"traffic"`
+	Outbound   string               `json:"xray_outbound,omitempty"`
+}
+
+// adminResponse describes the authenticated admin, without its token hash
+type adminResponse struct {
+	Name     string   `json:"name"`
+	Role     string   `json:"role"`
+	Credits  int64    `json:"credits"`
+	MaxUsers int      `json:"max_users"`
+	Plans    []string `json:"plans"`
+}
+
+// createUserRequest takes either a plan or, for owners, a number of days
+type createUserRequest struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	Plan       string   `json:"plan"`
+	ExpireDays int      `json:"expire_days"`
+	Email      string   `json:"email"`
+	Language   string   `json:"language"`
+	Nodes      []string `json:"nodes"`
+}
+
+type renewUserRequest struct {
+	Plan string `json:"plan"`
+	Days int    `json:"days"`
+}
+
+type actorKey struct{}
+
+// requestActor returns the admin a request was authenticated as
+func requestActor(r *http.Request) *Actor {
+	return r.Context().Value(actorKey{}).(*Actor)
+}
+
+// NewAPIServer creates an API server for the given manager
+func NewAPIServer(manager *VPSManager, cfg config.APIConfig) *APIServer {
+	s := &APIServer{
+		manager: manager,
+		token:   cfg.Token,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/users", s.handleUsers)
+	mux.HandleFunc("/api/users/", s.handleUser)
+	mux.HandleFunc("/api/protocols", s.handleProtocols)
+	mux.HandleFunc("/api/me", s.handleMe)
+	mux.HandleFunc("/api/audit", s.handleAudit)
+
+	s.server = &http.Server{
+		Addr:         cfg.Listen,
+		Handler:      s.authenticate(mux),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+	return s
+}
+
+// Start serves the API in the background
+func (s *APIServer) Start() error {
+	if s.token == "" {
+		return fmt.Errorf("api token is not configured")
+	}
+
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("API server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown gracefully stops the API server
+func (s *APIServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// authenticate requires an "Authorization: Bearer <token>" header. The
+// configured token acts as owner; admin tokens act as that admin.
+func (s *APIServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		var actor *Actor
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+			actor = s.manager.OwnerActor("api")
+		} else if token != "" {
+			admin, ok, err := s.manager.Admins.Authenticate(token)
+			if err != nil {
+				log.Printf("API authentication failed: %v", err)
+				writeError(w, http.StatusInternalServerError, "authentication failed")
+				return
+			}
+			if ok {
+				actor = s.manager.ActorFor(admin)
+			}
+		}
+		if actor == nil {
+			writeError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, actor)))
+	})
+}
+
+// handleUsers serves GET and POST on /api/users
+func (s *APIServer) handleUsers(w http.ResponseWriter, r *http.Request) {
+	actor := requestActor(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		users, err := actor.Users()
+		if err != nil {
+			writeManagerError(w, err)
+			return
+		}
+		resp := make([]userResponse, 0, len(users))
+		for _, user := range users {
+			resp = append(resp, newUserResponse(user))
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case http.MethodPost:
+		var req createUserRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		contact := Contact{Email: req.Email, Language: req.Language}
+		if err := actor.AddUser(req.Username, req.Password, req.Plan, req.ExpireDays, contact, req.Nodes); err != nil {
+			writeManagerError(w, err)
+			return
+		}
+		user, err := actor.User(req.Username)
+		if err != nil {
+			writeManagerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, newUserResponse(user))
+
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// handleUser serves /api/users/{name} and its actions
+func (s *APIServer) handleUser(w http.ResponseWriter, r *http.Request) {
+	actor := requestActor(r)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/"), "/")
+	username := parts[0]
+	if username == "" || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			user, err := actor.User(username)
+			if err != nil {
+				writeManagerError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, newUserResponse(user))
+
+		case http.MethodDelete:
+			if err := actor.RemoveUser(username); err != nil {
+				writeManagerError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var err error
+	switch parts[1] {
+	case "renew":
+		var req renewUserRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		_, err = actor.RenewUser(username, req.Plan, req.Days)
+	case "suspend":
+		err = actor.SuspendUser(username)
+	case "resume":
+		err = actor.ResumeUser(username)
+	case "contact":
+		var req Contact
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		err = actor.SetContact(username, req)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+
+	user, err := actor.User(username)
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newUserResponse(user))
+}
+
+// handleMe reports the authenticated admin's role, limits and balance
+func (s *APIServer) handleMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	admin := requestActor(r).Admin
+	if admin.Role != RoleOwner {
+		// Re-read the balance, which may have changed since authentication
+		fresh, err := s.manager.Admins.Get(admin.Name)
+		if err != nil {
+			writeManagerError(w, err)
+			return
+		}
+		admin = fresh
+	}
+	writeJSON(w, http.StatusOK, adminResponse{
+		Name:     admin.Name,
+		Role:     admin.Role,
+		Credits:  admin.Credits,
+		MaxUsers: admin.MaxUsers,
+		Plans:    admin.Plans,
+	})
+}
+
+// handleAudit queries the audit log with the user, actor, since and until
+// parameters; resellers only see their own actions
+func (s *APIServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := AuditFilter{User: query.Get("user"), Actor: query.Get("actor")}
+	var err error
+	if filter.Since, err = parseAuditTime(query.Get("since")); err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	if filter.Until, err = parseAuditTime(query.Get("until")); err != nil {
+		writeManagerError(w, err)
+		return
+	}
+
+	records, err := s.manager.Audit.Query(requestActor(r).AuditFilter(filter))
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// handleProtocols reports the state of each protocol's service
+func (s *APIServer) handleProtocols(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.manager.ProtocolStatus())
+}
+
+func newUserResponse(user User) userResponse {
+	return userResponse{
+		Username:   user.Username,
+		ExpireDate: user.ExpireDate,
+		Expired:    time.Now().After(user.ExpireDate),
+		Suspended:  user.Suspended,
+		Protocols:  user.Protocols,
+		Owner:      user.Owner,
+		Email:      user.Email,
+		Language:   user.Language,
+		Nodes:      user.Nodes,
+		Traffic:    user.Traffic,
+		Outbound:   user.XrayOutbound,
+	}
+}
+
+// decodeRequest parses a JSON body, writing a 400 response on failure
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+// writeManagerError maps VPSManager errors to HTTP status codes
+func writeManagerError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidInput):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrUserNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrUserExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrVetoed):
+		writeError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, ErrNoCredits):
+		writeError(w, http.StatusPaymentRequired, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"./config"
+)
+
+func newTestAPI(t *testing.T) (*testManager, http.Handler) {
+	t.Helper()
+	m := newTestManager(t)
+	api := NewAPIServer(m.VPSManager, config.APIConfig{Token: "test-token"})
+	return m, api.server.Handler
+}
+
+func doRequest(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return doRequestWithToken(t, h, "test-token", method, path, body)
+}
+
+func doRequestWithToken(t *testing.T, h http.Handler, token, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIRequiresToken(t *testing.T) {
+	_, h := newTestAPI(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+}
+
+func TestWriteManagerError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("%w: bad username", ErrInvalidInput), http.StatusBadRequest},
+		{ErrUserNotFound, http.StatusNotFound},
+		{ErrUserExists, http.StatusConflict},
+		{fmt.Errorf("%w: limit reached", ErrForbidden), http.StatusForbidden},
+		{ErrNoCredits, http.StatusPaymentRequired},
+		{errors.New("useradd failed"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		writeManagerError(rec, tt.err)
+		if rec.Code != tt.status {
+			t.Errorf("%v: expected %d, got %d", tt.err, tt.status, rec.Code)
+		}
+		var body map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] == "" {
+			t.Errorf("%v: expected JSON error body, got %q", tt.err, rec.Body.String())
+		}
+	}
+}
+
+func TestAPIUserLifecycle(t *testing.T) {
+	_, h := newTestAPI(t)
+
+	rec := doRequest(t, h, http.MethodPost, "/api/users", `{"username":"alice","password":"secret1","expire_days":30}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/api/users", `{"username":"alice","password":"secret1","expire_days":30}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("duplicate: expected 409, got %d", rec.Code)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/api/users/alice", "")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "password") {
+		t.Fatalf("get: unexpected %d %s", rec.Code, rec.Body)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/api/users/alice/suspend", "")
+	var user userResponse
+	json.Unmarshal(rec.Body.Bytes(), &user)
+	if rec.Code != http.StatusOK || !user.Suspended {
+		t.Fatalf("suspend: unexpected %d %s", rec.Code, rec.Body)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/api/users/alice/resume", "")
+	json.Unmarshal(rec.Body.Bytes(), &user)
+	if rec.Code != http.StatusOK || user.Suspended {
+		t.Fatalf("resume: unexpected %d %s", rec.Code, rec.Body)
+	}
+
+	rec = doRequest(t, h, http.MethodDelete, "/api/users/alice", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", rec.Code)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/api/users/alice", "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("get after delete: expected 404, got %d", rec.Code)
+	}
+}
+
+func TestAPIUserRouting(t *testing.T) {
+	m, h := newTestAPI(t)
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/api/users", "", http.StatusOK},
+		{http.MethodPut, "/api/users", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/users", `{"username":"Bad!","password":"secret1","expire_days":1}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/users", `{"unknown":1}`, http.StatusBadRequest},
+		{http.MethodGet, "/api/users/", "", http.StatusNotFound},
+		{http.MethodPut, "/api/users/alice", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/users/alice/renew", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/users/alice/renew", `{"days":0}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/users/alice/renew", `{"days":10}`, http.StatusOK},
+		{http.MethodPost, "/api/users/nobody/renew", `{"days":10}`, http.StatusNotFound},
+		{http.MethodPost, "/api/users/alice/explode", "", http.StatusNotFound},
+		{http.MethodPost, "/api/users/alice/renew/extra", "", http.StatusNotFound},
+		{http.MethodGet, "/api/protocols", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		rec := doRequest(t, h, tt.method, tt.path, tt.body)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: expected %d, got %d: %s", tt.method, tt.path, tt.status, rec.Code, rec.Body)
+		}
+	}
+}
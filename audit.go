@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const auditDefaultPath = "/var/log/vps_manager/audit.log"
+
+// auditSystem is the actor recorded for operations nobody asked for, such
+// as removing expired users
+const auditSystem = "system"
+
+// AuditRecord is one line of the audit log. Each record carries the hash of
+// the one before it, so editing or deleting a record breaks the chain.
+type AuditRecord struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	Protocols []string  `json:"protocols,omitempty"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+	Details   string    `json:"details,omitempty"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+// AuditFilter selects records in Query. Empty fields match everything.
+type AuditFilter struct {
+	User  string
+	Actor string
+	Since time.Time
+	Until time.Time
+}
+
+func (f AuditFilter) match(rec AuditRecord) bool {
+	return (f.User == "" || rec.Target == f.User) &&
+		(f.Actor == "" || rec.Actor == f.Actor) &&
+		(f.Since.IsZero() || !rec.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || rec.Time.Before(f.Until))
+}
+
+// AuditLog appends hash-chained JSON records to a file shared by every
+// vps_manager process
+type AuditLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewAuditLog creates an audit log backed by the file at path
+func NewAuditLog(path string) *AuditLog {
+	if path == "" {
+		path = auditDefaultPath
+	}
+	return &AuditLog{path: path}
+}
+
+// Append links rec to the end of the chain and writes it durably
+func (l *AuditLog) Append(rec AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock audit log: %v", err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	last, err := lastLine(f)
+	if err != nil {
+		return fmt.Errorf("failed to read audit log: %v", err)
+	}
+	if len(last) > 0 {
+		var prev AuditRecord
+		if err := json.Unmarshal(last, &prev); err != nil {
+			return fmt.Errorf("failed to parse last audit record: %v", err)
+		}
+		rec.Seq = prev.Seq + 1
+		rec.PrevHash = prev.Hash
+	} else {
+		rec.Seq = 1
+		rec.PrevHash = ""
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	if rec.Hash, err = auditHash(rec); err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log: %v", err)
+	}
+	return nil
+}
+
+// Query returns the records matching filter, oldest first
+func (l *AuditLog) Query(filter AuditFilter) ([]AuditRecord, error) {
+	records := make([]AuditRecord, 0)
+	err := l.scan(func(rec AuditRecord, _ []byte) error {
+		if filter.match(rec) {
+			records = append(records, rec)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Verify checks every record's hash and its link to the previous record.
+// It returns the number of records and the hash of the last one, which can
+// be kept elsewhere to also detect records removed from the end.
+func (l *AuditLog) Verify() (int, string, error) {
+	count := 0
+	head := ""
+	err := l.scan(func(rec AuditRecord, _ []byte) error {
+		count++
+		if rec.Seq != uint64(count) {
+			return fmt.Errorf("record %d has sequence number %d", count, rec.Seq)
+		}
+		if rec.PrevHash != head {
+			return fmt.Errorf("record %d does not follow the previous record", rec.Seq)
+		}
+		hash, err := auditHash(rec)
+		if err != nil {
+			return err
+		}
+		if hash != rec.Hash {
+			return fmt.Errorf("record %d has been modified", rec.Seq)
+		}
+		head = rec.Hash
+		return nil
+	})
+	return count, head, err
+}
+
+// scan calls fn for each record in file order
+func (l *AuditLog) scan(fn func(AuditRecord, []byte) error) error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return fmt.Errorf("failed to lock audit log: %v", err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d is not a valid audit record: %v", line, err)
+		}
+		if err := fn(rec, scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// auditHash is the SHA-256 of the record's JSON encoding with Hash empty
+func auditHash(rec AuditRecord) (string, error) {
+	rec.Hash = ""
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lastLine returns the final non-empty line of f without reading the
+// whole file
+func lastLine(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	for window := int64(4096); ; window *= 2 {
+		if window > size {
+			window = size
+		}
+		buf := make([]byte, window)
+		if _, err := f.ReadAt(buf, size-window); err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = bytes.TrimRight(buf, "\n")
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			return buf[i+1:], nil
+		}
+		if window == size {
+			return buf, nil
+		}
+	}
+}
+
+// audit records the outcome of an operation. A failure to write the record
+// is logged and counted, but does not undo an operation that already
+// happened.
+func (vm *VPSManager) audit(actor, action, target string, protocols []string, opErr error, details string) {
+	rec := AuditRecord{
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Protocols: protocols,
+		Result:    "success",
+		Details:   details,
+	}
+	if opErr != nil {
+		rec.Result = "failure"
+		rec.Error = opErr.Error()
+	}
+
+	if err := vm.Audit.Append(rec); err != nil {
+		log.Printf("AUDIT LOG WRITE FAILED for %s %s by %s: %v", action, target, actor, err)
+		vm.Metrics.AuditFailed()
+	}
+}
+
+// auditEvent records a finished user operation. Provisioning failures are
+// recorded as a failed user.add.
+func (vm *VPSManager) auditEvent(ev Event) error {
+	action := string(ev.Kind)
+	if ev.Kind == UserProvisionFailed {
+		action = string(UserAdded)
+	}
+	vm.audit(ev.Actor, action, ev.Username, ev.Protocols, ev.Err, ev.Details)
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendRecords(t *testing.T, l *AuditLog, actors ...string) {
+	t.Helper()
+	for _, actor := range actors {
+		if err := l.Append(AuditRecord{Actor: actor, Action: "user.add", Target: actor + "-user", Result: "success"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuditChainVerifies(t *testing.T) {
+	l := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	appendRecords(t, l, "root", "api", "system")
+
+	count, head, err := l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 records, got %d", count)
+	}
+
+	records, err := l.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[2].Hash != head || records[1].PrevHash != records[0].Hash || records[2].Seq != 3 {
+		t.Fatalf("records not chained: %+v", records)
+	}
+}
+
+func TestAuditVerifyDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines [][]byte) [][]byte
+		want   string
+	}{
+		{
+			name: "edited",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`"actor":"api"`), []byte(`"actor":"root"`), 1)
+				return lines
+			},
+			want: "record 2 has been modified",
+		},
+		{
+			name: "deleted",
+			tamper: func(lines [][]byte) [][]byte {
+				return append(lines[:1], lines[2:]...)
+			},
+			want: "sequence number 3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			l := NewAuditLog(path)
+			appendRecords(t, l, "root", "api", "system")
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := tt.tamper(bytes.Split(bytes.TrimSpace(data), []byte("\n")))
+			if err := ioutil.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := l.Verify(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestAuditQueryFilters(t *testing.T) {
+	l := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, actor := range []string{"root", "api", "root"} {
+		rec := AuditRecord{Time: start.AddDate(0, 0, i), Actor: actor, Action: "user.renew", Target: "alice", Result: "success"}
+		if i == 1 {
+			rec.Target = "bobby"
+		}
+		if err := l.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		filter AuditFilter
+		want   []uint64
+	}{
+		{AuditFilter{}, []uint64{1, 2, 3}},
+		{AuditFilter{User: "alice"}, []uint64{1, 3}},
+		{AuditFilter{Actor: "api"}, []uint64{2}},
+		{AuditFilter{Since: start.AddDate(0, 0, 1)}, []uint64{2, 3}},
+		{AuditFilter{Until: start.AddDate(0, 0, 1)}, []uint64{1}},
+		{AuditFilter{User: "alice", Since: start.AddDate(0, 0, 1)}, []uint64{3}},
+	}
+	for _, tt := range tests {
+		records, err := l.Query(tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint64
+		for _, rec := range records {
+			got = append(got, rec.Seq)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%+v: expected %v, got %v", tt.filter, tt.want, got)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("%+v: expected %v, got %v", tt.filter, tt.want, got)
+			}
+		}
+	}
+}
+
+func TestAuditRecordsFailures(t *testing.T) {
+	m := newTestManager(t)
+	m.xray.fail["AddUser"] = true
+	if err := m.OwnerActor("root").AddUser("alice", "secret1", "", 30, Contact{}, nil); err == nil {
+		t.Fatal("expected add to fail")
+	}
+	m.xray.fail["AddUser"] = false
+	if err := m.AddUser("bobby", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	m.ssh.fail["LockUser"] = true
+	if err := m.SuspendUser("bobby"); err == nil {
+		t.Fatal("expected suspend to fail")
+	}
+
+	records, err := m.Audit.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %+v", records)
+	}
+
+	add := records[0]
+	if add.Actor != "root" || add.Action != "user.add" || add.Result != "failure" || add.Error == "" {
+		t.Fatalf("unexpected add record: %+v", add)
+	}
+	if strings.Join(add.Protocols, ",") != "ssh,xray" {
+		t.Fatalf("expected the ssh and xray steps in protocols, got %v", add.Protocols)
+	}
+
+	suspend := records[2]
+	if suspend.Actor != auditSystem || suspend.Action != "user.suspend" || suspend.Result != "failure" || !strings.Contains(suspend.Error, "SSH") {
+		t.Fatalf("unexpected suspend record: %+v", suspend)
+	}
+
+	if _, _, err := m.Audit.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIAuditScopedToReseller(t *testing.T) {
+	m, h := newTestAPI(t)
+	_, token := newReseller(t, m, "resell", 100, 10, "monthly")
+	if rec := doRequestWithToken(t, h, token, http.MethodPost, "/api/users",
+		`{"username":"alice","password":"secret1","plan":"monthly"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body.String())
+	}
+	if err := m.AddUser("bobby", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := doRequestWithToken(t, h, token, http.MethodGet, "/api/audit", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("audit: %d %s", rec.Code, rec.Body.String())
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "alice") || strings.Contains(body, "bobby") {
+		t.Fatalf("reseller saw records of other actors: %s", body)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/api/audit?user=bobby", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "bobby") || strings.Contains(rec.Body.String(), "alice") {
+		t.Fatalf("owner query: %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"./protocols"
+)
+
+// ErrInvalidBackup is returned for archives that are damaged, tampered with
+// or not backups at all
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// backupFormatVersion is the archive layout Backup writes. Restore accepts
+// archives up to this version.
+const backupFormatVersion = 1
+
+const (
+	backupManifestName = "manifest.json"
+	backupAccountsName = "accounts.json"
+	// backupMaxFileSize bounds each entry read back from an archive
+	backupMaxFileSize = 64 << 20
+)
+
+// BackupManifest describes a backup archive. Every other entry in the
+// archive is listed in Files with its checksum.
+type BackupManifest struct {
+	Version   int          `json:"version"`
+	CreatedAt time.Time    `json:"created_at"`
+	Hostname  string       `json:"hostname"`
+	Domain    string       `json:"domain"`
+	Users     int          `json:"users"`
+	Files     []BackupFile `json:"files"`
+}
+
+// BackupFile is an entry of a backup archive. Path is where the file is
+// restored to; the accounts entry is only read by Restore and has none.
+type BackupFile struct {
+	Name   string      `json:"name"`
+	Path   string      `json:"path,omitempty"`
+	Mode   os.FileMode `json:"mode"`
+	Size   int64       `json:"size"`
+	SHA256 string      `json:"sha256"`
+}
+
+// RestoreReport summarizes a restore. Errors lists the accounts and
+// services that could not be brought back; the files are restored anyway.
+type RestoreReport struct {
+	Files    int
+	Accounts int
+	Errors   []string
+}
+
+// backupPaths lists the files that make up the server's state. Empty and
+// missing paths are skipped by Backup.
+func (vm *VPSManager) backupPaths(users []User) []string {
+	cfg := vm.Config
+	paths := []string{
+		vm.ConfigPath,
+		cfg.DbPath,
+		cfg.AdminsPath,
+		cfg.Telegram.TrialsPath,
+		cfg.Protocols.Xray.ConfigPath,
+		cfg.Protocols.WebSocket.ConfigPath,
+		cfg.Protocols.HTTP.ConfigPath,
+		cfg.Protocols.UDP.ConfigPath,
+		cfg.Protocols.Dropbear.ConfigPath,
+		cfg.Protocols.Squid.PasswdFile,
+		cfg.Protocols.SSL.CertPath,
+		cfg.Protocols.SSL.KeyPath,
+		cfg.Agent.CertPath,
+		cfg.Agent.KeyPath,
+		cfg.Agent.ClientCAPath,
+		cfg.Nodes.CertPath,
+		cfg.Nodes.KeyPath,
+		cfg.Nodes.CAPath,
+	}
+	paths = append(paths, protocols.SharedFiles()...)
+	for _, user := range users {
+		paths = append(paths, protocols.UserFiles(user.Username)...)
+	}
+	return paths
+}
+
+// hasSystemUser reports whether a user has a Linux account on this server
+func hasSystemUser(user User) bool {
+	return onLocalNode(user) && containsString(user.Protocols, "ssh")
+}
+
+// Backup writes a gzipped tar archive of the server's state to w: the
+// manager's own files, the protocol configs, password files and
+// certificates, and the shadow password hashes of the system users, which
+// the user database only keeps as bcrypt hashes.
+func (vm *VPSManager) Backup(w io.Writer) (BackupManifest, error) {
+	unlock, err := vm.lockStore()
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	defer unlock()
+
+	manifest := BackupManifest{
+		Version:   backupFormatVersion,
+		CreatedAt: time.Now().UTC(),
+		Domain:    vm.Config.Domain,
+		Users:     len(vm.Users),
+	}
+	manifest.Hostname, _ = os.Hostname()
+
+	var contents [][]byte
+	add := func(file BackupFile, data []byte) {
+		sum := sha256.Sum256(data)
+		file.Size = int64(len(data))
+		file.SHA256 = hex.EncodeToString(sum[:])
+		manifest.Files = append(manifest.Files, file)
+		contents = append(contents, data)
+	}
+
+	seen := make(map[string]bool)
+	for _, path := range vm.backupPaths(vm.Users) {
+		if path == "" {
+			continue
+		}
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return BackupManifest{}, err
+		}
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return BackupManifest{}, err
+		}
+		if !info.Mode().IsRegular() {
+			return BackupManifest{}, fmt.Errorf("%s is not a regular file", path)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return BackupManifest{}, err
+		}
+		add(BackupFile{Name: "files" + filepath.ToSlash(path), Path: path, Mode: info.Mode().Perm()}, data)
+	}
+
+	hashes := make(map[string]string)
+	for _, user := range vm.Users {
+		if !hasSystemUser(user) {
+			continue
+		}
+		hash, err := vm.SSHMgr.PasswordHash(user.Username)
+		if err != nil {
+			return BackupManifest{}, err
+		}
+		hashes[user.Username] = hash
+	}
+	accounts, err := json.MarshalIndent(hashes, "", "    ")
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	add(BackupFile{Name: backupAccountsName, Mode: 0600}, accounts)
+
+	data, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeBackupEntry(tw, backupManifestName, 0644, manifest.CreatedAt, data); err != nil {
+		return BackupManifest{}, err
+	}
+	for i, file := range manifest.Files {
+		if err := writeBackupEntry(tw, file.Name, file.Mode, manifest.CreatedAt, contents[i]); err != nil {
+			return BackupManifest{}, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return BackupManifest{}, err
+	}
+	if err := gz.Close(); err != nil {
+		return BackupManifest{}, err
+	}
+	return manifest, nil
+}
+
+func writeBackupEntry(tw *tar.Writer, name string, mode os.FileMode, modTime time.Time, data []byte) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     int64(mode.Perm()),
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// readBackup reads an archive and checks it against its manifest. Nothing
+// is trusted until every entry matches its checksum.
+func readBackup(r io.Reader) (BackupManifest, map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return BackupManifest{}, nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	tr := tar.NewReader(gz)
+
+	entries := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return BackupManifest{}, nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size > backupMaxFileSize {
+			return BackupManifest{}, nil, fmt.Errorf("%w: unexpected entry %s", ErrInvalidBackup, hdr.Name)
+		}
+		if _, dup := entries[hdr.Name]; dup {
+			return BackupManifest{}, nil, fmt.Errorf("%w: duplicate entry %s", ErrInvalidBackup, hdr.Name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return BackupManifest{}, nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		entries[hdr.Name] = data
+	}
+
+	data, ok := entries[backupManifestName]
+	if !ok {
+		return BackupManifest{}, nil, fmt.Errorf("%w: no manifest", ErrInvalidBackup)
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return BackupManifest{}, nil, fmt.Errorf("%w: bad manifest: %v", ErrInvalidBackup, err)
+	}
+	if manifest.Version < 1 || manifest.Version > backupFormatVersion {
+		return BackupManifest{}, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBackup, manifest.Version)
+	}
+
+	listed := map[string]bool{backupManifestName: true}
+	for _, file := range manifest.Files {
+		data, ok := entries[file.Name]
+		if !ok {
+			return BackupManifest{}, nil, fmt.Errorf("%w: %s is missing", ErrInvalidBackup, file.Name)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != file.Size || hex.EncodeToString(sum[:]) != file.SHA256 {
+			return BackupManifest{}, nil, fmt.Errorf("%w: checksum mismatch for %s", ErrInvalidBackup, file.Name)
+		}
+		if file.Path != "" && (!filepath.IsAbs(file.Path) || filepath.Clean(file.Path) != file.Path) {
+			return BackupManifest{}, nil, fmt.Errorf("%w: bad restore path %q", ErrInvalidBackup, file.Path)
+		}
+		listed[file.Name] = true
+	}
+	for name := range entries {
+		if !listed[name] {
+			return BackupManifest{}, nil, fmt.Errorf("%w: %s is not in the manifest", ErrInvalidBackup, name)
+		}
+	}
+	if !listed[backupAccountsName] {
+		return BackupManifest{}, nil, fmt.Errorf("%w: no %s", ErrInvalidBackup, backupAccountsName)
+	}
+	return manifest, entries, nil
+}
+
+// Restore puts the files of a backup back in place, recreates the system
+// users with their original passwords and, if restart is set, restarts the
+// protocol services so they pick up the restored configs. It is meant for a
+// freshly installed server; a running daemon should be stopped first.
+func (vm *VPSManager) Restore(r io.Reader, restart bool) (RestoreReport, error) {
+	var report RestoreReport
+
+	manifest, entries, err := readBackup(r)
+	if err != nil {
+		return report, err
+	}
+	var hashes map[string]string
+	if err := json.Unmarshal(entries[backupAccountsName], &hashes); err != nil {
+		return report, fmt.Errorf("%w: bad %s: %v", ErrInvalidBackup, backupAccountsName, err)
+	}
+
+	unlock, err := vm.lockStore()
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	for _, file := range manifest.Files {
+		if file.Path == "" {
+			continue
+		}
+		if err := restoreFile(file.Path, entries[file.Name], file.Mode); err != nil {
+			return report, fmt.Errorf("failed to restore %s: %v", file.Path, err)
+		}
+		report.Files++
+	}
+	if err := vm.loadFromFile(); err != nil {
+		return report, fmt.Errorf("failed to load restored users: %v", err)
+	}
+
+	for _, user := range vm.Users {
+		if !hasSystemUser(user) {
+			continue
+		}
+		hash, ok := hashes[user.Username]
+		if !ok {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: no password hash in backup", user.Username))
+			continue
+		}
+		err := vm.SSHMgr.RestoreUser(user.Username, hash)
+		if err == nil && user.Suspended {
+			err = vm.SSHMgr.LockUser(user.Username)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", user.Username, err))
+			continue
+		}
+		report.Accounts++
+	}
+
+	if restart {
+		for _, service := range restoreServices() {
+			if err := protocols.RestartService(service); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+			}
+		}
+	}
+	return report, nil
+}
+
+// restoreServices lists the systemd units backing the protocols, once each
+func restoreServices() []string {
+	seen := make(map[string]bool)
+	var services []string
+	for _, ps := range protocolServices {
+		if !seen[ps.Service] {
+			seen[ps.Service] = true
+			services = append(services, ps.Service)
+		}
+	}
+	sort.Strings(services)
+	return services
+}
+
+// restoreFile writes a file atomically with the given permissions,
+// creating its directory if needed
+func restoreFile(path string, data []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".restore"
+	if err := ioutil.WriteFile(tmp, data, mode.Perm()); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, mode.Perm()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+const backupUsage = `Usage:
+  vps_manager backup [-o archive.tar.gz]         archive users, configs and certificates
+  vps_manager restore [-no-restart] archive.tar.gz
+                                                 restore an archive and recreate system users`
+
+// runBackupCommand writes a backup archive
+func runBackupCommand(manager *VPSManager, actor *Actor, args []string) error {
+	if err := actor.require(RoleOwner); err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	output := flags.String("o", fmt.Sprintf("vps_manager-backup-%s.tar.gz", time.Now().Format("20060102-150405")), "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return fmt.Errorf("%w\n%s", ErrInvalidInput, backupUsage)
+	}
+
+	f, err := os.OpenFile(*output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	manifest, err := manager.Backup(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*output)
+	}
+	manager.audit(actor.Admin.Name, "backup.create", *output, nil, err,
+		fmt.Sprintf("%d files, %d users", len(manifest.Files), manifest.Users))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backed up %d users and %d files to %s\n", manifest.Users, len(manifest.Files), *output)
+	return nil
+}
+
+// runRestoreCommand restores a backup archive
+func runRestoreCommand(manager *VPSManager, actor *Actor, args []string) error {
+	if err := actor.require(RoleOwner); err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	noRestart := flags.Bool("no-restart", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return fmt.Errorf("%w\n%s", ErrInvalidInput, backupUsage)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	report, err := manager.Restore(f, !*noRestart)
+	manager.audit(actor.Admin.Name, "backup.restore", flags.Arg(0), nil, err,
+		fmt.Sprintf("%d files, %d accounts, %d errors", report.Files, report.Accounts, len(report.Errors)))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %d files and %d system accounts\n", report.Files, report.Accounts)
+	for _, msg := range report.Errors {
+		fmt.Printf("  %s\n", msg)
+	}
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("restore finished with %d errors", len(report.Errors))
+	}
+	fmt.Println("Restart vps_manager to use the restored config.json")
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newBackupManager returns a test manager whose config, Xray config and
+// squid passwd file live under dir
+func newBackupManager(t *testing.T, dir string) *testManager {
+	t.Helper()
+	m := newTestManager(t)
+	m.ConfigPath = filepath.Join(dir, "config.json")
+	m.Config.Protocols.Xray.ConfigPath = filepath.Join(dir, "xray", "config.json")
+	m.Config.Protocols.Squid.PasswdFile = filepath.Join(dir, "squid", "passwd")
+
+	os.MkdirAll(filepath.Join(dir, "xray"), 0755)
+	os.MkdirAll(filepath.Join(dir, "squid"), 0755)
+	ioutil.WriteFile(m.ConfigPath, []byte(`{"domain": "example.com"}`), 0644)
+	ioutil.WriteFile(m.Config.Protocols.Xray.ConfigPath, []byte(`{"inbounds": []}`), 0644)
+	ioutil.WriteFile(m.Config.Protocols.Squid.PasswdFile, []byte("alice:$apr1$x\n"), 0640)
+	return m
+}
+
+// rewriteBackup passes every entry of an archive through fn
+func rewriteBackup(t *testing.T, archive []byte, fn func(name string, data []byte) []byte) []byte {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+
+	var out bytes.Buffer
+	gzw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gzw)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(tr)
+		data = fn(hdr.Name, data)
+		hdr.Size = int64(len(data))
+		tw.WriteHeader(hdr)
+		tw.Write(data)
+	}
+	tw.Close()
+	gzw.Close()
+	return out.Bytes()
+}
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	m := newBackupManager(t, dir)
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddUser("bobby", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SuspendUser("bobby"); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	manifest, err := m.Backup(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Users != 2 {
+		t.Fatalf("expected 2 users in manifest, got %d", manifest.Users)
+	}
+
+	// Start over as on a freshly installed server
+	os.RemoveAll(dir)
+	os.Remove(m.Config.DbPath)
+	m.Users = nil
+	m.ssh.calls = nil
+
+	report, err := m.Restore(bytes.NewReader(archive.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Accounts != 2 || len(report.Errors) != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if calls := strings.Join(m.ssh.calls, ","); calls != "RestoreUser,RestoreUser,LockUser" {
+		t.Fatalf("unexpected SSH calls: %s", calls)
+	}
+
+	info, err := os.Stat(m.Config.Protocols.Squid.PasswdFile)
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Fatalf("squid passwd not restored with its mode: %v %v", info, err)
+	}
+	if data, _ := ioutil.ReadFile(m.ConfigPath); string(data) != `{"domain": "example.com"}` {
+		t.Fatalf("config not restored: %q", data)
+	}
+	user, err := m.GetUser("bobby")
+	if err != nil || !user.Suspended {
+		t.Fatalf("users not restored: %+v %v", user, err)
+	}
+}
+
+func TestRestoreRejectsDamagedBackup(t *testing.T) {
+	dir := t.TempDir()
+	m := newBackupManager(t, dir)
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if _, err := m.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(m.ConfigPath)
+
+	tampered := rewriteBackup(t, archive.Bytes(), func(name string, data []byte) []byte {
+		if strings.HasSuffix(name, "/xray/config.json") {
+			return []byte(`{"inbounds": [{"port": 1}]}`)
+		}
+		return data
+	})
+	if _, err := m.Restore(bytes.NewReader(tampered), false); !errors.Is(err, ErrInvalidBackup) {
+		t.Fatalf("expected ErrInvalidBackup for a modified file, got %v", err)
+	}
+	if _, err := os.Stat(m.ConfigPath); !os.IsNotExist(err) {
+		t.Fatal("files were restored from a damaged backup")
+	}
+
+	newer := rewriteBackup(t, archive.Bytes(), func(name string, data []byte) []byte {
+		if name == backupManifestName {
+			return bytes.Replace(data, []byte(`"version": 1`), []byte(`"version": 99`), 1)
+		}
+		return data
+	})
+	if _, err := m.Restore(bytes.NewReader(newer), false); err == nil || !strings.Contains(err.Error(), "unsupported version") {
+		t.Fatalf("expected unsupported version, got %v", err)
+	}
+
+	if _, err := m.Restore(strings.NewReader("not an archive"), false); !errors.Is(err, ErrInvalidBackup) {
+		t.Fatalf("expected ErrInvalidBackup, got %v", err)
+	}
+}
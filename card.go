@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+const connectionCardTemplate = `=== VPS Connection Card ===
+Username:    {{ .User.Username }}
+Password:    (the password chosen at account creation)
+Expires:     {{ .User.ExpireDate.Format "2006-01-02" }}{{ if .User.Suspended }} (SUSPENDED){{ end }}
+Server:      {{ .Domain }}
+
+SSH:         {{ .Domain }}:{{ .Config.SSH.Port }}
+Dropbear:    {{ .Domain }}:{{ .Config.Dropbear.Port }}
+WebSocket:   wss://{{ .Domain }}:{{ .WebSocketPort }}/ws
+HTTP proxy:  {{ .Domain }}:{{ .Config.HTTP.Port }}
+Squid proxy: {{ .Domain }}:{{ .Config.Squid.Port }}
+UDP:         {{ .Domain }}:{{ .Config.UDP.Port }}
+{{- if .XrayLinks }}
+
+Xray:
+{{- range .XrayLinks }}
+{{ . }}
+{{- end }}
+{{- end }}
+`
+
+var connectionCard = template.Must(template.New("card").Parse(connectionCardTemplate))
+
+// ConnectionCard renders a plain-text summary of how a user connects to each
+// protocol, including Xray import links
+func (vm *VPSManager) ConnectionCard(username string) (string, error) {
+	user, err := vm.GetUser(username)
+	if err != nil {
+		return "", err
+	}
+	return vm.renderConnectionCard(user)
+}
+
+// renderConnectionCard renders the card for a user record that is already
+// loaded, without taking the store lock
+func (vm *VPSManager) renderConnectionCard(user User) (string, error) {
+	links, err := vm.XrayMgr.ShareLinks(user.Username, vm.Config.Domain)
+	if err != nil {
+		return "", fmt.Errorf("failed to build xray links: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = connectionCard.Execute(&buf, map[string]interface{}{
+		"User":          user,
+		"Domain":        vm.Config.Domain,
+		"Config":        vm.Config.Protocols,
+		"WebSocketPort": webSocketPort(vm.Config),
+		"XrayLinks":     links,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render connection card: %v", err)
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConnectionCardUsesMainDomain(t *testing.T) {
+	m := newTestManager(t)
+	m.Config.Protocols.WebSocket.Port = 8443
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	card, err := m.ConnectionCard("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(card, "WebSocket:   wss://example.com:8443/ws\n") {
+		t.Fatalf("unexpected WebSocket line:\n%s", card)
+	}
+	if strings.Contains(card, "alice.example.com") {
+		t.Fatalf("card points at a per-user subdomain:\n%s", card)
+	}
+
+	// Behind the fallback inbound, nginx is reached on the Xray port
+	m.Config.Protocols.Xray.Fallback.Enabled = true
+	card, err = m.ConnectionCard("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(card, "WebSocket:   wss://example.com:443/ws\n") {
+		t.Fatalf("unexpected WebSocket line behind Xray:\n%s", card)
+	}
+}
@@ -3,13 +3,201 @@ package config
 import (
 	"encoding/json"
 	"io/ioutil"
+	"os"
 )
 
 type Config struct {
-	Domain    string         `json:"domain"`
-	LogPath   string         `json:"log_path"`
-	DbPath    string         `json:"db_path"`
-	Protocols ProtocolConfig `json:"protocols"`
+	Domain    string          `json:"domain"`
+	LogPath   string          `json:"log_path"`
+	AuditPath string          `json:"audit_path"`
+	DbPath    string          `json:"db_path"`
+	Protocols ProtocolConfig  `json:"protocols"`
+	API       APIConfig       `json:"api"`
+	Dashboard DashboardConfig `json:"dashboard"`
+	Telegram  TelegramConfig  `json:"telegram"`
+	Webhooks  WebhooksConfig  `json:"webhooks"`
+	Metrics   MetricsConfig   `json:"metrics"`
+	Email     EmailConfig     `json:"email"`
+	Agent     AgentConfig     `json:"agent"`
+	Nodes     NodesConfig     `json:"nodes"`
+	// AdminsPath stores reseller and support admins and the credit ledger
+	AdminsPath string `json:"admins_path"`
+	// RequireAdminMapping refuses the menu and CLI to sudoers that are not
+	// the system_user of an admin, instead of letting them act as owner
+	RequireAdminMapping bool         `json:"require_admin_mapping"`
+	Plans               []PlanConfig `json:"plans"`
+}
+
+// PlanConfig is a sellable account duration. Resellers pay Price credits
+// when they create or renew a user on the plan.
+type PlanConfig struct {
+	Name  string `json:"name"`
+	Days  int    `json:"days"`
+	Price int64  `json:"price"`
+}
+
+// APIConfig controls the HTTP JSON API served in daemon mode
+type APIConfig struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen"`
+	Token   string `json:"token"`
+}
+
+// DashboardConfig controls the embedded web admin dashboard. With TLS
+// enabled and no cert/key given, the SSL protocol certificate is used.
+type DashboardConfig struct {
+	Enabled      bool   `json:"enabled"`
+	Listen       string `json:"listen"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	TLS          bool   `json:"tls"`
+	CertPath     string `json:"cert_path"`
+	KeyPath      string `json:"key_path"`
+}
+
+// TelegramConfig controls the Telegram bot front-end
+type TelegramConfig struct {
+	Enabled      bool    `json:"enabled"`
+	Token        string  `json:"token"`
+	APIBaseURL   string  `json:"api_base_url"`
+	AdminChatIDs []int64 `json:"admin_chat_ids"`
+	TrialDays    int     `json:"trial_days"`
+	// TrialsEnabled lets customers create trials, up to MaxActiveTrials at a
+	// time and one per chat ever, as recorded in TrialsPath
+	TrialsEnabled   bool   `json:"trials_enabled"`
+	MaxActiveTrials int    `json:"max_active_trials"`
+	TrialsPath      string `json:"trials_path"`
+}
+
+// WebhooksConfig lists the endpoints notified of user lifecycle events
+type WebhooksConfig struct {
+	OutboxDir   string            `json:"outbox_dir"`
+	MaxAttempts int               `json:"max_attempts"`
+	Endpoints   []WebhookEndpoint `json:"endpoints"`
+}
+
+// WebhookEndpoint receives the events it subscribes to, or all events if
+// Events is empty. Payloads are signed with Secret using HMAC-SHA256.
+type WebhookEndpoint struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// MetricsConfig controls the Prometheus /metrics endpoint served in daemon
+// mode. If Token is set, scrapes must send it as a bearer token.
+type MetricsConfig struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen"`
+	Token   string `json:"token"`
+}
+
+// EmailConfig controls customer email notifications. Emails are sent on
+// account creation and suspension and ReminderDays before an account
+// expires. Templates in TemplatesDir/<language>/<name>.tmpl override the
+// built-in ones; Host and Port may point at a local SMTP sink for testing.
+type EmailConfig struct {
+	Enabled         bool   `json:"enabled"`
+	Host            string `json:"host"`
+	Port            int    `json:"port"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	From            string `json:"from"`
+	ReminderDays    int    `json:"reminder_days"`
+	DefaultLanguage string `json:"default_language"`
+	TemplatesDir    string `json:"templates_dir"`
+}
+
+// AgentConfig controls node agent mode, in which this server's protocol
+// managers are served to a controller over mutually authenticated TLS.
+// Controllers must present a certificate signed by ClientCAPath and, if
+// AllowedClients is set, with one of the listed common names.
+type AgentConfig struct {
+	Listen         string   `json:"listen"`
+	CertPath       string   `json:"cert_path"`
+	KeyPath        string   `json:"key_path"`
+	ClientCAPath   string   `json:"client_ca_path"`
+	AllowedClients []string `json:"allowed_clients"`
+}
+
+// NodesConfig registers the agents this server controls. The controller
+// authenticates with CertPath/KeyPath and verifies agents against CAPath.
+// New users are created on Default, or on this server if it is empty.
+type NodesConfig struct {
+	CertPath string       `json:"cert_path"`
+	KeyPath  string       `json:"key_path"`
+	CAPath   string       `json:"ca_path"`
+	Default  []string     `json:"default"`
+	Nodes    []NodeConfig `json:"nodes"`
+}
+
+// NodeConfig is a remote agent, addressed as host:port
+type NodeConfig struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// XrayInboundConfig declares an Xray inbound that is created, or updated
+// to match, when the daemon starts and by `vps_manager xray sync`. Port
+// defaults to the Xray port. Network is tcp, ws, grpc or httpupgrade, and
+// Path the WebSocket or HTTPUpgrade path or gRPC service name. Security is
+// none, tls, with the SSL certificate unless CertPath and KeyPath are set,
+// or reality, with Dest and ServerNames.
+type XrayInboundConfig struct {
+	Tag         string   `json:"tag"`
+	Protocol    string   `json:"protocol"`
+	Port        int      `json:"port,omitempty"`
+	Network     string   `json:"network,omitempty"`
+	Path        string   `json:"path,omitempty"`
+	Security    string   `json:"security,omitempty"`
+	ServerName  string   `json:"server_name,omitempty"`
+	CertPath    string   `json:"cert_path,omitempty"`
+	KeyPath     string   `json:"key_path,omitempty"`
+	ALPN        []string `json:"alpn,omitempty"`
+	Method      string   `json:"method,omitempty"`
+	Dest        string   `json:"dest,omitempty"`
+	ServerNames []string `json:"server_names,omitempty"`
+	ShortIDs    int      `json:"short_ids,omitempty"`
+	// Fallbacks route connections to a vless or trojan inbound over TCP
+	// with TLS that are not of its protocol
+	Fallbacks []XrayFallbackRoute `json:"fallbacks,omitempty"`
+}
+
+// XrayFallbackRoute sends connections with a matching TLS ALPN and HTTP
+// path, or any if both are empty, to Dest, a port or address
+type XrayFallbackRoute struct {
+	ALPN string `json:"alpn,omitempty"`
+	Path string `json:"path,omitempty"`
+	Dest string `json:"dest"`
+}
+
+// XrayFallbackConfig puts a VLESS over TCP with TLS inbound on the Xray
+// port that passes everything that is not VLESS on to nginx, so all
+// services share one public port. nginx then serves the WebSocket sites on
+// 127.0.0.1:WebSocketPort without TLS and hands other requests to the HTTP
+// site.
+type XrayFallbackConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Tag           string `json:"tag,omitempty"`
+	WebSocketPort int    `json:"websocket_port,omitempty"`
+}
+
+// XrayRoutingConfig is the traffic policy applied to Xray users. BitTorrent
+// and the geosite categories in BlockGeosite, such as "category-ads-all",
+// are blocked for everyone. Users can be assigned one of Outbounds to send
+// their traffic through instead of the server's own connection.
+type XrayRoutingConfig struct {
+	BlockBitTorrent bool                 `json:"block_bittorrent"`
+	BlockGeosite    []string             `json:"block_geosite"`
+	Outbounds       []XrayOutboundConfig `json:"outbounds"`
+}
+
+// XrayOutboundConfig is a named Xray outbound, with Settings as in Xray's
+// outbound settings object for Protocol
+type XrayOutboundConfig struct {
+	Name     string          `json:"name"`
+	Protocol string          `json:"protocol"`
+	Settings json.RawMessage `json:"settings,omitempty"`
 }
 
 type ProtocolConfig struct {
@@ -17,12 +205,20 @@ type ProtocolConfig struct {
 		Port int `json:"port"`
 	} `json:"ssh"`
 	Xray struct {
-		Port       int    `json:"port"`
-		ConfigPath string `json:"config_path"`
+		Port       int                 `json:"port"`
+		ConfigPath string              `json:"config_path"`
+		APIAddress string              `json:"api_address"`
+		Inbounds   []XrayInboundConfig `json:"inbounds,omitempty"`
+		Routing    XrayRoutingConfig   `json:"routing"`
+		Fallback   XrayFallbackConfig  `json:"fallback"`
 	} `json:"xray"`
 	WebSocket struct {
 		Port       int    `json:"port"`
 		ConfigPath string `json:"config_path"`
+		// UserPaths gives each user their own path on the Xray WebSocket
+		// inbounds nginx proxies: "username", "uuid" for one derived from
+		// their UUID, or empty for the inbound's own path
+		UserPaths string `json:"user_paths,omitempty"`
 	} `json:"websocket"`
 	SSL struct {
 		CertPath string `json:"cert_path"`
@@ -44,6 +240,19 @@ type ProtocolConfig struct {
 		Port       int    `json:"port"`
 		ConfigPath string `json:"config_path"`
 	} `json:"dropbear"`
+	Tunnel TunnelConfig `json:"tunnel"`
+}
+
+// TunnelConfig is the daemon's SSH over WebSocket tunnel, which nginx
+// proxies /ws to. Target is "ssh" or "dropbear", the server the tunnel
+// leads to. Raw upgrade requests are answered with Status and Banner as
+// the reason phrase, 101 Switching Protocols by default.
+type TunnelConfig struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Status  int    `json:"status,omitempty"`
+	Banner  string `json:"banner,omitempty"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -59,3 +268,18 @@ func LoadConfig(path string) (*Config, error) {
 
 	return &config, nil
 }
+
+// SaveConfig writes config to path atomically, in the layout of the
+// shipped config.json
+func SaveConfig(path string, config *Config) error {
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
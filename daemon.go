@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// expiryCheckInterval is how often the daemon removes expired users and
+// sends expiry reminders
+const expiryCheckInterval = time.Hour
+
+// runDaemon runs the background services until SIGINT or SIGTERM
+func runDaemon(manager *VPSManager) error {
+	var shutdowns []func(context.Context) error
+
+	// Only the daemon delivers webhooks; the menu and other commands just
+	// add to the outbox
+	if err := manager.Webhooks.Start(); err != nil {
+		return err
+	}
+	shutdowns = append(shutdowns, manager.Webhooks.Shutdown)
+
+	if manager.Config.API.Enabled {
+		api := NewAPIServer(manager, manager.Config.API)
+		if err := api.Start(); err != nil {
+			return err
+		}
+		shutdowns = append(shutdowns, api.Shutdown)
+		log.Printf("API listening on %s", manager.Config.API.Listen)
+	}
+
+	if manager.Config.Dashboard.Enabled {
+		dashboard, err := NewDashboard(manager, manager.Config.Dashboard)
+		if err != nil {
+			return err
+		}
+		if err := dashboard.Start(); err != nil {
+			return err
+		}
+		shutdowns = append(shutdowns, dashboard.Shutdown)
+		log.Printf("Dashboard listening on %s", manager.Config.Dashboard.Listen)
+	}
+
+	if manager.Config.Metrics.Enabled {
+		metrics := NewMetricsServer(manager, manager.Config.Metrics)
+		if err := metrics.Start(); err != nil {
+			return err
+		}
+		shutdowns = append(shutdowns, metrics.Shutdown)
+		log.Printf("Metrics listening on %s", manager.Config.Metrics.Listen)
+	}
+
+	if manager.Config.Protocols.Tunnel.Enabled {
+		tunnel, err := manager.newTunnel()
+		if err != nil {
+			return err
+		}
+		if err := tunnel.Start(); err != nil {
+			return err
+		}
+		shutdowns = append(shutdowns, tunnel.Shutdown)
+		log.Printf("SSH tunnel listening on %s, forwarding to %s", tunnel.Addr(), tunnel.Target)
+	}
+
+	if manager.Config.Telegram.Enabled {
+		bot := NewTelegramBot(manager, manager.Config.Telegram)
+		if err := bot.Start(); err != nil {
+			return err
+		}
+		shutdowns = append(shutdowns, bot.Shutdown)
+		log.Printf("Telegram bot started")
+	}
+
+	// Wait for background event subscribers after everything that publishes
+	// events has stopped
+	shutdowns = append(shutdowns, manager.Events.Shutdown)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	trafficTicker := time.NewTicker(trafficCollectInterval)
+	defer trafficTicker.Stop()
+
+	if changed, err := manager.SyncXrayInbounds(); err != nil {
+		log.Printf("Error applying Xray inbounds: %v", err)
+	} else if len(changed) > 0 {
+		log.Printf("Applied Xray inbounds: %v", changed)
+	}
+	if _, err := manager.ApplyXrayRouting(); err != nil {
+		log.Printf("Error applying Xray routing: %v", err)
+	}
+	if changed, err := manager.SyncNginx(); err != nil {
+		log.Printf("Error applying nginx sites: %v", err)
+	} else if changed {
+		log.Printf("Applied nginx sites")
+	}
+
+	collectTraffic(manager)
+	manager.CheckExpiredUsers()
+	manager.SendExpiryReminders()
+	for {
+		select {
+		case <-ticker.C:
+			manager.CheckExpiredUsers()
+			manager.SendExpiryReminders()
+		case <-trafficTicker.C:
+			collectTraffic(manager)
+		case sig := <-signals:
+			log.Printf("Received %v, shutting down", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for _, shutdown := range shutdowns {
+				if err := shutdown(ctx); err != nil {
+					log.Printf("Shutdown error: %v", err)
+				}
+			}
+			return nil
+		}
+	}
+}
+
+func collectTraffic(manager *VPSManager) {
+	if err := manager.CollectTraffic(); err != nil {
+		log.Printf("Error collecting traffic: %v", err)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"./config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+const (
+	sessionCookieName = "vps_session"
+	sessionLifetime   = 12 * time.Hour
+	sessionPruneEvery = 10 * time.Minute
+
+	// After loginMaxFailures failed logins within loginWindow, an IP is
+	// locked out for loginLockout
+	loginMaxFailures = 5
+	loginWindow      = 15 * time.Minute
+	loginLockout     = 15 * time.Minute
+)
+
+// dashboardSession is a logged-in admin browser session
+type dashboardSession struct {
+	CSRFToken string
+	Expires   time.Time
+}
+
+// loginAttempts tracks recent failed logins from one IP
+type loginAttempts struct {
+	Failures    int
+	First       time.Time
+	LockedUntil time.Time
+}
+
+// Dashboard serves the embedded web admin UI on top of VPSManager
+type Dashboard struct {
+	manager   *VPSManager
+	cfg       config.DashboardConfig
+	templates *template.Template
+	server    *http.Server
+	stop      chan struct{}
+
+	mu       sync.Mutex
+	sessions map[string]*dashboardSession
+	attempts map[string]*loginAttempts
+}
+
+// NewDashboard creates the web dashboard for the given manager
+func NewDashboard(manager *VPSManager, cfg config.DashboardConfig) (*Dashboard, error) {
+	templates, err := template.New("").Funcs(template.FuncMap{
+		"date": func(t time.Time) string { return t.Format("2006-01-02") },
+		"expired": func(t time.Time) bool {
+			return time.Now().After(t)
+		},
+	}).ParseFS(webFiles, "web/templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dashboard templates: %v", err)
+	}
+
+	static, err := fs.Sub(webFiles, "web/static")
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TLS {
+		if cfg.CertPath == "" {
+			cfg.CertPath = manager.Config.Protocols.SSL.CertPath
+		}
+		if cfg.KeyPath == "" {
+			cfg.KeyPath = manager.Config.Protocols.SSL.KeyPath
+		}
+	}
+
+	d := &Dashboard{
+		manager:   manager,
+		cfg:       cfg,
+		templates: templates,
+		stop:      make(chan struct{}),
+		sessions:  make(map[string]*dashboardSession),
+		attempts:  make(map[string]*loginAttempts),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("/login", d.handleLogin)
+	mux.HandleFunc("/logout", d.requireSession(d.handleLogout))
+	mux.HandleFunc("/users", d.requireSession(d.handleAddUser))
+	mux.HandleFunc("/users/", d.requireSession(d.handleUserAction))
+	mux.HandleFunc("/", d.requireSession(d.handleIndex))
+
+	d.server = &http.Server{
+		Addr:         cfg.Listen,
+		Handler:      mux,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+	return d, nil
+}
+
+// Start serves the dashboard in the background
+func (d *Dashboard) Start() error {
+	if d.cfg.Username == "" || d.cfg.PasswordHash == "" {
+		return fmt.Errorf("dashboard username and password_hash must be configured")
+	}
+
+	go func() {
+		var err error
+		if d.cfg.TLS {
+			err = d.server.ListenAndServeTLS(d.cfg.CertPath, d.cfg.KeyPath)
+		} else {
+			err = d.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("Dashboard stopped: %v", err)
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(sessionPruneEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.prune(time.Now())
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Shutdown gracefully stops the dashboard
+func (d *Dashboard) Shutdown(ctx context.Context) error {
+	close(d.stop)
+	return d.server.Shutdown(ctx)
+}
+
+// prune drops expired sessions and stale login attempt records
+func (d *Dashboard) prune(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for id, session := range d.sessions {
+		if now.After(session.Expires) {
+			delete(d.sessions, id)
+		}
+	}
+	for ip, attempts := range d.attempts {
+		if now.After(attempts.LockedUntil) && now.Sub(attempts.First) > loginWindow {
+			delete(d.attempts, ip)
+		}
+	}
+}
+
+// loginLocked reports whether an IP is locked out after too many failures
+func (d *Dashboard) loginLocked(ip string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	attempts, ok := d.attempts[ip]
+	return ok && now.Before(attempts.LockedUntil)
+}
+
+// recordLoginFailure counts a failed login, locking the IP out once it
+// reaches loginMaxFailures within loginWindow
+func (d *Dashboard) recordLoginFailure(ip string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	attempts, ok := d.attempts[ip]
+	if !ok || now.Sub(attempts.First) > loginWindow {
+		attempts = &loginAttempts{First: now}
+		d.attempts[ip] = attempts
+	}
+	attempts.Failures++
+	if attempts.Failures >= loginMaxFailures {
+		attempts.LockedUntil = now.Add(loginLockout)
+	}
+}
+
+// requireSession redirects to the login page unless the request carries a
+// valid session, and checks the CSRF token on state-changing requests
+func (d *Dashboard) requireSession(next func(http.ResponseWriter, *http.Request, *dashboardSession)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := d.session(r)
+		if session == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			token := r.FormValue("csrf")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+				http.Error(w, "invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+
+		next(w, r, session)
+	}
+}
+
+func (d *Dashboard) session(r *http.Request) *dashboardSession {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	session, ok := d.sessions[cookie.Value]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(session.Expires) {
+		delete(d.sessions, cookie.Value)
+		return nil
+	}
+	return session
+}
+
+func (d *Dashboard) handleLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		d.render(w, "login.html", map[string]interface{}{"Error": r.URL.Query().Get("err")})
+
+	case http.MethodPost:
+		username := r.FormValue("username")
+		password := r.FormValue("password")
+
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		now := time.Now()
+		if d.loginLocked(ip, now) {
+			http.Redirect(w, r, "/login?err="+url.QueryEscape("Too many failed logins, try again later"), http.StatusSeeOther)
+			return
+		}
+
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(d.cfg.Username)) == 1
+		passOK := bcrypt.CompareHashAndPassword([]byte(d.cfg.PasswordHash), []byte(password)) == nil
+		if !userOK || !passOK {
+			d.recordLoginFailure(ip, now)
+			d.manager.audit("dashboard:"+username, "dashboard.login", "", nil,
+				errors.New("invalid username or password"), "from "+ip)
+			http.Redirect(w, r, "/login?err="+url.QueryEscape("Invalid username or password"), http.StatusSeeOther)
+			return
+		}
+
+		id, err := randomToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		csrf, err := randomToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		d.mu.Lock()
+		d.sessions[id] = &dashboardSession{CSRFToken: csrf, Expires: time.Now().Add(sessionLifetime)}
+		d.mu.Unlock()
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookieName,
+			Value:    id,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   d.cfg.TLS,
+			SameSite: http.SameSiteStrictMode,
+			MaxAge:   int(sessionLifetime.Seconds()),
+		})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *Dashboard) handleLogout(w http.ResponseWriter, r *http.Request, _ *dashboardSession) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		d.mu.Lock()
+		delete(d.sessions, cookie.Value)
+		d.mu.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (d *Dashboard) handleIndex(w http.ResponseWriter, r *http.Request, session *dashboardSession) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	users, err := d.manager.GetUsers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	d.render(w, "index.html", map[string]interface{}{
+		"Users":     users,
+		"Protocols": d.manager.ProtocolStatus(),
+		"CSRF":      session.CSRFToken,
+		"Message":   r.URL.Query().Get("msg"),
+		"Error":     r.URL.Query().Get("err"),
+	})
+}
+
+func (d *Dashboard) handleAddUser(w http.ResponseWriter, r *http.Request, _ *dashboardSession) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	days, _ := strconv.Atoi(r.FormValue("days"))
+	contact := Contact{Email: strings.TrimSpace(r.FormValue("email"))}
+	err := d.actor().AddUser(username, r.FormValue("password"), "", days, contact, nil)
+	d.redirectResult(w, r, fmt.Sprintf("User %s added", username), err)
+}
+
+// actor is the identity dashboard changes are made and audited as
+func (d *Dashboard) actor() *Actor {
+	return d.manager.OwnerActor("dashboard:" + d.cfg.Username)
+}
+
+// handleUserAction serves /users/{name}/{renew|suspend|resume|delete|card}
+func (d *Dashboard) handleUserAction(w http.ResponseWriter, r *http.Request, _ *dashboardSession) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	username, action := parts[0], parts[1]
+
+	if action == "card" {
+		card, err := d.manager.ConnectionCard(username)
+		if err != nil {
+			d.redirectResult(w, r, "", err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", username+".txt"))
+		w.Write([]byte(card))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		message string
+		err     error
+	)
+	switch action {
+	case "renew":
+		days, _ := strconv.Atoi(r.FormValue("days"))
+		var expireDate time.Time
+		expireDate, err = d.actor().RenewUser(username, "", days)
+		message = fmt.Sprintf("User %s renewed until %s", username, expireDate.Format("2006-01-02"))
+	case "suspend":
+		err = d.actor().SuspendUser(username)
+		message = fmt.Sprintf("User %s suspended", username)
+	case "resume":
+		err = d.actor().ResumeUser(username)
+		message = fmt.Sprintf("User %s resumed", username)
+	case "delete":
+		err = d.actor().RemoveUser(username)
+		message = fmt.Sprintf("User %s deleted", username)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	d.redirectResult(w, r, message, err)
+}
+
+// redirectResult sends the browser back to the user list with a status line
+func (d *Dashboard) redirectResult(w http.ResponseWriter, r *http.Request, message string, err error) {
+	target := "/?msg=" + url.QueryEscape(message)
+	if err != nil {
+		target = "/?err=" + url.QueryEscape(err.Error())
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func (d *Dashboard) render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := d.templates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Failed to render %s: %v", name, err)
+	}
+}
+
+// randomToken returns 32 random bytes, hex encoded
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"./config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestDashboard(t *testing.T) *Dashboard {
+	t.Helper()
+	m := newTestManager(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("right-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDashboard(m.VPSManager, config.DashboardConfig{
+		Username:     "admin",
+		PasswordHash: string(hash),
+		TLS:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func login(d *Dashboard, password string) *httptest.ResponseRecorder {
+	form := url.Values{"username": {"admin"}, "password": {password}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "203.0.113.7:40000"
+	rec := httptest.NewRecorder()
+	d.server.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDashboardLoginLockout(t *testing.T) {
+	d := newTestDashboard(t)
+
+	for i := 0; i < loginMaxFailures; i++ {
+		login(d, "wrong")
+	}
+
+	rec := login(d, "right-password")
+	if len(rec.Result().Cookies()) != 0 {
+		t.Fatal("locked-out IP was able to log in")
+	}
+	if !strings.Contains(rec.Header().Get("Location"), "Too+many") {
+		t.Fatalf("expected lockout message, got %q", rec.Header().Get("Location"))
+	}
+}
+
+func TestDashboardSessionCookieAndPrune(t *testing.T) {
+	d := newTestDashboard(t)
+
+	rec := login(d, "right-password")
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].Secure || !cookies[0].HttpOnly {
+		t.Fatalf("expected one secure HttpOnly cookie, got %+v", cookies)
+	}
+
+	d.prune(time.Now().Add(sessionLifetime + time.Minute))
+	if len(d.sessions) != 0 {
+		t.Fatalf("expired session not pruned: %d left", len(d.sessions))
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrVetoed is returned when a synchronous subscriber rejects an operation
+var ErrVetoed = errors.New("operation rejected")
+
+// EventKind names a point in a user's lifecycle
+type EventKind string
+
+// Before events are published once an operation has been validated but
+// before it changes anything; a synchronous subscriber returning an error
+// cancels it. The others are published when the operation has finished,
+// successfully or not.
+const (
+	BeforeUserAdd     EventKind = "user.add.before"
+	BeforeUserRemove  EventKind = "user.remove.before"
+	BeforeUserRenew   EventKind = "user.renew.before"
+	BeforeUserSuspend EventKind = "user.suspend.before"
+	BeforeUserResume  EventKind = "user.resume.before"
+
+	UserAdded           EventKind = "user.add"
+	UserProvisionFailed EventKind = "user.provision_failed"
+	UserRemoved         EventKind = "user.remove"
+	UserRenewed         EventKind = "user.renew"
+	UserSuspended       EventKind = "user.suspend"
+	UserResumed         EventKind = "user.resume"
+	UserExpired         EventKind = "user.expire"
+)
+
+// vetoable reports whether subscribers may cancel the operation behind k
+func (k EventKind) vetoable() bool {
+	switch k {
+	case BeforeUserAdd, BeforeUserRemove, BeforeUserRenew, BeforeUserSuspend, BeforeUserResume:
+		return true
+	}
+	return false
+}
+
+// Event describes one step of a user lifecycle operation
+type Event struct {
+	Kind     EventKind
+	Time     time.Time
+	Actor    string
+	Username string
+	// User is the account as the operation left it. For Before events it is
+	// the account as it will be created or as it is now; after a failure it
+	// is only set if the change took effect anyway.
+	User      *User
+	Protocols []string
+	Days      int
+	Details   string
+	Err       error
+}
+
+// EventHandler receives published events. Errors returned for a Before
+// event veto the operation; for other events they are only logged.
+type EventHandler func(Event) error
+
+type subscription struct {
+	name    string
+	kinds   []EventKind
+	handler EventHandler
+	async   bool
+}
+
+func (s subscription) wants(kind EventKind) bool {
+	if len(s.kinds) == 0 {
+		return true
+	}
+	for _, k := range s.kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// EventBus delivers user lifecycle events from VPSManager to the audit log,
+// webhooks, metrics and any other subscriber registered on it
+type EventBus struct {
+	mu   sync.RWMutex
+	subs []subscription
+	wg   sync.WaitGroup
+}
+
+// NewEventBus creates a bus with no subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe registers a synchronous handler for the given kinds, or for
+// every kind if none are given. Handlers run in registration order on the
+// publishing goroutine while the user store is locked, so they must not
+// call back into VPSManager.
+func (b *EventBus) Subscribe(name string, handler EventHandler, kinds ...EventKind) {
+	b.subscribe(subscription{name: name, kinds: kinds, handler: handler})
+}
+
+// SubscribeAsync registers a fire-and-forget handler that runs on its own
+// goroutine after the synchronous ones. It cannot veto an operation.
+func (b *EventBus) SubscribeAsync(name string, handler func(Event), kinds ...EventKind) {
+	b.subscribe(subscription{name: name, kinds: kinds, async: true, handler: func(ev Event) error {
+		handler(ev)
+		return nil
+	}})
+}
+
+func (b *EventBus) subscribe(sub subscription) {
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+}
+
+// Publish delivers ev to its subscribers. If a synchronous subscriber
+// vetoes a Before event, the remaining subscribers are skipped and the
+// returned error wraps ErrVetoed.
+func (b *EventBus) Publish(ev Event) error {
+	if b == nil {
+		return nil
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	b.mu.RLock()
+	subs := make([]subscription, len(b.subs))
+	copy(subs, b.subs)
+	b.mu.RUnlock()
+
+	for _, sub := range subs {
+		if sub.async || !sub.wants(ev.Kind) {
+			continue
+		}
+		if err := sub.handler(ev); err != nil {
+			if ev.Kind.vetoable() {
+				return fmt.Errorf("%w by %s: %v", ErrVetoed, sub.name, err)
+			}
+			log.Printf("Event subscriber %s failed on %s %s: %v", sub.name, ev.Kind, ev.Username, err)
+		}
+	}
+
+	for _, sub := range subs {
+		if !sub.async || !sub.wants(ev.Kind) {
+			continue
+		}
+		b.wg.Add(1)
+		go b.runAsync(sub, ev)
+	}
+	return nil
+}
+
+func (b *EventBus) runAsync(sub subscription, ev Event) {
+	defer b.wg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Event subscriber %s panicked on %s %s: %v", sub.name, ev.Kind, ev.Username, r)
+		}
+	}()
+	sub.handler(ev)
+}
+
+// Shutdown waits for asynchronous handlers that are still running
+func (b *EventBus) Shutdown(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// subscribeBuiltins registers the audit log, webhooks, metrics and email
+// notifications. The audit log and webhook outbox are written synchronously
+// so a short-lived command does not exit before recording them; metrics
+// only live in memory and emails may be slow, so both run in the
+// background. The handlers look up their target on
+// each event so tests can swap it after the manager is built.
+func (vm *VPSManager) subscribeBuiltins() {
+	vm.Events.Subscribe("audit", vm.auditEvent,
+		UserAdded, UserProvisionFailed, UserRemoved, UserRenewed, UserSuspended, UserResumed)
+	vm.Events.Subscribe("webhooks", func(ev Event) error { return vm.Webhooks.HandleEvent(ev) },
+		UserAdded, UserProvisionFailed, UserRemoved, UserRenewed, UserSuspended, UserResumed, UserExpired)
+	vm.Events.SubscribeAsync("metrics", func(ev Event) { vm.Metrics.HandleEvent(ev) },
+		UserAdded, UserProvisionFailed, UserRemoved, UserRenewed, UserSuspended, UserResumed, UserExpired)
+	vm.Events.SubscribeAsync("email", vm.emailEvent, UserAdded, UserSuspended)
+}
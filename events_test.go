@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSyncSubscriberVetoesAdd(t *testing.T) {
+	m := newTestManager(t)
+	m.Events.Subscribe("quota", func(ev Event) error {
+		if ev.User.Owner == "" && ev.Days > 7 {
+			return errors.New("trial accounts are limited to 7 days")
+		}
+		return nil
+	}, BeforeUserAdd)
+
+	err := m.AddUser("alice", "secret1", 30)
+	if !errors.Is(err, ErrVetoed) {
+		t.Fatalf("expected ErrVetoed, got %v", err)
+	}
+	if len(m.ssh.calls) != 0 {
+		t.Fatalf("vetoed add reached the SSH manager: %v", m.ssh.calls)
+	}
+	if _, err := m.GetUser("alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("vetoed user was stored: %v", err)
+	}
+
+	records, err := m.Audit.Query(AuditFilter{User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Action != "user.add" || records[0].Result != "failure" {
+		t.Fatalf("expected a failed user.add record, got %+v", records)
+	}
+
+	if err := m.AddUser("bobby", "secret1", 7); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAfterEventErrorsDoNotFailOperation(t *testing.T) {
+	m := newTestManager(t)
+	m.Events.Subscribe("broken", func(Event) error { return errors.New("boom") }, UserAdded)
+
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatalf("after-event error failed the add: %v", err)
+	}
+}
+
+func TestAsyncSubscribers(t *testing.T) {
+	m := newTestManager(t)
+	events := make(chan Event, 10)
+	m.Events.SubscribeAsync("recorder", func(ev Event) { events <- ev })
+	m.Events.SubscribeAsync("panics", func(Event) { panic("boom") }, UserRemoved)
+
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RemoveUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Events.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+
+	var kinds []EventKind
+	for ev := range events {
+		kinds = append(kinds, ev.Kind)
+		if ev.Kind == UserRemoved && (ev.User == nil || ev.User.Username != "alice") {
+			t.Errorf("remove event without the removed user: %+v", ev)
+		}
+	}
+	want := map[EventKind]bool{BeforeUserAdd: true, UserAdded: true, BeforeUserRemove: true, UserRemoved: true}
+	if len(kinds) != len(want) {
+		t.Fatalf("expected %d events, got %v", len(want), kinds)
+	}
+	for _, kind := range kinds {
+		if !want[kind] {
+			t.Fatalf("unexpected event %s in %v", kind, kinds)
+		}
+	}
+}
+
+func TestMetricsCountOperations(t *testing.T) {
+	m := newTestManager(t)
+	m.Metrics = NewMetrics()
+
+	m.AddUser("alice", "secret1", 30)
+	m.ssh.fail["AddUser"] = true
+	m.AddUser("bobby", "secret1", 30)
+	m.Events.Shutdown(context.Background())
+
+	ops := m.Metrics.operations
+	if ops[operationKey{"user.add", "success"}] != 1 || ops[operationKey{"user.add", "failure"}] != 1 {
+		t.Fatalf("unexpected operation counts: %v", ops)
+	}
+}
@@ -4,5 +4,6 @@ go 1.16
 
 require (
 	github.com/google/uuid v1.3.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 ) 
\ No newline at end of file
@@ -0,0 +1,99 @@
+package htpasswd
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+)
+
+const (
+	apr1Magic   = "$apr1$"
+	apr1SaltLen = 8
+	// itoa64 is the alphabet crypt(3) encodes hashes and salts in
+	itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// newAPR1Salt returns a random salt of apr1SaltLen characters
+func newAPR1Salt() (string, error) {
+	b := make([]byte, apr1SaltLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+	for i := range b {
+		b[i] = itoa64[int(b[i])%len(itoa64)]
+	}
+	return string(b), nil
+}
+
+// apr1 is Apache's variant of the MD5-based crypt(3) of FreeBSD, which
+// only differs in its magic string
+func apr1(password, salt string) string {
+	if len(salt) > apr1SaltLen {
+		salt = salt[:apr1SaltLen]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(apr1Magic + salt))
+	for n := len(pw); n > 0; n -= md5.Size {
+		if n > md5.Size {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:n])
+		}
+	}
+	for n := len(pw); n != 0; n >>= 1 {
+		if n&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	// A thousand rounds to slow down brute force
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	out := []byte(apr1Magic + salt + "$")
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		v := uint(sum[group[0]])<<16 | uint(sum[group[1]])<<8 | uint(sum[group[2]])
+		out = appendCrypt64(out, v, 4)
+	}
+	return string(appendCrypt64(out, uint(sum[11]), 2))
+}
+
+// appendCrypt64 appends the low 6*n bits of v in itoa64, least
+// significant first
+func appendCrypt64(out []byte, v uint, n int) []byte {
+	for ; n > 0; n-- {
+		out = append(out, itoa64[v&0x3f])
+		v >>= 6
+	}
+	return out
+}
@@ -0,0 +1,264 @@
+// Package htpasswd reads and writes Apache htpasswd files, as used for
+// basic authentication by nginx and squid. Passwords are hashed with APR1
+// (Apache's MD5 crypt, the htpasswd default), bcrypt or unsalted SHA-1.
+// Every change holds an flock on a lock file next to the htpasswd file
+// and replaces the file atomically, so readers never see it half written.
+package htpasswd
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUserNotFound is returned for changes to a user without an entry
+var ErrUserNotFound = errors.New("user not found")
+
+// Algorithm is a password hashing scheme
+type Algorithm string
+
+const (
+	APR1   Algorithm = "apr1"
+	Bcrypt Algorithm = "bcrypt"
+	SHA    Algorithm = "sha"
+)
+
+// disabledPrefix comments out an entry. nginx and squid both skip such
+// lines, so a login can be disabled without losing its hash.
+const disabledPrefix = "#"
+
+// File is an htpasswd file. New passwords are hashed with Algorithm,
+// APR1 if it is empty, which both nginx and squid understand everywhere.
+type File struct {
+	Path      string
+	Algorithm Algorithm
+}
+
+// New returns the htpasswd file at path, hashing with algorithm
+func New(path string, algorithm Algorithm) *File {
+	return &File{Path: path, Algorithm: algorithm}
+}
+
+// Set adds a user or changes their password. A disabled entry stays
+// disabled.
+func (f *File) Set(username, password string) error {
+	if err := validUsername(username); err != nil {
+		return err
+	}
+	hash, err := Hash(f.Algorithm, password)
+	if err != nil {
+		return err
+	}
+	return f.update(func(lines []string) ([]string, error) {
+		entry := username + ":" + hash
+		if i, disabled := findEntry(lines, username); i >= 0 {
+			if disabled {
+				entry = disabledPrefix + entry
+			}
+			lines[i] = entry
+			return lines, nil
+		}
+		return append(lines, entry), nil
+	})
+}
+
+// Remove deletes a user's entry. Removing a user without one is not an
+// error.
+func (f *File) Remove(username string) error {
+	return f.update(func(lines []string) ([]string, error) {
+		i, _ := findEntry(lines, username)
+		if i < 0 {
+			return lines, nil
+		}
+		return append(lines[:i], lines[i+1:]...), nil
+	})
+}
+
+// SetEnabled comments out a user's entry, or restores one commented out
+func (f *File) SetEnabled(username string, enabled bool) error {
+	return f.update(func(lines []string) ([]string, error) {
+		i, _ := findEntry(lines, username)
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s in %s", ErrUserNotFound, username, f.Path)
+		}
+		entry := strings.TrimPrefix(lines[i], disabledPrefix)
+		if !enabled {
+			entry = disabledPrefix + entry
+		}
+		lines[i] = entry
+		return lines, nil
+	})
+}
+
+// Check reports whether password is the password of an enabled user
+func (f *File) Check(username, password string) (bool, error) {
+	lines, err := f.read()
+	if err != nil {
+		return false, err
+	}
+	i, disabled := findEntry(lines, username)
+	if i < 0 || disabled {
+		return false, nil
+	}
+	hash := strings.TrimPrefix(lines[i], username+":")
+	return Verify(hash, password)
+}
+
+// Users lists the users with an entry, enabled or not
+func (f *File) Users() ([]string, error) {
+	lines, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, line := range lines {
+		entry := strings.TrimPrefix(line, disabledPrefix)
+		if i := strings.Index(entry, ":"); i > 0 {
+			users = append(users, entry[:i])
+		}
+	}
+	return users, nil
+}
+
+// Hash hashes a password for an htpasswd entry
+func Hash(algorithm Algorithm, password string) (string, error) {
+	switch algorithm {
+	case APR1, "":
+		salt, err := newAPR1Salt()
+		if err != nil {
+			return "", err
+		}
+		return apr1(password, salt), nil
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %v", err)
+		}
+		return string(hash), nil
+	case SHA:
+		sum := sha1.Sum([]byte(password))
+		return "{SHA}" + base64.StdEncoding.EncodeToString(sum[:]), nil
+	}
+	return "", fmt.Errorf("unsupported htpasswd algorithm %q", algorithm)
+}
+
+// Verify reports whether password matches an htpasswd hash
+func Verify(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, apr1Magic):
+		salt := strings.TrimPrefix(hash, apr1Magic)
+		if i := strings.Index(salt, "$"); i >= 0 {
+			salt = salt[:i]
+		}
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1, nil
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("invalid bcrypt hash: %v", err)
+		}
+		return true, nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(want), []byte(hash)) == 1, nil
+	}
+	return false, fmt.Errorf("unsupported htpasswd hash %.6q", hash)
+}
+
+// validUsername rejects names that would break the file's format
+func validUsername(username string) error {
+	if username == "" || strings.ContainsAny(username, ":\r\n") || strings.HasPrefix(username, disabledPrefix) {
+		return fmt.Errorf("invalid htpasswd username %q", username)
+	}
+	return nil
+}
+
+// findEntry returns the index of a user's line, enabled or not, and
+// whether it is disabled, or -1
+func findEntry(lines []string, username string) (int, bool) {
+	for i, line := range lines {
+		entry := strings.TrimPrefix(line, disabledPrefix)
+		if strings.HasPrefix(entry, username+":") {
+			return i, entry != line
+		}
+	}
+	return -1, false
+}
+
+// read returns the file's lines without the trailing newline. A missing
+// file has none.
+func (f *File) read() ([]string, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", f.Path, err)
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// update applies fn to the file's lines under the lock and writes the
+// result through a temporary file and rename
+func (f *File) update(fn func(lines []string) ([]string, error)) error {
+	lockFile, err := os.OpenFile(f.Path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s lock: %v", f.Path, err)
+	}
+	defer lockFile.Close()
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock %s: %v", f.Path, err)
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	lines, err := f.read()
+	if err != nil {
+		return err
+	}
+	lines, err = fn(lines)
+	if err != nil {
+		return err
+	}
+
+	// Keep the owner and mode of the existing file, which squid and nginx
+	// workers need to be able to read
+	mode := os.FileMode(0644)
+	info, statErr := os.Stat(f.Path)
+	if statErr == nil {
+		mode = info.Mode().Perm()
+	}
+	var data string
+	if len(lines) > 0 {
+		data = strings.Join(lines, "\n") + "\n"
+	}
+	tmp := f.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(data), mode); err != nil {
+		return fmt.Errorf("failed to write %s: %v", f.Path, err)
+	}
+	if statErr == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			os.Chown(tmp, int(stat.Uid), int(stat.Gid))
+		}
+		os.Chmod(tmp, mode)
+	}
+	if err := os.Rename(tmp, f.Path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %v", f.Path, err)
+	}
+	return nil
+}
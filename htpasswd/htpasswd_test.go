@@ -0,0 +1,103 @@
+package htpasswd
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAPR1MatchesApache(t *testing.T) {
+	tests := []struct{ password, salt, want string }{
+		// The example from the Apache documentation
+		{"myPassword", "r31.....", "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"},
+		{"", "abcdefgh", "$apr1$abcdefgh$L.PT565ESX4Tp2bqNs7Ie."},
+	}
+	for _, tt := range tests {
+		if got := apr1(tt.password, tt.salt); got != tt.want {
+			t.Errorf("apr1(%q, %q) = %s, want %s", tt.password, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestHashAndVerify(t *testing.T) {
+	for _, algorithm := range []Algorithm{APR1, Bcrypt, SHA} {
+		hash, err := Hash(algorithm, "secret1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := Verify(hash, "secret1"); !ok || err != nil {
+			t.Errorf("%s: Verify(%s) = %v, %v", algorithm, hash, ok, err)
+		}
+		if ok, _ := Verify(hash, "secret2"); ok {
+			t.Errorf("%s: wrong password accepted", algorithm)
+		}
+	}
+	// htpasswd -B writes $2y$ hashes
+	hash, _ := Hash(Bcrypt, "secret1")
+	hash = "$2y$" + strings.TrimPrefix(hash, "$2a$")
+	if ok, err := Verify(hash, "secret1"); !ok || err != nil {
+		t.Errorf("Verify(%s) = %v, %v", hash, ok, err)
+	}
+	if _, err := Verify("plain", "plain"); err == nil {
+		t.Error("expected an unsupported hash to be an error")
+	}
+}
+
+func TestFileEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	ioutil.WriteFile(path, []byte("legacy:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0640)
+	f := New(path, "")
+
+	for _, name := range []string{"alice", "bob"} {
+		if err := f.Set(name, name+"-pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := f.Check("legacy", "secret"); !ok || err != nil {
+		t.Fatalf("existing SHA entry: %v, %v", ok, err)
+	}
+	if ok, _ := f.Check("alice", "alice-pw"); !ok {
+		t.Fatal("alice's password rejected")
+	}
+
+	if err := f.SetEnabled("alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := f.Check("alice", "alice-pw"); ok {
+		t.Fatal("disabled entry accepted")
+	}
+	// A new password keeps the entry disabled
+	if err := f.Set("alice", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetEnabled("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := f.Check("alice", "changed"); !ok {
+		t.Fatal("changed password rejected after re-enabling")
+	}
+
+	if err := f.Remove("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Remove("bob"); err != nil {
+		t.Fatalf("removing a missing user: %v", err)
+	}
+	if err := f.SetEnabled("bob", false); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	users, _ := f.Users()
+	if strings.Join(users, ",") != "legacy,alice" {
+		t.Fatalf("users = %v", users)
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	if !strings.HasPrefix(string(data), "legacy:{SHA}") || !strings.Contains(string(data), "\nalice:$apr1$") {
+		t.Fatalf("unexpected file:\n%s", data)
+	}
+	if err := f.Set("eve:x", "pw"); err == nil {
+		t.Fatal("expected a username with a colon to be rejected")
+	}
+}
@@ -38,7 +38,6 @@ apt install -y \
     nginx \
     squid \
     dropbear \
-    apache2-utils \
     git \
     curl \
     wget \
@@ -71,8 +70,8 @@ mkdir -p /var/log/xray
 
 # Download and install Xray directly
 cd /tmp
-wget -O xray.zip https://github.com/XTLS/Xray-core/releases/download/v1.8.4/Xray-linux-64.zip
-unzip -j xray.zip xray -d /usr/local/bin/
+wget -O xray.zip https://github.com/XTLS/Xray-core/releases/download/v25.1.30/Xray-linux-64.zip
+unzip -j xray.zip xray geoip.dat geosite.dat -d /usr/local/bin/
 chmod +x /usr/local/bin/xray
 rm -f xray.zip
 
@@ -85,20 +84,52 @@ fi
 # Create minimal config with a different port initially
 cat > /etc/xray/config.json << EOF
 {
+    "api": {
+        "tag": "api",
+        "services": ["HandlerService", "StatsService"]
+    },
+    "stats": {},
+    "policy": {
+        "levels": {
+            "0": {
+                "statsUserUplink": true,
+                "statsUserDownlink": true
+            }
+        }
+    },
     "inbounds": [
         {
+            "tag": "vmess-in",
             "port": 10085,
             "protocol": "vmess",
             "settings": {
                 "clients": []
             }
+        },
+        {
+            "tag": "api",
+            "listen": "127.0.0.1",
+            "port": 10086,
+            "protocol": "dokodemo-door",
+            "settings": {
+                "address": "127.0.0.1"
+            }
         }
     ],
     "outbounds": [
         {
             "protocol": "freedom"
         }
-    ]
+    ],
+    "routing": {
+        "rules": [
+            {
+                "type": "field",
+                "inboundTag": ["api"],
+                "outboundTag": "api"
+            }
+        ]
+    }
 }
 EOF
 
@@ -131,17 +162,8 @@ systemctl restart xray
 sleep 2
 if systemctl is-active --quiet xray; then
     print_success "Xray installed and running successfully!"
-    
-    # Now try to switch to port 443
-    print_status "Configuring Xray for port 443..."
-    sed -i 's/"port": 10085/"port": 443/' /etc/xray/config.json
-    
-    if systemctl restart xray; then
-        print_success "Xray configured successfully on port 443"
-    else
-        print_error "Could not bind to port 443. Using alternative port 10085"
-        print_status "You can change the port later in /etc/xray/config.json"
-    fi
+    # vps_manager adds the VLESS inbound on port 443, which nginx sits
+    # behind as a fallback, when its daemon starts
 else
     print_error "Xray failed to start. Logs:"
     journalctl -u xray --no-pager -n 20
@@ -186,14 +208,16 @@ go 1.20
 
 require (
 	github.com/google/uuid v1.3.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 )
 EOF
 
 # Update import paths
 print_status "Updating import paths..."
-sed -i 's|"./protocols"|"vps_manager/protocols"|g' vps_manager.go
-sed -i 's|"./config"|"vps_manager/config"|g' vps_manager.go
+find . -type f -name "*.go" -exec sed -i 's|"./protocols"|"vps_manager/protocols"|g' {} \;
+find . -type f -name "*.go" -exec sed -i 's|"./config"|"vps_manager/config"|g' {} \;
+find . -type f -name "*.go" -exec sed -i 's|"../htpasswd"|"vps_manager/htpasswd"|g' {} \;
 
 # Add ioutil imports for older Go versions
 print_status "Updating imports for compatibility..."
@@ -236,10 +260,14 @@ mkdir -p config
 
 # Write configuration file
 print_status "Creating configuration..."
+API_TOKEN=$(tr -dc 'a-f0-9' < /dev/urandom | head -c 48)
+DASHBOARD_PASSWORD=$(tr -dc 'A-Za-z0-9' < /dev/urandom | head -c 16)
+DASHBOARD_HASH=$(echo "$DASHBOARD_PASSWORD" | /usr/local/bin/vps_manager hash-password 2>/dev/null | tail -n 1)
 cat > /etc/vps_manager/config.json << EOF
 {
     "domain": "$(hostname -f)",
     "log_path": "/var/log/vps_manager/vps.log",
+    "audit_path": "/var/log/vps_manager/audit.log",
     "db_path": "/etc/vps_manager/users.json",
     "protocols": {
         "ssh": {
@@ -247,11 +275,29 @@ cat > /etc/vps_manager/config.json << EOF
         },
         "xray": {
             "port": 443,
-            "config_path": "/etc/xray/config.json"
+            "config_path": "/etc/xray/config.json",
+            "api_address": "127.0.0.1:10086",
+            "inbounds": [
+                {
+                    "tag": "vmess-in",
+                    "protocol": "vmess",
+                    "port": 10085
+                }
+            ],
+            "routing": {
+                "block_bittorrent": true,
+                "block_geosite": [],
+                "outbounds": []
+            },
+            "fallback": {
+                "enabled": true,
+                "websocket_port": 10080
+            }
         },
         "websocket": {
             "port": 80,
-            "config_path": "/etc/nginx/conf.d/websocket.conf"
+            "config_path": "/etc/nginx/conf.d/websocket.conf",
+            "user_paths": "uuid"
         },
         "ssl": {
             "cert_path": "/etc/ssl/certs/vps.crt",
@@ -272,11 +318,51 @@ cat > /etc/vps_manager/config.json << EOF
         "dropbear": {
             "port": 2222,
             "config_path": "/etc/dropbear/dropbear.conf"
+        },
+        "tunnel": {
+            "enabled": true,
+            "listen": "127.0.0.1:10000",
+            "target": "dropbear",
+            "status": 101,
+            "banner": "Switching Protocols"
         }
-    }
+    },
+    "api": {
+        "enabled": true,
+        "listen": "127.0.0.1:8088",
+        "token": "${API_TOKEN}"
+    },
+    "dashboard": {
+        "enabled": true,
+        "listen": "0.0.0.0:8089",
+        "username": "admin",
+        "password_hash": "${DASHBOARD_HASH}",
+        "tls": true,
+        "cert_path": "",
+        "key_path": ""
+    },
+    "metrics": {
+        "enabled": true,
+        "listen": "127.0.0.1:9108",
+        "token": ""
+    },
+    "admins_path": "/etc/vps_manager/admins.json",
+    "require_admin_mapping": false,
+    "plans": [
+        {"name": "monthly", "days": 30, "price": 10}
+    ]
 }
 EOF
 
+# Generate a self-signed certificate for the dashboard if none exists yet
+if [ ! -f /etc/ssl/certs/vps.crt ]; then
+    print_status "Generating self-signed certificate..."
+    openssl req -x509 -nodes -newkey rsa:2048 -days 365 \
+        -subj "/CN=$(hostname -f)" \
+        -keyout /etc/ssl/private/vps.key -out /etc/ssl/certs/vps.crt
+    chmod 600 /etc/ssl/private/vps.key
+fi
+
 # Configure firewall
 print_status "Configuring firewall..."
 ufw default deny incoming
@@ -288,6 +374,7 @@ ufw allow 8080/tcp
 ufw allow 3128/tcp
 ufw allow 7300/udp
 ufw allow 2222/tcp
+ufw allow 8089/tcp
 echo "y" | ufw enable
 
 # Create systemd service
@@ -298,7 +385,7 @@ Description=VPS Manager Service
 After=network.target
 
 [Service]
-ExecStart=/usr/local/bin/vps_manager
+ExecStart=/usr/local/bin/vps_manager daemon
 WorkingDirectory=/etc/vps_manager
 User=root
 Group=root
@@ -334,6 +421,8 @@ fi
 print_status "Installation completed!"
 echo -e "${GREEN}Important information:${NC}"
 echo "1. Configuration file: /etc/vps_manager/config.json"
-echo "2. Log file: /var/log/vps_manager/vps.log"
+echo "2. Log file: /var/log/vps_manager/vps.log (audit log: audit.log, check with vps_manager audit verify)"
 echo "3. Database file: /etc/vps_manager/users.json"
-echo "4. Service status: systemctl status vps_manager" 
\ No newline at end of file
+echo "4. Service status: systemctl status vps_manager"
+echo "5. API token: ${API_TOKEN} (listening on 127.0.0.1:8088)"
+echo "6. Dashboard: https://$(hostname -f):8089 (admin / ${DASHBOARD_PASSWORD})" 
\ No newline at end of file
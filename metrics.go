@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"./config"
+	"./protocols"
+)
+
+// expiryWindows are the "expiring within N days" buckets reported by
+// vps_manager_users_expiring
+var expiryWindows = []int{1, 3, 7, 30}
+
+// execBuckets are the upper bounds, in seconds, of the exec latency histogram
+var execBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics holds the counters collected by this process. Gauges such as user
+// counts are computed from the user database on each scrape, so they also
+// reflect changes made by the menu or other processes; counters only cover
+// work done by the daemon itself.
+type Metrics struct {
+	mu            sync.Mutex
+	provisioning  map[provisionKey]uint64
+	operations    map[operationKey]uint64
+	commands      map[string]*histogram
+	auditFailures uint64
+	tunnel        tunnelCounters
+}
+
+// tunnelCounters account the SSH tunnel's connections
+type tunnelCounters struct {
+	opened   map[string]uint64
+	failed   uint64
+	active   int64
+	uplink   int64
+	downlink int64
+}
+
+type provisionKey struct {
+	manager string
+	result  string
+}
+
+type operationKey struct {
+	operation string
+	result    string
+}
+
+// histogram is a Prometheus histogram with cumulative bucket counts
+type histogram struct {
+	buckets  []uint64
+	count    uint64
+	sum      float64
+	failures uint64
+}
+
+// NewMetrics creates an empty metrics registry
+func NewMetrics() *Metrics {
+	return &Metrics{
+		provisioning: make(map[provisionKey]uint64),
+		operations:   make(map[operationKey]uint64),
+		commands:     make(map[string]*histogram),
+		tunnel:       tunnelCounters{opened: make(map[string]uint64)},
+	}
+}
+
+// Provisioned counts one provisioning step by a protocol manager
+func (m *Metrics) Provisioned(manager string, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	m.mu.Lock()
+	m.provisioning[provisionKey{manager, result}]++
+	m.mu.Unlock()
+}
+
+// HandleEvent counts a finished user operation by result
+func (m *Metrics) HandleEvent(ev Event) {
+	if m == nil {
+		return
+	}
+	operation := string(ev.Kind)
+	result := "success"
+	if ev.Kind == UserProvisionFailed {
+		operation = string(UserAdded)
+	}
+	if ev.Err != nil || ev.Kind == UserProvisionFailed {
+		result = "failure"
+	}
+
+	m.mu.Lock()
+	m.operations[operationKey{operation, result}]++
+	m.mu.Unlock()
+}
+
+// AuditFailed counts an audit record that could not be written
+func (m *Metrics) AuditFailed() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.auditFailures++
+	m.mu.Unlock()
+}
+
+// ObserveCommand records the latency of an external command
+func (m *Metrics) ObserveCommand(command string, elapsed time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := m.commands[command]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(execBuckets))}
+		m.commands[command] = h
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range execBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+	if err != nil {
+		h.failures++
+	}
+}
+
+// TunnelOpened counts a tunnel connection that completed its handshake
+func (m *Metrics) TunnelOpened(mode string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.tunnel.opened[mode]++
+	m.tunnel.active++
+	m.mu.Unlock()
+}
+
+// TunnelClosed accounts the bytes of a finished tunnel connection, or
+// counts it as failed if it never opened
+func (m *Metrics) TunnelClosed(c protocols.TunnelConn) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c.Err != nil {
+		m.tunnel.failed++
+		return
+	}
+	m.tunnel.active--
+	m.tunnel.uplink += c.Uplink
+	m.tunnel.downlink += c.Downlink
+}
+
+// MetricsServer serves Prometheus metrics for a VPSManager
+type MetricsServer struct {
+	manager *VPSManager
+	token   string
+	server  *http.Server
+}
+
+// NewMetricsServer creates a metrics server for the given manager
+func NewMetricsServer(manager *VPSManager, cfg config.MetricsConfig) *MetricsServer {
+	s := &MetricsServer{
+		manager: manager,
+		token:   cfg.Token,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+
+	s.server = &http.Server{
+		Addr:         cfg.Listen,
+		Handler:      mux,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+	return s
+}
+
+// Start serves metrics in the background
+func (s *MetricsServer) Start() error {
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown gracefully stops the metrics server
+func (s *MetricsServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+func (s *MetricsServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := s.manager.writeMetrics(&buf, time.Now()); err != nil {
+		log.Printf("Failed to collect metrics: %v", err)
+		http.Error(w, "failed to collect metrics", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// writeMetrics renders every metric in the Prometheus text format
+func (vm *VPSManager) writeMetrics(w io.Writer, now time.Time) error {
+	users, err := vm.GetUsers()
+	if err != nil {
+		return err
+	}
+
+	states := map[string]int{"active": 0, "suspended": 0, "expired": 0}
+	byProtocol := make(map[string]int)
+	expiring := make([]int, len(expiryWindows))
+	for _, user := range users {
+		switch {
+		case now.After(user.ExpireDate):
+			states["expired"]++
+		case user.Suspended:
+			states["suspended"]++
+		default:
+			states["active"]++
+		}
+		for _, protocol := range user.Protocols {
+			byProtocol[protocol]++
+		}
+		for i, days := range expiryWindows {
+			if !now.After(user.ExpireDate) && user.ExpireDate.Before(now.AddDate(0, 0, days)) {
+				expiring[i]++
+			}
+		}
+	}
+
+	writeHeader(w, "vps_manager_users", "gauge", "Number of users by state.")
+	for _, state := range sortedKeys(states) {
+		fmt.Fprintf(w, "vps_manager_users{state=%q} %d\n", state, states[state])
+	}
+
+	writeHeader(w, "vps_manager_protocol_users", "gauge", "Number of users provisioned on each protocol.")
+	for _, protocol := range sortedKeys(byProtocol) {
+		fmt.Fprintf(w, "vps_manager_protocol_users{protocol=%s} %d\n", quoteLabel(protocol), byProtocol[protocol])
+	}
+
+	writeHeader(w, "vps_manager_users_expiring", "gauge", "Number of unexpired users whose account ends within the given number of days.")
+	for i, days := range expiryWindows {
+		fmt.Fprintf(w, "vps_manager_users_expiring{within_days=\"%d\"} %d\n", days, expiring[i])
+	}
+
+	vm.Metrics.writeCounters(w)
+
+	expiry, err := vm.SSLMgr.CertificateExpiry()
+	if err != nil {
+		log.Printf("Metrics: %v", err)
+	} else {
+		writeHeader(w, "vps_manager_certificate_expiry_timestamp_seconds", "gauge", "Unix time at which the SSL certificate expires.")
+		fmt.Fprintf(w, "vps_manager_certificate_expiry_timestamp_seconds{path=%s} %d\n",
+			quoteLabel(vm.Config.Protocols.SSL.CertPath), expiry.Unix())
+	}
+
+	writeHeader(w, "vps_manager_user_traffic_bytes", "counter", "Bytes each user has transferred through Xray, as last collected.")
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	for _, user := range users {
+		fmt.Fprintf(w, "vps_manager_user_traffic_bytes{user=%s,direction=\"uplink\"} %d\n", quoteLabel(user.Username), user.Traffic.Uplink)
+		fmt.Fprintf(w, "vps_manager_user_traffic_bytes{user=%s,direction=\"downlink\"} %d\n", quoteLabel(user.Username), user.Traffic.Downlink)
+	}
+
+	return nil
+}
+
+// writeCounters renders the provisioning and operation counters and exec
+// histograms
+func (m *Metrics) writeCounters(w io.Writer) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "vps_manager_audit_write_failures_total", "counter", "Audit records that could not be written.")
+	fmt.Fprintf(w, "vps_manager_audit_write_failures_total %d\n", m.auditFailures)
+
+	writeHeader(w, "vps_manager_provisioning_total", "counter", "Provisioning steps run by each protocol manager, by result.")
+	keys := make([]provisionKey, 0, len(m.provisioning))
+	for key := range m.provisioning {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].manager != keys[j].manager {
+			return keys[i].manager < keys[j].manager
+		}
+		return keys[i].result < keys[j].result
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "vps_manager_provisioning_total{manager=%s,result=%q} %d\n",
+			quoteLabel(key.manager), key.result, m.provisioning[key])
+	}
+
+	writeHeader(w, "vps_manager_user_operations_total", "counter", "User lifecycle operations, by result.")
+	ops := make([]operationKey, 0, len(m.operations))
+	for key := range m.operations {
+		ops = append(ops, key)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].operation != ops[j].operation {
+			return ops[i].operation < ops[j].operation
+		}
+		return ops[i].result < ops[j].result
+	})
+	for _, key := range ops {
+		fmt.Fprintf(w, "vps_manager_user_operations_total{operation=%q,result=%q} %d\n",
+			key.operation, key.result, m.operations[key])
+	}
+
+	commands := make([]string, 0, len(m.commands))
+	for command := range m.commands {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	writeHeader(w, "vps_manager_exec_duration_seconds", "histogram", "Latency of external commands run by the protocol managers.")
+	for _, command := range commands {
+		h := m.commands[command]
+		label := quoteLabel(command)
+		for i, bound := range execBuckets {
+			fmt.Fprintf(w, "vps_manager_exec_duration_seconds_bucket{command=%s,le=\"%g\"} %d\n", label, bound, h.buckets[i])
+		}
+		fmt.Fprintf(w, "vps_manager_exec_duration_seconds_bucket{command=%s,le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "vps_manager_exec_duration_seconds_sum{command=%s} %g\n", label, h.sum)
+		fmt.Fprintf(w, "vps_manager_exec_duration_seconds_count{command=%s} %d\n", label, h.count)
+	}
+
+	writeHeader(w, "vps_manager_exec_failures_total", "counter", "External commands that exited with an error.")
+	for _, command := range commands {
+		fmt.Fprintf(w, "vps_manager_exec_failures_total{command=%s} %d\n", quoteLabel(command), m.commands[command].failures)
+	}
+
+	writeHeader(w, "vps_manager_tunnel_connections_total", "counter", "SSH tunnel connections, by mode, or failed before the tunnel opened.")
+	modes := make([]string, 0, len(m.tunnel.opened))
+	for mode := range m.tunnel.opened {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	for _, mode := range modes {
+		fmt.Fprintf(w, "vps_manager_tunnel_connections_total{mode=%s} %d\n", quoteLabel(mode), m.tunnel.opened[mode])
+	}
+	fmt.Fprintf(w, "vps_manager_tunnel_connections_total{mode=\"failed\"} %d\n", m.tunnel.failed)
+
+	writeHeader(w, "vps_manager_tunnel_active_connections", "gauge", "Open SSH tunnel connections.")
+	fmt.Fprintf(w, "vps_manager_tunnel_active_connections %d\n", m.tunnel.active)
+
+	writeHeader(w, "vps_manager_tunnel_bytes_total", "counter", "Bytes carried by closed SSH tunnel connections.")
+	fmt.Fprintf(w, "vps_manager_tunnel_bytes_total{direction=\"uplink\"} %d\n", m.tunnel.uplink)
+	fmt.Fprintf(w, "vps_manager_tunnel_bytes_total{direction=\"downlink\"} %d\n", m.tunnel.downlink)
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// quoteLabel escapes a label value as the text format requires
+func quoteLabel(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"./config"
+	"./protocols"
+)
+
+// trafficXray is a stubXray that also reports traffic
+type trafficXray struct{ stubXray }
+
+func (s *trafficXray) UserTraffic(reset bool) (map[string]protocols.Traffic, error) {
+	return map[string]protocols.Traffic{"alice": {Uplink: 10, Downlink: 20}}, nil
+}
+
+func TestWriteMetrics(t *testing.T) {
+	m := newTestManager(t)
+	m.Metrics = NewMetrics()
+	m.XrayMgr = &trafficXray{}
+
+	for _, name := range []string{"alice", "bobby", "carol"} {
+		if err := m.AddUser(name, "secret1", 30); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.SuspendUser("bobby"); err != nil {
+		t.Fatal(err)
+	}
+	m.updateUser("carol", func(u *User) { u.ExpireDate = time.Now().Add(-time.Hour) })
+	m.updateUser("alice", func(u *User) { u.ExpireDate = time.Now().Add(2 * 24 * time.Hour) })
+
+	m.ssh.fail["AddUser"] = true
+	m.AddUser("dave_", "secret1", 30)
+
+	m.Metrics.ObserveCommand("useradd", 30*time.Millisecond, nil)
+	m.Metrics.ObserveCommand("useradd", 2*time.Second, errors.New("exit status 9"))
+
+	if err := m.CollectTraffic(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := m.writeMetrics(&buf, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		`vps_manager_users{state="active"} 1`,
+		`vps_manager_users{state="suspended"} 1`,
+		`vps_manager_users{state="expired"} 1`,
+		`vps_manager_protocol_users{protocol="xray"} 3`,
+		`vps_manager_users_expiring{within_days="1"} 0`,
+		`vps_manager_users_expiring{within_days="3"} 1`,
+		`vps_manager_provisioning_total{manager="ssh",result="failure"} 1`,
+		`vps_manager_provisioning_total{manager="ssh",result="success"} 3`,
+		`vps_manager_provisioning_total{manager="dropbear",result="success"} 3`,
+		`vps_manager_exec_duration_seconds_bucket{command="useradd",le="0.05"} 1`,
+		`vps_manager_exec_duration_seconds_bucket{command="useradd",le="2.5"} 2`,
+		`vps_manager_exec_duration_seconds_count{command="useradd"} 2`,
+		`vps_manager_exec_failures_total{command="useradd"} 1`,
+		`vps_manager_certificate_expiry_timestamp_seconds{path=""} 1900000000`,
+		`vps_manager_user_traffic_bytes{user="alice",direction="downlink"} 20`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestMetricsServerToken(t *testing.T) {
+	m := newTestManager(t)
+	h := NewMetricsServer(m.VPSManager, config.MetricsConfig{Token: "scrape"}).server.Handler
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "# TYPE vps_manager_users gauge") {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestQuoteLabel(t *testing.T) {
+	if got := quoteLabel("a\"b\\c\nd"); got != `"a\"b\\c\nd"` {
+		t.Fatalf("unexpected escaping: %s", got)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"./config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// migrationFormatVersion is the bundle layout ExportUsers writes
+const migrationFormatVersion = 1
+
+// MigrationBundle carries users to another server. Unlike a backup it holds
+// no files, only what the protocol managers need to create the same
+// accounts again, so it can be imported on a server laid out differently.
+// Passwords are in the clear: bundles must be handled like credentials.
+type MigrationBundle struct {
+	Version   int             `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Source    string          `json:"source"`
+	Domain    string          `json:"domain"`
+	Ports     map[string]int  `json:"ports"`
+	Users     []MigrationUser `json:"users"`
+}
+
+// MigrationUser is a user with the secrets needed to recreate their
+// accounts: the password for the protocol managers, the bcrypt hash kept
+// in the user database and the Xray ID their clients are configured with
+type MigrationUser struct {
+	Username       string    `json:"username"`
+	Password       string    `json:"password"`
+	PasswordHash   string    `json:"password_hash"`
+	XrayUUID       string    `json:"xray_uuid,omitempty"`
+	ExpireDate     time.Time `json:"expire_date"`
+	Protocols      []string  `json:"protocols"`
+	Suspended      bool      `json:"suspended"`
+	TelegramChatID int64     `json:"telegram_chat_id,omitempty"`
+	Trial          bool      `json:"trial,omitempty"`
+	Owner          string    `json:"owner,omitempty"`
+	Contact
+}
+
+// ImportReport lists the outcome of an import per user. Differences notes
+// imported users whose protocols here are not the ones they had on the
+// source server.
+type ImportReport struct {
+	Imported    []string
+	Skipped     []string
+	Failed      []string
+	Differences []string
+}
+
+// configPorts returns the protocol ports in cfg by protocol name
+func configPorts(cfg *config.Config) map[string]int {
+	p := cfg.Protocols
+	return map[string]int{
+		"ssh":       p.SSH.Port,
+		"xray":      p.Xray.Port,
+		"websocket": p.WebSocket.Port,
+		"http":      p.HTTP.Port,
+		"squid":     p.Squid.Port,
+		"udp":       p.UDP.Port,
+		"dropbear":  p.Dropbear.Port,
+	}
+}
+
+// setConfigPort changes the port of a protocol in cfg
+func setConfigPort(cfg *config.Config, protocol string, port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%w: bad port %d for %s", ErrInvalidInput, port, protocol)
+	}
+	p := &cfg.Protocols
+	switch protocol {
+	case "ssh":
+		p.SSH.Port = port
+	case "xray":
+		p.Xray.Port = port
+	case "websocket":
+		p.WebSocket.Port = port
+	case "http":
+		p.HTTP.Port = port
+	case "squid":
+		p.Squid.Port = port
+	case "udp":
+		p.UDP.Port = port
+	case "dropbear":
+		p.Dropbear.Port = port
+	default:
+		return fmt.Errorf("%w: unknown protocol %s", ErrInvalidInput, protocol)
+	}
+	return nil
+}
+
+// ExportUsers bundles the users on this server. Passwords are recovered
+// from the UDP configs and checked against the stored hashes; users whose
+// password cannot be recovered, and users that only exist on remote nodes,
+// are left out and listed in skipped.
+func (vm *VPSManager) ExportUsers() (bundle MigrationBundle, skipped []string, err error) {
+	users, err := vm.GetUsers()
+	if err != nil {
+		return MigrationBundle{}, nil, err
+	}
+
+	bundle = MigrationBundle{
+		Version:   migrationFormatVersion,
+		CreatedAt: time.Now().UTC(),
+		Domain:    vm.Config.Domain,
+		Ports:     configPorts(vm.Config),
+		Users:     make([]MigrationUser, 0, len(users)),
+	}
+	bundle.Source, _ = os.Hostname()
+
+	for _, user := range users {
+		if !onLocalNode(user) {
+			skipped = append(skipped, fmt.Sprintf("%s: not on this server", user.Username))
+			continue
+		}
+		password, err := vm.UDPMgr.Password(user.Username)
+		if err == nil && bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+			err = fmt.Errorf("UDP password does not match the stored hash")
+		}
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s: %v", user.Username, err))
+			continue
+		}
+
+		bundle.Users = append(bundle.Users, MigrationUser{
+			Username:       user.Username,
+			Password:       password,
+			PasswordHash:   user.Password,
+			XrayUUID:       user.XrayUUID,
+			ExpireDate:     user.ExpireDate,
+			Protocols:      user.Protocols,
+			Suspended:      user.Suspended,
+			TelegramChatID: user.TelegramChatID,
+			Trial:          user.Trial,
+			Owner:          user.Owner,
+			Contact:        user.Contact,
+		})
+	}
+	return bundle, skipped, nil
+}
+
+// ReadMigrationBundle decodes and checks a bundle
+func ReadMigrationBundle(r io.Reader) (MigrationBundle, error) {
+	var bundle MigrationBundle
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&bundle); err != nil {
+		return MigrationBundle{}, fmt.Errorf("%w: bad migration bundle: %v", ErrInvalidInput, err)
+	}
+	if bundle.Version < 1 || bundle.Version > migrationFormatVersion {
+		return MigrationBundle{}, fmt.Errorf("%w: unsupported migration bundle version %d", ErrInvalidInput, bundle.Version)
+	}
+	return bundle, nil
+}
+
+// remapConfig sets the domain and ports given on the command line in cfg,
+// and reports whether cfg changed. Only config.json is changed: services
+// already running keep their ports until they are set up again.
+func remapConfig(cfg *config.Config, domain string, ports map[string]int) (bool, error) {
+	changed := false
+	if domain != "" && domain != cfg.Domain {
+		cfg.Domain = domain
+		changed = true
+	}
+
+	current := configPorts(cfg)
+	protocols := make([]string, 0, len(ports))
+	for protocol := range ports {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+
+	for _, protocol := range protocols {
+		if ports[protocol] == current[protocol] {
+			continue
+		}
+		if err := setConfigPort(cfg, protocol, ports[protocol]); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// endpointDifferences lists where the source server's domain and ports
+// differ from cfg, which migrated clients need to be pointed at
+func endpointDifferences(cfg *config.Config, bundle MigrationBundle) []string {
+	var diffs []string
+	if bundle.Domain != "" && bundle.Domain != cfg.Domain {
+		diffs = append(diffs, fmt.Sprintf("domain %s, here %s", bundle.Domain, cfg.Domain))
+	}
+	current := configPorts(cfg)
+	protocols := make([]string, 0, len(bundle.Ports))
+	for protocol := range bundle.Ports {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+	for _, protocol := range protocols {
+		if port := bundle.Ports[protocol]; port != 0 && port != current[protocol] {
+			diffs = append(diffs, fmt.Sprintf("%s port %d, here %d", protocol, port, current[protocol]))
+		}
+	}
+	return diffs
+}
+
+// protocolDifference describes how the protocols a user has here differ
+// from the ones they had, or returns "" if they are the same
+func protocolDifference(had, has []string) string {
+	var added, missing []string
+	for _, protocol := range has {
+		if !containsProtocol(had, protocol) {
+			added = append(added, protocol)
+		}
+	}
+	for _, protocol := range had {
+		if !containsProtocol(has, protocol) {
+			missing = append(missing, protocol)
+		}
+	}
+	var parts []string
+	if len(added) > 0 {
+		parts = append(parts, "also has "+strings.Join(added, ", "))
+	}
+	if len(missing) > 0 {
+		parts = append(parts, "lacks "+strings.Join(missing, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func containsProtocol(protocols []string, protocol string) bool {
+	for _, p := range protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportUsers provisions the users of a bundle on this server through the
+// protocol managers, with their original passwords, Xray IDs, expiry and
+// suspension. Users get every protocol of this server, like new users do;
+// where that is not what they had, the report says so. Users that already
+// exist are skipped. Imports are audited as user.import and do not publish
+// lifecycle events, so customers are not sent welcome emails for accounts
+// they already have.
+func (vm *VPSManager) ImportUsers(actor string, bundle MigrationBundle) ImportReport {
+	var report ImportReport
+	for _, mu := range bundle.Users {
+		protocols, err := vm.importUser(actor, bundle.Source, mu)
+		switch {
+		case err == ErrUserExists:
+			report.Skipped = append(report.Skipped, mu.Username)
+		case err != nil:
+			report.Failed = append(report.Failed, fmt.Sprintf("%s: %v", mu.Username, err))
+		default:
+			report.Imported = append(report.Imported, mu.Username)
+			if diff := protocolDifference(mu.Protocols, protocols); diff != "" {
+				report.Differences = append(report.Differences, fmt.Sprintf("%s: %s", mu.Username, diff))
+			}
+		}
+	}
+	return report
+}
+
+// importUser creates a bundled user and returns the protocols it got
+func (vm *VPSManager) importUser(actor, source string, mu MigrationUser) ([]string, error) {
+	err := validateUser(mu.Username, mu.Password, 1)
+	if err == nil {
+		err = validateContact(mu.Contact)
+	}
+	if err == nil && bcrypt.CompareHashAndPassword([]byte(mu.PasswordHash), []byte(mu.Password)) != nil {
+		err = fmt.Errorf("%w: password does not match its hash", ErrInvalidInput)
+	}
+	if err != nil {
+		vm.audit(actor, "user.import", mu.Username, nil, err, "")
+		return nil, err
+	}
+
+	unlock, err := vm.lockStore()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if vm.findUser(mu.Username) >= 0 {
+		return nil, ErrUserExists
+	}
+
+	account, err := localNode{vm}.Provision(mu.Username, mu.Password, mu.XrayUUID)
+	if err != nil {
+		vm.audit(actor, "user.import", mu.Username, account.Protocols, err, "")
+		return nil, err
+	}
+
+	user := User{
+		Username:       mu.Username,
+		Password:       mu.PasswordHash,
+		ExpireDate:     mu.ExpireDate,
+		Protocols:      account.Protocols,
+		XrayUUID:       account.XrayUUID,
+		TelegramChatID: mu.TelegramChatID,
+		Trial:          mu.Trial,
+		Owner:          mu.Owner,
+		Contact:        mu.Contact,
+	}
+	setNodeState(&user, localNodeName, NodeActive, nil)
+
+	details := "from " + source
+	if diff := protocolDifference(mu.Protocols, user.Protocols); diff != "" {
+		details += ", " + diff
+	}
+	if mu.Suspended {
+		if errs := vm.suspendOnNodes(&user, true); len(errs) > 0 {
+			details += ", suspend failed: " + strings.Join(errs, "; ")
+		} else {
+			user.Suspended = true
+		}
+	}
+
+	vm.Users = append(vm.Users, user)
+	err = vm.saveToFile()
+	vm.audit(actor, "user.import", mu.Username, user.Protocols, err, details)
+	return user.Protocols, err
+}
+
+const migrateUsage = `Usage:
+  vps_manager export [-o bundle.json]            bundle users with their secrets for another server
+  vps_manager import [-domain d] [-port protocol=port]... bundle.json
+                                                 create the bundled users on this server; -domain and
+                                                 -port only change config.json, services keep
+                                                 listening where they are until set up again`
+
+// portFlags collects repeated -port protocol=port flags
+type portFlags map[string]int
+
+func (p portFlags) String() string { return "" }
+
+func (p portFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected protocol=port, got %q", value)
+	}
+	port, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fmt.Errorf("bad port in %q", value)
+	}
+	p[parts[0]] = port
+	return nil
+}
+
+// runExportCommand writes a migration bundle
+func runExportCommand(manager *VPSManager, actor *Actor, args []string) error {
+	if err := actor.require(RoleOwner); err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	output := flags.String("o", fmt.Sprintf("vps_manager-users-%s.json", time.Now().Format("20060102-150405")), "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return fmt.Errorf("%w\n%s", ErrInvalidInput, migrateUsage)
+	}
+
+	bundle, skipped, err := manager.ExportUsers()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(bundle, "", "    ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*output)
+	}
+	manager.audit(actor.Admin.Name, "user.export", *output, nil, err,
+		fmt.Sprintf("%d users, %d skipped", len(bundle.Users), len(skipped)))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d users to %s. It contains passwords; keep it private.\n", len(bundle.Users), *output)
+	for _, msg := range skipped {
+		fmt.Printf("  skipped %s\n", msg)
+	}
+	return nil
+}
+
+// runImportCommand creates a bundle's users, after setting the domain and
+// ports given with -domain and -port in config.json. The manager is
+// reloaded after a config change so the protocol managers use the new
+// ports. Without them this server's config is left alone, and where the
+// source server's endpoints differ, the differences are listed.
+func runImportCommand(manager *VPSManager, actor *Actor, args []string) error {
+	if err := actor.require(RoleOwner); err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	domain := flags.String("domain", "", "")
+	ports := make(portFlags)
+	flags.Var(ports, "port", "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return fmt.Errorf("%w\n%s", ErrInvalidInput, migrateUsage)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	bundle, err := ReadMigrationBundle(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	changed, err := remapConfig(manager.Config, *domain, ports)
+	if err != nil {
+		return err
+	}
+	if changed {
+		if err := config.SaveConfig(manager.ConfigPath, manager.Config); err != nil {
+			return fmt.Errorf("failed to save config: %v", err)
+		}
+		fmt.Printf("Updated %s: domain %s, ports %v\n", manager.ConfigPath, manager.Config.Domain, configPorts(manager.Config))
+		fmt.Println("Only config.json changed; reconfigure the services for the new ports to take effect.")
+		if manager, err = NewVPSManager(manager.ConfigPath); err != nil {
+			return err
+		}
+	}
+	if diffs := endpointDifferences(manager.Config, bundle); len(diffs) > 0 {
+		fmt.Println("The source server's endpoints differ; migrated clients need updating:")
+		for _, diff := range diffs {
+			fmt.Printf("  %s\n", diff)
+		}
+	}
+
+	report := manager.ImportUsers(actor.Admin.Name, bundle)
+	fmt.Printf("Imported %d users, skipped %d existing\n", len(report.Imported), len(report.Skipped))
+	for _, msg := range report.Differences {
+		fmt.Printf("  protocols differ for %s\n", msg)
+	}
+	for _, msg := range report.Failed {
+		fmt.Printf("  failed %s\n", msg)
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d users could not be imported", len(report.Failed))
+	}
+	return nil
+}
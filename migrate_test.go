@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMigrateUsersBetweenServers(t *testing.T) {
+	source := newTestManager(t)
+	if err := source.OwnerActor("root").AddUser("alice", "secret1", "", 30, Contact{Email: "alice@example.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.AddUser("bobby", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.SuspendUser("bobby"); err != nil {
+		t.Fatal(err)
+	}
+	// The stub UDP manager reports secret1, which does not match carol's hash
+	if err := source.AddUser("carol", "secret2", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, skipped, err := source.ExportUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Users) != 2 || len(skipped) != 1 || !strings.HasPrefix(skipped[0], "carol:") {
+		t.Fatalf("unexpected export: %d users, skipped %v", len(bundle.Users), skipped)
+	}
+
+	data, _ := json.Marshal(bundle)
+	bundle, err = ReadMigrationBundle(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := newTestManager(t)
+	report := target.ImportUsers("root", bundle)
+	if len(report.Imported) != 2 || len(report.Failed) != 0 {
+		t.Fatalf("unexpected import: %+v", report)
+	}
+	if calls := strings.Join(target.xray.calls, ","); calls != "AddUserWithID,AddUserWithID,RemoveUser" {
+		t.Fatalf("Xray IDs not carried over: %s", calls)
+	}
+
+	for _, name := range []string{"alice", "bobby"} {
+		want, _ := source.GetUser(name)
+		got, err := target.GetUser(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.XrayUUID != want.XrayUUID || got.Password != want.Password ||
+			!got.ExpireDate.Equal(want.ExpireDate) || got.Suspended != want.Suspended || got.Email != want.Email {
+			t.Errorf("%s not carried over:\n got %+v\nwant %+v", name, got, want)
+		}
+	}
+
+	if report := target.ImportUsers("root", bundle); len(report.Skipped) != 2 {
+		t.Fatalf("expected existing users to be skipped, got %+v", report)
+	}
+	records, err := target.Audit.Query(AuditFilter{User: "alice"})
+	if err != nil || len(records) != 1 || records[0].Action != "user.import" {
+		t.Fatalf("expected one user.import record, got %+v (%v)", records, err)
+	}
+}
+
+func TestImportRejectsMismatchedPassword(t *testing.T) {
+	source := newTestManager(t)
+	if err := source.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	bundle, _, err := source.ExportUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle.Users[0].Password = "secret2"
+
+	target := newTestManager(t)
+	if report := target.ImportUsers("root", bundle); len(report.Failed) != 1 {
+		t.Fatalf("expected the import to fail, got %+v", report)
+	}
+	if len(target.ssh.calls) != 0 {
+		t.Fatalf("accounts provisioned for a bad bundle: %v", target.ssh.calls)
+	}
+}
+
+func TestImportReportsProtocolDifferences(t *testing.T) {
+	source := newTestManager(t)
+	if err := source.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	bundle, _, err := source.ExportUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle.Users[0].Protocols = []string{"ssh", "xray", "openvpn"}
+
+	target := newTestManager(t)
+	report := target.ImportUsers("root", bundle)
+	want := "alice: also has ssl, websocket, http, squid, udp, dropbear; lacks openvpn"
+	if len(report.Imported) != 1 || len(report.Differences) != 1 || report.Differences[0] != want {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
+
+func TestRemapConfig(t *testing.T) {
+	m := newTestManager(t)
+	m.Config.Protocols.Squid.Port = 3128
+
+	// Without flags the config is left alone
+	changed, err := remapConfig(m.Config, "", nil)
+	if err != nil || changed {
+		t.Fatalf("expected no change, got %v %v", changed, err)
+	}
+
+	changed, err = remapConfig(m.Config, "new.example.com", map[string]int{"xray": 8443})
+	if err != nil || !changed {
+		t.Fatalf("expected a change, got %v %v", changed, err)
+	}
+	if m.Config.Domain != "new.example.com" || m.Config.Protocols.Xray.Port != 8443 || m.Config.Protocols.Squid.Port != 3128 {
+		t.Fatalf("unexpected config: %s %+v", m.Config.Domain, configPorts(m.Config))
+	}
+
+	changed, err = remapConfig(m.Config, "new.example.com", map[string]int{"xray": 8443})
+	if err != nil || changed {
+		t.Fatalf("expected no change the second time, got %v %v", changed, err)
+	}
+	if _, err := remapConfig(m.Config, "", map[string]int{"gopher": 70}); err == nil {
+		t.Fatal("expected unknown protocol to be rejected")
+	}
+
+	bundle := MigrationBundle{Domain: "old.example.com", Ports: map[string]int{"xray": 443, "squid": 3128}}
+	diffs := endpointDifferences(m.Config, bundle)
+	want := []string{"domain old.example.com, here new.example.com", "xray port 443, here 8443"}
+	if strings.Join(diffs, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("differences = %q, want %q", diffs, want)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"./config"
+	"./protocols"
+)
+
+// webSocketPort is the port clients reach the WebSocket site on: the Xray
+// port if nginx sits behind the fallback inbound
+func webSocketPort(cfg *config.Config) int {
+	if !fallbackConfig(cfg).Enabled {
+		return cfg.Protocols.WebSocket.Port
+	}
+	if cfg.Protocols.Xray.Port == 0 {
+		return protocols.XrayDefaultPort
+	}
+	return cfg.Protocols.Xray.Port
+}
+
+// webSocketFront is where nginx serves Xray's WebSocket inbounds that have
+// no TLS of their own, on the Xray port if nginx sits behind the fallback
+// inbound
+func webSocketFront(cfg *config.Config) *protocols.WebSocketFront {
+	return &protocols.WebSocketFront{
+		Host:      cfg.Domain,
+		Port:      webSocketPort(cfg),
+		UserPaths: cfg.Protocols.WebSocket.UserPaths,
+	}
+}
+
+// webSocketRoutes lists the paths nginx proxies to Xray's WebSocket
+// inbounds, as they are in the Xray config now
+func (vm *VPSManager) webSocketRoutes() ([]protocols.WebSocketRoute, error) {
+	inbounds, err := vm.XrayMgr.Inbounds()
+	if err != nil {
+		return nil, err
+	}
+	return webSocketFront(vm.Config).Routes(inbounds), nil
+}
+
+// SyncNginx renders the sites of every user on this server and the routes
+// to Xray's WebSocket inbounds into the managed nginx config, reloading
+// nginx if it changed
+func (vm *VPSManager) SyncNginx() (bool, error) {
+	users, err := vm.GetUsers()
+	if err != nil {
+		return false, err
+	}
+	var sites []protocols.NginxSite
+	for _, user := range users {
+		if onLocalNode(user) {
+			sites = append(sites, protocols.NginxSite{Username: user.Username})
+		}
+	}
+	routes, err := vm.webSocketRoutes()
+	if err != nil {
+		return false, err
+	}
+	return vm.NginxMgr.Apply(sites, routes)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"./protocols"
+)
+
+func TestNginxSitesFollowUsers(t *testing.T) {
+	m := newTestManager(t)
+	for _, name := range []string{"alice", "bob"} {
+		if err := m.AddUser(name, "secret1", 30); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.RemoveUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	want := []protocols.NginxSite{{Username: "bob"}}
+	if !reflect.DeepEqual(m.nginx.sites, want) {
+		t.Fatalf("sites = %v, want %v", m.nginx.sites, want)
+	}
+
+	// A user only on another node has no site here
+	m.Users = append(m.Users, User{Username: "carol", Nodes: map[string]NodeState{"edge": {Status: NodeActive}}})
+	if err := m.saveToFile(); err != nil {
+		t.Fatal(err)
+	}
+	m.nginx.sites = nil
+	if _, err := m.SyncNginx(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.nginx.sites, want) {
+		t.Fatalf("synced sites = %v, want %v", m.nginx.sites, want)
+	}
+}
+
+func TestProvisionRollsBackFailedSite(t *testing.T) {
+	m := newTestManager(t)
+	m.nginx.fail["AddSite"] = true
+	if err := m.AddUser("alice", "secret1", 30); err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if _, err := m.GetUser("alice"); err == nil {
+		t.Fatal("user saved after a failed site")
+	}
+	if got := m.ssh.calls; !reflect.DeepEqual(got, []string{"AddUser", "RemoveUser"}) {
+		t.Fatalf("SSH account not rolled back: %v", got)
+	}
+}
+
+func TestNginxRoutesFollowXrayInbounds(t *testing.T) {
+	m := newTestManager(t)
+	m.Config.Protocols.WebSocket.UserPaths = protocols.WebSocketPathsUsername
+	var inbound protocols.XrayInbound
+	err := json.Unmarshal([]byte(`{"tag": "vmess-ws", "port": 10001, "protocol": "vmess",
+		"settings": {"clients": [{"id": "11111111-1111-1111-1111-111111111111", "email": "alice"}]},
+		"streamSettings": {"network": "ws", "wsSettings": {"path": "/vmess"}}}`), &inbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.xray.inbounds = []protocols.XrayInbound{inbound}
+
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	want := []protocols.WebSocketRoute{{Path: "/vmess/alice", Port: 10001, Upstream: "/vmess"}}
+	if !reflect.DeepEqual(m.nginx.routes, want) {
+		t.Fatalf("routes = %+v, want %+v", m.nginx.routes, want)
+	}
+
+	// Without the Xray inbounds the site is not changed, so their routes
+	// are not dropped
+	m.xray.fail["Inbounds"] = true
+	if _, err := m.SyncNginx(); err == nil {
+		t.Fatal("expected the sync to fail")
+	}
+	if calls := m.nginx.calls; calls[len(calls)-1] != "AddSite" {
+		t.Fatalf("nginx changed without the routes: %v", calls)
+	}
+}
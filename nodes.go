@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// localNodeName is the node that stands for the server the manager runs on
+const localNodeName = "local"
+
+// Node states recorded on a user
+const (
+	NodeActive    = "active"
+	NodeSuspended = "suspended"
+	NodeFailed    = "failed"
+	// NodeRemoving is a node the account could not be removed from yet;
+	// removing the user again retries it
+	NodeRemoving = "removing"
+)
+
+// NodeState is a user's account on one node. Status is the last state
+// that was reached, or failed if the account could not be created there;
+// Error holds the last operation that failed on the node.
+type NodeState struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NodeAccount describes an account provisioned on a node
+type NodeAccount struct {
+	XrayUUID  string   `json:"xray_uuid,omitempty"`
+	Protocols []string `json:"protocols"`
+}
+
+// NodeClient drives the protocol managers of one server, either this one
+// or a remote agent
+type NodeClient interface {
+	// Provision creates the account on every protocol, rolling back on
+	// failure. On error the account lists the protocols that were touched.
+	Provision(username, password, xrayUUID string) (NodeAccount, error)
+	Remove(username string) error
+	Suspend(username string) error
+	Resume(username, xrayUUID string) error
+	Status() ([]ServiceStatus, error)
+}
+
+// NodeReport is the service status of one node, or why it could not be
+// reached
+type NodeReport struct {
+	Name     string          `json:"name"`
+	Services []ServiceStatus `json:"services,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// localNode runs operations on this server's protocol managers
+type localNode struct {
+	vm *VPSManager
+}
+
+func (n localNode) Provision(username, password, xrayUUID string) (NodeAccount, error) {
+	return n.vm.provisionLocal(username, password, xrayUUID)
+}
+
+func (n localNode) Remove(username string) error { return n.vm.removeLocal(username) }
+
+func (n localNode) Suspend(username string) error { return n.vm.suspendLocal(username) }
+
+func (n localNode) Resume(username, xrayUUID string) error {
+	return n.vm.resumeLocal(username, xrayUUID)
+}
+
+func (n localNode) Status() ([]ServiceStatus, error) { return n.vm.ProtocolStatus(), nil }
+
+// node returns the client for a node name
+func (vm *VPSManager) node(name string) (NodeClient, error) {
+	if name == localNodeName {
+		return localNode{vm}, nil
+	}
+	if node, ok := vm.Nodes[name]; ok {
+		return node, nil
+	}
+	return nil, fmt.Errorf("%w: unknown node %s", ErrInvalidInput, name)
+}
+
+// resolveNodes checks the nodes a new user should be created on, defaulting
+// to the configured default nodes or, without any, to this server
+func (vm *VPSManager) resolveNodes(names []string) ([]string, error) {
+	if len(names) == 0 {
+		names = vm.Config.Nodes.Default
+	}
+	if len(names) == 0 {
+		return []string{localNodeName}, nil
+	}
+
+	seen := make(map[string]bool)
+	resolved := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			continue
+		}
+		if _, err := vm.node(name); err != nil {
+			return nil, err
+		}
+		seen[name] = true
+		resolved = append(resolved, name)
+	}
+	return resolved, nil
+}
+
+// userNodes lists the nodes a user is on. Users created before nodes were
+// tracked only exist on this server.
+func userNodes(user User) []string {
+	if len(user.Nodes) == 0 {
+		return []string{localNodeName}
+	}
+	names := make([]string, 0, len(user.Nodes))
+	for name := range user.Nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// onLocalNode reports whether a user has an account on this server
+func onLocalNode(user User) bool {
+	if len(user.Nodes) == 0 {
+		return true
+	}
+	state, ok := user.Nodes[localNodeName]
+	return ok && state.Status != NodeFailed && state.Status != NodeRemoving
+}
+
+func setNodeState(user *User, name, status string, err error) {
+	if user.Nodes == nil {
+		user.Nodes = make(map[string]NodeState)
+	}
+	state := user.Nodes[name]
+	state.Status = status
+	state.Error = ""
+	if err != nil {
+		state.Error = err.Error()
+	}
+	state.UpdatedAt = time.Now().UTC()
+	user.Nodes[name] = state
+}
+
+// provisionUser creates the account on each node. Every node gets the same
+// Xray ID, taken from the first one to succeed. A node that fails is
+// recorded as failed on the user; provisioning only fails as a whole if no
+// node succeeded, in which case the returned User lists the protocols
+// touched on the last node tried.
+func (vm *VPSManager) provisionUser(username, password string, expireDays int, nodes []string) (User, error) {
+	// Hash password
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	user := User{
+		Username:   username,
+		Password:   string(hashedPassword),
+		ExpireDate: time.Now().AddDate(0, 0, expireDays),
+	}
+
+	var failures []string
+	var touched []string
+	for _, name := range nodes {
+		node, err := vm.node(name)
+		if err != nil {
+			return User{}, err
+		}
+
+		account, err := node.Provision(username, password, user.XrayUUID)
+		if err != nil {
+			touched = account.Protocols
+			setNodeState(&user, name, NodeFailed, err)
+			if len(nodes) == 1 {
+				return User{Protocols: touched}, err
+			}
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+			log.Printf("Provisioning %s on node %s failed: %v", username, name, err)
+			continue
+		}
+
+		if user.XrayUUID == "" {
+			user.XrayUUID = account.XrayUUID
+		}
+		if len(user.Protocols) == 0 {
+			user.Protocols = account.Protocols
+		}
+		setNodeState(&user, name, NodeActive, nil)
+	}
+
+	if len(failures) == len(nodes) {
+		return User{Protocols: touched}, fmt.Errorf("provisioning failed on every node: %s", strings.Join(failures, "; "))
+	}
+	return user, nil
+}
+
+// failedNodes lists the nodes a user could not be created on
+func failedNodes(user User) []string {
+	var names []string
+	for _, name := range userNodes(user) {
+		if user.Nodes[name].Status == NodeFailed {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// removeFromNodes deletes the account from every node it was created on.
+// Nodes it is gone from are dropped from the user; those it could not be
+// removed from are marked removing, so the user is still on record for the
+// removal to be retried. Errors from this server are reported as they are;
+// those from remote nodes are prefixed with the node's name.
+func (vm *VPSManager) removeFromNodes(user *User) []string {
+	var errors []string
+	for _, name := range userNodes(*user) {
+		if user.Nodes[name].Status == NodeFailed {
+			delete(user.Nodes, name)
+			continue
+		}
+		node, err := vm.node(name)
+		if err == nil {
+			err = node.Remove(user.Username)
+		}
+		if err == nil {
+			delete(user.Nodes, name)
+			continue
+		}
+		setNodeState(user, name, NodeRemoving, err)
+		if name == localNodeName {
+			errors = append(errors, err.Error())
+		} else {
+			errors = append(errors, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	return errors
+}
+
+// suspendOnNodes suspends or resumes the account on every node it was
+// created on, recording each node's result on the user
+func (vm *VPSManager) suspendOnNodes(user *User, suspend bool) []string {
+	var errors []string
+	for _, name := range userNodes(*user) {
+		state := user.Nodes[name]
+		if state.Status == NodeFailed || state.Status == NodeRemoving {
+			continue
+		}
+		if state.Status == "" {
+			state.Status = NodeActive
+		}
+
+		node, err := vm.node(name)
+		if err == nil {
+			if suspend {
+				err = node.Suspend(user.Username)
+			} else {
+				err = node.Resume(user.Username, user.XrayUUID)
+			}
+		}
+
+		if err != nil {
+			setNodeState(user, name, state.Status, err)
+			if name == localNodeName {
+				errors = append(errors, err.Error())
+			} else {
+				errors = append(errors, fmt.Sprintf("%s: %v", name, err))
+			}
+			continue
+		}
+		if suspend {
+			setNodeState(user, name, NodeSuspended, nil)
+		} else {
+			setNodeState(user, name, NodeActive, nil)
+		}
+	}
+	return errors
+}
+
+// printNodeStatus writes a table of node service states to stdout
+func printNodeStatus(reports []NodeReport) {
+	fmt.Printf("%-15s %s\n", "Node", "Services")
+	fmt.Println("-------------------------------------------------------------------------------")
+	for _, report := range reports {
+		if report.Error != "" {
+			fmt.Printf("%-15s unreachable: %s\n", report.Name, report.Error)
+			continue
+		}
+		states := make([]string, 0, len(report.Services))
+		for _, service := range report.Services {
+			states = append(states, fmt.Sprintf("%s=%s", service.Protocol, service.State))
+		}
+		fmt.Printf("%-15s %s\n", report.Name, strings.Join(states, " "))
+	}
+}
+
+// NodeStatus reports the service status of this server and every
+// registered node
+func (vm *VPSManager) NodeStatus() []NodeReport {
+	names := []string{localNodeName}
+	for name := range vm.Nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+
+	reports := make([]NodeReport, 0, len(names))
+	for _, name := range names {
+		report := NodeReport{Name: name}
+		node, err := vm.node(name)
+		if err == nil {
+			report.Services, err = node.Status()
+		}
+		if err != nil {
+			report.Error = err.Error()
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"math"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"./config"
+)
+
+// Email templates, found as <language>/<name>.tmpl in the templates
+// directory or under web/email. The first line of a template is the
+// "Subject:" header and the rest, after a blank line, is the body.
+const (
+	emailAccountCreated   = "account_created"
+	emailExpiryReminder   = "expiry_reminder"
+	emailAccountSuspended = "account_suspended"
+)
+
+const (
+	emailDefaultPort         = 25
+	emailDefaultReminderDays = 3
+	emailDefaultLanguage     = "en"
+)
+
+// Notifier emails customers about their accounts over SMTP
+type Notifier struct {
+	cfg config.EmailConfig
+}
+
+// NewNotifier creates a notifier for the configured SMTP server
+func NewNotifier(cfg config.EmailConfig) *Notifier {
+	if cfg.Port == 0 {
+		cfg.Port = emailDefaultPort
+	}
+	if cfg.ReminderDays <= 0 {
+		cfg.ReminderDays = emailDefaultReminderDays
+	}
+	if cfg.DefaultLanguage == "" {
+		cfg.DefaultLanguage = emailDefaultLanguage
+	}
+	return &Notifier{cfg: cfg}
+}
+
+// Enabled reports whether emails should be sent
+func (n *Notifier) Enabled() bool {
+	return n != nil && n.cfg.Enabled
+}
+
+// Send renders the named template in the user's language and mails it to
+// them. Users without an email address are skipped.
+func (n *Notifier) Send(name string, user User, data map[string]interface{}) error {
+	if user.Email == "" {
+		return nil
+	}
+	from, err := mail.ParseAddress(n.cfg.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address %q: %v", n.cfg.From, err)
+	}
+
+	tmpl, err := n.template(user.Language, name)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["User"] = user
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("failed to render %s email: %v", name, err)
+	}
+	subject, body := splitEmailTemplate(buf.String())
+
+	msg, err := emailMessage(from, user.Email, subject, body)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if n.cfg.Username != "" {
+		auth = smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, n.cfg.Host)
+	}
+	addr := net.JoinHostPort(n.cfg.Host, strconv.Itoa(n.cfg.Port))
+	if err := smtp.SendMail(addr, auth, from.Address, []string{user.Email}, msg); err != nil {
+		return fmt.Errorf("failed to send %s email to %s: %v", name, user.Username, err)
+	}
+	return nil
+}
+
+// template finds a template in the user's language, falling back to the
+// default language and then English. For each language a file in the
+// templates directory takes precedence over the built-in one, so single
+// templates can be translated or reworded.
+func (n *Notifier) template(language, name string) (*template.Template, error) {
+	file := name + ".tmpl"
+	for _, lang := range []string{language, n.cfg.DefaultLanguage, emailDefaultLanguage} {
+		if lang == "" || !languagePattern.MatchString(lang) {
+			continue
+		}
+
+		if n.cfg.TemplatesDir != "" {
+			data, err := ioutil.ReadFile(filepath.Join(n.cfg.TemplatesDir, lang, file))
+			if err == nil {
+				return parseEmailTemplate(name, data)
+			}
+			if !os.IsNotExist(err) {
+				return nil, fmt.Errorf("failed to read %s email template: %v", name, err)
+			}
+		}
+
+		data, err := fs.ReadFile(webFiles, path.Join("web/email", lang, file))
+		if err == nil {
+			return parseEmailTemplate(name, data)
+		}
+	}
+	return nil, fmt.Errorf("no %s email template", name)
+}
+
+func parseEmailTemplate(name string, data []byte) (*template.Template, error) {
+	tmpl, err := template.New(name).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s email template: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+// splitEmailTemplate separates the "Subject:" line of a rendered template
+// from the body
+func splitEmailTemplate(text string) (string, string) {
+	text = strings.TrimLeft(text, "\r\n")
+	line, body := text, ""
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		line, body = text[:i], text[i+1:]
+	}
+	subject := strings.TrimSpace(strings.TrimPrefix(line, "Subject:"))
+	return subject, strings.TrimLeft(body, "\r\n")
+}
+
+// emailMessage builds a UTF-8 plain-text message
+func emailMessage(from *mail.Address, to, subject, body string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", (&mail.Address{Address: to}).String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	if _, err := qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// emailEvent emails customers when their account is created, with its
+// connection card, and when it is suspended
+func (vm *VPSManager) emailEvent(ev Event) {
+	if !vm.Notifier.Enabled() || ev.Err != nil || ev.User == nil || ev.User.Email == "" {
+		return
+	}
+
+	var err error
+	switch ev.Kind {
+	case UserAdded:
+		var card string
+		card, err = vm.renderConnectionCard(*ev.User)
+		if err == nil {
+			err = vm.Notifier.Send(emailAccountCreated, *ev.User, map[string]interface{}{"Card": card})
+		}
+	case UserSuspended:
+		err = vm.Notifier.Send(emailAccountSuspended, *ev.User, nil)
+	}
+	if err != nil {
+		log.Printf("Email notification for %s failed: %v", ev.Username, err)
+	}
+}
+
+// SendExpiryReminders emails users whose account expires within the
+// configured number of days. Each expiry date is only reminded once, so a
+// renewal arms the reminder again.
+func (vm *VPSManager) SendExpiryReminders() {
+	if !vm.Notifier.Enabled() {
+		return
+	}
+	users, err := vm.GetUsers()
+	if err != nil {
+		log.Printf("Error sending expiry reminders: %v", err)
+		return
+	}
+
+	now := time.Now()
+	window := now.AddDate(0, 0, vm.Notifier.cfg.ReminderDays)
+	for _, user := range users {
+		if user.Email == "" || user.Suspended || !user.ExpireDate.After(now) || user.ExpireDate.After(window) {
+			continue
+		}
+		if user.ExpiryReminded != nil && user.ExpiryReminded.Equal(user.ExpireDate) {
+			continue
+		}
+
+		daysLeft := int(math.Ceil(user.ExpireDate.Sub(now).Hours() / 24))
+		if err := vm.Notifier.Send(emailExpiryReminder, user, map[string]interface{}{"DaysLeft": daysLeft}); err != nil {
+			log.Printf("Email notification for %s failed: %v", user.Username, err)
+			continue
+		}
+
+		expireDate := user.ExpireDate
+		err := vm.updateUser(user.Username, func(u *User) {
+			if u.ExpireDate.Equal(expireDate) {
+				u.ExpiryReminded = &expireDate
+			}
+		})
+		if err != nil {
+			log.Printf("Failed to record expiry reminder for %s: %v", user.Username, err)
+		}
+	}
+}
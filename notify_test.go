@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"./config"
+)
+
+// smtpSink is a minimal SMTP server that keeps every message it receives
+type smtpSink struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	messages []*mail.Message
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpSink{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 sink ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 sink")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			msg, err := mail.ReadMessage(strings.NewReader(data.String()))
+			if err != nil {
+				reply("554 bad message")
+				continue
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *smtpSink) received() []*mail.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*mail.Message(nil), s.messages...)
+}
+
+func (s *smtpSink) config() config.EmailConfig {
+	host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	return config.EmailConfig{Enabled: true, Host: host, Port: portNum, From: "VPS <noreply@example.com>"}
+}
+
+func messageBody(t *testing.T, msg *mail.Message) string {
+	t.Helper()
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func waitForEmails(t *testing.T, m *testManager) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Events.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmailOnCreateAndSuspend(t *testing.T) {
+	sink := newSMTPSink(t)
+	m := newTestManager(t)
+	cfg := sink.config()
+
+	// A Spanish account_created template, with no Spanish suspension
+	// template so that one falls back to the built-in English text
+	cfg.TemplatesDir = t.TempDir()
+	os.MkdirAll(filepath.Join(cfg.TemplatesDir, "es"), 0755)
+	ioutil.WriteFile(filepath.Join(cfg.TemplatesDir, "es", "account_created.tmpl"),
+		[]byte("Subject: Tu cuenta {{ .User.Username }} está lista\n\n{{ .Card }}"), 0644)
+	m.Notifier = NewNotifier(cfg)
+
+	err := m.OwnerActor("root").AddUser("alice", "secret1", "", 30, Contact{Email: "alice@example.com", Language: "es"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddUser("bobby", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	waitForEmails(t, m)
+
+	msgs := sink.received()
+	if len(msgs) != 1 {
+		t.Fatalf("expected one email, got %d", len(msgs))
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msgs[0].Header.Get("Subject"))
+	if err != nil || subject != "Tu cuenta alice está lista" {
+		t.Fatalf("unexpected subject %q (%v)", subject, err)
+	}
+	if to := msgs[0].Header.Get("To"); to != "<alice@example.com>" {
+		t.Fatalf("unexpected recipient %q", to)
+	}
+	if body := messageBody(t, msgs[0]); !strings.Contains(body, "vless://alice@example.com") {
+		t.Fatalf("connection card missing from body:\n%s", body)
+	}
+
+	if err := m.SuspendUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	waitForEmails(t, m)
+
+	msgs = sink.received()
+	if len(msgs) != 2 || !strings.Contains(msgs[1].Header.Get("Subject"), "has been suspended") {
+		t.Fatalf("expected an English suspension email, got %d messages", len(msgs))
+	}
+}
+
+func TestExpiryReminderSentOncePerExpiry(t *testing.T) {
+	sink := newSMTPSink(t)
+	m := newTestManager(t)
+	m.Notifier = NewNotifier(sink.config())
+
+	if err := m.OwnerActor("root").AddUser("alice", "secret1", "", 2, Contact{Email: "alice@example.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.OwnerActor("root").AddUser("bobby", "secret1", "", 30, Contact{Email: "bobby@example.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitForEmails(t, m)
+	created := len(sink.received())
+
+	m.SendExpiryReminders()
+	m.SendExpiryReminders()
+	msgs := sink.received()[created:]
+	if len(msgs) != 1 || msgs[0].Header.Get("To") != "<alice@example.com>" {
+		t.Fatalf("expected one reminder for alice, got %d", len(msgs))
+	}
+	if subject := msgs[0].Header.Get("Subject"); !strings.Contains(subject, "expires in 2 days") {
+		t.Fatalf("unexpected subject %q", subject)
+	}
+
+	// A renewal that still ends inside the window is reminded again
+	if _, err := m.RenewUser("alice", 1); err != nil {
+		t.Fatal(err)
+	}
+	m.SendExpiryReminders()
+	if n := len(sink.received()) - created; n != 2 {
+		t.Fatalf("expected a second reminder after renewal, got %d", n)
+	}
+}
+
+func TestInvalidContactRejected(t *testing.T) {
+	m := newTestManager(t)
+	for _, contact := range []Contact{
+		{Email: "not an address"},
+		{Email: "Alice <alice@example.com>"},
+		{Email: "alice@example.com\r\nBcc: eve@example.com"},
+		{Email: "alice@example.com", Language: "../etc"},
+	} {
+		err := m.OwnerActor("root").AddUser("alice", "secret1", "", 30, contact, nil)
+		if !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("%+v: expected ErrInvalidInput, got %v", contact, err)
+		}
+	}
+
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetContact("alice", Contact{Email: "alice@example.com", Language: "pt-br"}); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := m.GetUser("alice"); user.Email != "alice@example.com" || user.Language != "pt-br" {
+		t.Fatalf("contact not saved: %+v", user.Contact)
+	}
+}
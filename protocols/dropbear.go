@@ -21,16 +21,16 @@ func NewDropbearManager(port int, configPath string) *DropbearManager {
 func (d *DropbearManager) AddUser(username, password string) error {
 	// Create system user for Dropbear
 	addUser := exec.Command("useradd", "-m", "-s", "/bin/false", username)
-	if err := addUser.Run(); err != nil {
+	if err := run(addUser); err != nil {
 		return fmt.Errorf("failed to create dropbear user: %v", err)
 	}
 
 	// Set password
 	setPass := exec.Command("chpasswd")
 	setPass.Stdin = strings.NewReader(fmt.Sprintf("%s:%s", username, password))
-	if err := setPass.Run(); err != nil {
+	if err := run(setPass); err != nil {
 		// Cleanup on failure
-		exec.Command("userdel", "-r", username).Run()
+		run(exec.Command("userdel", "-r", username))
 		return fmt.Errorf("failed to set dropbear password: %v", err)
 	}
 
@@ -38,8 +38,7 @@ func (d *DropbearManager) AddUser(username, password string) error {
 }
 
 func (d *DropbearManager) RemoveUser(username string) error {
-	cmd := exec.Command("userdel", "-r", username)
-	if err := cmd.Run(); err != nil {
+	if err := removeSystemUser(username); err != nil {
 		return fmt.Errorf("failed to remove dropbear user: %v", err)
 	}
 	return nil
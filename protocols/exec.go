@@ -0,0 +1,58 @@
+package protocols
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// CommandObserver, when set, is told about every external command the
+// protocol managers run, for latency and failure metrics
+var CommandObserver func(command string, elapsed time.Duration, err error)
+
+// run executes cmd and reports it to CommandObserver
+func run(cmd *exec.Cmd) error {
+	start := time.Now()
+	err := cmd.Run()
+	observeCommand(cmd, start, err)
+	return err
+}
+
+// combinedOutput is cmd.CombinedOutput, reported to CommandObserver
+func combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	observeCommand(cmd, start, err)
+	return out, err
+}
+
+// output is cmd.Output, reported to CommandObserver
+func output(cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	out, err := cmd.Output()
+	observeCommand(cmd, start, err)
+	return out, err
+}
+
+func observeCommand(cmd *exec.Cmd, start time.Time, err error) {
+	if CommandObserver != nil {
+		CommandObserver(filepath.Base(cmd.Args[0]), time.Since(start), err)
+	}
+}
+
+// RestartService restarts a systemd unit
+func RestartService(name string) error {
+	if err := run(exec.Command("systemctl", "restart", name)); err != nil {
+		return fmt.Errorf("failed to restart %s service: %v", name, err)
+	}
+	return nil
+}
+
+// ReloadService has a systemd unit reload its configuration
+func ReloadService(name string) error {
+	if err := run(exec.Command("systemctl", "reload", name)); err != nil {
+		return fmt.Errorf("failed to reload %s service: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package protocols
+
+import "fmt"
+
+// Files the protocol managers write outside their configured paths
+const (
+	htpasswdPath          = "/etc/nginx/.htpasswd"
+	udpConfigPathTemplate = "/etc/udp/%s.json"
+)
+
+// SharedFiles lists the files the protocol managers keep for all users
+func SharedFiles() []string {
+	return []string{htpasswdPath}
+}
+
+// UserFiles lists the files the protocol managers may have written for a
+// user. Not all of them exist for every user.
+func UserFiles(username string) []string {
+	udpConfig := fmt.Sprintf(udpConfigPathTemplate, username)
+	return []string{
+		fmt.Sprintf(wsCertPathTemplate, username),
+		fmt.Sprintf(wsKeyPathTemplate, username),
+		udpConfig,
+		udpConfig + ".disabled",
+	}
+}
@@ -1,28 +1,31 @@
 package protocols
 
 import (
+	"bytes"
 	"fmt"
-	"os"
-	"os/exec"
 	"text/template"
+
+	"../htpasswd"
 )
 
 type HTTPManager struct {
 	ConfigPath string
 	Port       int
+	passwd     *htpasswd.File
 }
 
 func NewHTTPManager(port int, configPath string) *HTTPManager {
 	return &HTTPManager{
 		ConfigPath: configPath,
 		Port:       port,
+		passwd:     htpasswd.New(htpasswdPath, htpasswd.APR1),
 	}
 }
 
-const httpTemplate = `
+var httpTemplate = template.Must(template.New("http").Parse(`
 server {
     listen {{ .Port }};
-    server_name {{ .Domain }};
+    server_name {{ .ServerName }};
 
     location / {
         proxy_pass http://127.0.0.1:10000;
@@ -32,54 +35,58 @@ server {
         auth_basic_user_file /etc/nginx/.htpasswd;
     }
 }
-`
+`))
 
-func (h *HTTPManager) AddUser(username, password, domain string) error {
-	// Create nginx config
-	tmpl, err := template.New("http").Parse(httpTemplate)
-	if err != nil {
-		return fmt.Errorf("failed to parse template: %v", err)
+// render returns the server block for the sites on the main domain, or
+// nothing if there are none. Users are told apart by their htpasswd
+// entries.
+func (h *HTTPManager) render(sites []NginxSite, domain string) ([]byte, error) {
+	if len(sites) == 0 {
+		return nil, nil
 	}
-
 	config := struct {
-		Port   int
-		Domain string
+		Port       int
+		ServerName string
 	}{
-		Port:   h.Port,
-		Domain: domain,
-	}
-
-	f, err := os.Create(fmt.Sprintf("/etc/nginx/conf.d/%s_http.conf", username))
-	if err != nil {
-		return fmt.Errorf("failed to create config file: %v", err)
+		Port:       h.Port,
+		ServerName: serverName(domain),
 	}
-	defer f.Close()
 
-	if err := tmpl.Execute(f, config); err != nil {
-		return fmt.Errorf("failed to write config: %v", err)
+	var buf bytes.Buffer
+	if err := httpTemplate.Execute(&buf, config); err != nil {
+		return nil, fmt.Errorf("failed to render http config: %v", err)
 	}
+	return buf.Bytes(), nil
+}
 
-	// Add to htpasswd file
-	cmd := exec.Command("htpasswd", "-b", "/etc/nginx/.htpasswd", username, password)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add to htpasswd: %v", err)
+// AddUser adds the user's htpasswd entry. Their site is rendered by
+// NginxManager.
+func (h *HTTPManager) AddUser(username, password string) error {
+	if err := h.passwd.Set(username, password); err != nil {
+		return fmt.Errorf("failed to add http user: %v", err)
 	}
-
 	return nil
 }
 
 func (h *HTTPManager) RemoveUser(username string) error {
-	// Remove nginx config
-	configPath := fmt.Sprintf("/etc/nginx/conf.d/%s_http.conf", username)
-	if err := os.Remove(configPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove http config: %v", err)
+	if err := h.passwd.Remove(username); err != nil {
+		return fmt.Errorf("failed to remove http user: %v", err)
 	}
+	return nil
+}
 
-	// Remove from htpasswd
-	cmd := exec.Command("htpasswd", "-D", "/etc/nginx/.htpasswd", username)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to remove from htpasswd: %v", err)
+// SuspendUser comments out the user's htpasswd entry
+func (h *HTTPManager) SuspendUser(username string) error {
+	if err := h.passwd.SetEnabled(username, false); err != nil {
+		return fmt.Errorf("failed to suspend http user: %v", err)
 	}
+	return nil
+}
 
+// ResumeUser re-enables an entry commented out by SuspendUser
+func (h *HTTPManager) ResumeUser(username string) error {
+	if err := h.passwd.SetEnabled(username, true); err != nil {
+		return fmt.Errorf("failed to resume http user: %v", err)
+	}
 	return nil
 }
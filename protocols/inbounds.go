@@ -0,0 +1,468 @@
+package protocols
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInboundNotFound is returned for operations on an inbound tag that is
+// not in the Xray config
+var ErrInboundNotFound = errors.New("inbound not found")
+
+const defaultShadowsocksMethod = "2022-blake3-aes-128-gcm"
+
+// InboundSpec describes an inbound the manager creates or keeps in sync.
+// Port defaults to the manager's port. Network is tcp, ws, grpc or
+// httpupgrade, and Path the WebSocket or HTTPUpgrade path or the gRPC
+// service name. Security is none, tls, which serves CertFile and KeyFile
+// and offers ALPN, or reality, which hands unauthenticated connections to
+// Dest and generates a key pair and ShortIDs short IDs. Fallbacks, if any,
+// replace those of the inbound.
+type InboundSpec struct {
+	Tag         string
+	Protocol    string
+	Port        int
+	Network     string
+	Path        string
+	Security    string
+	ServerName  string
+	CertFile    string
+	KeyFile     string
+	ALPN        []string
+	Method      string
+	Dest        string
+	ServerNames []string
+	ShortIDs    int
+	Fallbacks   []Fallback
+}
+
+// Fallback sends connections to a VLESS or Trojan over TLS inbound that
+// are not VLESS or Trojan to Dest, an address or port, if their ALPN and
+// HTTP path match. Empty ALPN and Path match anything, so a fallback with
+// neither catches what the others do not.
+type Fallback struct {
+	ALPN string
+	Path string
+	Dest string
+}
+
+// InboundSpecOf describes an existing inbound, so it can be changed and
+// passed back to UpdateInbound
+func InboundSpecOf(inbound XrayInbound) InboundSpec {
+	stream := inbound.StreamSettings
+	spec := InboundSpec{
+		Tag:      inbound.Tag,
+		Protocol: inbound.Protocol,
+		Port:     inbound.Port,
+		Network:  stream.Network,
+		Security: stream.Security,
+		Method:   inbound.Settings.Method,
+	}
+	switch stream.Network {
+	case "ws":
+		spec.Path = stream.WSSettings.Path
+	case "httpupgrade":
+		spec.Path = stream.HTTPUpgradeSettings.Path
+	case "grpc":
+		spec.Path = stream.GRPCSettings.ServiceName
+	}
+	switch stream.Security {
+	case "tls":
+		spec.ServerName = stream.TLSSettings.ServerName
+		spec.ALPN = stream.TLSSettings.ALPN
+		if certs := stream.TLSSettings.Certificates; len(certs) > 0 {
+			spec.CertFile = certs[0].CertificateFile
+			spec.KeyFile = certs[0].KeyFile
+		}
+	case "reality":
+		spec.Dest = stream.RealitySettings.Dest
+		spec.ServerNames = stream.RealitySettings.ServerNames
+		spec.ShortIDs = len(stream.RealitySettings.ShortIDs)
+	}
+	for _, fallback := range inbound.Settings.Fallbacks {
+		dest := fallback.Dest
+		if dest == "" {
+			dest = string(fallback.raw.values["dest"])
+		}
+		spec.Fallbacks = append(spec.Fallbacks, Fallback{ALPN: fallback.ALPN, Path: fallback.Path, Dest: dest})
+	}
+	return spec
+}
+
+// normalize fills in defaults and checks the spec
+func (x *XrayManager) normalize(spec InboundSpec) (InboundSpec, error) {
+	if spec.Port == 0 {
+		spec.Port = x.Port
+	}
+	if spec.Network == "" {
+		spec.Network = "tcp"
+	}
+	if spec.Security == "" {
+		spec.Security = "none"
+	}
+	if spec.Protocol == "shadowsocks" && spec.Method == "" {
+		spec.Method = defaultShadowsocksMethod
+	}
+	if spec.Security == "reality" && spec.ShortIDs <= 0 {
+		spec.ShortIDs = 1
+	}
+
+	if spec.Tag == "" {
+		return spec, fmt.Errorf("inbound tag is required")
+	}
+	if spec.Port < 1 || spec.Port > 65535 {
+		return spec, fmt.Errorf("invalid port %d", spec.Port)
+	}
+	switch spec.Protocol {
+	case "vmess", "vless", "trojan", "shadowsocks":
+	default:
+		return spec, fmt.Errorf("unsupported protocol %q", spec.Protocol)
+	}
+	switch spec.Network {
+	case "tcp", "raw", "ws", "grpc", "httpupgrade":
+	default:
+		return spec, fmt.Errorf("unsupported transport %q", spec.Network)
+	}
+	if (spec.Network == "ws" || spec.Network == "httpupgrade") && !strings.HasPrefix(spec.Path, "/") {
+		return spec, fmt.Errorf("%s path %q must start with /", spec.Network, spec.Path)
+	}
+	if spec.Protocol == "shadowsocks" && strings.HasPrefix(spec.Method, "2022-") {
+		if _, ok := shadowsocks2022KeySizes[spec.Method]; !ok {
+			return spec, fmt.Errorf("unsupported shadowsocks method %s", spec.Method)
+		}
+	}
+
+	switch spec.Security {
+	case "none":
+	case "tls":
+		if spec.CertFile == "" || spec.KeyFile == "" {
+			return spec, fmt.Errorf("TLS needs a certificate and key file")
+		}
+	case "reality":
+		if spec.Protocol != "vless" && spec.Protocol != "trojan" {
+			return spec, fmt.Errorf("REALITY is only supported for vless and trojan")
+		}
+		if spec.Network != "tcp" && spec.Network != "raw" && spec.Network != "grpc" {
+			return spec, fmt.Errorf("REALITY is not supported over %s", spec.Network)
+		}
+		if !strings.Contains(spec.Dest, ":") {
+			return spec, fmt.Errorf("REALITY dest %q must be host:port", spec.Dest)
+		}
+		if len(spec.ServerNames) == 0 {
+			return spec, fmt.Errorf("REALITY needs at least one server name")
+		}
+	default:
+		return spec, fmt.Errorf("unsupported security %q", spec.Security)
+	}
+
+	if len(spec.Fallbacks) > 0 {
+		if spec.Protocol != "vless" && spec.Protocol != "trojan" {
+			return spec, fmt.Errorf("fallbacks are only supported for vless and trojan")
+		}
+		if (spec.Network != "tcp" && spec.Network != "raw") || spec.Security != "tls" {
+			return spec, fmt.Errorf("fallbacks need TCP with TLS")
+		}
+		for _, fallback := range spec.Fallbacks {
+			if fallback.Dest == "" {
+				return spec, fmt.Errorf("fallback for path %q has no destination", fallback.Path)
+			}
+			if fallback.Path != "" && !strings.HasPrefix(fallback.Path, "/") {
+				return spec, fmt.Errorf("fallback path %q must start with /", fallback.Path)
+			}
+		}
+	}
+	return spec, nil
+}
+
+// applySpec sets an inbound's protocol settings and stream settings from
+// spec, dropping the settings of any transport or security it no longer
+// uses. REALITY keys and short IDs already present are kept so existing
+// client links stay valid.
+func applySpec(inbound *XrayInbound, spec InboundSpec) error {
+	inbound.Tag = spec.Tag
+	inbound.Port = spec.Port
+	inbound.Protocol = spec.Protocol
+
+	settings := &inbound.Settings
+	switch spec.Protocol {
+	case "vless":
+		settings.Decryption = "none"
+	case "shadowsocks":
+		settings.Method = spec.Method
+		if size, ok := shadowsocks2022KeySizes[spec.Method]; ok {
+			key, err := base64.StdEncoding.DecodeString(settings.Password)
+			if err != nil || len(key) != size {
+				key = make([]byte, size)
+				if _, err := rand.Read(key); err != nil {
+					return fmt.Errorf("failed to generate shadowsocks key: %v", err)
+				}
+				settings.Password = base64.StdEncoding.EncodeToString(key)
+			}
+		}
+		if _, ok := settings.raw.values["network"]; !ok {
+			settings.raw.set("network", json.RawMessage(`"tcp,udp"`))
+		}
+	}
+
+	stream := &inbound.StreamSettings
+	stream.Network = spec.Network
+	stream.Security = spec.Security
+	if spec.Network != "ws" {
+		stream.WSSettings = XrayTransportSettings{}
+		stream.raw.remove("wsSettings")
+	}
+	if spec.Network != "httpupgrade" {
+		stream.HTTPUpgradeSettings = XrayTransportSettings{}
+		stream.raw.remove("httpupgradeSettings")
+	}
+	if spec.Network != "grpc" {
+		stream.GRPCSettings = XrayGRPCSettings{}
+		stream.raw.remove("grpcSettings")
+	}
+	if spec.Security != "tls" {
+		stream.TLSSettings = XrayTLSSettings{}
+		stream.raw.remove("tlsSettings")
+	}
+	if spec.Security != "reality" {
+		stream.RealitySettings = XrayRealitySettings{}
+		stream.raw.remove("realitySettings")
+	}
+
+	switch spec.Network {
+	case "ws":
+		stream.WSSettings.Path = spec.Path
+	case "httpupgrade":
+		stream.HTTPUpgradeSettings.Path = spec.Path
+	case "grpc":
+		stream.GRPCSettings.ServiceName = spec.Path
+	}
+
+	switch spec.Security {
+	case "tls":
+		tls := &stream.TLSSettings
+		tls.ServerName = spec.ServerName
+		if len(spec.ALPN) > 0 {
+			tls.ALPN = spec.ALPN
+		}
+		if len(tls.Certificates) == 0 {
+			tls.Certificates = []XrayCertificate{{}}
+		}
+		tls.Certificates[0].CertificateFile = spec.CertFile
+		tls.Certificates[0].KeyFile = spec.KeyFile
+	case "reality":
+		reality := &stream.RealitySettings
+		reality.Dest = spec.Dest
+		reality.ServerNames = spec.ServerNames
+		if reality.PrivateKey == "" {
+			privateKey, _, err := GenerateRealityKeys()
+			if err != nil {
+				return err
+			}
+			reality.PrivateKey = privateKey
+		}
+		for len(reality.ShortIDs) < spec.ShortIDs {
+			id, err := generateShortID()
+			if err != nil {
+				return err
+			}
+			reality.ShortIDs = append(reality.ShortIDs, id)
+		}
+	}
+
+	if len(spec.Fallbacks) > 0 {
+		settings.Fallbacks = settings.Fallbacks[:0:0]
+		for _, fallback := range spec.Fallbacks {
+			settings.Fallbacks = append(settings.Fallbacks, newFallback(fallback))
+		}
+	}
+
+	// Clients on the default flow follow the transport in and out of Vision
+	if spec.Protocol == "vless" {
+		for i, client := range settings.Clients {
+			if client.Flow == "" || client.Flow == xtlsVisionFlow {
+				settings.Clients[i].Flow = visionFlow(*inbound)
+			}
+		}
+	}
+	return nil
+}
+
+// newFallback converts a fallback. A bare port is written as a number, the
+// form Xray reads as a port on 127.0.0.1.
+func newFallback(fallback Fallback) XrayFallback {
+	f := XrayFallback{ALPN: fallback.ALPN, Path: fallback.Path, Dest: fallback.Dest}
+	if _, err := strconv.Atoi(fallback.Dest); err == nil {
+		f.Dest = ""
+		f.raw.set("dest", json.RawMessage(fallback.Dest))
+	}
+	return f
+}
+
+// findInbound returns the index of the inbound with a tag, or -1
+func findInbound(config *XrayConfig, tag string) int {
+	for i, inbound := range config.Inbounds {
+		if inbound.Tag == tag {
+			return i
+		}
+	}
+	return -1
+}
+
+// putInbound creates or updates the inbound spec describes and reports
+// whether the config changed. New inbounds get a client for every user in
+// users, by username to UUID.
+func (x *XrayManager) putInbound(config *XrayConfig, spec InboundSpec, users map[string]string) (bool, error) {
+	spec, err := x.normalize(spec)
+	if err != nil {
+		return false, err
+	}
+	i := findInbound(config, spec.Tag)
+	for _, inbound := range config.Inbounds {
+		if inbound.Port == spec.Port && inbound.Tag != spec.Tag {
+			return false, fmt.Errorf("port %d is already used by inbound %q", spec.Port, inbound.Tag)
+		}
+	}
+
+	if i >= 0 {
+		inbound := config.Inbounds[i]
+		if inbound.Protocol != spec.Protocol {
+			return false, fmt.Errorf("inbound %q is %s, remove it to change the protocol", spec.Tag, inbound.Protocol)
+		}
+		if spec.Protocol == "shadowsocks" && inbound.Settings.Method != spec.Method && len(inbound.Settings.Clients) > 0 {
+			return false, fmt.Errorf("inbound %q has users, remove it to change the cipher", spec.Tag)
+		}
+		before, err := json.Marshal(inbound)
+		if err != nil {
+			return false, fmt.Errorf("failed to marshal inbound: %v", err)
+		}
+		if err := applySpec(&inbound, spec); err != nil {
+			return false, err
+		}
+		after, err := json.Marshal(inbound)
+		if err != nil {
+			return false, fmt.Errorf("failed to marshal inbound: %v", err)
+		}
+		config.Inbounds[i] = inbound
+		return !bytes.Equal(before, after), nil
+	}
+
+	inbound := XrayInbound{Settings: XrayInboundSettings{Clients: []XrayClient{}}}
+	if err := applySpec(&inbound, spec); err != nil {
+		return false, err
+	}
+	if acceptsUsers(inbound) {
+		names := make([]string, 0, len(users))
+		for username := range users {
+			names = append(names, username)
+		}
+		sort.Strings(names)
+		for _, username := range names {
+			client, err := newClient(inbound, username, users[username])
+			if err != nil {
+				return false, err
+			}
+			inbound.Settings.Clients = append(inbound.Settings.Clients, client)
+		}
+	}
+	config.Inbounds = append(config.Inbounds, inbound)
+	return true, nil
+}
+
+// applyInbounds saves a config whose inbounds changed and restarts Xray,
+// since inbounds cannot be changed through the API without dropping their
+// connections anyway
+func (x *XrayManager) applyInbounds(config *XrayConfig) error {
+	config.enableStats()
+	if err := x.saveConfig(config); err != nil {
+		return err
+	}
+	return x.restart()
+}
+
+// Inbounds returns the inbounds in the Xray config
+func (x *XrayManager) Inbounds() ([]XrayInbound, error) {
+	config, err := x.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return config.Inbounds, nil
+}
+
+// AddInbound creates an inbound and gives every user in users, by username
+// to UUID, a client on it
+func (x *XrayManager) AddInbound(spec InboundSpec, users map[string]string) error {
+	config, err := x.loadConfig()
+	if err != nil {
+		return err
+	}
+	if findInbound(config, spec.Tag) >= 0 {
+		return fmt.Errorf("inbound %q already exists", spec.Tag)
+	}
+	if _, err := x.putInbound(config, spec, users); err != nil {
+		return err
+	}
+	return x.applyInbounds(config)
+}
+
+// UpdateInbound changes the port, transport or security of the inbound
+// tagged spec.Tag. Its clients are kept; the protocol cannot change.
+func (x *XrayManager) UpdateInbound(spec InboundSpec) error {
+	config, err := x.loadConfig()
+	if err != nil {
+		return err
+	}
+	if findInbound(config, spec.Tag) < 0 {
+		return fmt.Errorf("%w: %s", ErrInboundNotFound, spec.Tag)
+	}
+	changed, err := x.putInbound(config, spec, nil)
+	if err != nil || !changed {
+		return err
+	}
+	return x.applyInbounds(config)
+}
+
+// RemoveInbound deletes an inbound and its clients
+func (x *XrayManager) RemoveInbound(tag string) error {
+	config, err := x.loadConfig()
+	if err != nil {
+		return err
+	}
+	i := findInbound(config, tag)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrInboundNotFound, tag)
+	}
+	config.Inbounds = append(config.Inbounds[:i], config.Inbounds[i+1:]...)
+	return x.applyInbounds(config)
+}
+
+// SyncInbounds creates or updates the inbounds specs describe, attaching
+// users to new ones, and returns the tags that changed. Inbounds not in
+// specs are left alone. Xray is only restarted if something changed.
+func (x *XrayManager) SyncInbounds(specs []InboundSpec, users map[string]string) ([]string, error) {
+	config, err := x.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for _, spec := range specs {
+		ok, err := x.putInbound(config, spec, users)
+		if err != nil {
+			return nil, fmt.Errorf("inbound %q: %v", spec.Tag, err)
+		}
+		if ok {
+			changed = append(changed, spec.Tag)
+		}
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	return changed, x.applyInbounds(config)
+}
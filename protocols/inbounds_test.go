@@ -0,0 +1,153 @@
+package protocols
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestXrayInboundLifecycle(t *testing.T) {
+	logPath := fakeCommands(t)
+	x := newTestXrayManager(t, taggedXrayConfig)
+	x.Port = 2096
+	users := map[string]string{"alice": "11111111-1111-1111-1111-111111111111"}
+
+	spec := InboundSpec{Tag: "vless-ws", Protocol: "vless", Network: "ws", Path: "/vl", Security: "tls",
+		CertFile: "/etc/ssl/certs/vps.crt", KeyFile: "/etc/ssl/private/vps.key"}
+	if err := x.AddInbound(spec, users); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.AddInbound(spec, users); err == nil {
+		t.Fatal("expected an error for a duplicate tag")
+	}
+	if calls := readCalls(t, logPath); calls != restartCalls {
+		t.Fatalf("expected one restart, got %q", calls)
+	}
+
+	inbounds, err := x.Inbounds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := inbounds[2]
+	if added.Port != 2096 || added.StreamSettings.WSSettings.Path != "/vl" || added.Settings.Decryption != "none" {
+		t.Fatalf("unexpected inbound: %+v", added)
+	}
+	if clients := added.Settings.Clients; len(clients) != 1 || clients[0].Email != "alice" || clients[0].Flow != "" {
+		t.Fatalf("unexpected clients: %+v", clients)
+	}
+
+	// Moving to raw TCP drops the WebSocket settings and turns on Vision
+	spec.Network, spec.Path = "tcp", ""
+	if err := x.UpdateInbound(spec); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(x.ConfigPath)
+	if strings.Contains(string(data), "wsSettings") {
+		t.Fatalf("stale wsSettings left in config:\n%s", data)
+	}
+	inbounds, _ = x.Inbounds()
+	if flow := inbounds[2].Settings.Clients[0].Flow; flow != xtlsVisionFlow {
+		t.Fatalf("expected Vision after moving to TCP, got %q", flow)
+	}
+
+	// An update that changes nothing does not restart Xray
+	readCalls(t, logPath)
+	if err := x.UpdateInbound(spec); err != nil {
+		t.Fatal(err)
+	}
+	if calls := readCalls(t, logPath); calls != "" {
+		t.Fatalf("unexpected calls for a no-op update: %q", calls)
+	}
+
+	spec.Protocol = "trojan"
+	if err := x.UpdateInbound(spec); err == nil || !strings.Contains(err.Error(), "change the protocol") {
+		t.Fatalf("expected a protocol change error, got %v", err)
+	}
+	if err := x.UpdateInbound(InboundSpec{Tag: "missing", Protocol: "vmess"}); !errors.Is(err, ErrInboundNotFound) {
+		t.Fatalf("expected ErrInboundNotFound, got %v", err)
+	}
+
+	if err := x.RemoveInbound("vless-ws"); err != nil {
+		t.Fatal(err)
+	}
+	if inbounds, _ = x.Inbounds(); len(inbounds) != 2 {
+		t.Fatalf("inbound not removed: %+v", inbounds)
+	}
+}
+
+func TestXraySyncInbounds(t *testing.T) {
+	logPath := fakeCommands(t)
+	x := newTestXrayManager(t, taggedXrayConfig)
+	specs := []InboundSpec{
+		{Tag: "vmess-in", Protocol: "vmess", Port: 8443, Network: "grpc", Path: "vm"},
+		{Tag: "ss-in", Protocol: "shadowsocks", Port: 8388},
+	}
+	users := map[string]string{"alice": "11111111-1111-1111-1111-111111111111"}
+
+	changed, err := x.SyncInbounds(specs, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(changed, ",") != "vmess-in,ss-in" {
+		t.Fatalf("unexpected changes: %v", changed)
+	}
+	inbounds, _ := x.Inbounds()
+	if inbounds[1].StreamSettings.GRPCSettings.ServiceName != "vm" || len(inbounds[1].Settings.Clients) != 0 {
+		t.Fatalf("existing inbound not updated in place: %+v", inbounds[1])
+	}
+	ss := inbounds[2]
+	if ss.Settings.Method != defaultShadowsocksMethod || len(ss.Settings.Clients) != 1 || ss.Settings.Password == "" {
+		t.Fatalf("unexpected shadowsocks inbound: %+v", ss)
+	}
+
+	readCalls(t, logPath)
+	if changed, err = x.SyncInbounds(specs, users); err != nil || len(changed) != 0 {
+		t.Fatalf("second sync changed %v: %v", changed, err)
+	}
+	if calls := readCalls(t, logPath); calls != "" {
+		t.Fatalf("unexpected calls: %q", calls)
+	}
+
+	specs[1].Port = 8443
+	if _, err := x.SyncInbounds(specs, users); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("expected a port conflict, got %v", err)
+	}
+}
+
+func TestXrayFallbackInbound(t *testing.T) {
+	fakeCommands(t)
+	x := newTestXrayManager(t, taggedXrayConfig)
+	spec := InboundSpec{Tag: "vless-fallback", Protocol: "vless", Port: 2053, Security: "tls",
+		CertFile: "/etc/ssl/certs/vps.crt", KeyFile: "/etc/ssl/private/vps.key", ALPN: []string{"http/1.1"},
+		Fallbacks: []Fallback{{Path: "/ws", Dest: "127.0.0.1:10080"}, {Dest: "8080"}}}
+
+	bad := spec
+	bad.Security = "none"
+	if err := x.AddInbound(bad, nil); err == nil || !strings.Contains(err.Error(), "TCP with TLS") {
+		t.Fatalf("expected fallbacks to need TLS, got %v", err)
+	}
+	if err := x.AddInbound(spec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(x.ConfigPath)
+	got := compact(t, data)
+	for _, want := range []string{
+		`"fallbacks":[{"path":"/ws","dest":"127.0.0.1:10080"},{"dest":8080}]`,
+		`"tlsSettings":{"alpn":["http/1.1"],"certificates":[{"certificateFile":"/etc/ssl/certs/vps.crt","keyFile":"/etc/ssl/private/vps.key"}]}`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %s in\n%s", want, got)
+		}
+	}
+
+	// The numeric dest reads back as it was written
+	inbounds, _ := x.Inbounds()
+	if fallbacks := InboundSpecOf(inbounds[2]).Fallbacks; len(fallbacks) != 2 || fallbacks[1].Dest != "8080" {
+		t.Fatalf("unexpected fallbacks: %+v", fallbacks)
+	}
+	if changed, err := x.SyncInbounds([]InboundSpec{spec}, nil); err != nil || len(changed) != 0 {
+		t.Fatalf("expected no change, got %v %v", changed, err)
+	}
+}
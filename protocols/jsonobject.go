@@ -0,0 +1,172 @@
+package protocols
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// jsonObject is a JSON object that keeps its keys in order and its values
+// as they were read, so a config can be edited through a typed view and
+// written back without losing or reordering anything the view leaves out
+type jsonObject struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+func (o *jsonObject) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("expected a JSON object, got %v", tok)
+	}
+
+	o.keys = nil
+	o.values = make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		if _, dup := o.values[key]; !dup {
+			o.keys = append(o.keys, key)
+		}
+		o.values[key] = value
+	}
+	_, err = dec.Token()
+	return err
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(o.values[key])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// set replaces a value in place, or appends the key if it is new
+func (o *jsonObject) set(key string, value json.RawMessage) {
+	if o.values == nil {
+		o.values = make(map[string]json.RawMessage)
+	}
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// remove deletes a key
+func (o *jsonObject) remove(key string) {
+	if _, ok := o.values[key]; !ok {
+		return
+	}
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func (o jsonObject) clone() jsonObject {
+	c := jsonObject{keys: append([]string(nil), o.keys...), values: make(map[string]json.RawMessage, len(o.values))}
+	for key, value := range o.values {
+		c.values[key] = value
+	}
+	return c
+}
+
+// jsonKey returns the object key of a json-tagged struct field, or "" for
+// fields that are not part of the typed view
+func jsonKey(field reflect.StructField) string {
+	tag := field.Tag.Get("json")
+	if tag == "" || tag == "-" {
+		return ""
+	}
+	return strings.Split(tag, ",")[0]
+}
+
+// decodeObject reads data into raw and into the json-tagged fields of the
+// struct v points to. A field whose value does not fit its Go type, such
+// as a port range given as a string, is left zero and kept as it was.
+func decodeObject(data []byte, raw *jsonObject, v interface{}) error {
+	if err := json.Unmarshal(data, raw); err != nil {
+		return err
+	}
+
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		key := jsonKey(rt.Field(i))
+		value, ok := raw.values[key]
+		if key == "" || !ok {
+			continue
+		}
+		field := reflect.New(rt.Field(i).Type)
+		if err := json.Unmarshal(value, field.Interface()); err != nil {
+			continue
+		}
+		rv.Field(i).Set(field.Elem())
+	}
+	return nil
+}
+
+// encodeObject writes raw with the json-tagged fields of the struct v
+// points to merged in. Fields that still hold what raw decodes to keep
+// their original bytes; new keys are only added for non-zero values.
+func encodeObject(raw jsonObject, v interface{}) ([]byte, error) {
+	out := raw.clone()
+
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		key := jsonKey(rt.Field(i))
+		if key == "" {
+			continue
+		}
+		current := rv.Field(i)
+
+		if value, ok := raw.values[key]; ok {
+			original := reflect.New(rt.Field(i).Type)
+			err := json.Unmarshal(value, original.Interface())
+			if err == nil && reflect.DeepEqual(original.Elem().Interface(), current.Interface()) {
+				continue
+			}
+			if err != nil && current.IsZero() {
+				continue
+			}
+		} else if current.IsZero() {
+			continue
+		}
+
+		data, err := json.Marshal(current.Interface())
+		if err != nil {
+			return nil, err
+		}
+		out.set(key, data)
+	}
+	return json.Marshal(out)
+}
@@ -0,0 +1,232 @@
+package protocols
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	nginxHeader     = "# Managed by vps_manager; changes will be overwritten.\n"
+	nginxSiteMarker = "# site "
+)
+
+// legacyNginxConfigs match the per-user files older versions wrote next to
+// the managed ones. They are removed on the next Apply.
+var legacyNginxConfigs = []string{
+	"/etc/nginx/conf.d/*_websocket.conf",
+	"/etc/nginx/conf.d/*_http.conf",
+}
+
+// NginxSite is a user's site in the managed nginx config. Sites are all
+// served on the server's main domain; users are told apart by their
+// htpasswd entries and WebSocket paths.
+type NginxSite struct {
+	Username string
+}
+
+// NginxManager renders the WebSocket and HTTP sites of all users into the
+// managed config files, one per kind of site, and reloads nginx when they
+// change. The site list is kept in the files themselves, so sites can be
+// added and removed one at a time as well as replaced as a whole. The
+// WebSocket site also proxies the routes it is given to Xray's WebSocket
+// inbounds; they are not kept, and must be passed in full every time.
+type NginxManager struct {
+	WebSocket *WebSocketManager
+	HTTP      *HTTPManager
+}
+
+func NewNginxManager(webSocket *WebSocketManager, http *HTTPManager) *NginxManager {
+	return &NginxManager{
+		WebSocket: webSocket,
+		HTTP:      http,
+	}
+}
+
+// managedFile is the wanted content of a file; nil data means it should
+// not exist
+type managedFile struct {
+	path string
+	data []byte
+}
+
+// Sites returns the sites in the managed config
+func (n *NginxManager) Sites() ([]NginxSite, error) {
+	data, err := ioutil.ReadFile(n.HTTP.ConfigPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read nginx config: %v", err)
+	}
+
+	var sites []NginxSite
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, nginxSiteMarker) {
+			continue
+		}
+		// Older versions followed the username with the user's subdomain
+		fields := strings.Fields(strings.TrimPrefix(line, nginxSiteMarker))
+		if len(fields) > 0 {
+			sites = append(sites, NginxSite{Username: fields[0]})
+		}
+	}
+	return sites, nil
+}
+
+// AddSite adds a site, unless the user already has one, with routes as
+// the WebSocket routes
+func (n *NginxManager) AddSite(site NginxSite, routes []WebSocketRoute) error {
+	sites, err := n.Sites()
+	if err != nil {
+		return err
+	}
+	sites = append(withoutSite(sites, site.Username), site)
+	_, err = n.Apply(sites, routes)
+	return err
+}
+
+// RemoveSite removes the user's site, if there is one, with routes as the
+// WebSocket routes
+func (n *NginxManager) RemoveSite(username string, routes []WebSocketRoute) error {
+	sites, err := n.Sites()
+	if err != nil {
+		return err
+	}
+	_, err = n.Apply(withoutSite(sites, username), routes)
+	return err
+}
+
+// Apply replaces the managed config with one for sites and routes and
+// reports whether it changed. The new files are checked with `nginx -t`
+// before nginx is reloaded; if nginx rejects them, every file is put back
+// as it was and the running config is left alone.
+func (n *NginxManager) Apply(sites []NginxSite, routes []WebSocketRoute) (bool, error) {
+	sites = append([]NginxSite(nil), sites...)
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Username < sites[j].Username })
+
+	webSocket, err := n.WebSocket.render(sites, routes, n.HTTP.Port)
+	if err != nil {
+		return false, err
+	}
+	http, err := n.HTTP.render(sites, n.WebSocket.Domain)
+	if err != nil {
+		return false, err
+	}
+	files := []managedFile{
+		{n.WebSocket.ConfigPath, append(siteHeader(sites), webSocket...)},
+		{n.HTTP.ConfigPath, append(siteHeader(sites), http...)},
+	}
+	for _, pattern := range legacyNginxConfigs {
+		legacy, _ := filepath.Glob(pattern)
+		for _, path := range legacy {
+			files = append(files, managedFile{path: path})
+		}
+	}
+
+	previous, changed, err := readManagedFiles(files)
+	if err != nil {
+		return false, err
+	}
+	if !changed {
+		return false, nil
+	}
+
+	if err := writeManagedFiles(files); err != nil {
+		writeManagedFiles(previous)
+		return false, err
+	}
+	if err := testNginxConfig(); err != nil {
+		if rerr := writeManagedFiles(previous); rerr != nil {
+			return false, fmt.Errorf("%v; failed to restore the previous config: %v", err, rerr)
+		}
+		return false, err
+	}
+	return true, ReloadService("nginx")
+}
+
+// siteHeader lists the sites, one marker line each, for Sites to read back
+func siteHeader(sites []NginxSite) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(nginxHeader)
+	for _, site := range sites {
+		fmt.Fprintf(&buf, "%s%s\n", nginxSiteMarker, site.Username)
+	}
+	return buf.Bytes()
+}
+
+func withoutSite(sites []NginxSite, username string) []NginxSite {
+	kept := make([]NginxSite, 0, len(sites))
+	for _, site := range sites {
+		if site.Username != username {
+			kept = append(kept, site)
+		}
+	}
+	return kept
+}
+
+// serverName is the server_name of the sites: the main domain, or any
+// name if there is none
+func serverName(domain string) string {
+	if domain == "" {
+		return "_"
+	}
+	return domain
+}
+
+// readManagedFiles returns the current state of files and whether it
+// differs from the wanted one
+func readManagedFiles(files []managedFile) ([]managedFile, bool, error) {
+	previous := make([]managedFile, len(files))
+	changed := false
+	for i, file := range files {
+		data, err := ioutil.ReadFile(file.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, false, fmt.Errorf("failed to read nginx config: %v", err)
+		}
+		previous[i] = managedFile{path: file.path, data: data}
+		if (data == nil) != (file.data == nil) || !bytes.Equal(data, file.data) {
+			changed = true
+		}
+	}
+	return previous, changed, nil
+}
+
+// writeManagedFiles writes each file through a temporary file and rename,
+// or removes it
+func writeManagedFiles(files []managedFile) error {
+	for _, file := range files {
+		if file.data == nil {
+			if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove nginx config: %v", err)
+			}
+			continue
+		}
+		tmp := file.path + ".tmp"
+		if err := ioutil.WriteFile(tmp, file.data, 0644); err != nil {
+			return fmt.Errorf("failed to write nginx config: %v", err)
+		}
+		if err := os.Rename(tmp, file.path); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("failed to write nginx config: %v", err)
+		}
+	}
+	return nil
+}
+
+// testNginxConfig has nginx check the config on disk. Where nginx is not
+// installed there is nothing to check against, and the config is accepted.
+func testNginxConfig() error {
+	if _, err := exec.LookPath("nginx"); err != nil {
+		return nil
+	}
+	if out, err := combinedOutput(exec.Command("nginx", "-t")); err != nil {
+		return fmt.Errorf("nginx rejected the new config: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package protocols
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestNginxManager(t *testing.T) *NginxManager {
+	t.Helper()
+	dir := t.TempDir()
+	patterns := legacyNginxConfigs
+	legacyNginxConfigs = []string{filepath.Join(dir, "*_websocket.conf"), filepath.Join(dir, "*_http.conf")}
+	t.Cleanup(func() { legacyNginxConfigs = patterns })
+
+	webSocket := NewWebSocketManager(443, filepath.Join(dir, "websocket.conf"), "/etc/ssl/vps.crt", "/etc/ssl/vps.key")
+	webSocket.Domain = "example.com"
+	return NewNginxManager(webSocket, NewHTTPManager(80, filepath.Join(dir, "http.conf")))
+}
+
+func TestNginxRendersAllSites(t *testing.T) {
+	logPath := fakeCommands(t)
+	n := newTestNginxManager(t)
+	legacy := filepath.Join(filepath.Dir(n.HTTP.ConfigPath), "alice_websocket.conf")
+	ioutil.WriteFile(legacy, []byte("server {}\n"), 0644)
+
+	if err := n.AddSite(NginxSite{Username: "bob"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.AddSite(NginxSite{Username: "alice"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readCalls(t, logPath); got != strings.Repeat("nginx -t\nsystemctl reload nginx\n", 2) {
+		t.Fatalf("unexpected calls:\n%s", got)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatal("per-user config was not removed")
+	}
+
+	sites, err := n.Sites()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []NginxSite{{"alice"}, {"bob"}}
+	if !reflect.DeepEqual(sites, want) {
+		t.Fatalf("sites = %v, want %v", sites, want)
+	}
+	for _, path := range []string{n.WebSocket.ConfigPath, n.HTTP.ConfigPath} {
+		data, _ := ioutil.ReadFile(path)
+		if got := strings.Count(string(data), "server {"); got != 1 {
+			t.Fatalf("%s has %d server blocks, want 1:\n%s", path, got, data)
+		}
+		if !strings.Contains(string(data), "server_name example.com;") {
+			t.Fatalf("%s is not served on the main domain:\n%s", path, data)
+		}
+	}
+	data, _ := ioutil.ReadFile(n.WebSocket.ConfigPath)
+	if !strings.Contains(string(data), "ssl_certificate /etc/ssl/vps.crt;") {
+		t.Fatalf("websocket site does not use the server certificate:\n%s", data)
+	}
+
+	// Nothing to do when the sites are unchanged
+	if changed, err := n.Apply(want, nil); err != nil || changed {
+		t.Fatalf("Apply = %v, %v; want no change", changed, err)
+	}
+	if got := readCalls(t, logPath); got != "" {
+		t.Fatalf("unexpected calls:\n%s", got)
+	}
+
+	if err := n.RemoveSite("alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(n.HTTP.ConfigPath)
+	if strings.Contains(string(data), "alice") || !strings.Contains(string(data), "# site bob\n") {
+		t.Fatalf("alice's site was not removed:\n%s", data)
+	}
+}
+
+func TestNginxReadsLegacySiteMarkers(t *testing.T) {
+	fakeCommands(t)
+	n := newTestNginxManager(t)
+	legacy := nginxHeader + "# site alice alice.example.com\n# site bob bob.example.com\n"
+	if err := ioutil.WriteFile(n.HTTP.ConfigPath, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.RemoveSite("alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(n.HTTP.ConfigPath)
+	if strings.Contains(string(data), "alice") || strings.Contains(string(data), "bob.example.com") {
+		t.Fatalf("subdomains left in the config:\n%s", data)
+	}
+	if sites, _ := n.Sites(); !reflect.DeepEqual(sites, []NginxSite{{"bob"}}) {
+		t.Fatalf("sites = %v, want bob", sites)
+	}
+}
+
+func TestNginxRevertsRejectedConfig(t *testing.T) {
+	logPath := fakeCommands(t, "nginx -t#once")
+	n := newTestNginxManager(t)
+	if _, err := n.Apply([]NginxSite{{"bob"}}, nil); err == nil {
+		t.Fatal("expected the rejected config to fail")
+	}
+	for _, path := range []string{n.WebSocket.ConfigPath, n.HTTP.ConfigPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s was left behind", path)
+		}
+	}
+	if got := readCalls(t, logPath); got != "nginx -t\n" {
+		t.Fatalf("nginx was reloaded after a failed test:\n%s", got)
+	}
+
+	if err := n.AddSite(NginxSite{Username: "bob"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := ioutil.ReadFile(n.HTTP.ConfigPath)
+	logPath = fakeCommands(t, "nginx -t")
+	if err := n.AddSite(NginxSite{Username: "carol"}, nil); err == nil {
+		t.Fatal("expected the rejected config to fail")
+	}
+	after, _ := ioutil.ReadFile(n.HTTP.ConfigPath)
+	if string(after) != string(before) {
+		t.Fatalf("config not restored:\n%s", after)
+	}
+	if got := readCalls(t, logPath); got != "nginx -t\n" {
+		t.Fatalf("nginx was reloaded after a failed test:\n%s", got)
+	}
+}
+
+const frontedXrayConfig = `{
+    "stats": {},
+    "policy": {"levels": {"0": {"statsUserUplink": true, "statsUserDownlink": true}}},
+    "inbounds": [
+        {"tag": "vmess-ws", "port": 10001, "listen": "127.0.0.1", "protocol": "vmess", "settings": {"clients": []}, "streamSettings": {"network": "ws", "wsSettings": {"path": "/vmess"}}},
+        {"tag": "vless-ws-tls", "port": 8443, "protocol": "vless", "settings": {"clients": [], "decryption": "none"}, "streamSettings": {"network": "ws", "security": "tls", "wsSettings": {"path": "/direct"}}}
+    ]
+}`
+
+func TestNginxProxiesUserPaths(t *testing.T) {
+	fakeCommands(t)
+	n := newTestNginxManager(t)
+	n.WebSocket.BehindXray = true
+	n.WebSocket.Port = 10080
+	x := newTestXrayManager(t, frontedXrayConfig)
+	x.Front = &WebSocketFront{Host: "example.com", Port: 443, UserPaths: WebSocketPathsUUID}
+
+	const uuid = "44444444-4444-4444-4444-444444444444"
+	if err := x.AddUserWithID("dave", uuid); err != nil {
+		t.Fatal(err)
+	}
+	inbounds, err := x.Inbounds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.AddSite(NginxSite{Username: "dave"}, x.Front.Routes(inbounds)); err != nil {
+		t.Fatal(err)
+	}
+
+	path := x.Front.userPath("/vmess", XrayClient{ID: uuid})
+	if !strings.HasPrefix(path, "/vmess/") || strings.Contains(path, uuid) {
+		t.Fatalf("unexpected user path %q", path)
+	}
+	data, _ := ioutil.ReadFile(n.WebSocket.ConfigPath)
+	config := string(data)
+	for _, want := range []string{
+		"listen 127.0.0.1:10080;",
+		"server_name example.com;",
+		"location = " + path + " {\n        proxy_pass http://127.0.0.1:10001/vmess;",
+		"location / {\n        proxy_pass http://127.0.0.1:80;",
+	} {
+		if !strings.Contains(config, want) {
+			t.Fatalf("websocket config lacks %q:\n%s", want, config)
+		}
+	}
+	if strings.Contains(config, "/direct") {
+		t.Fatalf("inbound with its own TLS proxied:\n%s", config)
+	}
+
+	links, err := x.ShareLinks("dave", "203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(links[0], "vmess://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vmess map[string]string
+	if err := json.Unmarshal(data, &vmess); err != nil {
+		t.Fatal(err)
+	}
+	if vmess["add"] != "203.0.113.1" || vmess["port"] != "443" || vmess["net"] != "ws" || vmess["path"] != path ||
+		vmess["host"] != "example.com" || vmess["tls"] != "tls" || vmess["sni"] != "example.com" {
+		t.Fatalf("unexpected vmess link: %s", data)
+	}
+	want := "vless://" + uuid + "@203.0.113.1:8443?encryption=none&type=ws&path=%2Fdirect&security=tls#dave"
+	if links[1] != want {
+		t.Fatalf("vless link = %s, want %s", links[1], want)
+	}
+}
+
+func TestNginxRefusesRoutesOnTunnelPath(t *testing.T) {
+	logPath := fakeCommands(t)
+	n := newTestNginxManager(t)
+
+	for _, path := range []string{"/ws", "/ws/alice"} {
+		_, err := n.Apply(nil, []WebSocketRoute{{Path: path, Port: 10001, Upstream: "/ws"}})
+		if err == nil || !strings.Contains(err.Error(), "SSH tunnel") {
+			t.Fatalf("expected %s to be refused, got %v", path, err)
+		}
+	}
+	if _, err := os.Stat(n.WebSocket.ConfigPath); !os.IsNotExist(err) {
+		t.Fatal("config written with a colliding route")
+	}
+	if calls := readCalls(t, logPath); calls != "" {
+		t.Fatalf("nginx called: %q", calls)
+	}
+
+	if _, err := n.Apply(nil, []WebSocketRoute{{Path: "/wss", Port: 10001, Upstream: "/wss"}}); err != nil {
+		t.Fatal(err)
+	}
+}
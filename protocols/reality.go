@@ -0,0 +1,57 @@
+package protocols
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	xtlsVisionFlow    = "xtls-rprx-vision"
+	realityShortIDLen = 8
+)
+
+// GenerateRealityKeys returns a new x25519 key pair in the encoding
+// `xray x25519` uses
+func GenerateRealityKeys() (privateKey, publicKey string, err error) {
+	key := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", fmt.Errorf("failed to generate REALITY key: %v", err)
+	}
+	// Clamp the scalar as xray does, so the stored key is the one it uses
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+	privateKey = base64.RawURLEncoding.EncodeToString(key)
+	publicKey, err = realityPublicKey(privateKey)
+	if err != nil {
+		return "", "", err
+	}
+	return privateKey, publicKey, nil
+}
+
+// realityPublicKey derives the public key clients need from the server's
+// private key
+func realityPublicKey(privateKey string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid REALITY private key: %v", err)
+	}
+	pub, err := curve25519.X25519(data, curve25519.Basepoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid REALITY private key: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(pub), nil
+}
+
+// generateShortID returns a random short ID of realityShortIDLen bytes as hex
+func generateShortID() (string, error) {
+	b := make([]byte, realityShortIDLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate REALITY short ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,224 @@
+package protocols
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// managedRulePrefix marks the routing rules ApplyRouting owns; rules
+	// without it are left where they are
+	managedRulePrefix = "vps_manager-"
+	blockOutboundTag  = "block"
+	directOutbound    = "direct"
+)
+
+// OutboundProfile is a named outbound users can be routed through, such as
+// a socks or WireGuard exit. Settings is the outbound's settings object.
+type OutboundProfile struct {
+	Name     string
+	Protocol string
+	Settings json.RawMessage
+}
+
+// RoutingPolicy is the routing the manager keeps in the Xray config.
+// BitTorrent and the geosite categories in BlockGeosite are blocked for
+// everyone; UserOutbounds routes users, by username, through a profile or
+// the built-in "block" outbound. Everyone else uses the default outbound.
+type RoutingPolicy struct {
+	BlockBitTorrent bool
+	BlockGeosite    []string
+	Profiles        []OutboundProfile
+	UserOutbounds   map[string]string
+}
+
+// ApplyRouting brings the outbounds and managed routing rules in line with
+// policy and reports whether anything changed. Xray is restarted to load
+// new rules.
+func (x *XrayManager) ApplyRouting(policy RoutingPolicy) (bool, error) {
+	config, err := x.loadConfig()
+	if err != nil {
+		return false, err
+	}
+	before, err := json.Marshal(config)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal config: %v", err)
+	}
+
+	if err := config.applyRouting(policy); err != nil {
+		return false, err
+	}
+
+	after, err := json.Marshal(config)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal config: %v", err)
+	}
+	if bytes.Equal(before, after) {
+		return false, nil
+	}
+	if err := x.saveConfig(config); err != nil {
+		return false, err
+	}
+	if err := x.restart(); err != nil {
+		return !errors.Is(err, ErrRolledBack), err
+	}
+	return true, nil
+}
+
+// applyRouting edits the config to implement policy
+func (c *XrayConfig) applyRouting(policy RoutingPolicy) error {
+	profiles := make(map[string]bool)
+	for _, profile := range policy.Profiles {
+		if profile.Name == "" || profile.Name == directOutbound || profile.Name == blockOutboundTag {
+			return fmt.Errorf("invalid outbound profile name %q", profile.Name)
+		}
+		if profile.Protocol == "" {
+			return fmt.Errorf("outbound profile %q has no protocol", profile.Name)
+		}
+		profiles[profile.Name] = true
+		c.putOutbound(profile.Name, profile.Protocol, profile.Settings)
+	}
+
+	// Users by the outbound they are routed through
+	routed := make(map[string][]string)
+	for username, outbound := range policy.UserOutbounds {
+		switch {
+		case outbound == "" || outbound == directOutbound:
+			continue
+		case outbound != blockOutboundTag && !profiles[outbound]:
+			return fmt.Errorf("user %s is assigned unknown outbound %q", username, outbound)
+		}
+		routed[outbound] = append(routed[outbound], username)
+	}
+
+	// Blocks come first so they also apply to users with their own outbound
+	var rules []XrayRoutingRule
+	if policy.BlockBitTorrent {
+		rules = append(rules, XrayRoutingRule{Type: "field", RuleTag: managedRulePrefix + "bittorrent",
+			Protocol: []string{"bittorrent"}, OutboundTag: blockOutboundTag})
+		c.enableSniffing()
+	}
+	if len(policy.BlockGeosite) > 0 {
+		domains := make([]string, len(policy.BlockGeosite))
+		for i, category := range policy.BlockGeosite {
+			domains[i] = "geosite:" + strings.TrimPrefix(category, "geosite:")
+		}
+		rules = append(rules, XrayRoutingRule{Type: "field", RuleTag: managedRulePrefix + "geosite",
+			Domain: domains, OutboundTag: blockOutboundTag})
+	}
+	outbounds := make([]string, 0, len(routed))
+	for outbound := range routed {
+		outbounds = append(outbounds, outbound)
+	}
+	sort.Strings(outbounds)
+	for _, outbound := range outbounds {
+		users := routed[outbound]
+		sort.Strings(users)
+		rules = append(rules, XrayRoutingRule{Type: "field", RuleTag: managedRulePrefix + "user-" + outbound,
+			User: users, OutboundTag: outbound})
+	}
+
+	for _, rule := range rules {
+		if rule.OutboundTag == blockOutboundTag && !c.hasOutbound(blockOutboundTag) {
+			c.Outbounds = append(c.Outbounds, XrayOutbound{Tag: blockOutboundTag, Protocol: "blackhole"})
+		}
+	}
+	c.Routing.Rules = replaceManagedRules(c.Routing.Rules, rules)
+	return nil
+}
+
+// replaceManagedRules swaps the managed rules in existing for rules, at the
+// position of the first managed rule, or at the end if there is none
+func replaceManagedRules(existing, rules []XrayRoutingRule) []XrayRoutingRule {
+	at := -1
+	kept := make([]XrayRoutingRule, 0, len(existing)+len(rules))
+	for _, rule := range existing {
+		if strings.HasPrefix(rule.RuleTag, managedRulePrefix) {
+			if at < 0 {
+				at = len(kept)
+			}
+			continue
+		}
+		kept = append(kept, rule)
+	}
+	if at < 0 {
+		at = len(kept)
+	}
+	out := append([]XrayRoutingRule(nil), kept[:at]...)
+	out = append(out, rules...)
+	return append(out, kept[at:]...)
+}
+
+func (c *XrayConfig) hasOutbound(tag string) bool {
+	for _, outbound := range c.Outbounds {
+		if outbound.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// putOutbound sets the protocol and settings of the outbound with a tag,
+// keeping its other fields, or adds it. Settings that only differ in
+// formatting are left as they are.
+func (c *XrayConfig) putOutbound(tag, protocol string, settings json.RawMessage) {
+	for i, outbound := range c.Outbounds {
+		if outbound.Tag == tag {
+			c.Outbounds[i].Protocol = protocol
+			if !sameJSON(outbound.Settings, settings) {
+				c.Outbounds[i].Settings = settings
+			}
+			return
+		}
+	}
+	c.Outbounds = append(c.Outbounds, XrayOutbound{Tag: tag, Protocol: protocol, Settings: settings})
+}
+
+// sniffedProtocols are the destOverride values enableSniffing makes sure of
+var sniffedProtocols = []string{"http", "tls", "quic"}
+
+// enableSniffing turns on protocol sniffing on the inbounds users connect
+// to, which rules matching on protocol depend on. Other sniffing settings
+// of an inbound are kept.
+func (c *XrayConfig) enableSniffing() {
+	for i, inbound := range c.Inbounds {
+		if !acceptsUsers(inbound) {
+			continue
+		}
+		var sniffing jsonObject
+		if data, ok := inbound.raw.values["sniffing"]; ok {
+			if err := json.Unmarshal(data, &sniffing); err != nil {
+				sniffing = jsonObject{}
+			}
+		}
+		var overrides []string
+		json.Unmarshal(sniffing.values["destOverride"], &overrides)
+		for _, protocol := range sniffedProtocols {
+			if !containsString(overrides, protocol) {
+				overrides = append(overrides, protocol)
+			}
+		}
+		destOverride, _ := json.Marshal(overrides)
+		sniffing.set("enabled", json.RawMessage("true"))
+		sniffing.set("destOverride", destOverride)
+		// With metadataOnly, Xray does not look at the traffic itself
+		if _, ok := sniffing.values["metadataOnly"]; ok {
+			sniffing.set("metadataOnly", json.RawMessage("false"))
+		}
+		data, _ := json.Marshal(sniffing)
+		c.Inbounds[i].raw.set("sniffing", data)
+	}
+}
+
+// sameJSON reports whether two JSON values are equal apart from whitespace
+func sameJSON(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
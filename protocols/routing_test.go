@@ -0,0 +1,100 @@
+package protocols
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const routedXrayConfig = `{
+    "stats": {},
+    "policy": {"levels": {"0": {"statsUserUplink": true, "statsUserDownlink": true}}},
+    "inbounds": [
+        {"tag": "api", "listen": "127.0.0.1", "port": 10086, "protocol": "dokodemo-door", "settings": {"address": "127.0.0.1"}},
+        {"tag": "vless-in", "port": 443, "protocol": "vless", "settings": {"clients": [], "decryption": "none"}}
+    ],
+    "outbounds": [{"protocol": "freedom"}],
+    "routing": {"rules": [{"type": "field", "inboundTag": ["api"], "outboundTag": "api"}]}
+}`
+
+func TestXrayApplyRouting(t *testing.T) {
+	logPath := fakeCommands(t)
+	x := newTestXrayManager(t, routedXrayConfig)
+	policy := RoutingPolicy{
+		BlockBitTorrent: true,
+		BlockGeosite:    []string{"category-ads-all"},
+		Profiles: []OutboundProfile{{Name: "exit-de", Protocol: "socks",
+			Settings: json.RawMessage(`{"servers": [{"address": "10.0.0.2", "port": 1080}]}`)}},
+		UserOutbounds: map[string]string{"carol": "exit-de", "alice": "exit-de", "bobby": "block", "dave_": "direct"},
+	}
+
+	changed, err := x.ApplyRouting(policy)
+	if err != nil || !changed {
+		t.Fatalf("expected a change, got %v %v", changed, err)
+	}
+	if calls := readCalls(t, logPath); calls != restartCalls {
+		t.Fatalf("expected a restart, got %q", calls)
+	}
+
+	data, _ := ioutil.ReadFile(x.ConfigPath)
+	got := compact(t, data)
+	for _, want := range []string{
+		`"sniffing":{"enabled":true,"destOverride":["http","tls","quic"]}}]`,
+		`"outbounds":[{"protocol":"freedom"},{"tag":"exit-de","protocol":"socks","settings":{"servers":[{"address":"10.0.0.2","port":1080}]}},{"tag":"block","protocol":"blackhole"}]`,
+		`"rules":[{"type":"field","inboundTag":["api"],"outboundTag":"api"},` +
+			`{"type":"field","ruleTag":"vps_manager-bittorrent","protocol":["bittorrent"],"outboundTag":"block"},` +
+			`{"type":"field","ruleTag":"vps_manager-geosite","domain":["geosite:category-ads-all"],"outboundTag":"block"},` +
+			`{"type":"field","ruleTag":"vps_manager-user-block","user":["bobby"],"outboundTag":"block"},` +
+			`{"type":"field","ruleTag":"vps_manager-user-exit-de","user":["alice","carol"],"outboundTag":"exit-de"}]`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %s in\n%s", want, got)
+		}
+	}
+	if strings.Count(got, `"sniffing"`) != 1 {
+		t.Errorf("sniffing should only be enabled on user inbounds:\n%s", got)
+	}
+
+	// Applying the same policy again changes nothing
+	if changed, err := x.ApplyRouting(policy); err != nil || changed {
+		t.Fatalf("expected no change, got %v %v", changed, err)
+	}
+
+	// Managed rules are replaced in place, others kept
+	config, _ := x.loadConfig()
+	config.Routing.Rules = append(config.Routing.Rules, XrayRoutingRule{Type: "field", Domain: []string{"example.com"}, OutboundTag: "block"})
+	if err := x.saveConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x.ApplyRouting(RoutingPolicy{UserOutbounds: map[string]string{"alice": "block"}}); err != nil {
+		t.Fatal(err)
+	}
+	config, _ = x.loadConfig()
+	var tags []string
+	for _, rule := range config.Routing.Rules {
+		tags = append(tags, rule.RuleTag+"/"+rule.OutboundTag)
+	}
+	if got := strings.Join(tags, ","); got != "/api,vps_manager-user-block/block,/block" {
+		t.Fatalf("unexpected rules: %s", got)
+	}
+
+	if _, err := x.ApplyRouting(RoutingPolicy{UserOutbounds: map[string]string{"alice": "missing"}}); err == nil {
+		t.Fatal("expected an error for an unknown outbound")
+	}
+}
+
+func TestXrayRoutingEnablesDisabledSniffing(t *testing.T) {
+	fakeCommands(t)
+	x := newTestXrayManager(t, strings.Replace(routedXrayConfig, `"decryption": "none"}}`,
+		`"decryption": "none"}, "sniffing": {"enabled": false, "destOverride": ["fakedns"], "metadataOnly": true, "routeOnly": true}}`, 1))
+
+	if _, err := x.ApplyRouting(RoutingPolicy{BlockBitTorrent: true}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(x.ConfigPath)
+	want := `"sniffing":{"enabled":true,"destOverride":["fakedns","http","tls","quic"],"metadataOnly":false,"routeOnly":true}`
+	if got := compact(t, data); !strings.Contains(got, want) {
+		t.Fatalf("missing %s in\n%s", want, got)
+	}
+}
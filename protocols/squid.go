@@ -2,37 +2,50 @@ package protocols
 
 import (
 	"fmt"
-	"os/exec"
+
+	"../htpasswd"
 )
 
 type SquidManager struct {
 	PasswdFile string
 	Port       int
+	passwd     *htpasswd.File
 }
 
 func NewSquidManager(port int, passwdFile string) *SquidManager {
 	return &SquidManager{
 		PasswdFile: passwdFile,
 		Port:       port,
+		passwd:     htpasswd.New(passwdFile, htpasswd.APR1),
 	}
 }
 
 func (s *SquidManager) AddUser(username, password string) error {
-	// Create htpasswd entry
-	cmd := exec.Command("htpasswd", "-b", s.PasswdFile, username, password)
-	if err := cmd.Run(); err != nil {
+	if err := s.passwd.Set(username, password); err != nil {
 		return fmt.Errorf("failed to add squid user: %v", err)
 	}
-
 	return nil
 }
 
 func (s *SquidManager) RemoveUser(username string) error {
-	// Remove from htpasswd file
-	cmd := exec.Command("htpasswd", "-D", s.PasswdFile, username)
-	if err := cmd.Run(); err != nil {
+	if err := s.passwd.Remove(username); err != nil {
 		return fmt.Errorf("failed to remove squid user: %v", err)
 	}
+	return nil
+}
 
+// SuspendUser comments out the user's htpasswd entry
+func (s *SquidManager) SuspendUser(username string) error {
+	if err := s.passwd.SetEnabled(username, false); err != nil {
+		return fmt.Errorf("failed to suspend squid user: %v", err)
+	}
+	return nil
+}
+
+// ResumeUser re-enables an entry commented out by SuspendUser
+func (s *SquidManager) ResumeUser(username string) error {
+	if err := s.passwd.SetEnabled(username, true); err != nil {
+		return fmt.Errorf("failed to resume squid user: %v", err)
+	}
 	return nil
 }
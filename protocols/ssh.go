@@ -1,11 +1,19 @@
 package protocols
 
 import (
+	"errors"
 	"fmt"
 	"os/exec"
 	"strings"
 )
 
+const (
+	// useraddExitUserExists is useradd's exit status for an existing user
+	useraddExitUserExists = 9
+	// userdelExitNoUser is userdel's exit status for a missing user
+	userdelExitNoUser = 6
+)
+
 type SSHManager struct {
 	Port int
 }
@@ -19,14 +27,14 @@ func NewSSHManager(port int) *SSHManager {
 func (s *SSHManager) AddUser(username, password string) error {
 	// Create system user
 	cmd := exec.Command("useradd", "-m", "-s", "/bin/false", username)
-	if err := cmd.Run(); err != nil {
+	if err := run(cmd); err != nil {
 		return fmt.Errorf("failed to create system user: %v", err)
 	}
 
 	// Set password
 	setPasswd := exec.Command("chpasswd")
 	setPasswd.Stdin = strings.NewReader(fmt.Sprintf("%s:%s", username, password))
-	if err := setPasswd.Run(); err != nil {
+	if err := run(setPasswd); err != nil {
 		return fmt.Errorf("failed to set password: %v", err)
 	}
 
@@ -34,6 +42,65 @@ func (s *SSHManager) AddUser(username, password string) error {
 }
 
 func (s *SSHManager) RemoveUser(username string) error {
-	cmd := exec.Command("userdel", "-r", username)
-	return cmd.Run()
+	return removeSystemUser(username)
+}
+
+// removeSystemUser deletes a system user and its home. A user that is
+// already gone counts as removed, so removals can be retried, and SSH and
+// Dropbear can both remove the user they share.
+func removeSystemUser(username string) error {
+	err := run(exec.Command("userdel", "-r", username))
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == userdelExitNoUser {
+		return nil
+	}
+	return err
+}
+
+// LockUser disables password login and expires the account, which also
+// blocks the Dropbear login sharing the same system user
+func (s *SSHManager) LockUser(username string) error {
+	cmd := exec.Command("usermod", "-L", "-e", "1", username)
+	if out, err := combinedOutput(cmd); err != nil {
+		return fmt.Errorf("failed to lock system user: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// UnlockUser re-enables a previously locked system user
+func (s *SSHManager) UnlockUser(username string) error {
+	cmd := exec.Command("usermod", "-U", "-e", "", username)
+	if out, err := combinedOutput(cmd); err != nil {
+		return fmt.Errorf("failed to unlock system user: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// PasswordHash returns the user's password hash from the shadow database
+func (s *SSHManager) PasswordHash(username string) (string, error) {
+	out, err := output(exec.Command("getent", "shadow", username))
+	if err != nil {
+		return "", fmt.Errorf("failed to read shadow entry for %s: %v", username, err)
+	}
+	fields := strings.Split(strings.TrimSpace(string(out)), ":")
+	if len(fields) < 2 {
+		return "", fmt.Errorf("malformed shadow entry for %s", username)
+	}
+	return fields[1], nil
+}
+
+// RestoreUser creates a system user with a password hash taken from
+// PasswordHash, or sets the hash if the user already exists
+func (s *SSHManager) RestoreUser(username, passwordHash string) error {
+	cmd := exec.Command("useradd", "-m", "-s", "/bin/false", "-p", passwordHash, username)
+	out, err := combinedOutput(cmd)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == useraddExitUserExists {
+		cmd = exec.Command("usermod", "-p", passwordHash, username)
+		out, err = combinedOutput(cmd)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore system user: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
 }
@@ -7,6 +7,7 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	"os"
 	"time"
@@ -84,10 +85,28 @@ func (s *SSLManager) GenerateCertificate(domain string) error {
 	return nil
 }
 
+// CertificateExpiry returns the NotAfter time of the certificate at CertPath
+func (s *SSLManager) CertificateExpiry() (time.Time, error) {
+	data, err := ioutil.ReadFile(s.CertPath)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read certificate: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return time.Time{}, fmt.Errorf("no PEM certificate in %s", s.CertPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	return cert.NotAfter, nil
+}
+
 func (s *SSLManager) RemoveUser(username string) error {
 	// Remove SSL certificate and key for the user
-	certPath := fmt.Sprintf("/etc/ssl/certs/%s.crt", username)
-	keyPath := fmt.Sprintf("/etc/ssl/private/%s.key", username)
+	certPath := fmt.Sprintf(wsCertPathTemplate, username)
+	keyPath := fmt.Sprintf(wsKeyPathTemplate, username)
 
 	if err := os.Remove(certPath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to remove certificate: %v", err)
@@ -0,0 +1,422 @@
+package protocols
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tunnelHandshakeTimeout = 10 * time.Second
+	// websocketGUID is appended to the client's key to compute the accept
+	// key of the handshake (RFC 6455 section 1.3)
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// websocketMaxFrame bounds the frames clients may send; SSH packets
+	// are far smaller
+	websocketMaxFrame = 1 << 20
+)
+
+// Tunnel connection modes
+const (
+	// TunnelWebSocket is a real WebSocket: SSH travels in binary frames
+	TunnelWebSocket = "websocket"
+	// TunnelRaw is an HTTP request, usually a fake upgrade, answered with
+	// the configured status, after which SSH flows unframed
+	TunnelRaw = "raw"
+	// TunnelDirect is a client that started speaking SSH straight away
+	TunnelDirect = "direct"
+)
+
+// TunnelConn is the accounting of one tunnel connection. Uplink counts the
+// SSH bytes from the client, Downlink those sent to it.
+type TunnelConn struct {
+	RemoteAddr string
+	Mode       string
+	Opened     time.Time
+	Closed     time.Time
+	Uplink     int64
+	Downlink   int64
+	// Err is why the connection could not be set up, if it was not
+	Err error
+}
+
+// TunnelServer accepts the "SSH over WebSocket" connections of tunnelling
+// apps and pipes them to the SSH server at Target. A request carrying a
+// WebSocket key gets a proper handshake and framing; any other HTTP request
+// gets a response with Status and Banner as its reason phrase, after which
+// the connection carries raw SSH. Behind nginx, Status must be 101 for nginx
+// to switch the connection over.
+type TunnelServer struct {
+	Listen string
+	Target string
+	Status int
+	Banner string
+	// OnOpen and OnClose, if set, are told about every connection once its
+	// handshake is done and when it ends
+	OnOpen  func(mode string)
+	OnClose func(TunnelConn)
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	stopped  bool
+	wg       sync.WaitGroup
+}
+
+// NewTunnelServer creates a tunnel listening on listen that answers raw
+// upgrades with 101 Switching Protocols
+func NewTunnelServer(listen, target string) *TunnelServer {
+	return &TunnelServer{
+		Listen: listen,
+		Target: target,
+		Status: http.StatusSwitchingProtocols,
+		Banner: "Switching Protocols",
+	}
+}
+
+// Start listens and serves connections in the background
+func (s *TunnelServer) Start() error {
+	listener, err := net.Listen("tcp", s.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to start tunnel: %v", err)
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.conns = make(map[net.Conn]bool)
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.serve(listener)
+	return nil
+}
+
+// Addr returns the address the tunnel is listening on
+func (s *TunnelServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Shutdown stops accepting connections and closes the open ones, which
+// cannot be drained as SSH sessions last indefinitely
+func (s *TunnelServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopped = true
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *TunnelServer) serve(listener net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Tunnel: accept failed: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !s.track(conn, true) {
+			conn.Close()
+			return
+		}
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+// track adds or removes an open connection. It refuses new ones once
+// Shutdown has started.
+func (s *TunnelServer) track(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.stopped {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *TunnelServer) handle(client net.Conn) {
+	defer s.wg.Done()
+	defer s.track(client, false)
+	defer client.Close()
+
+	stats := TunnelConn{RemoteAddr: client.RemoteAddr().String(), Opened: time.Now()}
+	stats.Err = s.tunnel(client, &stats)
+	stats.Closed = time.Now()
+	if s.OnClose != nil {
+		s.OnClose(stats)
+	}
+}
+
+// tunnel runs the handshake and pipes the connection until either side
+// closes it. It returns an error only if the tunnel was never set up.
+func (s *TunnelServer) tunnel(client net.Conn, stats *TunnelConn) error {
+	client.SetReadDeadline(time.Now().Add(tunnelHandshakeTimeout))
+	reader := bufio.NewReader(client)
+	mode, key, err := readTunnelRequest(reader)
+	if err != nil {
+		return err
+	}
+	client.SetReadDeadline(time.Time{})
+	stats.Mode = mode
+
+	upstream, err := net.DialTimeout("tcp", s.Target, tunnelHandshakeTimeout)
+	if err != nil {
+		if mode != TunnelDirect {
+			io.WriteString(client, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		}
+		return fmt.Errorf("failed to connect to %s: %v", s.Target, err)
+	}
+	defer upstream.Close()
+
+	switch mode {
+	case TunnelWebSocket:
+		_, err = fmt.Fprintf(client, "HTTP/1.1 101 %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+			s.Banner, websocketAccept(key))
+	case TunnelRaw:
+		_, err = fmt.Fprintf(client, "HTTP/1.1 %d %s\r\n\r\n", s.Status, s.Banner)
+	}
+	if err != nil {
+		return err
+	}
+	if s.OnOpen != nil {
+		s.OnOpen(mode)
+	}
+
+	var toUpstream io.Reader = reader
+	var toClient io.Writer = client
+	if mode == TunnelWebSocket {
+		ws := &websocketConn{conn: client, reader: reader}
+		toUpstream, toClient = ws, ws
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		n, _ := io.Copy(upstream, toUpstream)
+		atomic.AddInt64(&stats.Uplink, n)
+		done <- struct{}{}
+	}()
+	go func() {
+		n, _ := io.Copy(toClient, upstream)
+		atomic.AddInt64(&stats.Downlink, n)
+		done <- struct{}{}
+	}()
+	// Once either side is done, closing both ends the other copy
+	<-done
+	client.Close()
+	upstream.Close()
+	<-done
+	return nil
+}
+
+// readTunnelRequest reads what the client sends before SSH: nothing, or an
+// HTTP request. Tunnelling apps often send several requests in one payload;
+// any that have already arrived behind the first are skipped too. The key
+// is the client's WebSocket key, if it asked for a real WebSocket.
+func readTunnelRequest(reader *bufio.Reader) (mode, key string, err error) {
+	start, err := reader.Peek(4)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read request: %v", err)
+	}
+	if string(start) == "SSH-" {
+		return TunnelDirect, "", nil
+	}
+
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid request: %v", err)
+	}
+	key = req.Header.Get("Sec-WebSocket-Key")
+	for reader.Buffered() >= 4 {
+		next, _ := reader.Peek(4)
+		if string(next) == "SSH-" {
+			break
+		}
+		if _, err := http.ReadRequest(reader); err != nil {
+			return "", "", fmt.Errorf("invalid request: %v", err)
+		}
+	}
+	if key != "" && strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return TunnelWebSocket, key, nil
+	}
+	return TunnelRaw, "", nil
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept value for a key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// websocketConn carries a byte stream in WebSocket frames: Read returns the
+// payloads of the client's data frames, answering pings on the way, and
+// Write sends binary frames
+type websocketConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+	// remaining is the unread payload of the current frame
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+}
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+func (w *websocketConn) Read(p []byte) (int, error) {
+	for w.remaining == 0 {
+		opcode, length, err := w.readHeader()
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case wsContinuation, wsText, wsBinary:
+			w.remaining = length
+		case wsClose:
+			w.writeFrame(wsClose, nil)
+			return 0, io.EOF
+		case wsPing, wsPong:
+			if length > 125 {
+				return 0, errors.New("websocket: oversized control frame")
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(w.reader, payload); err != nil {
+				return 0, err
+			}
+			w.unmask(payload)
+			if opcode == wsPing {
+				if err := w.writeFrame(wsPong, payload); err != nil {
+					return 0, err
+				}
+			}
+		default:
+			return 0, fmt.Errorf("websocket: unknown opcode %#x", opcode)
+		}
+	}
+
+	if uint64(len(p)) > w.remaining {
+		p = p[:w.remaining]
+	}
+	n, err := w.reader.Read(p)
+	w.unmask(p[:n])
+	w.remaining -= uint64(n)
+	return n, err
+}
+
+// readHeader reads a frame header and its masking key. Client frames must
+// be masked.
+func (w *websocketConn) readHeader() (opcode byte, length uint64, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(w.reader, head[:]); err != nil {
+		return 0, 0, err
+	}
+	opcode = head[0] & 0x0f
+	if head[1]&0x80 == 0 {
+		return 0, 0, errors.New("websocket: unmasked client frame")
+	}
+
+	length = uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(w.reader, ext[:]); err != nil {
+			return 0, 0, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(w.reader, ext[:]); err != nil {
+			return 0, 0, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > websocketMaxFrame {
+		return 0, 0, fmt.Errorf("websocket: frame of %d bytes is too large", length)
+	}
+
+	if _, err := io.ReadFull(w.reader, w.mask[:]); err != nil {
+		return 0, 0, err
+	}
+	w.maskPos = 0
+	return opcode, length, nil
+}
+
+func (w *websocketConn) unmask(p []byte) {
+	for i := range p {
+		p[i] ^= w.mask[w.maskPos&3]
+		w.maskPos++
+	}
+}
+
+func (w *websocketConn) Write(p []byte) (int, error) {
+	if err := w.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends one unmasked frame, as servers do
+func (w *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, byte(n>>8), byte(n))
+	default:
+		header[1] = 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		header = append(header, ext[:]...)
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if _, err := w.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := w.conn.Write(payload)
+	return err
+}
@@ -0,0 +1,163 @@
+package protocols
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSSHBanner = "SSH-2.0-test\r\n"
+
+// startFakeSSH serves connections that get an SSH banner and then have
+// everything echoed back
+func startFakeSSH(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, testSSHBanner)
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func startTunnel(t *testing.T, configure func(*TunnelServer)) (*TunnelServer, chan TunnelConn) {
+	t.Helper()
+	s := NewTunnelServer("127.0.0.1:0", startFakeSSH(t))
+	closed := make(chan TunnelConn, 1)
+	s.OnClose = func(c TunnelConn) { closed <- c }
+	if configure != nil {
+		configure(s)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s, closed
+}
+
+func dialTunnel(t *testing.T, s *TunnelServer, request string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+func readN(t *testing.T, r io.Reader, n int) string {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func waitClosed(t *testing.T, closed chan TunnelConn) TunnelConn {
+	t.Helper()
+	select {
+	case c := <-closed:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel connection not accounted for")
+	}
+	return TunnelConn{}
+}
+
+func TestTunnelRawUpgrade(t *testing.T) {
+	s, closed := startTunnel(t, func(s *TunnelServer) {
+		s.Status = 200
+		s.Banner = "Welcome"
+	})
+	// Apps often send a second request behind the first
+	payload := "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n" +
+		"GET /cdn HTTP/1.1\r\nHost: cdn.example.com\r\n\r\n"
+	conn, r := dialTunnel(t, s, payload)
+
+	want := "HTTP/1.1 200 Welcome\r\n\r\n" + testSSHBanner
+	if got := readN(t, r, len(want)); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	io.WriteString(conn, "hello")
+	if got := readN(t, r, 5); got != "hello" {
+		t.Fatalf("echo = %q", got)
+	}
+	conn.Close()
+
+	c := waitClosed(t, closed)
+	if c.Mode != TunnelRaw || c.Err != nil || c.Uplink != 5 || c.Downlink != int64(len(testSSHBanner)+5) {
+		t.Fatalf("unexpected accounting: %+v", c)
+	}
+}
+
+func TestTunnelWebSocket(t *testing.T) {
+	s, closed := startTunnel(t, nil)
+	conn, r := dialTunnel(t, s, "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	// The accept key for the key in RFC 6455's example
+	want := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n"
+	if got := readN(t, r, len(want)); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got := readN(t, r, 2+len(testSSHBanner)); got != "\x82\x0e"+testSSHBanner {
+		t.Fatalf("banner frame = %q", got)
+	}
+
+	// Client frames are masked
+	mask := []byte{1, 2, 3, 4}
+	masked := []byte("hello")
+	for i := range masked {
+		masked[i] ^= mask[i%4]
+	}
+	conn.Write(append([]byte{0x89, 0x80}, mask...)) // empty ping
+	conn.Write(append(append([]byte{0x82, 0x85}, mask...), masked...))
+	if got := readN(t, r, 2); got != "\x8a\x00" {
+		t.Fatalf("pong frame = %q", got)
+	}
+	if got := readN(t, r, 7); got != "\x82\x05hello" {
+		t.Fatalf("echo frame = %q", got)
+	}
+	conn.Write(append([]byte{0x88, 0x80}, mask...))
+	if got := readN(t, r, 2); got != "\x88\x00" {
+		t.Fatalf("close frame = %q", got)
+	}
+
+	c := waitClosed(t, closed)
+	if c.Mode != TunnelWebSocket || c.Uplink != 5 || c.Downlink != int64(len(testSSHBanner)+5) {
+		t.Fatalf("unexpected accounting: %+v", c)
+	}
+}
+
+func TestTunnelRejectsGarbage(t *testing.T) {
+	s, closed := startTunnel(t, nil)
+	conn, _ := dialTunnel(t, s, "\x16\x03\x01 not http\r\n\r\n")
+	defer conn.Close()
+
+	c := waitClosed(t, closed)
+	if c.Err == nil || !strings.Contains(c.Err.Error(), "invalid request") {
+		t.Fatalf("expected an invalid request, got %+v", c)
+	}
+}
@@ -1,7 +1,9 @@
 package protocols
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"text/template"
 )
@@ -43,7 +45,7 @@ func (u *UDPManager) AddUser(username, password string) error {
 		Password: password,
 	}
 
-	f, err := os.Create(fmt.Sprintf("/etc/udp/%s.json", username))
+	f, err := os.Create(fmt.Sprintf(udpConfigPathTemplate, username))
 	if err != nil {
 		return fmt.Errorf("failed to create config file: %v", err)
 	}
@@ -57,9 +59,53 @@ func (u *UDPManager) AddUser(username, password string) error {
 }
 
 func (u *UDPManager) RemoveUser(username string) error {
-	configPath := fmt.Sprintf("/etc/udp/%s.json", username)
+	configPath := fmt.Sprintf(udpConfigPathTemplate, username)
 	if err := os.Remove(configPath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to remove UDP config: %v", err)
 	}
+	os.Remove(configPath + ".disabled")
 	return nil
 }
+
+// SuspendUser moves the user's config aside so it is no longer loaded
+func (u *UDPManager) SuspendUser(username string) error {
+	configPath := fmt.Sprintf(udpConfigPathTemplate, username)
+	if err := os.Rename(configPath, configPath+".disabled"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to suspend UDP config: %v", err)
+	}
+	return nil
+}
+
+// ResumeUser restores a config moved aside by SuspendUser
+func (u *UDPManager) ResumeUser(username string) error {
+	configPath := fmt.Sprintf(udpConfigPathTemplate, username)
+	if err := os.Rename(configPath+".disabled", configPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to resume UDP config: %v", err)
+	}
+	return nil
+}
+
+// Password returns the password in the user's config, which is kept in the
+// clear because the UDP server compares it directly
+func (u *UDPManager) Password(username string) (string, error) {
+	configPath := fmt.Sprintf(udpConfigPathTemplate, username)
+	data, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(configPath + ".disabled")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read UDP config: %v", err)
+	}
+
+	var config struct {
+		Users map[string]string `json:"users"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("failed to parse UDP config: %v", err)
+	}
+	password, ok := config.Users[username]
+	if !ok {
+		return "", fmt.Errorf("user %s not found in UDP config", username)
+	}
+	return password, nil
+}
@@ -1,16 +1,19 @@
 package protocols
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"os"
+	"net/url"
+	"strings"
 	"text/template"
 )
 
 // Add constants for paths and template
 const (
-	wsConfigPathTemplate = "/etc/nginx/conf.d/%s_websocket.conf"
-	wsCertPathTemplate   = "/etc/ssl/certs/%s.crt"
-	wsKeyPathTemplate    = "/etc/ssl/private/%s.key"
+	wsCertPathTemplate = "/etc/ssl/certs/%s.crt"
+	wsKeyPathTemplate  = "/etc/ssl/private/%s.key"
 )
 
 // WebSocketManager handles WebSocket proxy configuration with SSL support
@@ -19,6 +22,92 @@ type WebSocketManager struct {
 	Port       int
 	CertPath   string
 	KeyPath    string
+	// Domain is the server's main domain, which the sites are served on
+	Domain string
+	// TunnelAddr is the SSH tunnel that tunnelPath is proxied to
+	TunnelAddr string
+	// BehindXray serves the sites without TLS on 127.0.0.1:Port, for an
+	// Xray inbound that terminates TLS to fall back to. Requests for other
+	// paths are handed on to the HTTP site.
+	BehindXray bool
+}
+
+// tunnelPath is the path the SSH tunnel is served on, and everything under it
+const tunnelPath = "/ws"
+
+// How users of a WebSocket inbound behind the front get their paths
+const (
+	// WebSocketPathsShared has every user connect on the inbound's path
+	WebSocketPathsShared = ""
+	// WebSocketPathsUsername appends the username to the inbound's path
+	WebSocketPathsUsername = "username"
+	// WebSocketPathsUUID appends a hash of the user's UUID, so paths do
+	// not give away usernames
+	WebSocketPathsUUID = "uuid"
+)
+
+// WebSocketFront is where nginx serves the Xray WebSocket inbounds that
+// have no TLS of their own: clients connect to Host on Port over TLS, and
+// nginx proxies each inbound's path, or each user's path, to the inbound.
+type WebSocketFront struct {
+	Host      string
+	Port      int
+	UserPaths string
+}
+
+// WebSocketRoute is a path nginx proxies to an Xray WebSocket inbound on
+// the local Port, rewritten to the inbound's own path
+type WebSocketRoute struct {
+	Path     string
+	Port     int
+	Upstream string
+}
+
+// frontedInbound reports whether an inbound is served through the front
+func frontedInbound(inbound XrayInbound) bool {
+	stream := inbound.StreamSettings
+	return stream.Network == "ws" && (stream.Security == "" || stream.Security == "none")
+}
+
+// userPath returns the path a client connects to an inbound with the
+// given path on
+func (f *WebSocketFront) userPath(inboundPath string, client XrayClient) string {
+	if inboundPath == "" {
+		inboundPath = "/"
+	}
+	base := strings.TrimSuffix(inboundPath, "/")
+	switch f.UserPaths {
+	case WebSocketPathsUsername:
+		return base + "/" + url.PathEscape(client.Email)
+	case WebSocketPathsUUID:
+		sum := sha256.Sum256([]byte(client.ID + client.Password))
+		return base + "/" + hex.EncodeToString(sum[:8])
+	}
+	return inboundPath
+}
+
+// Routes lists the paths nginx proxies to the fronted inbounds among
+// inbounds: the inbound's own path, or with per-user paths, one for each
+// client
+func (f *WebSocketFront) Routes(inbounds []XrayInbound) []WebSocketRoute {
+	var routes []WebSocketRoute
+	for _, inbound := range inbounds {
+		if !frontedInbound(inbound) {
+			continue
+		}
+		upstream := inbound.StreamSettings.WSSettings.Path
+		if upstream == "" {
+			upstream = "/"
+		}
+		if f.UserPaths == WebSocketPathsShared {
+			routes = append(routes, WebSocketRoute{Path: upstream, Port: inbound.Port, Upstream: upstream})
+			continue
+		}
+		for _, client := range inbound.Settings.Clients {
+			routes = append(routes, WebSocketRoute{Path: f.userPath(upstream, client), Port: inbound.Port, Upstream: upstream})
+		}
+	}
+	return routes
 }
 
 // NewWebSocketManager creates a new WebSocket manager with the specified configuration
@@ -28,71 +117,95 @@ func NewWebSocketManager(port int, configPath string, certPath string, keyPath s
 		Port:       port,
 		CertPath:   certPath,
 		KeyPath:    keyPath,
+		TunnelAddr: "127.0.0.1:10000",
 	}
 }
 
-const websocketTemplate = `
+var websocketTemplate = template.Must(template.New("websocket").Parse(`
+{{- define "proxy" }}
+        proxy_http_version 1.1;
+        proxy_set_header Upgrade $http_upgrade;
+        proxy_set_header Connection "upgrade";
+        proxy_set_header Host $http_host;
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_set_header X-Forwarded-Proto $scheme;
+{{- end }}
 server {
+{{- if .BehindXray }}
+    listen 127.0.0.1:{{ .Port }};
+    server_name {{ .ServerName }};
+{{- else }}
     listen {{ .Port }} ssl;
-    server_name {{ .Domain }};
+    server_name {{ .ServerName }};
 
     ssl_certificate {{ .CertPath }};
     ssl_certificate_key {{ .KeyPath }};
     ssl_protocols TLSv1.2 TLSv1.3;
     ssl_ciphers ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384;
+{{- end }}
 
-    location /ws {
-        proxy_pass http://127.0.0.1:10000;
-        proxy_http_version 1.1;
-        proxy_set_header Upgrade $http_upgrade;
-        proxy_set_header Connection "upgrade";
+    location {{ .TunnelPath }} {
+        proxy_pass http://{{ .TunnelAddr }};
+        {{- template "proxy" }}
+    }
+{{- range .Routes }}
+
+    location = {{ .Path }} {
+        proxy_pass http://127.0.0.1:{{ .Port }}{{ .Upstream }};
+        {{- template "proxy" }}
+    }
+{{- end }}
+{{- if .BehindXray }}
+
+    location / {
+        proxy_pass http://127.0.0.1:{{ .HTTPPort }};
         proxy_set_header Host $http_host;
         proxy_set_header X-Real-IP $remote_addr;
-        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-        proxy_set_header X-Forwarded-Proto $scheme;
     }
+{{- end }}
 }
-`
+`))
 
-// AddUser creates a new WebSocket configuration for the specified user
-func (w *WebSocketManager) AddUser(username, domain string) error {
-	tmpl, err := template.New("websocket").Parse(websocketTemplate)
-	if err != nil {
-		return fmt.Errorf("failed to parse template: %v", err)
+// render returns the server block for the main domain, with the server
+// certificate, or nothing if there is neither a domain nor a site to
+// serve. With BehindXray, requests for other paths go to the HTTP site on
+// httpPort. Routes on the SSH tunnel's path are refused, as one of the two
+// would be cut off from its clients.
+func (w *WebSocketManager) render(sites []NginxSite, routes []WebSocketRoute, httpPort int) ([]byte, error) {
+	if w.Domain == "" && len(sites) == 0 {
+		return nil, nil
+	}
+	for _, route := range routes {
+		if route.Path == tunnelPath || strings.HasPrefix(route.Path, tunnelPath+"/") {
+			return nil, fmt.Errorf("WebSocket path %s of the inbound on port %d collides with the SSH tunnel on %s", route.Path, route.Port, tunnelPath)
+		}
 	}
-
 	config := struct {
-		Port     int
-		Domain   string
-		CertPath string
-		KeyPath  string
+		Port       int
+		ServerName string
+		CertPath   string
+		KeyPath    string
+		BehindXray bool
+		TunnelAddr string
+		TunnelPath string
+		Routes     []WebSocketRoute
+		HTTPPort   int
 	}{
-		Port:     w.Port,
-		Domain:   domain,
-		CertPath: fmt.Sprintf(wsCertPathTemplate, username),
-		KeyPath:  fmt.Sprintf(wsKeyPathTemplate, username),
-	}
-
-	configPath := fmt.Sprintf(wsConfigPathTemplate, username)
-	f, err := os.Create(configPath)
-	if err != nil {
-		return fmt.Errorf("failed to create config file: %v", err)
-	}
-	defer f.Close()
-
-	if err := tmpl.Execute(f, config); err != nil {
-		os.Remove(configPath) // Cleanup on error
-		return fmt.Errorf("failed to write config: %v", err)
+		Port:       w.Port,
+		ServerName: serverName(w.Domain),
+		CertPath:   w.CertPath,
+		KeyPath:    w.KeyPath,
+		BehindXray: w.BehindXray,
+		TunnelAddr: w.TunnelAddr,
+		TunnelPath: tunnelPath,
+		Routes:     routes,
+		HTTPPort:   httpPort,
 	}
 
-	return nil
-}
-
-// RemoveUser removes the WebSocket configuration for the specified user
-func (w *WebSocketManager) RemoveUser(username string) error {
-	configPath := fmt.Sprintf(wsConfigPathTemplate, username)
-	if err := os.Remove(configPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove websocket config: %v", err)
+	var buf bytes.Buffer
+	if err := websocketTemplate.Execute(&buf, config); err != nil {
+		return nil, fmt.Errorf("failed to render websocket config: %v", err)
 	}
-	return nil
+	return buf.Bytes(), nil
 }
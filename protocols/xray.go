@@ -1,45 +1,318 @@
 package protocols
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
+	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 // Add constants for configuration
 const (
-	xrayDefaultPort = 443
+	// XrayDefaultPort is the port of new inbounds if none is configured
+	XrayDefaultPort = 443
 	xrayConfigPath  = "/etc/xray/config.json"
 )
 
-// XrayConfig represents the Xray server configuration structure
+// XrayConfig is the Xray server configuration. Only the parts the manager
+// edits are modeled; log and every other key, including unknown keys inside
+// modeled objects, are written back as they were read and in the same
+// order.
 type XrayConfig struct {
-	Inbounds []struct {
-		Port     int    `json:"port"`
-		Protocol string `json:"protocol"`
-		Settings struct {
-			Clients []struct {
-				ID    string `json:"id"`
-				Email string `json:"email"`
-			} `json:"clients"`
-		} `json:"settings"`
-	} `json:"inbounds"`
+	API       XrayAPI         `json:"api"`
+	Stats     json.RawMessage `json:"stats"`
+	Policy    XrayPolicy      `json:"policy"`
+	Inbounds  []XrayInbound   `json:"inbounds"`
+	Outbounds []XrayOutbound  `json:"outbounds"`
+	Routing   XrayRouting     `json:"routing"`
+
+	raw jsonObject
+}
+
+// XrayAPI configures the gRPC API services
+type XrayAPI struct {
+	Tag      string   `json:"tag"`
+	Services []string `json:"services"`
+
+	raw jsonObject
+}
+
+// XrayPolicy holds the policies of each user level, by level number
+type XrayPolicy struct {
+	Levels map[string]XrayPolicyLevel `json:"levels"`
+
+	raw jsonObject
+}
+
+// XrayPolicyLevel configures the users of a level
+type XrayPolicyLevel struct {
+	StatsUserUplink   bool `json:"statsUserUplink"`
+	StatsUserDownlink bool `json:"statsUserDownlink"`
+
+	raw jsonObject
+}
+
+// XrayOutbound is an outbound, addressed by routing rules through its Tag
+type XrayOutbound struct {
+	Tag      string          `json:"tag"`
+	Protocol string          `json:"protocol"`
+	Settings json.RawMessage `json:"settings"`
+
+	raw jsonObject
+}
+
+// XrayRouting holds the routing rules, which Xray tries in order
+type XrayRouting struct {
+	Rules []XrayRoutingRule `json:"rules"`
+
+	raw jsonObject
+}
+
+// XrayRoutingRule sends traffic matching all of its conditions to
+// OutboundTag. RuleTag names the rule; the manager marks the rules it owns
+// with it.
+type XrayRoutingRule struct {
+	Type        string   `json:"type"`
+	RuleTag     string   `json:"ruleTag"`
+	InboundTag  []string `json:"inboundTag"`
+	User        []string `json:"user"`
+	Protocol    []string `json:"protocol"`
+	Domain      []string `json:"domain"`
+	OutboundTag string   `json:"outboundTag"`
+
+	raw jsonObject
+}
+
+// XrayInbound is an inbound. Port is zero when the config gives a port
+// range or env: reference, which is kept as is.
+type XrayInbound struct {
+	Tag            string              `json:"tag"`
+	Port           int                 `json:"port"`
+	Protocol       string              `json:"protocol"`
+	Settings       XrayInboundSettings `json:"settings"`
+	StreamSettings XrayStreamSettings  `json:"streamSettings"`
+
+	raw jsonObject
+}
+
+// XrayInboundSettings holds an inbound's clients. Shadowsocks inbounds
+// also set the cipher Method and, for the 2022 ciphers, the server key in
+// Password. VLESS inbounds set Decryption to "none".
+type XrayInboundSettings struct {
+	Clients    []XrayClient `json:"clients"`
+	Method     string       `json:"method"`
+	Password   string       `json:"password"`
+	Decryption string       `json:"decryption"`
+	// Fallbacks, on VLESS and Trojan inbounds over TCP with TLS, forward
+	// connections that are not of the inbound's protocol elsewhere
+	Fallbacks []XrayFallback `json:"fallbacks"`
+
+	raw jsonObject
+}
+
+// XrayFallback forwards connections whose TLS ALPN and first HTTP request
+// path match, or any if both are empty, to Dest, an address or local port.
+// Dest is empty when the config gives a bare port number, which is kept.
+type XrayFallback struct {
+	ALPN string `json:"alpn"`
+	Path string `json:"path"`
+	Dest string `json:"dest"`
+	Xver int    `json:"xver"`
+
+	raw jsonObject
+}
+
+// XrayStreamSettings is an inbound's transport and its security layer,
+// with the settings of the ones the manager can configure
+type XrayStreamSettings struct {
+	Network             string                `json:"network"`
+	Security            string                `json:"security"`
+	WSSettings          XrayTransportSettings `json:"wsSettings"`
+	HTTPUpgradeSettings XrayTransportSettings `json:"httpupgradeSettings"`
+	GRPCSettings        XrayGRPCSettings      `json:"grpcSettings"`
+	TLSSettings         XrayTLSSettings       `json:"tlsSettings"`
+	RealitySettings     XrayRealitySettings   `json:"realitySettings"`
+
+	raw jsonObject
+}
+
+// XrayTransportSettings configures the WebSocket and HTTPUpgrade transports
+type XrayTransportSettings struct {
+	Path string `json:"path"`
+	Host string `json:"host"`
+
+	raw jsonObject
+}
+
+// XrayGRPCSettings configures the gRPC transport
+type XrayGRPCSettings struct {
+	ServiceName string `json:"serviceName"`
+
+	raw jsonObject
 }
 
+// XrayTLSSettings configures TLS
+type XrayTLSSettings struct {
+	ServerName   string            `json:"serverName"`
+	ALPN         []string          `json:"alpn"`
+	Certificates []XrayCertificate `json:"certificates"`
+
+	raw jsonObject
+}
+
+// XrayCertificate is a certificate and key TLS serves from files
+type XrayCertificate struct {
+	CertificateFile string `json:"certificateFile"`
+	KeyFile         string `json:"keyFile"`
+
+	raw jsonObject
+}
+
+// XrayRealitySettings configures REALITY: connections that fail
+// authentication are forwarded to Dest, whose certificate clients see for
+// the names in ServerNames. Clients authenticate with the public key of
+// PrivateKey and one of ShortIDs.
+type XrayRealitySettings struct {
+	Show        bool     `json:"show"`
+	Dest        string   `json:"dest"`
+	ServerNames []string `json:"serverNames"`
+	PrivateKey  string   `json:"privateKey"`
+	ShortIDs    []string `json:"shortIds"`
+
+	raw jsonObject
+}
+
+// XrayClient is a client of a VMess, VLESS, Trojan or Shadowsocks inbound.
+// VMess and VLESS clients are identified by ID, Trojan and Shadowsocks
+// clients by Password; Email names the user.
+type XrayClient struct {
+	ID       string `json:"id"`
+	Password string `json:"password"`
+	Method   string `json:"method"`
+	Security string `json:"security"`
+	Email    string `json:"email"`
+	Flow     string `json:"flow"`
+	Level    int    `json:"level"`
+	AlterID  int    `json:"alterId"`
+
+	raw jsonObject
+}
+
+func (c *XrayConfig) UnmarshalJSON(data []byte) error { return decodeObject(data, &c.raw, c) }
+
+func (c XrayConfig) MarshalJSON() ([]byte, error) { return encodeObject(c.raw, &c) }
+
+func (a *XrayAPI) UnmarshalJSON(data []byte) error { return decodeObject(data, &a.raw, a) }
+
+func (a XrayAPI) MarshalJSON() ([]byte, error) { return encodeObject(a.raw, &a) }
+
+func (p *XrayPolicy) UnmarshalJSON(data []byte) error { return decodeObject(data, &p.raw, p) }
+
+func (p XrayPolicy) MarshalJSON() ([]byte, error) { return encodeObject(p.raw, &p) }
+
+func (l *XrayPolicyLevel) UnmarshalJSON(data []byte) error { return decodeObject(data, &l.raw, l) }
+
+func (l XrayPolicyLevel) MarshalJSON() ([]byte, error) { return encodeObject(l.raw, &l) }
+
+func (o *XrayOutbound) UnmarshalJSON(data []byte) error { return decodeObject(data, &o.raw, o) }
+
+func (o XrayOutbound) MarshalJSON() ([]byte, error) { return encodeObject(o.raw, &o) }
+
+func (r *XrayRouting) UnmarshalJSON(data []byte) error { return decodeObject(data, &r.raw, r) }
+
+func (r XrayRouting) MarshalJSON() ([]byte, error) { return encodeObject(r.raw, &r) }
+
+func (r *XrayRoutingRule) UnmarshalJSON(data []byte) error { return decodeObject(data, &r.raw, r) }
+
+func (r XrayRoutingRule) MarshalJSON() ([]byte, error) { return encodeObject(r.raw, &r) }
+
+func (in *XrayInbound) UnmarshalJSON(data []byte) error { return decodeObject(data, &in.raw, in) }
+
+func (in XrayInbound) MarshalJSON() ([]byte, error) { return encodeObject(in.raw, &in) }
+
+func (s *XrayInboundSettings) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, &s.raw, s)
+}
+
+func (s XrayInboundSettings) MarshalJSON() ([]byte, error) { return encodeObject(s.raw, &s) }
+
+func (s *XrayStreamSettings) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, &s.raw, s)
+}
+
+func (s XrayStreamSettings) MarshalJSON() ([]byte, error) { return encodeObject(s.raw, &s) }
+
+func (f *XrayFallback) UnmarshalJSON(data []byte) error { return decodeObject(data, &f.raw, f) }
+
+func (f XrayFallback) MarshalJSON() ([]byte, error) { return encodeObject(f.raw, &f) }
+
+func (t *XrayTransportSettings) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, &t.raw, t)
+}
+
+func (t XrayTransportSettings) MarshalJSON() ([]byte, error) { return encodeObject(t.raw, &t) }
+
+func (g *XrayGRPCSettings) UnmarshalJSON(data []byte) error { return decodeObject(data, &g.raw, g) }
+
+func (g XrayGRPCSettings) MarshalJSON() ([]byte, error) { return encodeObject(g.raw, &g) }
+
+func (t *XrayTLSSettings) UnmarshalJSON(data []byte) error { return decodeObject(data, &t.raw, t) }
+
+func (t XrayTLSSettings) MarshalJSON() ([]byte, error) { return encodeObject(t.raw, &t) }
+
+func (c *XrayCertificate) UnmarshalJSON(data []byte) error { return decodeObject(data, &c.raw, c) }
+
+func (c XrayCertificate) MarshalJSON() ([]byte, error) { return encodeObject(c.raw, &c) }
+
+func (r *XrayRealitySettings) UnmarshalJSON(data []byte) error {
+	return decodeObject(data, &r.raw, r)
+}
+
+func (r XrayRealitySettings) MarshalJSON() ([]byte, error) { return encodeObject(r.raw, &r) }
+
+func (c *XrayClient) UnmarshalJSON(data []byte) error { return decodeObject(data, &c.raw, c) }
+
+func (c XrayClient) MarshalJSON() ([]byte, error) { return encodeObject(c.raw, &c) }
+
 // XrayManager handles Xray server configuration and user management
 type XrayManager struct {
 	ConfigPath string
 	Port       int
+	// APIAddress is the host:port of Xray's API inbound, used to query
+	// traffic statistics and to add and remove users without restarting
+	// Xray. Leave empty if the API is not enabled.
+	APIAddress string
+	// Front, if set, is where nginx serves the WebSocket inbounds without
+	// TLS of their own; share links for them point there
+	Front *WebSocketFront
 }
 
-// NewXrayManager creates a new Xray manager with the specified configuration
-func NewXrayManager(port int, configPath string) *XrayManager {
+// Traffic is the number of bytes a user has sent and received
+type Traffic struct {
+	Uplink   int64
+	Downlink int64
+}
+
+// NewXrayManager creates a new Xray manager with the specified configuration.
+// Port is the default port of new inbounds.
+func NewXrayManager(port int, configPath, apiAddress string) *XrayManager {
+	if port == 0 {
+		port = XrayDefaultPort
+	}
 	return &XrayManager{
 		Port:       port,
 		ConfigPath: configPath,
+		APIAddress: apiAddress,
 	}
 }
 
@@ -58,20 +331,132 @@ func (x *XrayManager) loadConfig() (*XrayConfig, error) {
 	return &config, nil
 }
 
-// saveConfig writes the Xray configuration to file
+// saveConfig writes the Xray configuration to a staging file next to the
+// config, checks it with `xray run -test` and swaps it in atomically, so an
+// invalid config never reaches the running service. The first save keeps
+// the config it replaces as the last known-good one for restart to roll
+// back to, until a restart proves a newer one good.
 func (x *XrayManager) saveConfig(config *XrayConfig) error {
 	data, err := json.MarshalIndent(config, "", "    ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %v", err)
 	}
 
-	if err := ioutil.WriteFile(x.ConfigPath, data, 0644); err != nil {
+	// Xray picks the config format from the file extension
+	staging := strings.TrimSuffix(x.ConfigPath, ".json") + ".staging.json"
+	if err := ioutil.WriteFile(staging, data, 0644); err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	if err := testXrayConfig(staging); err != nil {
+		os.Remove(staging)
+		return err
+	}
+
+	if _, err := os.Stat(x.lastGoodPath()); os.IsNotExist(err) {
+		if err := copyFile(x.ConfigPath, x.lastGoodPath()); err != nil && !os.IsNotExist(err) {
+			os.Remove(staging)
+			return fmt.Errorf("failed to keep the previous config: %v", err)
+		}
+	}
+	if err := os.Rename(staging, x.ConfigPath); err != nil {
+		os.Remove(staging)
 		return fmt.Errorf("failed to write config: %v", err)
 	}
 
 	return nil
 }
 
+// lastGoodPath is where the last config Xray is known to run on is kept
+func (x *XrayManager) lastGoodPath() string {
+	return x.ConfigPath + ".last-good"
+}
+
+// markGood records the saved config as the one to roll back to, once the
+// running Xray has taken it
+func (x *XrayManager) markGood() error {
+	if err := copyFile(x.ConfigPath, x.lastGoodPath()); err != nil {
+		return fmt.Errorf("failed to keep the known-good config: %v", err)
+	}
+	return nil
+}
+
+// copyFile replaces dst with a copy of src through a temporary file
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// testXrayConfig has Xray check a config file without running it. Where
+// Xray is not installed there is nothing to check against, and the file is
+// accepted.
+func testXrayConfig(path string) error {
+	if _, err := exec.LookPath("xray"); err != nil {
+		return nil
+	}
+	cmd := exec.Command("xray", "run", "-test", "-config", path)
+	if out, err := combinedOutput(cmd); err != nil {
+		return fmt.Errorf("xray rejected the new config: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// enableStats turns on the per-user traffic counters: the stats section,
+// the user stats policy of every level clients use, and StatsService if
+// the API is configured. It reports whether the config changed, in which
+// case Xray must be restarted for it to take effect.
+func (c *XrayConfig) enableStats() bool {
+	changed := false
+	if len(c.Stats) == 0 || string(c.Stats) == "null" {
+		c.Stats = json.RawMessage("{}")
+		changed = true
+	}
+
+	levels := map[string]bool{"0": true}
+	for _, inbound := range c.Inbounds {
+		for _, client := range inbound.Settings.Clients {
+			levels[strconv.Itoa(client.Level)] = true
+		}
+	}
+	if c.Policy.Levels == nil {
+		c.Policy.Levels = make(map[string]XrayPolicyLevel)
+	}
+	for level := range levels {
+		policy := c.Policy.Levels[level]
+		if !policy.StatsUserUplink || !policy.StatsUserDownlink {
+			policy.StatsUserUplink = true
+			policy.StatsUserDownlink = true
+			c.Policy.Levels[level] = policy
+			changed = true
+		}
+	}
+
+	if c.API.Tag != "" && !containsString(c.API.Services, "StatsService") {
+		c.API.Services = append(c.API.Services, "StatsService")
+		changed = true
+	}
+	return changed
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 // generateUUID creates a new random UUID for user identification
 func generateUUID() (string, error) {
 	id, err := uuid.NewRandom()
@@ -81,62 +466,137 @@ func generateUUID() (string, error) {
 	return id.String(), nil
 }
 
-// AddUser adds a new user to the Xray configuration
-func (x *XrayManager) AddUser(username string) error {
-	config, err := x.loadConfig()
+// AddUser adds a new user to the Xray configuration and returns the UUID
+// generated for it
+func (x *XrayManager) AddUser(username string) (string, error) {
+	// Generate UUID for user
+	uuid, err := generateUUID()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// Generate UUID for user
-	uuid, err := generateUUID()
+	if err := x.AddUserWithID(username, uuid); err != nil {
+		return "", err
+	}
+
+	return uuid, nil
+}
+
+// shadowsocks2022KeySizes are the key lengths of the Shadowsocks 2022
+// ciphers, which require base64 keys of exactly that many bytes
+var shadowsocks2022KeySizes = map[string]int{
+	"2022-blake3-aes-128-gcm":       16,
+	"2022-blake3-aes-256-gcm":       32,
+	"2022-blake3-chacha20-poly1305": 32,
+}
+
+// acceptsUsers reports whether users can be added to an inbound. Single
+// user Shadowsocks inbounds, which have no clients list, are left alone.
+func acceptsUsers(inbound XrayInbound) bool {
+	switch inbound.Protocol {
+	case "vmess", "vless", "trojan":
+		return true
+	case "shadowsocks":
+		_, ok := inbound.Settings.raw.values["clients"]
+		return ok || inbound.Settings.Clients != nil
+	}
+	return false
+}
+
+// newClient returns the client a user gets on an inbound. VMess and VLESS
+// use the UUID as is; Trojan and Shadowsocks passwords are derived from it,
+// so a user has the same credentials on every node and after a migration.
+// VLESS clients of TLS or REALITY inbounds over raw TCP use XTLS Vision.
+func newClient(inbound XrayInbound, username, uuid string) (XrayClient, error) {
+	switch inbound.Protocol {
+	case "vless":
+		return XrayClient{ID: uuid, Email: username, Flow: visionFlow(inbound)}, nil
+	case "trojan":
+		return XrayClient{Password: uuid, Email: username}, nil
+	case "shadowsocks":
+		method := inbound.Settings.Method
+		if !strings.HasPrefix(method, "2022-") {
+			return XrayClient{Password: uuid, Method: method, Email: username}, nil
+		}
+		size, ok := shadowsocks2022KeySizes[method]
+		if !ok {
+			return XrayClient{}, fmt.Errorf("unsupported shadowsocks method %s", method)
+		}
+		sum := sha256.Sum256([]byte(uuid))
+		return XrayClient{Password: base64.StdEncoding.EncodeToString(sum[:size]), Email: username}, nil
+	}
+	return XrayClient{ID: uuid, Email: username}, nil
+}
+
+// visionFlow returns the flow VLESS clients of an inbound use: XTLS Vision
+// where the inbound's transport supports it, none otherwise
+func visionFlow(inbound XrayInbound) string {
+	stream := inbound.StreamSettings
+	if stream.Network != "" && stream.Network != "tcp" && stream.Network != "raw" {
+		return ""
+	}
+	if stream.Security != "tls" && stream.Security != "reality" {
+		return ""
+	}
+	return xtlsVisionFlow
+}
+
+// AddUserWithID adds a user to the Xray configuration with a known UUID
+func (x *XrayManager) AddUserWithID(username, uuid string) error {
+	config, err := x.loadConfig()
 	if err != nil {
 		return err
 	}
 
-	// Add user to each compatible inbound
+	restart := config.enableStats()
+
+	// Add user to each compatible inbound that doesn't already have it
+	var changed []XrayInbound
 	for i, inbound := range config.Inbounds {
-		if inbound.Protocol == "vmess" || inbound.Protocol == "vless" {
-			config.Inbounds[i].Settings.Clients = append(
-				config.Inbounds[i].Settings.Clients,
-				struct {
-					ID    string `json:"id"`
-					Email string `json:"email"`
-				}{
-					ID:    uuid,
-					Email: username,
-				},
-			)
+		if acceptsUsers(inbound) {
+			if hasClient(inbound.Settings.Clients, username) {
+				continue
+			}
+			client, err := newClient(inbound, username, uuid)
+			if err != nil {
+				return err
+			}
+			config.Inbounds[i].Settings.Clients = append(config.Inbounds[i].Settings.Clients, client)
+			changed = append(changed, config.Inbounds[i])
 		}
 	}
 
 	if err := x.saveConfig(config); err != nil {
 		return err
 	}
-
-	// Restart Xray service
-	cmd := exec.Command("systemctl", "restart", "xray")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to restart xray service: %v", err)
+	if restart {
+		return x.restart()
 	}
 
-	return nil
+	return x.applyLive(changed, func(inbound XrayInbound) error {
+		return x.addLiveUser(inbound, username)
+	})
 }
 
-// RemoveUser removes a user from the Xray configuration
+// RemoveUser removes a user from the Xray configuration. Through the API
+// the user can no longer connect, but connections already open stay up
+// until they close.
 func (x *XrayManager) RemoveUser(username string) error {
 	config, err := x.loadConfig()
 	if err != nil {
 		return err
 	}
 
+	restart := config.enableStats()
+
 	// Remove user from all inbounds
+	var changed []XrayInbound
 	for i, inbound := range config.Inbounds {
-		if inbound.Protocol == "vmess" || inbound.Protocol == "vless" {
-			newClients := make([]struct {
-				ID    string `json:"id"`
-				Email string `json:"email"`
-			}, 0)
+		if acceptsUsers(inbound) {
+			if !hasClient(inbound.Settings.Clients, username) {
+				continue
+			}
+			newClients := make([]XrayClient, 0)
 
 			for _, client := range inbound.Settings.Clients {
 				if client.Email != username {
@@ -145,8 +605,388 @@ func (x *XrayManager) RemoveUser(username string) error {
 			}
 
 			config.Inbounds[i].Settings.Clients = newClients
+			changed = append(changed, inbound)
+		}
+	}
+
+	if err := x.saveConfig(config); err != nil {
+		return err
+	}
+	if restart {
+		return x.restart()
+	}
+
+	return x.applyLive(changed, func(inbound XrayInbound) error {
+		return x.removeLiveUser(inbound, username)
+	})
+}
+
+// applyLive pushes a change already saved to the config file to the running
+// Xray through its HandlerService, so other users stay connected. Without
+// an API address, if an inbound has no tag to address it by, or if the API
+// call fails, Xray is restarted to load the saved config instead. A config
+// the running Xray took becomes the known-good one.
+func (x *XrayManager) applyLive(inbounds []XrayInbound, update func(XrayInbound) error) error {
+	if len(inbounds) == 0 {
+		return nil
+	}
+	if x.APIAddress == "" {
+		return x.restart()
+	}
+	for _, inbound := range inbounds {
+		if inbound.Tag == "" {
+			return x.restart()
+		}
+	}
+
+	for _, inbound := range inbounds {
+		if err := update(inbound); err != nil {
+			if restartErr := x.restart(); restartErr != nil {
+				return fmt.Errorf("%v; %w", err, restartErr)
+			}
+			return nil
+		}
+	}
+	return x.markGood()
+}
+
+// addLiveUser adds a client of the inbound through AddUserOperation. The
+// xray CLI reads users from a config file, so the inbound is written out
+// with only that client.
+func (x *XrayManager) addLiveUser(inbound XrayInbound, username string) error {
+	var clients []XrayClient
+	for _, client := range inbound.Settings.Clients {
+		if client.Email == username {
+			clients = append(clients, client)
+		}
+	}
+	inbound.Settings.Clients = clients
+
+	data, err := json.Marshal(map[string][]XrayInbound{"inbounds": {inbound}})
+	if err != nil {
+		return fmt.Errorf("failed to marshal xray user: %v", err)
+	}
+	f, err := ioutil.TempFile("", "xray-user-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write xray user: %v", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write xray user: %v", err)
+	}
+
+	cmd := exec.Command("xray", "api", "adu", "--server="+x.APIAddress, f.Name())
+	if out, err := combinedOutput(cmd); err != nil {
+		return fmt.Errorf("failed to add xray user through API: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// removeLiveUser removes a client from the inbound through
+// RemoveUserOperation
+func (x *XrayManager) removeLiveUser(inbound XrayInbound, username string) error {
+	cmd := exec.Command("xray", "api", "rmu", "--server="+x.APIAddress, "-tag="+inbound.Tag, username)
+	if out, err := combinedOutput(cmd); err != nil {
+		return fmt.Errorf("failed to remove xray user through API: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// xrayHealthCheckDelay is how long Xray gets to fail after a restart before
+// it is considered healthy
+var xrayHealthCheckDelay = 2 * time.Second
+
+// ErrRolledBack is returned when Xray did not come up on a new config and
+// the last known-good one was put back. The change was not applied.
+var ErrRolledBack = errors.New("restored the previous config")
+
+// restart reloads the Xray service so config changes take effect. If Xray
+// fails to restart or is not running shortly after, the last known-good
+// config is put back and Xray restarted on it, and ErrRolledBack returned.
+// A config Xray runs on becomes the new known-good one.
+func (x *XrayManager) restart() error {
+	err := RestartService("xray")
+	if err == nil {
+		err = checkXrayHealth()
+	}
+	if err == nil {
+		return x.markGood()
+	}
+
+	if rollbackErr := x.rollback(); rollbackErr != nil {
+		return fmt.Errorf("%v; rollback failed: %v", err, rollbackErr)
+	}
+	return fmt.Errorf("%w: %v", ErrRolledBack, err)
+}
+
+// checkXrayHealth waits xrayHealthCheckDelay and checks the service is up
+func checkXrayHealth() error {
+	time.Sleep(xrayHealthCheckDelay)
+	if err := run(exec.Command("systemctl", "is-active", "--quiet", "xray")); err != nil {
+		return fmt.Errorf("xray is not running after restart: %v", err)
+	}
+	return nil
+}
+
+// rollback replaces the config with the last known-good one and restarts
+// Xray on it
+func (x *XrayManager) rollback() error {
+	if err := copyFile(x.lastGoodPath(), x.ConfigPath); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no previous config to restore: %v", err)
+		}
+		return fmt.Errorf("failed to restore config: %v", err)
+	}
+	if err := RestartService("xray"); err != nil {
+		return err
+	}
+	return checkXrayHealth()
+}
+
+// hasClient reports whether an inbound already contains the client
+func hasClient(clients []XrayClient, email string) bool {
+	for _, client := range clients {
+		if client.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+// ShareLinks builds a client import link for every inbound the user belongs to
+func (x *XrayManager) ShareLinks(username, host string) ([]string, error) {
+	config, err := x.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]string, 0)
+	for _, inbound := range config.Inbounds {
+		for _, client := range inbound.Settings.Clients {
+			if client.Email != username {
+				continue
+			}
+
+			switch inbound.Protocol {
+			case "vmess":
+				link, err := vmessLink(x.linkTransport(inbound, client), client, host, username)
+				if err != nil {
+					return nil, err
+				}
+				links = append(links, link)
+			case "vless":
+				link, err := vlessLink(inbound, x.linkTransport(inbound, client), client, host, username)
+				if err != nil {
+					return nil, err
+				}
+				links = append(links, link)
+			case "trojan":
+				transport := x.linkTransport(inbound, client)
+				if transport.security == "" {
+					transport.security = "tls"
+				}
+				links = append(links, fmt.Sprintf("trojan://%s@%s:%d?security=%s%s&type=%s%s#%s",
+					url.PathEscape(client.Password), host, transport.port, transport.security, transport.sniParam(),
+					transport.network, transport.pathParams(), url.PathEscape(username)))
+			case "shadowsocks":
+				links = append(links, shadowsocksLink(inbound, client, host, username))
+			}
+		}
+	}
+
+	return links, nil
+}
+
+// linkTransport is how a client reaches an inbound: on the inbound's own
+// port and transport, or for an inbound behind the WebSocket front, on the
+// front's port over TLS with the client's own path
+type linkTransport struct {
+	port     int
+	network  string
+	security string
+	sni      string
+	path     string
+	host     string
+}
+
+func (x *XrayManager) linkTransport(inbound XrayInbound, client XrayClient) linkTransport {
+	stream := inbound.StreamSettings
+	t := linkTransport{port: inbound.Port, network: stream.Network, security: stream.Security}
+	if t.network == "" || t.network == "raw" {
+		t.network = "tcp"
+	}
+	switch t.network {
+	case "ws":
+		t.path, t.host = stream.WSSettings.Path, stream.WSSettings.Host
+	case "httpupgrade":
+		t.path, t.host = stream.HTTPUpgradeSettings.Path, stream.HTTPUpgradeSettings.Host
+	}
+	if t.security == "tls" {
+		t.sni = stream.TLSSettings.ServerName
+	}
+	if x.Front != nil && frontedInbound(inbound) {
+		t.port = x.Front.Port
+		t.security = "tls"
+		t.sni = x.Front.Host
+		t.host = x.Front.Host
+		t.path = x.Front.userPath(t.path, client)
+	}
+	return t
+}
+
+func (t linkTransport) sniParam() string {
+	if t.sni == "" {
+		return ""
+	}
+	return "&sni=" + url.QueryEscape(t.sni)
+}
+
+func (t linkTransport) pathParams() string {
+	var params string
+	if t.host != "" {
+		params += "&host=" + url.QueryEscape(t.host)
+	}
+	if t.path != "" {
+		params += "&path=" + url.QueryEscape(t.path)
+	}
+	return params
+}
+
+// vmessLink builds a VMess link in the v2rayN JSON format
+func vmessLink(t linkTransport, client XrayClient, host, username string) (string, error) {
+	link := map[string]interface{}{
+		"v":    "2",
+		"ps":   username,
+		"add":  host,
+		"port": fmt.Sprint(t.port),
+		"id":   client.ID,
+		"aid":  fmt.Sprint(client.AlterID),
+		"net":  t.network,
+		"type": "none",
+	}
+	if t.path != "" {
+		link["path"] = t.path
+	}
+	if t.host != "" {
+		link["host"] = t.host
+	}
+	if t.security == "tls" {
+		link["tls"] = "tls"
+		if t.sni != "" {
+			link["sni"] = t.sni
+		}
+	}
+	data, err := json.Marshal(link)
+	if err != nil {
+		return "", fmt.Errorf("failed to build vmess link: %v", err)
+	}
+	return "vmess://" + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// vlessLink builds a VLESS link. REALITY links carry the public key, SNI
+// and a short ID the client needs to pass the server's authentication.
+func vlessLink(inbound XrayInbound, t linkTransport, client XrayClient, host, username string) (string, error) {
+	// Build the query by hand, url.Values would sort the keys
+	query := "encryption=none&type=" + url.QueryEscape(t.network) + t.pathParams()
+	switch t.security {
+	case "tls":
+		query += "&security=tls" + t.sniParam()
+	case "reality":
+		reality := inbound.StreamSettings.RealitySettings
+		query += "&security=reality&fp=chrome"
+		if reality.PrivateKey != "" {
+			publicKey, err := realityPublicKey(reality.PrivateKey)
+			if err != nil {
+				return "", err
+			}
+			query += "&pbk=" + url.QueryEscape(publicKey)
+		}
+		if len(reality.ServerNames) > 0 {
+			query += "&sni=" + url.QueryEscape(reality.ServerNames[0])
 		}
+		if len(reality.ShortIDs) > 0 {
+			query += "&sid=" + url.QueryEscape(reality.ShortIDs[0])
+		}
+	}
+	if client.Flow != "" {
+		query += "&flow=" + url.QueryEscape(client.Flow)
+	}
+	return fmt.Sprintf("vless://%s@%s:%d?%s#%s",
+		client.ID, host, t.port, query, url.PathEscape(username)), nil
+}
+
+// shadowsocksLink builds a SIP002 link. Shadowsocks 2022 links carry the
+// server and user keys percent-encoded, older ciphers base64 encode the
+// method and password.
+func shadowsocksLink(inbound XrayInbound, client XrayClient, host, username string) string {
+	method := client.Method
+	if method == "" {
+		method = inbound.Settings.Method
+	}
+
+	var userinfo string
+	if strings.HasPrefix(method, "2022-") {
+		userinfo = method + ":" + url.QueryEscape(inbound.Settings.Password+":"+client.Password)
+	} else {
+		userinfo = base64.RawURLEncoding.EncodeToString([]byte(method + ":" + client.Password))
+	}
+	return fmt.Sprintf("ss://%s@%s:%d#%s", userinfo, host, inbound.Port, url.PathEscape(username))
+}
+
+// UserTraffic queries Xray's StatsService for per-user byte counters,
+// keyed by client email. The counters run from when Xray started or, if
+// reset is set, from the last call that reset them, so callers that reset
+// can add up the results. It returns nil if no API address is configured.
+func (x *XrayManager) UserTraffic(reset bool) (map[string]Traffic, error) {
+	if x.APIAddress == "" {
+		return nil, nil
+	}
+
+	args := []string{"api", "statsquery", "--server=" + x.APIAddress, "-pattern", "user>>>"}
+	if reset {
+		args = append(args, "-reset")
+	}
+	cmd := exec.Command("xray", args...)
+	out, err := output(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query xray stats: %v", err)
 	}
 
-	return x.saveConfig(config)
+	// Counter names look like "user>>>alice>>>traffic>>>uplink". Values are
+	// int64s, which protobuf JSON encodes as strings.
+	var result struct {
+		Stat []struct {
+			Name  string      `json:"name"`
+			Value json.Number `json:"value"`
+		} `json:"stat"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse xray stats: %v", err)
+	}
+
+	traffic := make(map[string]Traffic)
+	for _, stat := range result.Stat {
+		parts := strings.Split(stat.Name, ">>>")
+		if len(parts) != 4 || parts[0] != "user" || parts[2] != "traffic" {
+			continue
+		}
+		value, err := strconv.ParseInt(stat.Value.String(), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		t := traffic[parts[1]]
+		switch parts[3] {
+		case "uplink":
+			t.Uplink = value
+		case "downlink":
+			t.Downlink = value
+		}
+		traffic[parts[1]] = t
+	}
+	return traffic, nil
 }
@@ -0,0 +1,504 @@
+package protocols
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const fullXrayConfig = `{
+    "log": {"loglevel": "warning", "access": "/var/log/xray/access.log"},
+    "stats": {},
+    "api": {"tag": "api", "services": ["StatsService"]},
+    "inbounds": [
+        {
+            "tag": "vless-in",
+            "listen": "0.0.0.0",
+            "port": 443,
+            "protocol": "vless",
+            "settings": {
+                "clients": [
+                    {"id": "11111111-1111-1111-1111-111111111111", "flow": "xtls-rprx-vision", "level": 0, "email": "alice", "x-note": "kept"}
+                ],
+                "decryption": "none",
+                "fallbacks": [{"dest": 8080}]
+            },
+            "streamSettings": {"network": "tcp", "security": "reality", "realitySettings": {"dest": "example.com:443"}},
+            "sniffing": {"enabled": true}
+        },
+        {
+            "port": "10000-10010",
+            "protocol": "vmess",
+            "settings": {"clients": [{"id": "22222222-2222-2222-2222-222222222222", "alterId": 0, "email": "bobby"}]}
+        }
+    ],
+    "outbounds": [{"protocol": "freedom"}, {"protocol": "blackhole", "tag": "block"}],
+    "routing": {"rules": [{"type": "field", "outboundTag": "block", "ip": ["geoip:private"]}]}
+}`
+
+func newTestXrayManager(t *testing.T, config string) *XrayManager {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return NewXrayManager(443, path, "")
+}
+
+// compact normalizes JSON whitespace, keeping key order
+func compact(t *testing.T, data []byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestXrayConfigRoundTrip(t *testing.T) {
+	x := newTestXrayManager(t, fullXrayConfig)
+	config, err := x.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := x.saveConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(x.ConfigPath)
+	if got, want := compact(t, data), compact(t, []byte(fullXrayConfig)); got != want {
+		t.Fatalf("config changed by a load and save:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestXrayConfigEditKeepsUnmodeledFields(t *testing.T) {
+	x := newTestXrayManager(t, fullXrayConfig)
+	config, err := x.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Inbounds[1].Port != 0 || config.Inbounds[0].Settings.Clients[0].Flow != "xtls-rprx-vision" {
+		t.Fatalf("unexpected typed view: %+v", config.Inbounds)
+	}
+
+	for i := range config.Inbounds {
+		config.Inbounds[i].Settings.Clients = append(config.Inbounds[i].Settings.Clients, XrayClient{ID: "33333333-3333-3333-3333-333333333333", Email: "carol"})
+	}
+	config.Inbounds[0].Settings.Clients[0].Level = 1
+	if err := x.saveConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(x.ConfigPath)
+	got := compact(t, data)
+	for _, want := range []string{
+		`"outbounds":[{"protocol":"freedom"},{"protocol":"blackhole","tag":"block"}]`,
+		`"routing":{"rules":[{"type":"field","outboundTag":"block","ip":["geoip:private"]}]}`,
+		`{"id":"11111111-1111-1111-1111-111111111111","flow":"xtls-rprx-vision","level":1,"email":"alice","x-note":"kept"}`,
+		`{"id":"33333333-3333-3333-3333-333333333333","email":"carol"}`,
+		`"decryption":"none","fallbacks":[{"dest":8080}]},"streamSettings"`,
+		`"port":"10000-10010"`,
+		`"alterId":0,"email":"bobby"}`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %s in\n%s", want, got)
+		}
+	}
+	if !strings.HasPrefix(got, `{"log":`) || !strings.HasSuffix(got, `"routing":{"rules":[{"type":"field","outboundTag":"block","ip":["geoip:private"]}]}}`) {
+		t.Errorf("top-level key order changed:\n%s", got)
+	}
+}
+
+func TestXrayShareLinksUseClientSettings(t *testing.T) {
+	x := newTestXrayManager(t, fullXrayConfig)
+	links, err := x.ShareLinks("alice", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || !strings.Contains(links[0], "flow=xtls-rprx-vision") {
+		t.Fatalf("unexpected links: %v", links)
+	}
+}
+
+// fakeCommands puts xray, systemctl and nginx scripts first on PATH that append
+// their arguments, and for xray api calls the contents of any file
+// argument, to the returned log. A command fails if it starts with one of
+// failing, such as "xray api" or "systemctl is-active", and only the
+// first time if the prefix ends in "#once".
+func fakeCommands(t *testing.T, failing ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "calls.log")
+	script := `#!/bin/sh
+echo "$(basename "$0") $*" >> ` + logPath + `
+if [ "$1" = api ]; then
+    for arg; do [ -f "$arg" ] && cat "$arg" >> ` + logPath + ` && echo >> ` + logPath + `; done
+fi
+case "$(basename "$0") $*" in
+`
+	for i, prefix := range failing {
+		if strings.HasSuffix(prefix, "#once") {
+			marker := filepath.Join(dir, fmt.Sprintf("failed-%d", i))
+			script += "\"" + strings.TrimSuffix(prefix, "#once") + "\"*) [ -f " + marker + " ] || { touch " + marker + "; exit 1; };;\n"
+			continue
+		}
+		script += "\"" + prefix + "\"*) exit 1;;\n"
+	}
+	script += "esac\nexit 0\n"
+	ioutil.WriteFile(filepath.Join(dir, "xray"), []byte(script), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "systemctl"), []byte(script), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "nginx"), []byte(script), 0755)
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	delay := xrayHealthCheckDelay
+	xrayHealthCheckDelay = 0
+	t.Cleanup(func() {
+		os.Setenv("PATH", path)
+		xrayHealthCheckDelay = delay
+	})
+	return logPath
+}
+
+// readCalls returns and clears the logged commands, leaving out the
+// `xray run -test` checks every save makes
+func readCalls(t *testing.T, logPath string) string {
+	t.Helper()
+	data, _ := ioutil.ReadFile(logPath)
+	os.Remove(logPath)
+	var calls []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if !strings.HasPrefix(line, "xray run -test ") {
+			calls = append(calls, line)
+		}
+	}
+	return strings.Join(calls, "")
+}
+
+// restartCalls is what a successful restart runs
+const restartCalls = "systemctl restart xray\nsystemctl is-active --quiet xray\n"
+
+const taggedXrayConfig = `{
+    "stats": {},
+    "policy": {"levels": {"0": {"handshake": 4, "statsUserUplink": true, "statsUserDownlink": true}}},
+    "inbounds": [
+        {"tag": "vless-in", "port": 443, "protocol": "vless", "settings": {"clients": [{"id": "11111111-1111-1111-1111-111111111111", "email": "alice"}], "decryption": "none"}},
+        {"tag": "vmess-in", "port": 8443, "protocol": "vmess", "settings": {"clients": []}}
+    ]
+}`
+
+func TestXrayUsersAppliedThroughAPI(t *testing.T) {
+	logPath := fakeCommands(t)
+	x := newTestXrayManager(t, taggedXrayConfig)
+	x.APIAddress = "127.0.0.1:10086"
+
+	if err := x.AddUserWithID("carol", "33333333-3333-3333-3333-333333333333"); err != nil {
+		t.Fatal(err)
+	}
+	calls := readCalls(t, logPath)
+	if strings.Contains(calls, "systemctl") || strings.Count(calls, "xray api adu --server=127.0.0.1:10086 ") != 2 {
+		t.Fatalf("expected an API call per inbound and no restart, got:\n%s", calls)
+	}
+	if strings.Contains(calls, "alice") || !strings.Contains(calls, `"decryption":"none"`) {
+		t.Fatalf("expected each inbound to be sent with only the new client, got:\n%s", calls)
+	}
+
+	if err := x.RemoveUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := readCalls(t, logPath); calls != "xray api rmu --server=127.0.0.1:10086 -tag=vless-in alice\n" {
+		t.Fatalf("unexpected calls:\n%s", calls)
+	}
+
+	config, err := x.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasClient(config.Inbounds[0].Settings.Clients, "alice") || !hasClient(config.Inbounds[1].Settings.Clients, "carol") {
+		t.Fatalf("changes not persisted: %+v", config.Inbounds)
+	}
+}
+
+func TestXrayRestartsWhenAPIUnusable(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		config     string
+		apiAddress string
+		failing    []string
+	}{
+		{"no API", taggedXrayConfig, "", nil},
+		{"untagged inbound", fullXrayConfig, "127.0.0.1:10086", nil},
+		{"API error", taggedXrayConfig, "127.0.0.1:10086", []string{"xray api"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logPath := fakeCommands(t, tt.failing...)
+			x := newTestXrayManager(t, tt.config)
+			x.APIAddress = tt.apiAddress
+
+			if err := x.AddUserWithID("carol", "33333333-3333-3333-3333-333333333333"); err != nil {
+				t.Fatal(err)
+			}
+			if calls := readCalls(t, logPath); !strings.HasSuffix(calls, restartCalls) {
+				t.Fatalf("expected a restart, got:\n%s", calls)
+			}
+		})
+	}
+}
+
+func TestXrayEnablesUserStats(t *testing.T) {
+	logPath := fakeCommands(t)
+	x := newTestXrayManager(t, `{"api": {"tag": "api", "services": ["HandlerService"]}, "inbounds": [{"tag": "in", "port": 443, "protocol": "vless", "settings": {"clients": []}}]}`)
+	x.APIAddress = "127.0.0.1:10086"
+
+	if err := x.AddUserWithID("carol", "33333333-3333-3333-3333-333333333333"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := readCalls(t, logPath); calls != restartCalls {
+		t.Fatalf("expected a restart to load the stats settings, got:\n%s", calls)
+	}
+	data, _ := ioutil.ReadFile(x.ConfigPath)
+	got := compact(t, data)
+	for _, want := range []string{
+		`"api":{"tag":"api","services":["HandlerService","StatsService"]}`,
+		`"stats":{}`,
+		`"policy":{"levels":{"0":{"statsUserUplink":true,"statsUserDownlink":true}}}`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %s in\n%s", want, got)
+		}
+	}
+
+	// Once enabled, later changes go through the API again
+	if err := x.RemoveUser("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := readCalls(t, logPath); strings.Contains(calls, "systemctl") {
+		t.Fatalf("unexpected restart:\n%s", calls)
+	}
+}
+
+const passwordXrayConfig = `{
+    "stats": {},
+    "policy": {"levels": {"0": {"statsUserUplink": true, "statsUserDownlink": true}}},
+    "inbounds": [
+        {"tag": "trojan-in", "port": 443, "protocol": "trojan", "settings": {"clients": []}, "streamSettings": {"network": "ws", "security": "tls"}},
+        {"tag": "ss2022-in", "port": 8388, "protocol": "shadowsocks", "settings": {"method": "2022-blake3-aes-128-gcm", "password": "c2VydmVyLWtleS0xNmJ5dA==", "clients": []}},
+        {"tag": "ss-in", "port": 8389, "protocol": "shadowsocks", "settings": {"method": "chacha20-poly1305", "clients": []}},
+        {"tag": "ss-single", "port": 8390, "protocol": "shadowsocks", "settings": {"method": "aes-256-gcm", "password": "shared"}}
+    ]
+}`
+
+func TestXrayPasswordProtocols(t *testing.T) {
+	fakeCommands(t)
+	x := newTestXrayManager(t, passwordXrayConfig)
+	const uuid = "33333333-3333-3333-3333-333333333333"
+	if err := x.AddUserWithID("carol", uuid); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := x.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trojan := config.Inbounds[0].Settings.Clients
+	if len(trojan) != 1 || trojan[0].Password != uuid || trojan[0].ID != "" {
+		t.Fatalf("unexpected trojan clients: %+v", trojan)
+	}
+	ss2022 := config.Inbounds[1].Settings.Clients
+	key, err := base64.StdEncoding.DecodeString(ss2022[0].Password)
+	if err != nil || len(key) != 16 {
+		t.Fatalf("expected a 16 byte key, got %q", ss2022[0].Password)
+	}
+	ss := config.Inbounds[2].Settings.Clients
+	if ss[0].Password != uuid || ss[0].Method != "chacha20-poly1305" {
+		t.Fatalf("unexpected shadowsocks clients: %+v", ss)
+	}
+	if len(config.Inbounds[3].Settings.Clients) != 0 {
+		t.Fatal("user added to a single user shadowsocks inbound")
+	}
+
+	links, err := x.ShareLinks("carol", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"trojan://" + uuid + "@example.com:443?security=tls&type=ws#carol",
+		"ss://2022-blake3-aes-128-gcm:" + url.QueryEscape("c2VydmVyLWtleS0xNmJ5dA==:"+ss2022[0].Password) + "@example.com:8388#carol",
+		"ss://" + base64.RawURLEncoding.EncodeToString([]byte("chacha20-poly1305:"+uuid)) + "@example.com:8389#carol",
+	}
+	if strings.Join(links, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected links:\n%s\nwant:\n%s", strings.Join(links, "\n"), strings.Join(want, "\n"))
+	}
+
+	if err := x.RemoveUser("carol"); err != nil {
+		t.Fatal(err)
+	}
+	config, _ = x.loadConfig()
+	for _, inbound := range config.Inbounds {
+		if hasClient(inbound.Settings.Clients, "carol") {
+			t.Fatalf("carol still in %s", inbound.Tag)
+		}
+	}
+}
+
+func TestXrayAddRealityInbound(t *testing.T) {
+	logPath := fakeCommands(t)
+	x := newTestXrayManager(t, taggedXrayConfig)
+	spec := InboundSpec{Tag: "vless-reality", Protocol: "vless", Port: 8443, Security: "reality", Dest: "www.example.org:443", ServerNames: []string{"www.example.org"}}
+	if err := x.AddInbound(spec, map[string]string{"alice": "11111111-1111-1111-1111-111111111111"}); err == nil {
+		t.Fatal("expected an error for a port already in use")
+	}
+
+	spec.Port = 2053
+	if err := x.AddInbound(spec, map[string]string{"alice": "11111111-1111-1111-1111-111111111111"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls := readCalls(t, logPath); calls != restartCalls {
+		t.Fatalf("expected a restart, got %q", calls)
+	}
+
+	config, err := x.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbound := config.Inbounds[2]
+	reality := inbound.StreamSettings.RealitySettings
+	if inbound.Settings.Decryption != "none" || inbound.StreamSettings.Security != "reality" || len(reality.ShortIDs) != 1 || len(reality.ShortIDs[0]) != 16 {
+		t.Fatalf("unexpected inbound: %+v", inbound)
+	}
+	if clients := inbound.Settings.Clients; len(clients) != 1 || clients[0].Flow != "xtls-rprx-vision" {
+		t.Fatalf("unexpected clients: %+v", clients)
+	}
+	publicKey, err := realityPublicKey(reality.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New users get Vision on the REALITY inbound only
+	if err := x.AddUserWithID("bobby", "22222222-2222-2222-2222-222222222222"); err != nil {
+		t.Fatal(err)
+	}
+	config, _ = x.loadConfig()
+	if flow := config.Inbounds[0].Settings.Clients[1].Flow; flow != "" {
+		t.Fatalf("plain VLESS client got flow %q", flow)
+	}
+	links, err := x.ShareLinks("bobby", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "vless://22222222-2222-2222-2222-222222222222@example.com:2053?encryption=none&type=tcp&security=reality&fp=chrome&pbk=" +
+		publicKey + "&sni=www.example.org&sid=" + reality.ShortIDs[0] + "&flow=xtls-rprx-vision#bobby"
+	if len(links) != 3 || links[2] != want {
+		t.Fatalf("unexpected links:\n%s\nwant %s", strings.Join(links, "\n"), want)
+	}
+}
+
+func TestRealityKeys(t *testing.T) {
+	private, public, err := GenerateRealityKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if derived, err := realityPublicKey(private); err != nil || derived != public || len(public) != 43 {
+		t.Fatalf("public key %q does not match %q: %v", derived, public, err)
+	}
+	// RFC 7748 test vector
+	if derived, err := realityPublicKey("dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo"); err != nil || derived != "hSDwCYkwp1R0i33ctD73Wg2_Og0mOBr066SpjqqbTmo" {
+		t.Fatalf("unexpected public key %q: %v", derived, err)
+	}
+	if _, err := realityPublicKey("not a key"); err == nil {
+		t.Fatal("expected an error for an invalid key")
+	}
+}
+
+func TestXrayRejectsInvalidConfig(t *testing.T) {
+	logPath := fakeCommands(t, "xray run -test")
+	x := newTestXrayManager(t, taggedXrayConfig)
+
+	err := x.AddUserWithID("carol", "33333333-3333-3333-3333-333333333333")
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expected the config to be rejected, got %v", err)
+	}
+	if data, _ := ioutil.ReadFile(x.ConfigPath); string(data) != taggedXrayConfig {
+		t.Fatalf("config changed:\n%s", data)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(x.ConfigPath), "config.staging.json")); !os.IsNotExist(err) {
+		t.Fatal("staging file left behind")
+	}
+	if calls := readCalls(t, logPath); calls != "" {
+		t.Fatalf("unexpected calls:\n%s", calls)
+	}
+}
+
+func TestXrayTestsStagedConfig(t *testing.T) {
+	logPath := fakeCommands(t)
+	x := newTestXrayManager(t, taggedXrayConfig)
+
+	if err := x.AddUserWithID("carol", "33333333-3333-3333-3333-333333333333"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(logPath)
+	staging := filepath.Join(filepath.Dir(x.ConfigPath), "config.staging.json")
+	if want := "xray run -test -config " + staging + "\n"; !strings.HasPrefix(string(data), want) {
+		t.Fatalf("expected %q, got:\n%s", want, data)
+	}
+	if _, err := os.Stat(staging); !os.IsNotExist(err) {
+		t.Fatal("staging file left behind")
+	}
+}
+
+func TestXrayKeepsLastGoodConfig(t *testing.T) {
+	fakeCommands(t)
+	x := newTestXrayManager(t, taggedXrayConfig)
+
+	if err := x.AddUserWithID("carol", "33333333-3333-3333-3333-333333333333"); err != nil {
+		t.Fatal(err)
+	}
+	withCarol, _ := ioutil.ReadFile(x.ConfigPath)
+	if good, _ := ioutil.ReadFile(x.ConfigPath + ".last-good"); string(good) != string(withCarol) {
+		t.Fatalf("healthy config not kept as known-good:\n%s", good)
+	}
+
+	// The removal does not survive the restart, so carol stays
+	fakeCommands(t, "systemctl is-active#once")
+	err := x.RemoveUser("carol")
+	if !errors.Is(err, ErrRolledBack) {
+		t.Fatalf("expected ErrRolledBack, got %v", err)
+	}
+	if data, _ := ioutil.ReadFile(x.ConfigPath); string(data) != string(withCarol) {
+		t.Fatalf("config not rolled back:\n%s", data)
+	}
+	if good, _ := ioutil.ReadFile(x.ConfigPath + ".last-good"); string(good) != string(withCarol) {
+		t.Fatalf("known-good config changed:\n%s", good)
+	}
+}
+
+func TestXrayRollsBackFailedRestart(t *testing.T) {
+	logPath := fakeCommands(t, "systemctl is-active#once")
+	x := newTestXrayManager(t, taggedXrayConfig)
+
+	err := x.AddUserWithID("carol", "33333333-3333-3333-3333-333333333333")
+	if err == nil || !strings.Contains(err.Error(), "restored the previous config") {
+		t.Fatalf("expected a rollback, got %v", err)
+	}
+	if data, _ := ioutil.ReadFile(x.ConfigPath); string(data) != taggedXrayConfig {
+		t.Fatalf("config not rolled back:\n%s", data)
+	}
+	if calls := readCalls(t, logPath); calls != restartCalls+restartCalls {
+		t.Fatalf("expected a restart on the new and the previous config, got:\n%s", calls)
+	}
+
+	// Xray still down on the previous config
+	logPath = fakeCommands(t, "systemctl is-active")
+	err = x.AddUserWithID("carol", "33333333-3333-3333-3333-333333333333")
+	if err == nil || !strings.Contains(err.Error(), "rollback failed") {
+		t.Fatalf("expected a failed rollback, got %v", err)
+	}
+}
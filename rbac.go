@@ -0,0 +1,606 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"./config"
+)
+
+// Admin roles. Owners manage everything; resellers manage only the users
+// they created, within their limits and credits; support staff can look up
+// any user and suspend or resume it.
+const (
+	RoleOwner    = "owner"
+	RoleReseller = "reseller"
+	RoleSupport  = "support"
+)
+
+const adminDefaultPath = "/etc/vps_manager/admins.json"
+
+var (
+	ErrForbidden = errors.New("permission denied")
+	ErrNoCredits = errors.New("insufficient credits")
+)
+
+// Admin is an identity allowed to manage users
+type Admin struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	// TokenHash is the hex SHA-256 of the admin's API token
+	TokenHash string `json:"token_hash,omitempty"`
+	// SystemUser maps a Linux login to this admin when the menu or CLI is
+	// run through sudo
+	SystemUser string   `json:"system_user,omitempty"`
+	MaxUsers   int      `json:"max_users,omitempty"`
+	Plans      []string `json:"plans,omitempty"`
+	Credits    int64    `json:"credits"`
+}
+
+// LedgerEntry records one change to an admin's credit balance
+type LedgerEntry struct {
+	Time     time.Time `json:"time"`
+	Admin    string    `json:"admin"`
+	Amount   int64     `json:"amount"`
+	Balance  int64     `json:"balance"`
+	Reason   string    `json:"reason"`
+	Username string    `json:"username,omitempty"`
+}
+
+type adminDB struct {
+	Admins []Admin       `json:"admins"`
+	Ledger []LedgerEntry `json:"ledger"`
+}
+
+// AdminStore persists admins and the credit ledger. Like the user database
+// it is shared between processes, so every access takes an flock and
+// reloads the file. The lock is never held while the user database is
+// locked or accounts are provisioned, so the two locks have no order to
+// keep.
+type AdminStore struct {
+	path string
+	mu   sync.Mutex
+	db   adminDB
+}
+
+// NewAdminStore creates a store backed by the file at path
+func NewAdminStore(path string) *AdminStore {
+	if path == "" {
+		path = adminDefaultPath
+	}
+	return &AdminStore{path: path}
+}
+
+func (s *AdminStore) lock() (func(), error) {
+	s.mu.Lock()
+
+	lockFile, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("failed to open admin store lock: %v", err)
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		lockFile.Close()
+		s.mu.Unlock()
+		return nil, fmt.Errorf("failed to lock admin store: %v", err)
+	}
+
+	unlock := func() {
+		syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		lockFile.Close()
+		s.mu.Unlock()
+	}
+
+	s.db = adminDB{}
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		unlock()
+		return nil, fmt.Errorf("failed to read admin store: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.db); err != nil {
+			unlock()
+			return nil, fmt.Errorf("failed to parse admin store: %v", err)
+		}
+	}
+	return unlock, nil
+}
+
+func (s *AdminStore) save() error {
+	data, err := json.MarshalIndent(s.db, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *AdminStore) find(name string) int {
+	for i, admin := range s.db.Admins {
+		if admin.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Admins returns a copy of all admins
+func (s *AdminStore) Admins() ([]Admin, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	admins := make([]Admin, len(s.db.Admins))
+	copy(admins, s.db.Admins)
+	return admins, nil
+}
+
+// Get returns the named admin
+func (s *AdminStore) Get(name string) (Admin, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return Admin{}, err
+	}
+	defer unlock()
+
+	i := s.find(name)
+	if i < 0 {
+		return Admin{}, fmt.Errorf("%w: no admin named %s", ErrInvalidInput, name)
+	}
+	return s.db.Admins[i], nil
+}
+
+// Authenticate finds the admin whose API token is token
+func (s *AdminStore) Authenticate(token string) (Admin, bool, error) {
+	admins, err := s.Admins()
+	if err != nil {
+		return Admin{}, false, err
+	}
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	for _, admin := range admins {
+		if admin.TokenHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(admin.TokenHash)) == 1 {
+			return admin, true, nil
+		}
+	}
+	return Admin{}, false, nil
+}
+
+// BySystemUser finds the admin mapped to a Linux login
+func (s *AdminStore) BySystemUser(login string) (Admin, bool, error) {
+	admins, err := s.Admins()
+	if err != nil {
+		return Admin{}, false, err
+	}
+	for _, admin := range admins {
+		if admin.SystemUser != "" && admin.SystemUser == login {
+			return admin, true, nil
+		}
+	}
+	return Admin{}, false, nil
+}
+
+// Create adds an admin and returns its newly generated API token
+func (s *AdminStore) Create(admin Admin) (string, error) {
+	if !usernamePattern.MatchString(admin.Name) {
+		return "", fmt.Errorf("%w: admin name must be 3-32 lowercase letters, digits, '_' or '-'", ErrInvalidInput)
+	}
+	switch admin.Role {
+	case RoleOwner, RoleReseller, RoleSupport:
+	default:
+		return "", fmt.Errorf("%w: role must be owner, reseller or support", ErrInvalidInput)
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if s.find(admin.Name) >= 0 {
+		return "", fmt.Errorf("%w: admin %s already exists", ErrInvalidInput, admin.Name)
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(token))
+	admin.TokenHash = hex.EncodeToString(sum[:])
+	admin.Credits = 0
+
+	s.db.Admins = append(s.db.Admins, admin)
+	if err := s.save(); err != nil {
+		return "", fmt.Errorf("failed to save admin store: %v", err)
+	}
+	return token, nil
+}
+
+// Remove deletes an admin. Its ledger entries are kept.
+func (s *AdminStore) Remove(name string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	i := s.find(name)
+	if i < 0 {
+		return fmt.Errorf("%w: no admin named %s", ErrInvalidInput, name)
+	}
+	s.db.Admins = append(s.db.Admins[:i], s.db.Admins[i+1:]...)
+	return s.save()
+}
+
+// SetLimits sets how many users a reseller may own and which plans it may sell
+func (s *AdminStore) SetLimits(name string, maxUsers int, plans []string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	i := s.find(name)
+	if i < 0 {
+		return fmt.Errorf("%w: no admin named %s", ErrInvalidInput, name)
+	}
+	s.db.Admins[i].MaxUsers = maxUsers
+	s.db.Admins[i].Plans = plans
+	return s.save()
+}
+
+// Credit adds amount (negative to deduct) to an admin's balance and returns
+// the new balance
+func (s *AdminStore) Credit(name string, amount int64, reason string) (int64, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	i := s.find(name)
+	if i < 0 {
+		return 0, fmt.Errorf("%w: no admin named %s", ErrInvalidInput, name)
+	}
+	if s.db.Admins[i].Credits+amount < 0 {
+		return 0, ErrNoCredits
+	}
+	s.record(i, amount, reason, "")
+	if err := s.save(); err != nil {
+		return 0, fmt.Errorf("failed to save admin store: %v", err)
+	}
+	return s.db.Admins[i].Credits, nil
+}
+
+// Ledger returns the ledger entries of the named admin, or all entries if
+// name is empty
+func (s *AdminStore) Ledger(name string) ([]LedgerEntry, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries := make([]LedgerEntry, 0)
+	for _, entry := range s.db.Ledger {
+		if name == "" || entry.Admin == name {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// record changes the balance of admin i and appends a ledger entry. The
+// caller holds the lock and saves.
+func (s *AdminStore) record(i int, amount int64, reason, username string) {
+	s.db.Admins[i].Credits += amount
+	s.db.Ledger = append(s.db.Ledger, LedgerEntry{
+		Time:     time.Now(),
+		Admin:    s.db.Admins[i].Name,
+		Amount:   amount,
+		Balance:  s.db.Admins[i].Credits,
+		Reason:   reason,
+		Username: username,
+	})
+}
+
+// charge debits price from a reseller's balance, runs op and refunds the
+// price if op fails. The store is locked only to reserve and refund, not
+// while op provisions accounts; reserving up front is what keeps two
+// concurrent purchases from spending the same credits.
+func (s *AdminStore) charge(name string, price int64, reason, username string, op func(Admin) error) error {
+	admin, err := s.reserve(name, price, reason, username)
+	if err != nil {
+		return err
+	}
+	if err := op(admin); err != nil {
+		if price == 0 {
+			return err
+		}
+		if refundErr := s.refund(name, price, reason, username); refundErr != nil {
+			return fmt.Errorf("%v; the %d credits charged were not refunded: %v", err, price, refundErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// reserve debits price from a reseller's balance if it covers it, and
+// returns the admin
+func (s *AdminStore) reserve(name string, price int64, reason, username string) (Admin, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return Admin{}, err
+	}
+	defer unlock()
+
+	i := s.find(name)
+	if i < 0 {
+		return Admin{}, fmt.Errorf("%w: admin %s no longer exists", ErrForbidden, name)
+	}
+	if s.db.Admins[i].Credits < price {
+		return Admin{}, fmt.Errorf("%w: %s costs %d, balance is %d", ErrNoCredits, reason, price, s.db.Admins[i].Credits)
+	}
+	if price == 0 {
+		return s.db.Admins[i], nil
+	}
+	s.record(i, -price, reason, username)
+	if err := s.save(); err != nil {
+		return Admin{}, fmt.Errorf("failed to save admin store: %v", err)
+	}
+	return s.db.Admins[i], nil
+}
+
+// refund returns a reserved price to a reseller whose purchase failed
+func (s *AdminStore) refund(name string, price int64, reason, username string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	i := s.find(name)
+	if i < 0 {
+		return fmt.Errorf("admin %s no longer exists", name)
+	}
+	s.record(i, price, "refund "+reason, username)
+	if err := s.save(); err != nil {
+		return fmt.Errorf("failed to save admin store: %v", err)
+	}
+	return nil
+}
+
+// Actor performs user operations on behalf of an admin, enforcing its
+// role, user ownership, limits and credits
+type Actor struct {
+	vm    *VPSManager
+	Admin Admin
+}
+
+// OwnerActor acts with full rights under the given audit name. It is used
+// for the configured API token, the dashboard, the Telegram admins and root
+// at the console.
+func (vm *VPSManager) OwnerActor(name string) *Actor {
+	return &Actor{vm: vm, Admin: Admin{Name: name, Role: RoleOwner}}
+}
+
+// ActorFor acts on behalf of a stored admin
+func (vm *VPSManager) ActorFor(admin Admin) *Actor {
+	return &Actor{vm: vm, Admin: admin}
+}
+
+// ConsoleActor identifies who runs the menu or CLI. A user who reaches the
+// binary through sudo is mapped to the admin with that system_user. Other
+// sudoers act as owner under their login, unless require_admin_mapping is
+// set; anyone else is root and acts as owner.
+func (vm *VPSManager) ConsoleActor() (*Actor, error) {
+	login := os.Getenv("SUDO_USER")
+	if login == "" || login == "root" {
+		return vm.OwnerActor("root"), nil
+	}
+	admin, ok, err := vm.Admins.BySystemUser(login)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return vm.ActorFor(admin), nil
+	}
+	if vm.Config.RequireAdminMapping {
+		return nil, fmt.Errorf("%w: %s is not mapped to an admin", ErrForbidden, login)
+	}
+	return vm.OwnerActor(login), nil
+}
+
+func (a *Actor) isOwner() bool { return a.Admin.Role == RoleOwner }
+
+// require fails unless the actor has one of roles
+func (a *Actor) require(roles ...string) error {
+	for _, role := range roles {
+		if a.Admin.Role == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s may not do this", ErrForbidden, a.Admin.Role)
+}
+
+// AuditFilter restricts an audit query to what the actor may read. Owners
+// and support staff see everything; resellers see only their own actions.
+func (a *Actor) AuditFilter(filter AuditFilter) AuditFilter {
+	if a.Admin.Role == RoleReseller {
+		filter.Actor = a.Admin.Name
+	}
+	return filter
+}
+
+// visible reports whether the actor may see user
+func (a *Actor) visible(user User) bool {
+	return a.Admin.Role != RoleReseller || user.Owner == a.Admin.Name
+}
+
+// Users returns the users the actor may see
+func (a *Actor) Users() ([]User, error) {
+	users, err := a.vm.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	visible := make([]User, 0, len(users))
+	for _, user := range users {
+		if a.visible(user) {
+			visible = append(visible, user)
+		}
+	}
+	return visible, nil
+}
+
+// User returns the named user if the actor may see it. Users owned by
+// another reseller are reported as not found.
+func (a *Actor) User(username string) (User, error) {
+	user, err := a.vm.GetUser(username)
+	if err != nil {
+		return User{}, err
+	}
+	if !a.visible(user) {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// plan resolves a plan name, or a number of days for owners, into the
+// duration and price of a purchase
+func (a *Actor) plan(name string, days int) (int, int64, error) {
+	if name == "" {
+		if a.Admin.Role == RoleReseller {
+			return 0, 0, fmt.Errorf("%w: resellers must choose a plan", ErrInvalidInput)
+		}
+		return days, 0, nil
+	}
+
+	var plan *config.PlanConfig
+	for i := range a.vm.Config.Plans {
+		if a.vm.Config.Plans[i].Name == name {
+			plan = &a.vm.Config.Plans[i]
+		}
+	}
+	if plan == nil {
+		return 0, 0, fmt.Errorf("%w: unknown plan %s", ErrInvalidInput, name)
+	}
+
+	if a.Admin.Role != RoleReseller {
+		return plan.Days, 0, nil
+	}
+	if len(a.Admin.Plans) > 0 {
+		allowed := false
+		for _, p := range a.Admin.Plans {
+			allowed = allowed || p == name
+		}
+		if !allowed {
+			return 0, 0, fmt.Errorf("%w: plan %s is not available to %s", ErrForbidden, name, a.Admin.Name)
+		}
+	}
+	return plan.Days, plan.Price, nil
+}
+
+// AddUser creates a user on a plan, or for a number of days if the actor is
+// an owner. Resellers own the users they create and pay the plan's price.
+func (a *Actor) AddUser(username, password, plan string, days int, contact Contact, nodes []string) error {
+	if err := a.require(RoleOwner, RoleReseller); err != nil {
+		return err
+	}
+	days, price, err := a.plan(plan, days)
+	if err != nil {
+		return err
+	}
+	if a.isOwner() {
+		return a.vm.addUserAs(a.Admin.Name, username, password, days, "", 0, contact, nodes)
+	}
+
+	return a.vm.Admins.charge(a.Admin.Name, price, "add "+plan, username, func(admin Admin) error {
+		return a.vm.addUserAs(a.Admin.Name, username, password, days, a.Admin.Name, admin.MaxUsers, contact, nodes)
+	})
+}
+
+// RenewUser extends a user by a plan, or by a number of days if the actor
+// is an owner. Resellers pay the plan's price.
+func (a *Actor) RenewUser(username, plan string, days int) (time.Time, error) {
+	if err := a.require(RoleOwner, RoleReseller); err != nil {
+		return time.Time{}, err
+	}
+	if _, err := a.User(username); err != nil {
+		return time.Time{}, err
+	}
+	days, price, err := a.plan(plan, days)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if a.isOwner() {
+		return a.vm.renewUserAs(a.Admin.Name, username, days)
+	}
+
+	var expireDate time.Time
+	err = a.vm.Admins.charge(a.Admin.Name, price, "renew "+plan, username, func(Admin) error {
+		var err error
+		expireDate, err = a.vm.renewUserAs(a.Admin.Name, username, days)
+		return err
+	})
+	return expireDate, err
+}
+
+// RemoveUser deletes a user the actor owns
+func (a *Actor) RemoveUser(username string) error {
+	if err := a.require(RoleOwner, RoleReseller); err != nil {
+		return err
+	}
+	if _, err := a.User(username); err != nil {
+		return err
+	}
+	return a.vm.removeUserAs(a.Admin.Name, username)
+}
+
+// SetContact changes the notification email of a user the actor owns
+func (a *Actor) SetContact(username string, contact Contact) error {
+	if err := a.require(RoleOwner, RoleReseller); err != nil {
+		return err
+	}
+	if _, err := a.User(username); err != nil {
+		return err
+	}
+	return a.vm.setContactAs(a.Admin.Name, username, contact)
+}
+
+// SuspendUser blocks a user the actor may see
+func (a *Actor) SuspendUser(username string) error {
+	if _, err := a.User(username); err != nil {
+		return err
+	}
+	return a.vm.suspendUserAs(a.Admin.Name, username)
+}
+
+// ResumeUser restores a user the actor may see
+func (a *Actor) ResumeUser(username string) error {
+	if _, err := a.User(username); err != nil {
+		return err
+	}
+	return a.vm.resumeUserAs(a.Admin.Name, username)
+}
+
+// CheckExpiredUsers removes expired users; only owners may run it by hand
+func (a *Actor) CheckExpiredUsers() error {
+	if err := a.require(RoleOwner); err != nil {
+		return err
+	}
+	a.vm.CheckExpiredUsers()
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"./config"
+)
+
+// newReseller creates a reseller with the given balance and limits
+func newReseller(t *testing.T, m *testManager, name string, credits int64, maxUsers int, plans ...string) (*Actor, string) {
+	t.Helper()
+	token, err := m.Admins.Create(Admin{Name: name, Role: RoleReseller})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credits > 0 {
+		if _, err := m.Admins.Credit(name, credits, "top-up"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Admins.SetLimits(name, maxUsers, plans); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := m.Admins.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.ActorFor(admin), token
+}
+
+func TestResellerAddUserDebitsCredits(t *testing.T) {
+	m := newTestManager(t)
+	reseller, _ := newReseller(t, m, "resa", 15, 0)
+
+	if err := reseller.AddUser("alice", "secret1", "", 30, Contact{}, nil); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected plan to be required, got %v", err)
+	}
+	if err := reseller.AddUser("alice", "secret1", "monthly", 0, Contact{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := m.GetUser("alice"); user.Owner != "resa" {
+		t.Fatalf("expected alice to be owned by resa, got %q", user.Owner)
+	}
+
+	if err := reseller.AddUser("bobby", "secret1", "monthly", 0, Contact{}, nil); !errors.Is(err, ErrNoCredits) {
+		t.Fatalf("expected ErrNoCredits, got %v", err)
+	}
+	if _, err := m.GetUser("bobby"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatal("user created without enough credits")
+	}
+
+	if _, err := reseller.RenewUser("alice", "weekly", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	admin, _ := m.Admins.Get("resa")
+	if admin.Credits != 2 {
+		t.Fatalf("expected balance 2, got %d", admin.Credits)
+	}
+	ledger, _ := m.Admins.Ledger("resa")
+	if len(ledger) != 3 || ledger[1].Amount != -10 || ledger[1].Username != "alice" || ledger[2].Balance != 2 {
+		t.Fatalf("unexpected ledger %+v", ledger)
+	}
+}
+
+func TestResellerFailedAddIsNotCharged(t *testing.T) {
+	m := newTestManager(t)
+	reseller, _ := newReseller(t, m, "resa", 10, 0)
+
+	m.ssh.fail["AddUser"] = true
+	if err := reseller.AddUser("alice", "secret1", "monthly", 0, Contact{}, nil); err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if admin, _ := m.Admins.Get("resa"); admin.Credits != 10 {
+		t.Fatalf("charged for a failed add, balance %d", admin.Credits)
+	}
+}
+
+func TestChargeDoesNotHoldAdminStore(t *testing.T) {
+	m := newTestManager(t)
+	newReseller(t, m, "resa", 10, 0)
+
+	err := m.Admins.charge("resa", 10, "add monthly", "alice", func(Admin) error {
+		// Other admin operations go ahead while the purchase is provisioned
+		admin, err := m.Admins.Get("resa")
+		if err != nil {
+			return err
+		}
+		if admin.Credits != 0 {
+			t.Errorf("price not reserved, balance %d", admin.Credits)
+		}
+		return errStub
+	})
+	if err != errStub {
+		t.Fatalf("expected the op's error, got %v", err)
+	}
+
+	admin, _ := m.Admins.Get("resa")
+	ledger, _ := m.Admins.Ledger("resa")
+	if admin.Credits != 10 || len(ledger) != 3 || ledger[2].Amount != 10 || ledger[2].Reason != "refund add monthly" {
+		t.Fatalf("price not refunded: balance %d, ledger %+v", admin.Credits, ledger)
+	}
+}
+
+func TestConsoleActor(t *testing.T) {
+	m := newTestManager(t)
+	if _, err := m.Admins.Create(Admin{Name: "helpdesk", Role: RoleSupport, SystemUser: "maria"}); err != nil {
+		t.Fatal(err)
+	}
+	login := os.Getenv("SUDO_USER")
+	defer os.Setenv("SUDO_USER", login)
+
+	for sudoer, want := range map[string]Admin{
+		"":       {Name: "root", Role: RoleOwner},
+		"maria":  {Name: "helpdesk", Role: RoleSupport},
+		"ubuntu": {Name: "ubuntu", Role: RoleOwner},
+	} {
+		os.Setenv("SUDO_USER", sudoer)
+		actor, err := m.ConsoleActor()
+		if err != nil || actor.Admin.Name != want.Name || actor.Admin.Role != want.Role {
+			t.Errorf("SUDO_USER=%s: got %+v (%v), want %s as %s", sudoer, actor, err, want.Name, want.Role)
+		}
+	}
+
+	m.Config.RequireAdminMapping = true
+	os.Setenv("SUDO_USER", "ubuntu")
+	if _, err := m.ConsoleActor(); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected an unmapped sudoer to be refused, got %v", err)
+	}
+	os.Setenv("SUDO_USER", "maria")
+	if actor, err := m.ConsoleActor(); err != nil || actor.Admin.Name != "helpdesk" {
+		t.Fatalf("mapped sudoer refused: %v", err)
+	}
+}
+
+func TestResellerLimits(t *testing.T) {
+	m := newTestManager(t)
+	reseller, _ := newReseller(t, m, "resa", 100, 1, "weekly")
+
+	if err := reseller.AddUser("alice", "secret1", "monthly", 0, Contact{}, nil); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected disallowed plan to be rejected, got %v", err)
+	}
+	if err := reseller.AddUser("alice", "secret1", "weekly", 0, Contact{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := reseller.AddUser("bobby", "secret1", "weekly", 0, Contact{}, nil); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected account limit to be enforced, got %v", err)
+	}
+}
+
+func TestResellerOnlySeesOwnUsers(t *testing.T) {
+	m := newTestManager(t)
+	resa, _ := newReseller(t, m, "resa", 100, 0)
+	resb, _ := newReseller(t, m, "resb", 100, 0)
+
+	if err := resa.AddUser("alice", "secret1", "weekly", 0, Contact{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddUser("owned", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	if users, _ := resb.Users(); len(users) != 0 {
+		t.Fatalf("resb sees other users: %+v", users)
+	}
+	for name, err := range map[string]error{
+		"get":     func() error { _, err := resb.User("alice"); return err }(),
+		"renew":   func() error { _, err := resb.RenewUser("alice", "weekly", 0); return err }(),
+		"suspend": resb.SuspendUser("alice"),
+		"remove":  resb.RemoveUser("owned"),
+	} {
+		if !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("%s: expected ErrUserNotFound, got %v", name, err)
+		}
+	}
+	if admin, _ := m.Admins.Get("resb"); admin.Credits != 100 {
+		t.Fatalf("resb charged for a rejected renewal, balance %d", admin.Credits)
+	}
+
+	if err := resa.RemoveUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSupportRole(t *testing.T) {
+	m := newTestManager(t)
+	if _, err := m.Admins.Create(Admin{Name: "helpdesk", Role: RoleSupport}); err != nil {
+		t.Fatal(err)
+	}
+	admin, _ := m.Admins.Get("helpdesk")
+	support := m.ActorFor(admin)
+
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	if users, _ := support.Users(); len(users) != 1 {
+		t.Fatalf("support should see every user, got %+v", users)
+	}
+	if err := support.SuspendUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := support.AddUser("bobby", "secret1", "", 30, Contact{}, nil); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected support add to be forbidden, got %v", err)
+	}
+	if err := support.RemoveUser("alice"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected support remove to be forbidden, got %v", err)
+	}
+	if err := support.CheckExpiredUsers(); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected support expiry check to be forbidden, got %v", err)
+	}
+}
+
+func TestAPIResellerToken(t *testing.T) {
+	m := newTestManager(t)
+	h := NewAPIServer(m.VPSManager, config.APIConfig{Token: "test-token"}).server.Handler
+	_, token := newReseller(t, m, "resa", 10, 0)
+	if err := m.AddUser("owned", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/api/me", "", http.StatusOK},
+		{http.MethodPost, "/api/users", `{"username":"alice","password":"secret1","expire_days":30}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/users", `{"username":"alice","password":"secret1","plan":"monthly"}`, http.StatusCreated},
+		{http.MethodPost, "/api/users", `{"username":"bobby","password":"secret1","plan":"weekly"}`, http.StatusPaymentRequired},
+		{http.MethodGet, "/api/users/owned", "", http.StatusNotFound},
+		{http.MethodDelete, "/api/users/owned", "", http.StatusNotFound},
+		{http.MethodGet, "/api/users/alice", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := doRequestWithToken(t, h, token, tt.method, tt.path, tt.body)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: expected %d, got %d: %s", tt.method, tt.path, tt.status, rec.Code, rec.Body)
+		}
+	}
+
+	rec := doRequestWithToken(t, h, token, http.MethodGet, "/api/users", "")
+	if rec.Code != http.StatusOK || rec.Body.String() == "" || strings.Contains(rec.Body.String(), "owned") {
+		t.Fatalf("reseller list leaks other users: %s", rec.Body)
+	}
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"./config"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	telegramDefaultBaseURL   = "https://api.telegram.org"
+	telegramPollTimeout      = 30
+	telegramDefaultTrial     = 1
+	telegramDefaultMaxTrials = 10
+	telegramDefaultTrials    = "/etc/vps_manager/telegram_trials.json"
+)
+
+const telegramHelp = `Available commands:
+/trial - create a trial account
+/expiry [username] - show when an account expires
+/config [username] - show connection details
+/qr [username] - get an Xray QR code
+
+Admin commands:
+/add username password days - create an account
+/renew username days - extend an account`
+
+// TelegramBot maps Telegram commands to VPSManager operations
+type TelegramBot struct {
+	manager *VPSManager
+	cfg     config.TelegramConfig
+	baseURL string
+	admins  map[int64]bool
+	client  *http.Client
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	trialsMu sync.Mutex
+}
+
+// telegramTrial records that a chat has used its one free trial. Records
+// are kept after the trial account expires or is removed.
+type telegramTrial struct {
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// botError is an error whose message is safe to show to customers. Any
+// other error is reported to non-admin chats as a generic failure.
+type botError string
+
+func (e botError) Error() string { return string(e) }
+
+func botErrorf(format string, args ...interface{}) error {
+	return botError(fmt.Sprintf(format, args...))
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
+}
+
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+// NewTelegramBot creates a bot for the given manager
+func NewTelegramBot(manager *VPSManager, cfg config.TelegramConfig) *TelegramBot {
+	baseURL := strings.TrimRight(cfg.APIBaseURL, "/")
+	if baseURL == "" {
+		baseURL = telegramDefaultBaseURL
+	}
+	if cfg.TrialDays <= 0 {
+		cfg.TrialDays = telegramDefaultTrial
+	}
+	if cfg.MaxActiveTrials <= 0 {
+		cfg.MaxActiveTrials = telegramDefaultMaxTrials
+	}
+	if cfg.TrialsPath == "" {
+		cfg.TrialsPath = telegramDefaultTrials
+	}
+
+	admins := make(map[int64]bool)
+	for _, id := range cfg.AdminChatIDs {
+		admins[id] = true
+	}
+
+	return &TelegramBot{
+		manager: manager,
+		cfg:     cfg,
+		baseURL: baseURL,
+		admins:  admins,
+		client:  &http.Client{Timeout: (telegramPollTimeout + 10) * time.Second},
+	}
+}
+
+// Start begins long-polling for updates in the background
+func (b *TelegramBot) Start() error {
+	if b.cfg.Token == "" {
+		return fmt.Errorf("telegram token is not configured")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	b.done = make(chan struct{})
+	go b.poll(ctx)
+	return nil
+}
+
+// Shutdown stops polling and waits for the current update to finish
+func (b *TelegramBot) Shutdown(ctx context.Context) error {
+	b.cancel()
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *TelegramBot) poll(ctx context.Context) {
+	defer close(b.done)
+
+	var offset int64
+	for {
+		updates, err := b.getUpdates(ctx, offset)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Telegram getUpdates failed: %v", err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			if update.Message == nil || update.Message.Text == "" {
+				continue
+			}
+			b.handleMessage(update.Message.Chat.ID, update.Message.Text)
+		}
+	}
+}
+
+// handleMessage dispatches a single command and replies to the chat
+func (b *TelegramBot) handleMessage(chatID int64, text string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return
+	}
+	// Commands may be addressed as /cmd@BotName in group chats
+	command := strings.SplitN(fields[0], "@", 2)[0]
+	args := fields[1:]
+
+	var err error
+	switch command {
+	case "/start", "/help":
+		err = b.sendMessage(chatID, html.EscapeString(telegramHelp))
+	case "/trial":
+		err = b.cmdTrial(chatID)
+	case "/expiry":
+		err = b.cmdExpiry(chatID, args)
+	case "/config":
+		err = b.cmdConfig(chatID, args)
+	case "/qr":
+		err = b.cmdQR(chatID, args)
+	case "/add":
+		err = b.cmdAdd(chatID, args)
+	case "/renew":
+		err = b.cmdRenew(chatID, args)
+	default:
+		err = b.sendMessage(chatID, "Unknown command. Send /help for the list of commands.")
+	}
+
+	if err != nil {
+		log.Printf("Telegram command %s from %d failed: %v", command, chatID, err)
+		b.sendMessage(chatID, "Error: "+html.EscapeString(b.publicMessage(chatID, err)))
+	}
+}
+
+// publicMessage returns the text of err that may be shown in a chat. Admins
+// see the full error; customers only see validation and lookup failures.
+func (b *TelegramBot) publicMessage(chatID int64, err error) string {
+	var be botError
+	switch {
+	case b.admins[chatID], errors.As(err, &be), errors.Is(err, ErrInvalidInput):
+		return err.Error()
+	case errors.Is(err, ErrUserNotFound):
+		return ErrUserNotFound.Error()
+	default:
+		return "something went wrong, please try again later"
+	}
+}
+
+func (b *TelegramBot) cmdTrial(chatID int64) error {
+	if !b.cfg.TrialsEnabled {
+		return botErrorf("trials are not available right now")
+	}
+
+	b.trialsMu.Lock()
+	defer b.trialsMu.Unlock()
+
+	trials, err := b.loadTrials()
+	if err != nil {
+		return err
+	}
+	if trial, used := trials[chatID]; used && !b.admins[chatID] {
+		return botErrorf("this chat already used its trial (%s)", trial.Username)
+	}
+
+	users, err := b.manager.GetUsers()
+	if err != nil {
+		return err
+	}
+	active := 0
+	for _, user := range users {
+		if user.Trial {
+			active++
+		}
+	}
+	if active >= b.cfg.MaxActiveTrials {
+		return botErrorf("no trial slots are free right now, please try again later")
+	}
+
+	suffix, err := randomString("0123456789", 6)
+	if err != nil {
+		return err
+	}
+	password, err := randomString("abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789", 10)
+	if err != nil {
+		return err
+	}
+	username := "trial" + suffix
+
+	if err := b.manager.addUserAs(telegramActor(chatID), username, password, b.cfg.TrialDays, "", 0, Contact{}, nil); err != nil {
+		return err
+	}
+	err = b.manager.updateUser(username, func(u *User) {
+		u.TelegramChatID = chatID
+		u.Trial = true
+	})
+	if err != nil {
+		return err
+	}
+
+	trials[chatID] = telegramTrial{Username: username, CreatedAt: time.Now()}
+	if err := b.saveTrials(trials); err != nil {
+		return err
+	}
+
+	user, err := b.manager.GetUser(username)
+	if err != nil {
+		return err
+	}
+	return b.sendMessage(chatID, fmt.Sprintf(
+		"Trial account created.\nUsername: <code>%s</code>\nPassword: <code>%s</code>\nExpires: %s\n\nSend /config or /qr for connection details.",
+		username, html.EscapeString(password), user.ExpireDate.Format("2006-01-02 15:04")))
+}
+
+// loadTrials reads the chats that already used a trial
+func (b *TelegramBot) loadTrials() (map[int64]telegramTrial, error) {
+	trials := make(map[int64]telegramTrial)
+	data, err := ioutil.ReadFile(b.cfg.TrialsPath)
+	if os.IsNotExist(err) {
+		return trials, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trial records: %v", err)
+	}
+	if err := json.Unmarshal(data, &trials); err != nil {
+		return nil, fmt.Errorf("failed to parse trial records: %v", err)
+	}
+	return trials, nil
+}
+
+func (b *TelegramBot) saveTrials(trials map[int64]telegramTrial) error {
+	data, err := json.MarshalIndent(trials, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := b.cfg.TrialsPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write trial records: %v", err)
+	}
+	return os.Rename(tmp, b.cfg.TrialsPath)
+}
+
+func (b *TelegramBot) cmdExpiry(chatID int64, args []string) error {
+	user, err := b.resolveUser(chatID, args)
+	if err != nil {
+		return err
+	}
+
+	status := "active"
+	switch {
+	case user.Suspended:
+		status = "suspended"
+	case time.Now().After(user.ExpireDate):
+		status = "expired"
+	}
+	return b.sendMessage(chatID, fmt.Sprintf("Account <code>%s</code> expires on %s (%s).",
+		user.Username, user.ExpireDate.Format("2006-01-02"), status))
+}
+
+func (b *TelegramBot) cmdConfig(chatID int64, args []string) error {
+	user, err := b.resolveUser(chatID, args)
+	if err != nil {
+		return err
+	}
+
+	card, err := b.manager.ConnectionCard(user.Username)
+	if err != nil {
+		return err
+	}
+	return b.sendMessage(chatID, "<pre>"+html.EscapeString(card)+"</pre>")
+}
+
+func (b *TelegramBot) cmdQR(chatID int64, args []string) error {
+	user, err := b.resolveUser(chatID, args)
+	if err != nil {
+		return err
+	}
+
+	links, err := b.manager.XrayMgr.ShareLinks(user.Username, b.manager.Config.Domain)
+	if err != nil {
+		return err
+	}
+	if len(links) == 0 {
+		return botErrorf("account %s has no Xray links", user.Username)
+	}
+
+	for _, link := range links {
+		png, err := qrcode.Encode(link, qrcode.Medium, 512)
+		if err != nil {
+			return fmt.Errorf("failed to generate QR code: %v", err)
+		}
+		if err := b.sendPhoto(chatID, png, "<code>"+html.EscapeString(link)+"</code>"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *TelegramBot) cmdAdd(chatID int64, args []string) error {
+	if !b.admins[chatID] {
+		return botErrorf("this command is for admins only")
+	}
+	if len(args) != 3 {
+		return botErrorf("usage: /add username password days")
+	}
+	days, err := strconv.Atoi(args[2])
+	if err != nil {
+		return fmt.Errorf("%w: days must be a number", ErrInvalidInput)
+	}
+
+	if err := b.manager.OwnerActor(telegramActor(chatID)).AddUser(args[0], args[1], "", days, Contact{}, nil); err != nil {
+		return err
+	}
+	return b.sendMessage(chatID, fmt.Sprintf("User <code>%s</code> created for %d days.", args[0], days))
+}
+
+func (b *TelegramBot) cmdRenew(chatID int64, args []string) error {
+	if !b.admins[chatID] {
+		return botErrorf("this command is for admins only")
+	}
+	if len(args) != 2 {
+		return botErrorf("usage: /renew username days")
+	}
+	days, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("%w: days must be a number", ErrInvalidInput)
+	}
+
+	expireDate, err := b.manager.OwnerActor(telegramActor(chatID)).RenewUser(args[0], "", days)
+	if err != nil {
+		return err
+	}
+	return b.sendMessage(chatID, fmt.Sprintf("User <code>%s</code> renewed until %s.", args[0], expireDate.Format("2006-01-02")))
+}
+
+// resolveUser picks the account a command refers to. Admins may name any
+// user; customers may only see accounts linked to their chat.
+func (b *TelegramBot) resolveUser(chatID int64, args []string) (User, error) {
+	if len(args) > 0 {
+		user, err := b.manager.GetUser(args[0])
+		if err != nil {
+			return User{}, err
+		}
+		if !b.admins[chatID] && user.TelegramChatID != chatID {
+			return User{}, ErrUserNotFound
+		}
+		return user, nil
+	}
+
+	users, err := b.manager.GetUsers()
+	if err != nil {
+		return User{}, err
+	}
+	for _, user := range users {
+		if user.TelegramChatID == chatID {
+			return user, nil
+		}
+	}
+	return User{}, botErrorf("no account is linked to this chat, send /trial to create one")
+}
+
+func (b *TelegramBot) getUpdates(ctx context.Context, offset int64) ([]telegramUpdate, error) {
+	params := url.Values{}
+	params.Set("offset", strconv.FormatInt(offset, 10))
+	params.Set("timeout", strconv.Itoa(telegramPollTimeout))
+	params.Set("allowed_updates", `["message"]`)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.methodURL("getUpdates"),
+		strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, stripURL(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	result, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []telegramUpdate
+	if err := json.Unmarshal(result, &updates); err != nil {
+		return nil, fmt.Errorf("failed to parse updates: %v", err)
+	}
+	return updates, nil
+}
+
+func (b *TelegramBot) sendMessage(chatID int64, text string) error {
+	params := url.Values{}
+	params.Set("chat_id", strconv.FormatInt(chatID, 10))
+	params.Set("text", text)
+	params.Set("parse_mode", "HTML")
+
+	req, err := http.NewRequest(http.MethodPost, b.methodURL("sendMessage"), strings.NewReader(params.Encode()))
+	if err != nil {
+		return stripURL(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	_, err = b.do(req)
+	return err
+}
+
+func (b *TelegramBot) sendPhoto(chatID int64, png []byte, caption string) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("chat_id", strconv.FormatInt(chatID, 10))
+	form.WriteField("caption", caption)
+	form.WriteField("parse_mode", "HTML")
+	part, err := form.CreateFormFile("photo", "qr.png")
+	if err != nil {
+		return err
+	}
+	part.Write(png)
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, b.methodURL("sendPhoto"), &body)
+	if err != nil {
+		return stripURL(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	_, err = b.do(req)
+	return err
+}
+
+// do sends a Bot API request and unwraps the {"ok", "result"} envelope
+func (b *TelegramBot) do(req *http.Request) (json.RawMessage, error) {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, stripURL(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var result telegramResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid response (HTTP %d): %v", resp.StatusCode, err)
+	}
+	if !result.OK {
+		return nil, fmt.Errorf("telegram API error: %s", result.Description)
+	}
+	return result.Result, nil
+}
+
+// telegramActor is the audit identity of a chat
+func telegramActor(chatID int64) string {
+	return fmt.Sprintf("telegram:%d", chatID)
+}
+
+// stripURL drops the request URL from a *url.Error, since Bot API URLs
+// contain the token and errors end up in logs and chat replies
+func stripURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("telegram request failed: %w", urlErr.Err)
+	}
+	return err
+}
+
+func (b *TelegramBot) methodURL(method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", b.baseURL, b.cfg.Token, method)
+}
+
+// randomString returns n characters drawn uniformly from alphabet
+func randomString(alphabet string, n int) (string, error) {
+	out := make([]byte, n)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range out {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate random string: %v", err)
+		}
+		out[i] = alphabet[idx.Int64()]
+	}
+	return string(out), nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"./config"
+)
+
+const (
+	testBotToken  = "123456:secret-bot-token"
+	testAdminChat = 1
+)
+
+// fakeBotAPI records the messages a bot sends through sendMessage
+type fakeBotAPI struct {
+	mu       sync.Mutex
+	messages map[int64][]string
+}
+
+func (f *fakeBotAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/bot"+testBotToken+"/sendMessage" {
+		http.Error(w, `{"ok":false,"description":"Not Found"}`, http.StatusNotFound)
+		return
+	}
+	chatID, _ := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+
+	f.mu.Lock()
+	f.messages[chatID] = append(f.messages[chatID], r.FormValue("text"))
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true,"result":{}}`))
+}
+
+// last returns the most recent message sent to chatID
+func (f *fakeBotAPI) last(chatID int64) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	msgs := f.messages[chatID]
+	if len(msgs) == 0 {
+		return ""
+	}
+	return msgs[len(msgs)-1]
+}
+
+func newTestBot(t *testing.T, cfg config.TelegramConfig) (*testManager, *TelegramBot, *fakeBotAPI) {
+	t.Helper()
+	m := newTestManager(t)
+
+	api := &fakeBotAPI{messages: make(map[int64][]string)}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	cfg.Token = testBotToken
+	cfg.APIBaseURL = server.URL
+	cfg.AdminChatIDs = []int64{testAdminChat}
+	cfg.TrialsPath = filepath.Join(t.TempDir(), "trials.json")
+	return m, NewTelegramBot(m.VPSManager, cfg), api
+}
+
+func TestTelegramTrialOncePerChat(t *testing.T) {
+	m, bot, api := newTestBot(t, config.TelegramConfig{TrialsEnabled: true})
+
+	bot.handleMessage(42, "/trial")
+	if !strings.Contains(api.last(42), "Trial account created") {
+		t.Fatalf("expected trial to be created, got %q", api.last(42))
+	}
+	user, err := bot.resolveUser(42, nil)
+	if err != nil || !user.Trial {
+		t.Fatalf("trial not linked to chat: %+v %v", user, err)
+	}
+
+	bot.handleMessage(42, "/trial")
+	if !strings.Contains(api.last(42), "already used its trial") {
+		t.Fatalf("expected second trial to be rejected, got %q", api.last(42))
+	}
+
+	// Removing the account must not free the chat for another trial
+	if err := m.RemoveUser(user.Username); err != nil {
+		t.Fatal(err)
+	}
+	bot.handleMessage(42, "/trial")
+	if !strings.Contains(api.last(42), "already used its trial") {
+		t.Fatalf("expected trial after removal to be rejected, got %q", api.last(42))
+	}
+}
+
+func TestTelegramTrialLimits(t *testing.T) {
+	_, bot, api := newTestBot(t, config.TelegramConfig{})
+	bot.handleMessage(42, "/trial")
+	if !strings.Contains(api.last(42), "not available") {
+		t.Fatalf("expected disabled trials to be rejected, got %q", api.last(42))
+	}
+
+	_, bot, api = newTestBot(t, config.TelegramConfig{TrialsEnabled: true, MaxActiveTrials: 1})
+	bot.handleMessage(42, "/trial")
+	bot.handleMessage(43, "/trial")
+	if !strings.Contains(api.last(43), "no trial slots") {
+		t.Fatalf("expected trial cap to be enforced, got %q", api.last(43))
+	}
+}
+
+func TestTelegramAdminOnlyCommands(t *testing.T) {
+	m, bot, api := newTestBot(t, config.TelegramConfig{})
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := m.GetUser("alice")
+
+	bot.handleMessage(42, "/add mallory secret1 30")
+	if !strings.Contains(api.last(42), "admins only") {
+		t.Fatalf("expected /add to be rejected, got %q", api.last(42))
+	}
+	if _, err := m.GetUser("mallory"); err == nil {
+		t.Fatal("non-admin /add created a user")
+	}
+
+	bot.handleMessage(42, "/renew alice 30")
+	if !strings.Contains(api.last(42), "admins only") {
+		t.Fatalf("expected /renew to be rejected, got %q", api.last(42))
+	}
+	if after, _ := m.GetUser("alice"); !after.ExpireDate.Equal(before.ExpireDate) {
+		t.Fatal("non-admin /renew extended the account")
+	}
+
+	bot.handleMessage(testAdminChat, "/add bobby secret1 30")
+	if _, err := m.GetUser("bobby"); err != nil {
+		t.Fatalf("admin /add failed: %v (%q)", err, api.last(testAdminChat))
+	}
+}
+
+func TestTelegramResolveUserOwnership(t *testing.T) {
+	m, bot, api := newTestBot(t, config.TelegramConfig{})
+	for _, name := range []string{"alice", "bobby"} {
+		if err := m.AddUser(name, "secret1", 30); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.updateUser("alice", func(u *User) { u.TelegramChatID = 42 })
+
+	if user, err := bot.resolveUser(42, nil); err != nil || user.Username != "alice" {
+		t.Fatalf("expected chat's own account, got %+v %v", user, err)
+	}
+	if _, err := bot.resolveUser(42, []string{"bobby"}); err != ErrUserNotFound {
+		t.Fatalf("expected other account to be hidden, got %v", err)
+	}
+	if _, err := bot.resolveUser(testAdminChat, []string{"bobby"}); err != nil {
+		t.Fatalf("admin lookup failed: %v", err)
+	}
+
+	bot.handleMessage(42, "/expiry bobby")
+	if !strings.Contains(api.last(42), ErrUserNotFound.Error()) {
+		t.Fatalf("expected not found reply, got %q", api.last(42))
+	}
+}
+
+func TestTelegramErrorsHideToken(t *testing.T) {
+	m := newTestManager(t)
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	bot := NewTelegramBot(m.VPSManager, config.TelegramConfig{Token: testBotToken, APIBaseURL: server.URL})
+	err := bot.sendMessage(42, "hello")
+	if err == nil {
+		t.Fatal("expected request to a closed server to fail")
+	}
+	if strings.Contains(err.Error(), testBotToken) {
+		t.Fatalf("error leaks the bot token: %v", err)
+	}
+}
+
+func TestTelegramPublicMessage(t *testing.T) {
+	_, bot, _ := newTestBot(t, config.TelegramConfig{})
+	internal := errStub
+
+	if got := bot.publicMessage(42, internal); strings.Contains(got, internal.Error()) {
+		t.Fatalf("customer sees internal error: %q", got)
+	}
+	if got := bot.publicMessage(testAdminChat, internal); got != internal.Error() {
+		t.Fatalf("admin should see the full error, got %q", got)
+	}
+	if got := bot.publicMessage(42, botErrorf("usage: /x")); got != "usage: /x" {
+		t.Fatalf("customer should see bot errors, got %q", got)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"./protocols"
+)
+
+// trafficCollectInterval is how often the daemon adds Xray's traffic
+// counters to the user database
+const trafficCollectInterval = 5 * time.Minute
+
+// TrafficReporter is implemented by managers that can report per-user
+// traffic counters
+type TrafficReporter interface {
+	UserTraffic(reset bool) (map[string]protocols.Traffic, error)
+}
+
+// TrafficUsage is the data a user has transferred through Xray on this
+// server since their account was created
+type TrafficUsage struct {
+	Uplink    int64     `json:"uplink"`
+	Downlink  int64     `json:"downlink"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CollectTraffic adds the traffic Xray counted since the last collection to
+// each user's usage. Xray's counters are reset once the usage is saved, so
+// usage keeps adding up across Xray restarts, and a failed save leaves the
+// counters for the next collection. Traffic of users that are no longer in
+// the database is dropped.
+func (vm *VPSManager) CollectTraffic() error {
+	reporter, ok := vm.XrayMgr.(TrafficReporter)
+	if !ok {
+		return nil
+	}
+
+	unlock, err := vm.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	traffic, err := reporter.UserTraffic(false)
+	if err != nil {
+		return err
+	}
+	if len(traffic) == 0 && len(vm.trafficCarry) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	for i := range vm.Users {
+		t, ok := traffic[vm.Users[i].Username]
+		carry, carried := vm.trafficCarry[vm.Users[i].Username]
+		if !ok && !carried {
+			continue
+		}
+		vm.Users[i].Traffic.Uplink += addCarry(t.Uplink, carry.Uplink)
+		vm.Users[i].Traffic.Downlink += addCarry(t.Downlink, carry.Downlink)
+		vm.Users[i].Traffic.UpdatedAt = now
+	}
+	if err := vm.saveToFile(); err != nil {
+		return err
+	}
+	vm.trafficCarry = nil
+
+	// Whatever was counted between the two reads is carried over. Counters
+	// lower than before mean Xray restarted in between and started again
+	// from zero.
+	reset, err := reporter.UserTraffic(true)
+	if err != nil {
+		// The counters still hold what was just saved, so it is carried as
+		// a negative baseline for the next collection to subtract
+		vm.trafficCarry = make(map[string]protocols.Traffic, len(traffic))
+		for username, t := range traffic {
+			vm.trafficCarry[username] = protocols.Traffic{Uplink: -t.Uplink, Downlink: -t.Downlink}
+		}
+		return fmt.Errorf("traffic saved but the counters were not reset: %v", err)
+	}
+	for username, r := range reset {
+		t := traffic[username]
+		if r.Uplink >= t.Uplink && r.Downlink >= t.Downlink {
+			r.Uplink -= t.Uplink
+			r.Downlink -= t.Downlink
+		}
+		if r.Uplink == 0 && r.Downlink == 0 {
+			continue
+		}
+		if vm.trafficCarry == nil {
+			vm.trafficCarry = make(map[string]protocols.Traffic)
+		}
+		vm.trafficCarry[username] = r
+	}
+	return nil
+}
+
+// addCarry adds carried-over traffic to a counter read. A negative carry is
+// a baseline already saved; a counter below it means Xray restarted since
+// and counted from zero, so the read is taken as it is.
+func addCarry(read, carry int64) int64 {
+	if read+carry < 0 {
+		return read
+	}
+	return read + carry
+}
+
+// formatBytes renders a byte count with a binary unit, as in "1.5 GiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"./protocols"
+)
+
+// countingXray reports the same traffic on every call and records whether
+// the counters were reset
+type countingXray struct {
+	stubXray
+	resets int
+}
+
+func (s *countingXray) UserTraffic(reset bool) (map[string]protocols.Traffic, error) {
+	if reset {
+		s.resets++
+	}
+	return map[string]protocols.Traffic{
+		"alice": {Uplink: 100, Downlink: 2000},
+		"gone_": {Uplink: 1, Downlink: 1},
+	}, nil
+}
+
+func TestCollectTrafficAccumulates(t *testing.T) {
+	m := newTestManager(t)
+	xray := &countingXray{}
+	m.XrayMgr = xray
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddUser("bobby", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := m.CollectTraffic(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if xray.resets != 2 {
+		t.Fatalf("expected counters to be reset on each collection, got %d", xray.resets)
+	}
+
+	alice, _ := m.GetUser("alice")
+	if alice.Traffic.Uplink != 200 || alice.Traffic.Downlink != 4000 || alice.Traffic.UpdatedAt.IsZero() {
+		t.Fatalf("unexpected traffic for alice: %+v", alice.Traffic)
+	}
+	if bobby, _ := m.GetUser("bobby"); bobby.Traffic.Uplink != 0 || !bobby.Traffic.UpdatedAt.IsZero() {
+		t.Fatalf("unexpected traffic for bobby: %+v", bobby.Traffic)
+	}
+}
+
+// growingXray counts 10 more bytes of uplink for alice before every read,
+// as if she kept using the connection, and zeroes the counter on reset
+type growingXray struct {
+	stubXray
+	uplink int64
+}
+
+func (s *growingXray) UserTraffic(reset bool) (map[string]protocols.Traffic, error) {
+	s.uplink += 10
+	traffic := map[string]protocols.Traffic{"alice": {Uplink: s.uplink}}
+	if reset {
+		s.uplink = 0
+	}
+	return traffic, nil
+}
+
+func TestCollectTrafficSurvivesFailedSave(t *testing.T) {
+	m := newTestManager(t)
+	m.XrayMgr = &growingXray{}
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.CollectTraffic(); err != nil {
+		t.Fatal(err)
+	}
+	// A directory in the way of the temporary file makes the save fail
+	blocker := m.Config.DbPath + ".tmp"
+	if err := os.Mkdir(blocker, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CollectTraffic(); err == nil {
+		t.Fatal("expected the save to fail")
+	}
+	os.Remove(blocker)
+	if err := m.CollectTraffic(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 10 from the first collection, 10 counted while it saved, and 20 the
+	// failed collection left on the counters
+	if alice, _ := m.GetUser("alice"); alice.Traffic.Uplink != 40 {
+		t.Fatalf("expected 40 bytes of uplink, got %d", alice.Traffic.Uplink)
+	}
+}
+
+// unresetXray is growingXray with resets that fail until allowed
+type unresetXray struct {
+	growingXray
+	allowReset bool
+}
+
+func (s *unresetXray) UserTraffic(reset bool) (map[string]protocols.Traffic, error) {
+	if reset && !s.allowReset {
+		return nil, errors.New("stats API unavailable")
+	}
+	return s.growingXray.UserTraffic(reset)
+}
+
+func TestCollectTrafficSurvivesFailedReset(t *testing.T) {
+	m := newTestManager(t)
+	xray := &unresetXray{}
+	m.XrayMgr = xray
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.CollectTraffic(); err == nil {
+		t.Fatal("expected the reset to fail")
+	}
+	xray.allowReset = true
+	if err := m.CollectTraffic(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The counters reach 10 on the first read and 20 on the second; what the
+	// first collection saved must not be counted again
+	if alice, _ := m.GetUser("alice"); alice.Traffic.Uplink != 20 {
+		t.Fatalf("expected 20 bytes of uplink, got %d", alice.Traffic.Uplink)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:             "0 B",
+		1023:          "1023 B",
+		1536:          "1.5 KiB",
+		5 << 30:       "5.0 GiB",
+		3 << 40:       "3.0 TiB",
+		1<<20 + 1<<19: "1.5 MiB",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"./config"
+	"./protocols"
+)
+
+// tunnelConfig returns the tunnel settings with defaults filled in
+func tunnelConfig(cfg *config.Config) config.TunnelConfig {
+	tunnel := cfg.Protocols.Tunnel
+	if tunnel.Listen == "" {
+		tunnel.Listen = "127.0.0.1:10000"
+	}
+	if tunnel.Target == "" {
+		tunnel.Target = "ssh"
+	}
+	return tunnel
+}
+
+// tunnelProxyAddr is the address nginx reaches the tunnel on
+func tunnelProxyAddr(cfg *config.Config) string {
+	listen := tunnelConfig(cfg).Listen
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// newTunnel creates the SSH over WebSocket tunnel configured in
+// config.json. Every connection is counted in the metrics and logged with
+// the bytes it carried when it closes.
+func (vm *VPSManager) newTunnel() (*protocols.TunnelServer, error) {
+	cfg := tunnelConfig(vm.Config)
+	var port int
+	switch cfg.Target {
+	case "ssh":
+		port = vm.Config.Protocols.SSH.Port
+		if port == 0 {
+			port = 22
+		}
+	case "dropbear":
+		port = vm.Config.Protocols.Dropbear.Port
+	default:
+		return nil, fmt.Errorf("%w: unknown tunnel target %q", ErrInvalidInput, cfg.Target)
+	}
+	if port == 0 {
+		return nil, fmt.Errorf("%w: tunnel target %s has no port configured", ErrInvalidInput, cfg.Target)
+	}
+
+	tunnel := protocols.NewTunnelServer(cfg.Listen, fmt.Sprintf("127.0.0.1:%d", port))
+	if cfg.Status != 0 {
+		tunnel.Status = cfg.Status
+	}
+	if cfg.Banner != "" {
+		tunnel.Banner = cfg.Banner
+	}
+	tunnel.OnOpen = vm.Metrics.TunnelOpened
+	tunnel.OnClose = func(c protocols.TunnelConn) {
+		vm.Metrics.TunnelClosed(c)
+		if c.Err != nil {
+			log.Printf("Tunnel connection from %s failed: %v", c.RemoteAddr, c.Err)
+			return
+		}
+		log.Printf("Tunnel %s connection from %s closed after %s: %s up, %s down", c.Mode, c.RemoteAddr,
+			c.Closed.Sub(c.Opened).Round(time.Second), formatBytes(c.Uplink), formatBytes(c.Downlink))
+	}
+	return tunnel, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"./protocols"
+)
+
+func TestNewTunnelTarget(t *testing.T) {
+	m := newTestManager(t)
+
+	tunnel, err := m.newTunnel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.Listen != "127.0.0.1:10000" || tunnel.Target != "127.0.0.1:22" || tunnel.Status != 101 {
+		t.Fatalf("unexpected defaults: %+v", tunnel)
+	}
+
+	// Dropbear has no default port to fall back on
+	m.Config.Protocols.Tunnel.Target = "dropbear"
+	if _, err := m.newTunnel(); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput without a Dropbear port, got %v", err)
+	}
+
+	m.Config.Protocols.Dropbear.Port = 2222
+	m.Config.Protocols.Tunnel.Status = 200
+	m.Config.Protocols.Tunnel.Banner = "Connected"
+	if tunnel, err = m.newTunnel(); err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.Target != "127.0.0.1:2222" || tunnel.Status != 200 || tunnel.Banner != "Connected" {
+		t.Fatalf("unexpected tunnel: %+v", tunnel)
+	}
+
+	m.Config.Protocols.Tunnel.Target = "telnet"
+	if _, err := m.newTunnel(); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput, got %v", err)
+	}
+}
+
+func TestTunnelProxyAddr(t *testing.T) {
+	m := newTestManager(t)
+	for listen, want := range map[string]string{
+		"":               "127.0.0.1:10000",
+		"0.0.0.0:8880":   "127.0.0.1:8880",
+		":8880":          "127.0.0.1:8880",
+		"10.0.0.5:10000": "10.0.0.5:10000",
+	} {
+		m.Config.Protocols.Tunnel.Listen = listen
+		if got := tunnelProxyAddr(m.Config); got != want {
+			t.Errorf("tunnelProxyAddr(%q) = %s, want %s", listen, got, want)
+		}
+	}
+}
+
+func TestTunnelMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.TunnelOpened(protocols.TunnelRaw)
+	metrics.TunnelOpened(protocols.TunnelWebSocket)
+	metrics.TunnelClosed(protocols.TunnelConn{Mode: protocols.TunnelRaw, Uplink: 100, Downlink: 2000})
+	metrics.TunnelClosed(protocols.TunnelConn{Err: errors.New("invalid request")})
+
+	var buf bytes.Buffer
+	metrics.writeCounters(&buf)
+	for _, want := range []string{
+		`vps_manager_tunnel_connections_total{mode="raw"} 1`,
+		`vps_manager_tunnel_connections_total{mode="websocket"} 1`,
+		`vps_manager_tunnel_connections_total{mode="failed"} 1`,
+		`vps_manager_tunnel_active_connections 1`,
+		`vps_manager_tunnel_bytes_total{direction="uplink"} 100`,
+		`vps_manager_tunnel_bytes_total{direction="downlink"} 2000`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
@@ -2,10 +2,19 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/mail"
 	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"./config"
@@ -13,25 +22,159 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+	ErrInvalidInput = errors.New("invalid input")
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{2,31}$`)
+
+var languagePattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]{2})?$`)
+
 type User struct {
-	Username   string    `json:"username"`
-	Password   string    `json:"password"`
-	ExpireDate time.Time `json:"expire_date"`
-	Protocols  []string  `json:"protocols"`
+	Username       string    `json:"username"`
+	Password       string    `json:"password"`
+	ExpireDate     time.Time `json:"expire_date"`
+	Protocols      []string  `json:"protocols"`
+	XrayUUID       string    `json:"xray_uuid,omitempty"`
+	Suspended      bool      `json:"suspended"`
+	TelegramChatID int64     `json:"telegram_chat_id,omitempty"`
+	Trial          bool      `json:"trial,omitempty"`
+	Owner          string    `json:"owner,omitempty"`
+	Contact
+	// ExpiryReminded is the expiry date a reminder email was last sent for
+	ExpiryReminded *time.Time `json:"expiry_reminded,omitempty"`
+	// Nodes records the account on each server it was created on
+	Nodes map[string]NodeState `json:"nodes,omitempty"`
+	// Traffic is the user's cumulative Xray usage on this server
+	Traffic TrafficUsage `json:"traffic"`
+	// XrayOutbound is the outbound profile the user's Xray traffic leaves
+	// through, or empty for the server's own connection
+	XrayOutbound string `json:"xray_outbound,omitempty"`
+}
+
+// Contact is how a customer is notified by email, and in which language
+type Contact struct {
+	Email    string `json:"email,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// ServiceStatus reports the systemd state of a service backing a protocol
+type ServiceStatus struct {
+	Protocol string `json:"protocol"`
+	Service  string `json:"service"`
+	Active   bool   `json:"active"`
+	State    string `json:"state"`
+}
+
+// protocolServices maps protocols to the systemd units that serve them
+var protocolServices = []struct {
+	Protocol string
+	Service  string
+}{
+	{"ssh", "ssh"},
+	{"xray", "xray"},
+	{"websocket", "nginx"},
+	{"http", "nginx"},
+	{"squid", "squid"},
+	{"dropbear", "dropbear"},
+}
+
+// suspendProtocols are the protocols SuspendUser and ResumeUser act on
+var suspendProtocols = []string{"ssh", "xray", "http", "squid", "udp"}
+
+// The Provisioner interfaces are the subset of each protocols manager that
+// VPSManager uses, so the managers can be replaced in tests
+type SSHProvisioner interface {
+	AddUser(username, password string) error
+	RemoveUser(username string) error
+	LockUser(username string) error
+	UnlockUser(username string) error
+	PasswordHash(username string) (string, error)
+	RestoreUser(username, passwordHash string) error
+}
+
+type XrayProvisioner interface {
+	AddUser(username string) (string, error)
+	AddUserWithID(username, uuid string) error
+	RemoveUser(username string) error
+	ShareLinks(username, host string) ([]string, error)
+	Inbounds() ([]protocols.XrayInbound, error)
+	AddInbound(spec protocols.InboundSpec, users map[string]string) error
+	UpdateInbound(spec protocols.InboundSpec) error
+	RemoveInbound(tag string) error
+	SyncInbounds(specs []protocols.InboundSpec, users map[string]string) ([]string, error)
+	ApplyRouting(policy protocols.RoutingPolicy) (bool, error)
+}
+
+// NginxProvisioner keeps the users' WebSocket and HTTP sites in the nginx
+// config
+type NginxProvisioner interface {
+	AddSite(site protocols.NginxSite, routes []protocols.WebSocketRoute) error
+	RemoveSite(username string, routes []protocols.WebSocketRoute) error
+	Apply(sites []protocols.NginxSite, routes []protocols.WebSocketRoute) (bool, error)
+}
+
+type CertProvisioner interface {
+	RemoveUser(username string) error
+	CertificateExpiry() (time.Time, error)
+}
+
+type HTTPProvisioner interface {
+	AddUser(username, password string) error
+	RemoveUser(username string) error
+	SuspendUser(username string) error
+	ResumeUser(username string) error
+}
+
+type PasswordProvisioner interface {
+	AddUser(username, password string) error
+	RemoveUser(username string) error
+	SuspendUser(username string) error
+	ResumeUser(username string) error
+}
+
+// UDPProvisioner can also recover a user's password, which the migration
+// bundle needs to recreate accounts elsewhere
+type UDPProvisioner interface {
+	AddUser(username, password string) error
+	RemoveUser(username string) error
+	SuspendUser(username string) error
+	ResumeUser(username string) error
+	Password(username string) (string, error)
+}
+
+type DropbearProvisioner interface {
+	AddUser(username, password string) error
+	RemoveUser(username string) error
 }
 
 type VPSManager struct {
-	Users        []User
-	Config       *config.Config
-	SSHMgr       *protocols.SSHManager
-	XrayMgr      *protocols.XrayManager
-	WebSocketMgr *protocols.WebSocketManager
-	SSLMgr       *protocols.SSLManager
-	HTTPMgr      *protocols.HTTPManager
-	SquidMgr     *protocols.SquidManager
-	UDPMgr       *protocols.UDPManager
-	DropbearMgr  *protocols.DropbearManager
-	LogFile      *os.File
+	mu          sync.Mutex
+	Users       []User
+	Config      *config.Config
+	ConfigPath  string
+	SSHMgr      SSHProvisioner
+	XrayMgr     XrayProvisioner
+	NginxMgr    NginxProvisioner
+	SSLMgr      CertProvisioner
+	HTTPMgr     HTTPProvisioner
+	SquidMgr    PasswordProvisioner
+	UDPMgr      UDPProvisioner
+	DropbearMgr DropbearProvisioner
+	Audit       *AuditLog
+	Webhooks    *WebhookDispatcher
+	Metrics     *Metrics
+	Notifier    *Notifier
+	Admins      *AdminStore
+	Events      *EventBus
+	// Nodes are the remote agents users can be provisioned on, by name
+	Nodes map[string]NodeClient
+	// trafficCarry is traffic Xray counted while CollectTraffic was saving,
+	// to be added on the next collection, or, negated, traffic already saved
+	// whose counters could not be reset
+	trafficCarry map[string]protocols.Traffic
 }
 
 func NewVPSManager(configPath string) (*VPSManager, error) {
@@ -44,127 +187,320 @@ func NewVPSManager(configPath string) (*VPSManager, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to open log file: %v", err)
 	}
+	// Diagnostics go to the log file as well as stderr; user and admin
+	// actions are recorded in the audit log
+	log.SetOutput(io.MultiWriter(os.Stderr, logFile))
+
+	metrics := NewMetrics()
+	protocols.CommandObserver = metrics.ObserveCommand
+
+	webSocket := protocols.NewWebSocketManager(
+		cfg.Protocols.WebSocket.Port,
+		cfg.Protocols.WebSocket.ConfigPath,
+		cfg.Protocols.SSL.CertPath,
+		cfg.Protocols.SSL.KeyPath,
+	)
+	webSocket.Domain = cfg.Domain
+	webSocket.TunnelAddr = tunnelProxyAddr(cfg)
+	xray := protocols.NewXrayManager(
+		cfg.Protocols.Xray.Port,
+		cfg.Protocols.Xray.ConfigPath,
+		cfg.Protocols.Xray.APIAddress,
+	)
+	xray.Front = webSocketFront(cfg)
+	if fallback := fallbackConfig(cfg); fallback.Enabled {
+		webSocket.Port = fallback.WebSocketPort
+		webSocket.BehindXray = true
+	}
+	http := protocols.NewHTTPManager(cfg.Protocols.HTTP.Port, cfg.Protocols.HTTP.ConfigPath)
 
-	return &VPSManager{
-		Users:   make([]User, 0),
-		Config:  cfg,
-		SSHMgr:  protocols.NewSSHManager(cfg.Protocols.SSH.Port),
-		XrayMgr: protocols.NewXrayManager(cfg.Protocols.Xray.Port, cfg.Protocols.Xray.ConfigPath),
-		WebSocketMgr: protocols.NewWebSocketManager(
-			cfg.Protocols.WebSocket.Port,
-			cfg.Protocols.WebSocket.ConfigPath,
-			cfg.Protocols.SSL.CertPath,
-			cfg.Protocols.SSL.KeyPath,
-		),
+	vm := &VPSManager{
+		Users:       make([]User, 0),
+		Config:      cfg,
+		ConfigPath:  configPath,
+		SSHMgr:      protocols.NewSSHManager(cfg.Protocols.SSH.Port),
+		XrayMgr:     xray,
+		NginxMgr:    protocols.NewNginxManager(webSocket, http),
 		SSLMgr:      protocols.NewSSLManager(cfg.Protocols.SSL.CertPath, cfg.Protocols.SSL.KeyPath),
-		HTTPMgr:     protocols.NewHTTPManager(cfg.Protocols.HTTP.Port, cfg.Protocols.HTTP.ConfigPath),
+		HTTPMgr:     http,
 		SquidMgr:    protocols.NewSquidManager(cfg.Protocols.Squid.Port, cfg.Protocols.Squid.PasswdFile),
 		UDPMgr:      protocols.NewUDPManager(cfg.Protocols.UDP.Port, cfg.Protocols.UDP.ConfigPath),
 		DropbearMgr: protocols.NewDropbearManager(cfg.Protocols.Dropbear.Port, cfg.Protocols.Dropbear.ConfigPath),
-		LogFile:     logFile,
-	}, nil
+		Audit:       NewAuditLog(cfg.AuditPath),
+		Webhooks:    NewWebhookDispatcher(cfg.Webhooks),
+		Metrics:     metrics,
+		Notifier:    NewNotifier(cfg.Email),
+		Admins:      NewAdminStore(cfg.AdminsPath),
+		Events:      NewEventBus(),
+	}
+
+	vm.Nodes, err = newRemoteNodes(cfg.Nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	vm.subscribeBuiltins()
+	return vm, nil
 }
 
 func (vm *VPSManager) AddUser(username, password string, expireDays int) error {
-	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return vm.addUserAs(auditSystem, username, password, expireDays, "", 0, Contact{}, nil)
+}
+
+// addUserAs creates a user on behalf of actor, owned by the named reseller
+// or by nobody, on the given nodes or the default ones. If maxOwned is set,
+// the owner may have no more than that many users; it is checked with the
+// store locked, so concurrent adds cannot overshoot it.
+func (vm *VPSManager) addUserAs(actor, username, password string, expireDays int, owner string, maxOwned int, contact Contact, nodes []string) error {
+	done := Event{Kind: UserAdded, Actor: actor, Username: username, Days: expireDays}
+	err := validateUser(username, password, expireDays)
+	if err == nil {
+		err = validateContact(contact)
+	}
+	if err == nil {
+		nodes, err = vm.resolveNodes(nodes)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to hash password: %v", err)
+		done.Err = err
+		vm.Events.Publish(done)
+		return err
 	}
 
-	// Add system user
-	if err := vm.SSHMgr.AddUser(username, password); err != nil {
+	unlock, err := vm.lockStore()
+	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	// Add to Xray
-	if err := vm.XrayMgr.AddUser(username); err != nil {
-		vm.SSHMgr.RemoveUser(username)
+	if vm.findUser(username) >= 0 {
+		done.Err = ErrUserExists
+		vm.Events.Publish(done)
+		return ErrUserExists
+	}
+	if maxOwned > 0 && vm.ownedUsers(owner) >= maxOwned {
+		done.Err = fmt.Errorf("%w: account limit of %d reached", ErrForbidden, maxOwned)
+		vm.Events.Publish(done)
+		return done.Err
+	}
+
+	err = vm.Events.Publish(Event{
+		Kind:     BeforeUserAdd,
+		Actor:    actor,
+		Username: username,
+		User:     &User{Username: username, ExpireDate: time.Now().AddDate(0, 0, expireDays), Owner: owner, Contact: contact},
+		Days:     expireDays,
+	})
+	if err != nil {
+		done.Err = err
+		vm.Events.Publish(done)
 		return err
 	}
 
-	// Setup WebSocket
-	domain := fmt.Sprintf("%s.%s", username, vm.Config.Domain)
-	if err := vm.WebSocketMgr.AddUser(username, domain); err != nil {
-		vm.SSHMgr.RemoveUser(username)
-		vm.XrayMgr.RemoveUser(username)
+	newUser, err := vm.provisionUser(username, password, expireDays, nodes)
+	if err != nil {
+		done.Kind = UserProvisionFailed
+		done.Protocols = newUser.Protocols
+		done.Err = err
+		vm.Events.Publish(done)
+		return err
+	}
+	newUser.Owner = owner
+	newUser.Contact = contact
+
+	vm.Users = append(vm.Users, newUser)
+	done.Protocols = newUser.Protocols
+	done.Details = fmt.Sprintf("expires %s", newUser.ExpireDate.Format(time.RFC3339))
+	if failed := failedNodes(newUser); len(failed) > 0 {
+		done.Details += fmt.Sprintf(", failed on %s", strings.Join(failed, ", "))
+	}
+	if err := vm.saveToFile(); err != nil {
+		done.Err = err
+		vm.Events.Publish(done)
 		return err
 	}
 
-	// Generate SSL certificate
-	if err := vm.SSLMgr.GenerateCertificate(domain); err != nil {
+	done.User = &newUser
+	vm.Events.Publish(done)
+	return nil
+}
+
+// ownedUsers counts the users owned by a reseller. The caller holds the
+// store lock.
+func (vm *VPSManager) ownedUsers(owner string) int {
+	n := 0
+	for _, user := range vm.Users {
+		if user.Owner == owner {
+			n++
+		}
+	}
+	return n
+}
+
+// provisionLocal creates the account on every protocol of this server,
+// rolling back on failure. The Xray client gets xrayUUID, or a new ID if it
+// is empty. On error the returned account lists the protocols that were
+// touched.
+func (vm *VPSManager) provisionLocal(username, password, xrayUUID string) (NodeAccount, error) {
+	var touched []string
+
+	// Add system user
+	touched = append(touched, "ssh")
+	err := vm.SSHMgr.AddUser(username, password)
+	vm.Metrics.Provisioned("ssh", err)
+	if err != nil {
+		return NodeAccount{Protocols: touched}, err
+	}
+
+	// Add to Xray
+	touched = append(touched, "xray")
+	if xrayUUID == "" {
+		xrayUUID, err = vm.XrayMgr.AddUser(username)
+	} else {
+		err = vm.XrayMgr.AddUserWithID(username, xrayUUID)
+	}
+	vm.Metrics.Provisioned("xray", err)
+	if err != nil {
+		vm.SSHMgr.RemoveUser(username)
+		return NodeAccount{Protocols: touched}, err
+	}
+
+	// Add the WebSocket and HTTP sites. They are served on the main domain
+	// with the server certificate, which SSL connections use as well.
+	touched = append(touched, "websocket")
+	routes, err := vm.webSocketRoutes()
+	if err == nil {
+		err = vm.NginxMgr.AddSite(protocols.NginxSite{Username: username}, routes)
+	}
+	vm.Metrics.Provisioned("websocket", err)
+	if err != nil {
 		vm.SSHMgr.RemoveUser(username)
 		vm.XrayMgr.RemoveUser(username)
-		return err
+		return NodeAccount{Protocols: touched}, err
 	}
 
 	// Add HTTP proxy
-	if err := vm.HTTPMgr.AddUser(username, password, domain); err != nil {
+	touched = append(touched, "http")
+	err = vm.HTTPMgr.AddUser(username, password)
+	vm.Metrics.Provisioned("http", err)
+	if err != nil {
 		vm.cleanup(username)
-		return err
+		return NodeAccount{Protocols: touched}, err
 	}
 
 	// Add Squid proxy
-	if err := vm.SquidMgr.AddUser(username, password); err != nil {
+	touched = append(touched, "squid")
+	err = vm.SquidMgr.AddUser(username, password)
+	vm.Metrics.Provisioned("squid", err)
+	if err != nil {
 		vm.cleanup(username)
-		return err
+		return NodeAccount{Protocols: touched}, err
 	}
 
 	// Add UDP configuration
-	if err := vm.UDPMgr.AddUser(username, password); err != nil {
+	touched = append(touched, "udp")
+	err = vm.UDPMgr.AddUser(username, password)
+	vm.Metrics.Provisioned("udp", err)
+	if err != nil {
 		vm.cleanup(username)
-		return err
+		return NodeAccount{Protocols: touched}, err
 	}
 
 	// Add Dropbear user
-	if err := vm.DropbearMgr.AddUser(username, password); err != nil {
+	touched = append(touched, "dropbear")
+	err = vm.DropbearMgr.AddUser(username, password)
+	vm.Metrics.Provisioned("dropbear", err)
+	if err != nil {
 		vm.cleanup(username)
-		return err
-	}
-
-	expireDate := time.Now().AddDate(0, 0, expireDays)
-	newUser := User{
-		Username:   username,
-		Password:   string(hashedPassword),
-		ExpireDate: expireDate,
-		Protocols:  []string{"ssh", "ssl", "websocket", "http", "squid", "xray", "udp", "dropbear"},
+		return NodeAccount{Protocols: touched}, err
 	}
 
-	vm.Users = append(vm.Users, newUser)
-	vm.logAction("AddUser", fmt.Sprintf("Added user %s with expiration %v", username, expireDate))
-	return vm.saveToFile()
+	return NodeAccount{
+		XrayUUID:  xrayUUID,
+		Protocols: []string{"ssh", "ssl", "websocket", "http", "squid", "xray", "udp", "dropbear"},
+	}, nil
 }
 
 func (vm *VPSManager) RemoveUser(username string) error {
+	return vm.removeUserAs(auditSystem, username)
+}
+
+func (vm *VPSManager) removeUserAs(actor, username string) error {
+	unlock, err := vm.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return vm.removeUser(actor, username)
+}
+
+func (vm *VPSManager) removeUser(actor, username string) error {
 	// Find user first
-	var found bool
-	for i, user := range vm.Users {
-		if user.Username == username {
-			vm.Users = append(vm.Users[:i], vm.Users[i+1:]...)
-			found = true
-			break
-		}
+	done := Event{Kind: UserRemoved, Actor: actor, Username: username}
+	i := vm.findUser(username)
+	if i < 0 {
+		done.Err = ErrUserNotFound
+		vm.Events.Publish(done)
+		return ErrUserNotFound
 	}
-	if !found {
-		return fmt.Errorf("user not found")
+	removed := vm.Users[i]
+	err := vm.Events.Publish(Event{Kind: BeforeUserRemove, Actor: actor, Username: username, User: &removed})
+	if err != nil {
+		done.Err = err
+		vm.Events.Publish(done)
+		return err
+	}
+
+	// Remove from every node the user is on. Until every node has removed
+	// the account, the user stays on record with the nodes left to retry.
+	errors := vm.removeFromNodes(&removed)
+	if len(removed.Nodes) == 0 {
+		vm.Users = append(vm.Users[:i], vm.Users[i+1:]...)
+	} else {
+		vm.Users[i] = removed
+	}
+
+	// Save changes to file
+	if err := vm.saveToFile(); err != nil {
+		errors = append(errors, fmt.Sprintf("Save to file: %v", err))
+	}
+
+	if len(errors) > 0 {
+		done.Err = fmt.Errorf("errors removing user: %v", errors)
 	}
+	done.User = &removed
+	done.Protocols = removed.Protocols
+	vm.Events.Publish(done)
 
-	// Remove from all protocols
+	// If there were any errors, return them all
+	return done.Err
+}
+
+// removeLocal deletes the account from every protocol of this server,
+// carrying on past failures so as much as possible is cleaned up. Xray goes
+// first: if its removal is rolled back, the client is still active and the
+// rest of the account is left alone too.
+func (vm *VPSManager) removeLocal(username string) error {
 	var errors []string
 
+	// Remove from Xray
+	if err := vm.XrayMgr.RemoveUser(username); rolledBack(err) {
+		return fmt.Errorf("Xray: %w", err)
+	} else if err != nil {
+		errors = append(errors, fmt.Sprintf("Xray: %v", err))
+	}
+
 	// Remove SSH user
 	if err := vm.SSHMgr.RemoveUser(username); err != nil {
 		errors = append(errors, fmt.Sprintf("SSH: %v", err))
 	}
 
-	// Remove from Xray
-	if err := vm.XrayMgr.RemoveUser(username); err != nil {
-		errors = append(errors, fmt.Sprintf("Xray: %v", err))
+	// Remove the WebSocket and HTTP sites
+	routes, err := vm.webSocketRoutes()
+	if err == nil {
+		err = vm.NginxMgr.RemoveSite(username, routes)
 	}
-
-	// Remove WebSocket configuration
-	if err := vm.WebSocketMgr.RemoveUser(username); err != nil {
-		errors = append(errors, fmt.Sprintf("WebSocket: %v", err))
+	if err != nil {
+		errors = append(errors, fmt.Sprintf("nginx: %v", err))
 	}
 
 	// Remove SSL certificates
@@ -191,56 +527,457 @@ func (vm *VPSManager) RemoveUser(username string) error {
 		errors = append(errors, fmt.Sprintf("Dropbear: %v", err))
 	}
 
-	// Save changes to file
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// rolledBack reports whether a protocol change failed and was undone,
+// leaving things as they were before it
+func rolledBack(err error) bool {
+	return errors.Is(err, protocols.ErrRolledBack)
+}
+
+// RenewUser extends a user's expiration by the given number of days, counting
+// from today if the account has already expired
+func (vm *VPSManager) RenewUser(username string, days int) (time.Time, error) {
+	return vm.renewUserAs(auditSystem, username, days)
+}
+
+func (vm *VPSManager) renewUserAs(actor, username string, days int) (time.Time, error) {
+	done := Event{Kind: UserRenewed, Actor: actor, Username: username, Days: days}
+	if days <= 0 || days > 3650 {
+		done.Err = fmt.Errorf("%w: days must be between 1 and 3650", ErrInvalidInput)
+		vm.Events.Publish(done)
+		return time.Time{}, done.Err
+	}
+
+	unlock, err := vm.lockStore()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer unlock()
+
+	i := vm.findUser(username)
+	if i < 0 {
+		done.Err = ErrUserNotFound
+		vm.Events.Publish(done)
+		return time.Time{}, ErrUserNotFound
+	}
+
+	current := vm.Users[i]
+	err = vm.Events.Publish(Event{Kind: BeforeUserRenew, Actor: actor, Username: username, User: &current, Days: days})
+	if err != nil {
+		done.Err = err
+		vm.Events.Publish(done)
+		return time.Time{}, err
+	}
+
+	base := vm.Users[i].ExpireDate
+	if now := time.Now(); base.Before(now) {
+		base = now
+	}
+	vm.Users[i].ExpireDate = base.AddDate(0, 0, days)
+
+	done.Details = fmt.Sprintf("%d days, expires %s", days, vm.Users[i].ExpireDate.Format(time.RFC3339))
 	if err := vm.saveToFile(); err != nil {
-		errors = append(errors, fmt.Sprintf("Save to file: %v", err))
+		done.Err = err
+		vm.Events.Publish(done)
+		return time.Time{}, err
 	}
 
-	vm.logAction("RemoveUser", fmt.Sprintf("Removed user %s", username))
+	renewed := vm.Users[i]
+	done.User = &renewed
+	vm.Events.Publish(done)
+	return renewed.ExpireDate, nil
+}
+
+// SuspendUser blocks access on every protocol without deleting the account.
+// Every step is idempotent, so a partially failed suspension can be retried;
+// the user is only marked suspended once all of them succeeded.
+func (vm *VPSManager) SuspendUser(username string) error {
+	return vm.suspendUserAs(auditSystem, username)
+}
+
+func (vm *VPSManager) suspendUserAs(actor, username string) error {
+	unlock, err := vm.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	done := Event{Kind: UserSuspended, Actor: actor, Username: username}
+	i := vm.findUser(username)
+	if i < 0 {
+		done.Err = ErrUserNotFound
+		vm.Events.Publish(done)
+		return ErrUserNotFound
+	}
+
+	current := vm.Users[i]
+	err = vm.Events.Publish(Event{Kind: BeforeUserSuspend, Actor: actor, Username: username, User: &current})
+	if err != nil {
+		done.Err = err
+		vm.Events.Publish(done)
+		return err
+	}
+	done.Protocols = suspendProtocols
+
+	errors := vm.suspendOnNodes(&vm.Users[i], true)
+	if len(errors) > 0 {
+		done.Err = fmt.Errorf("errors suspending user: %v", errors)
+		// Keep the per-node results; the user's state only changes once
+		// every node has succeeded
+		if err := vm.saveToFile(); err != nil {
+			log.Printf("Failed to save node status for %s: %v", username, err)
+		}
+		vm.Events.Publish(done)
+		return done.Err
+	}
+
+	vm.Users[i].Suspended = true
+	if err := vm.saveToFile(); err != nil {
+		done.Err = fmt.Errorf("failed to save users: %v", err)
+		vm.Events.Publish(done)
+		return done.Err
+	}
+
+	updated := vm.Users[i]
+	done.User = &updated
+	vm.Events.Publish(done)
+	return nil
+}
+
+// ResumeUser restores access for a suspended user. Like SuspendUser it can be
+// retried after a partial failure.
+func (vm *VPSManager) ResumeUser(username string) error {
+	return vm.resumeUserAs(auditSystem, username)
+}
+
+func (vm *VPSManager) resumeUserAs(actor, username string) error {
+	unlock, err := vm.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	done := Event{Kind: UserResumed, Actor: actor, Username: username}
+	i := vm.findUser(username)
+	if i < 0 {
+		done.Err = ErrUserNotFound
+		vm.Events.Publish(done)
+		return ErrUserNotFound
+	}
+
+	current := vm.Users[i]
+	err = vm.Events.Publish(Event{Kind: BeforeUserResume, Actor: actor, Username: username, User: &current})
+	if err != nil {
+		done.Err = err
+		vm.Events.Publish(done)
+		return err
+	}
+	done.Protocols = suspendProtocols
+
+	errors := vm.suspendOnNodes(&vm.Users[i], false)
+	if len(errors) > 0 {
+		done.Err = fmt.Errorf("errors resuming user: %v", errors)
+		// Keep the per-node results; the user's state only changes once
+		// every node has succeeded
+		if err := vm.saveToFile(); err != nil {
+			log.Printf("Failed to save node status for %s: %v", username, err)
+		}
+		vm.Events.Publish(done)
+		return done.Err
+	}
+
+	vm.Users[i].Suspended = false
+	if err := vm.saveToFile(); err != nil {
+		done.Err = fmt.Errorf("failed to save users: %v", err)
+		vm.Events.Publish(done)
+		return done.Err
+	}
+
+	updated := vm.Users[i]
+	done.User = &updated
+	vm.Events.Publish(done)
+	return nil
+}
+
+// suspendLocal blocks the account on every protocol of this server. Each
+// step is idempotent.
+func (vm *VPSManager) suspendLocal(username string) error {
+	var errors []string
+
+	if err := vm.SSHMgr.LockUser(username); err != nil {
+		errors = append(errors, fmt.Sprintf("SSH: %v", err))
+	}
+
+	if err := vm.XrayMgr.RemoveUser(username); err != nil {
+		errors = append(errors, fmt.Sprintf("Xray: %v", err))
+	}
+
+	if err := vm.HTTPMgr.SuspendUser(username); err != nil {
+		errors = append(errors, fmt.Sprintf("HTTP: %v", err))
+	}
+
+	if err := vm.SquidMgr.SuspendUser(username); err != nil {
+		errors = append(errors, fmt.Sprintf("Squid: %v", err))
+	}
+
+	if err := vm.UDPMgr.SuspendUser(username); err != nil {
+		errors = append(errors, fmt.Sprintf("UDP: %v", err))
+	}
 
-	// If there were any errors, return them all
 	if len(errors) > 0 {
-		return fmt.Errorf("errors removing user: %v", errors)
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// resumeLocal restores the account on every protocol of this server,
+// re-adding the Xray client with its original ID
+func (vm *VPSManager) resumeLocal(username, xrayUUID string) error {
+	var errors []string
+
+	if err := vm.SSHMgr.UnlockUser(username); err != nil {
+		errors = append(errors, fmt.Sprintf("SSH: %v", err))
+	}
+
+	if xrayUUID != "" {
+		if err := vm.XrayMgr.AddUserWithID(username, xrayUUID); err != nil {
+			errors = append(errors, fmt.Sprintf("Xray: %v", err))
+		}
+	}
+
+	if err := vm.HTTPMgr.ResumeUser(username); err != nil {
+		errors = append(errors, fmt.Sprintf("HTTP: %v", err))
+	}
+
+	if err := vm.SquidMgr.ResumeUser(username); err != nil {
+		errors = append(errors, fmt.Sprintf("Squid: %v", err))
 	}
 
+	if err := vm.UDPMgr.ResumeUser(username); err != nil {
+		errors = append(errors, fmt.Sprintf("UDP: %v", err))
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
 	return nil
 }
 
-func (vm *VPSManager) ListUsers() {
+// GetUser returns a copy of the named user
+func (vm *VPSManager) GetUser(username string) (User, error) {
+	unlock, err := vm.lockStore()
+	if err != nil {
+		return User{}, err
+	}
+	defer unlock()
+
+	i := vm.findUser(username)
+	if i < 0 {
+		return User{}, ErrUserNotFound
+	}
+	return vm.Users[i], nil
+}
+
+// GetUsers returns a copy of all users
+func (vm *VPSManager) GetUsers() ([]User, error) {
+	unlock, err := vm.lockStore()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	users := make([]User, len(vm.Users))
+	copy(users, vm.Users)
+	return users, nil
+}
+
+// ProtocolStatus queries systemd for the state of each protocol's service
+func (vm *VPSManager) ProtocolStatus() []ServiceStatus {
+	statuses := make([]ServiceStatus, 0, len(protocolServices))
+	for _, ps := range protocolServices {
+		out, _ := exec.Command("systemctl", "is-active", ps.Service).Output()
+		state := strings.TrimSpace(string(out))
+		if state == "" {
+			state = "unknown"
+		}
+		statuses = append(statuses, ServiceStatus{
+			Protocol: ps.Protocol,
+			Service:  ps.Service,
+			Active:   state == "active",
+			State:    state,
+		})
+	}
+	return statuses
+}
+
+// printUsers writes a table of users to stdout
+func printUsers(users []User) {
 	fmt.Println("Current Users:")
-	fmt.Printf("%-15s %-25s %-30s\n", "Username", "Expire Date", "Protocols")
-	fmt.Println("--------------------------------------------------------")
+	fmt.Printf("%-15s %-25s %-10s %-12s %-12s %-30s\n", "Username", "Expire Date", "Status", "Owner", "Traffic", "Protocols")
+	fmt.Println("-------------------------------------------------------------------------------")
 
-	for _, user := range vm.Users {
-		fmt.Printf("%-15s %-25s %-30v\n",
+	for _, user := range users {
+		status := "active"
+		if user.Suspended {
+			status = "suspended"
+		}
+		owner := user.Owner
+		if owner == "" {
+			owner = "-"
+		}
+		fmt.Printf("%-15s %-25s %-10s %-12s %-12s %-30v\n",
 			user.Username,
 			user.ExpireDate.Format("2006-01-02"),
+			status,
+			owner,
+			formatBytes(user.Traffic.Uplink+user.Traffic.Downlink),
 			user.Protocols)
 	}
 }
 
 func (vm *VPSManager) CheckExpiredUsers() {
+	unlock, err := vm.lockStore()
+	if err != nil {
+		fmt.Printf("Error checking expired users: %v\n", err)
+		return
+	}
+	defer unlock()
+
 	now := time.Now()
 	expired := make([]string, 0)
 
 	for _, user := range vm.Users {
 		if now.After(user.ExpireDate) {
 			expired = append(expired, user.Username)
+			user := user
+			vm.Events.Publish(Event{Kind: UserExpired, Actor: auditSystem, Username: user.Username, User: &user})
 		}
 	}
 
 	for _, username := range expired {
 		fmt.Printf("Removing expired user: %s\n", username)
-		vm.RemoveUser(username)
+		vm.removeUser(auditSystem, username)
+	}
+}
+
+// SetContact changes the email address and language a user is notified in
+func (vm *VPSManager) SetContact(username string, contact Contact) error {
+	return vm.setContactAs(auditSystem, username, contact)
+}
+
+func (vm *VPSManager) setContactAs(actor, username string, contact Contact) error {
+	err := validateContact(contact)
+	if err == nil {
+		err = vm.updateUser(username, func(u *User) { u.Contact = contact })
+	}
+	vm.audit(actor, "user.contact", username, nil, err, contact.Email)
+	return err
+}
+
+// updateUser applies fn to the named user and persists the result
+func (vm *VPSManager) updateUser(username string, fn func(*User)) error {
+	unlock, err := vm.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	i := vm.findUser(username)
+	if i < 0 {
+		return ErrUserNotFound
+	}
+	fn(&vm.Users[i])
+	return vm.saveToFile()
+}
+
+func (vm *VPSManager) findUser(username string) int {
+	for i, user := range vm.Users {
+		if user.Username == username {
+			return i
+		}
 	}
+	return -1
 }
 
+func validateUser(username, password string, expireDays int) error {
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("%w: username must be 3-32 lowercase letters, digits, '_' or '-'", ErrInvalidInput)
+	}
+	if len(password) < 6 {
+		return fmt.Errorf("%w: password must be at least 6 characters", ErrInvalidInput)
+	}
+	if strings.ContainsAny(password, "\r\n") {
+		return fmt.Errorf("%w: password must not contain newlines", ErrInvalidInput)
+	}
+	if expireDays <= 0 || expireDays > 3650 {
+		return fmt.Errorf("%w: expiration days must be between 1 and 3650", ErrInvalidInput)
+	}
+	return nil
+}
+
+// validateContact checks an optional email address and language code
+func validateContact(contact Contact) error {
+	if contact.Email != "" {
+		addr, err := mail.ParseAddress(contact.Email)
+		if err != nil || addr.Address != contact.Email {
+			return fmt.Errorf("%w: invalid email address", ErrInvalidInput)
+		}
+	}
+	if contact.Language != "" && !languagePattern.MatchString(contact.Language) {
+		return fmt.Errorf("%w: language must be a code such as en or pt-br", ErrInvalidInput)
+	}
+	return nil
+}
+
+// lockStore serializes access to the user database. The interactive menu and
+// the daemon are separate processes sharing users.json, so besides the
+// in-process mutex it takes an flock on a lock file and reloads the users, so
+// a change made by the other process is never overwritten.
+func (vm *VPSManager) lockStore() (func(), error) {
+	vm.mu.Lock()
+
+	lockFile, err := os.OpenFile(vm.Config.DbPath+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		vm.mu.Unlock()
+		return nil, fmt.Errorf("failed to open database lock: %v", err)
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		lockFile.Close()
+		vm.mu.Unlock()
+		return nil, fmt.Errorf("failed to lock database: %v", err)
+	}
+
+	unlock := func() {
+		syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		lockFile.Close()
+		vm.mu.Unlock()
+	}
+
+	if err := vm.loadFromFile(); err != nil {
+		unlock()
+		return nil, fmt.Errorf("failed to load users: %v", err)
+	}
+	return unlock, nil
+}
+
+// saveToFile writes the users atomically so a crash never leaves a
+// truncated database behind
 func (vm *VPSManager) saveToFile() error {
 	data, err := json.MarshalIndent(vm.Users, "", "    ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(vm.Config.DbPath, data, 0644)
+
+	tmp := vm.Config.DbPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, vm.Config.DbPath)
 }
 
 func (vm *VPSManager) loadFromFile() error {
@@ -252,19 +989,20 @@ func (vm *VPSManager) loadFromFile() error {
 		return err
 	}
 
-	return json.Unmarshal(data, &vm.Users)
-}
-
-func (vm *VPSManager) logAction(action, message string) {
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	logEntry := fmt.Sprintf("[%s] %s: %s\n", timestamp, action, message)
-	vm.LogFile.WriteString(logEntry)
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return err
+	}
+	vm.Users = users
+	return nil
 }
 
 func (vm *VPSManager) cleanup(username string) {
 	vm.SSHMgr.RemoveUser(username)
 	vm.XrayMgr.RemoveUser(username)
-	vm.WebSocketMgr.RemoveUser(username)
+	if routes, err := vm.webSocketRoutes(); err == nil {
+		vm.NginxMgr.RemoveSite(username, routes)
+	}
 	vm.SSLMgr.RemoveUser(username)
 	vm.HTTPMgr.RemoveUser(username)
 	vm.SquidMgr.RemoveUser(username)
@@ -273,6 +1011,19 @@ func (vm *VPSManager) cleanup(username string) {
 }
 
 func main() {
+	// hash-password runs before the config is loaded so install.sh can use it
+	// to generate the dashboard credentials
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		fmt.Fprint(os.Stderr, "Enter password: ")
+		password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(password, "\r\n")), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatalf("Failed to hash password: %v", err)
+		}
+		fmt.Println(string(hash))
+		return
+	}
+
 	manager, err := NewVPSManager("config.json")
 	if err != nil {
 		log.Fatalf("Failed to initialize VPS manager: %v", err)
@@ -282,7 +1033,79 @@ func main() {
 		return
 	}
 
+	actor, err := manager.ConsoleActor()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "daemon":
+			if err := actor.require(RoleOwner); err != nil {
+				log.Fatalf("%v", err)
+			}
+			if err := runDaemon(manager); err != nil {
+				log.Fatalf("Daemon failed: %v", err)
+			}
+		case "agent":
+			if err := actor.require(RoleOwner); err != nil {
+				log.Fatalf("%v", err)
+			}
+			if err := runAgent(manager); err != nil {
+				log.Fatalf("Agent failed: %v", err)
+			}
+		case "nodes":
+			if err := actor.require(RoleOwner); err != nil {
+				log.Fatalf("%v", err)
+			}
+			printNodeStatus(manager.NodeStatus())
+		case "admin":
+			if err := runAdminCommand(manager, actor, os.Args[2:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		case "audit":
+			if err := runAuditCommand(manager, actor, os.Args[2:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		case "backup":
+			if err := runBackupCommand(manager, actor, os.Args[2:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		case "restore":
+			if err := runRestoreCommand(manager, actor, os.Args[2:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		case "export":
+			if err := runExportCommand(manager, actor, os.Args[2:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		case "import":
+			if err := runImportCommand(manager, actor, os.Args[2:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		case "xray":
+			if err := runXrayCommand(manager, actor, os.Args[2:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		default:
+			fmt.Printf("Unknown command: %s\n", os.Args[1])
+			os.Exit(2)
+		}
+		waitForEvents(manager)
+		return
+	}
+
 	reader := bufio.NewReader(os.Stdin)
+	if !actor.isOwner() {
+		fmt.Printf("Signed in as %s (%s), %d credits\n", actor.Admin.Name, actor.Admin.Role, actor.Admin.Credits)
+	}
 
 	for {
 		fmt.Println("\n=== VPS Management System ===")
@@ -290,7 +1113,10 @@ func main() {
 		fmt.Println("2. Remove User")
 		fmt.Println("3. List Users")
 		fmt.Println("4. Check Expired Users")
-		fmt.Println("5. Exit")
+		fmt.Println("5. Renew User")
+		fmt.Println("6. Suspend User")
+		fmt.Println("7. Resume User")
+		fmt.Println("8. Exit")
 		fmt.Print("Choose an option: ")
 
 		var choice int
@@ -306,11 +1132,22 @@ func main() {
 			password, _ := reader.ReadString('\n')
 			password = password[:len(password)-1]
 
-			fmt.Print("Enter expiration days: ")
-			var days int
-			fmt.Scanf("%d", &days)
+			plan, days := promptPlan(reader, actor, "Enter expiration days: ")
+
+			fmt.Print("Enter email (optional): ")
+			email, _ := reader.ReadString('\n')
 
-			if err := manager.AddUser(username, password, days); err != nil {
+			var nodes []string
+			if len(manager.Nodes) > 0 {
+				fmt.Print("Enter nodes, comma separated (empty for default): ")
+				line, _ := reader.ReadString('\n')
+				if line = strings.TrimSpace(line); line != "" {
+					nodes = strings.Split(line, ",")
+				}
+			}
+
+			contact := Contact{Email: strings.TrimSpace(email)}
+			if err := actor.AddUser(username, password, plan, days, contact, nodes); err != nil {
 				fmt.Printf("Error adding user: %v\n", err)
 			} else {
 				fmt.Println("User added successfully")
@@ -321,20 +1158,63 @@ func main() {
 			username, _ := reader.ReadString('\n')
 			username = username[:len(username)-1]
 
-			if err := manager.RemoveUser(username); err != nil {
+			if err := actor.RemoveUser(username); err != nil {
 				fmt.Printf("Error removing user: %v\n", err)
 			} else {
 				fmt.Println("User removed successfully")
 			}
 
 		case 3:
-			manager.ListUsers()
+			users, err := actor.Users()
+			if err != nil {
+				fmt.Printf("Error loading users: %v\n", err)
+			} else {
+				printUsers(users)
+			}
 
 		case 4:
-			manager.CheckExpiredUsers()
+			if err := actor.CheckExpiredUsers(); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
 
 		case 5:
+			fmt.Print("Enter username to renew: ")
+			username, _ := reader.ReadString('\n')
+			username = username[:len(username)-1]
+
+			plan, days := promptPlan(reader, actor, "Enter days to add: ")
+
+			if expireDate, err := actor.RenewUser(username, plan, days); err != nil {
+				fmt.Printf("Error renewing user: %v\n", err)
+			} else {
+				fmt.Printf("User renewed until %s\n", expireDate.Format("2006-01-02"))
+			}
+
+		case 6:
+			fmt.Print("Enter username to suspend: ")
+			username, _ := reader.ReadString('\n')
+			username = username[:len(username)-1]
+
+			if err := actor.SuspendUser(username); err != nil {
+				fmt.Printf("Error suspending user: %v\n", err)
+			} else {
+				fmt.Println("User suspended successfully")
+			}
+
+		case 7:
+			fmt.Print("Enter username to resume: ")
+			username, _ := reader.ReadString('\n')
+			username = username[:len(username)-1]
+
+			if err := actor.ResumeUser(username); err != nil {
+				fmt.Printf("Error resuming user: %v\n", err)
+			} else {
+				fmt.Println("User resumed successfully")
+			}
+
+		case 8:
 			fmt.Println("Goodbye!")
+			waitForEvents(manager)
 			return
 
 		default:
@@ -342,3 +1222,39 @@ func main() {
 		}
 	}
 }
+
+// waitForEvents gives background event subscribers, such as emails about
+// the changes just made, a chance to finish before the process exits
+func waitForEvents(manager *VPSManager) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := manager.Events.Shutdown(ctx); err != nil {
+		log.Printf("Gave up waiting for event subscribers: %v", err)
+	}
+}
+
+// promptPlan asks for a plan when plans are configured, falling back to a
+// number of days for owners who leave it empty
+func promptPlan(reader *bufio.Reader, actor *Actor, daysPrompt string) (string, int) {
+	if len(actor.vm.Config.Plans) > 0 {
+		names := make([]string, 0, len(actor.vm.Config.Plans))
+		for _, plan := range actor.vm.Config.Plans {
+			names = append(names, fmt.Sprintf("%s (%d days, %d credits)", plan.Name, plan.Days, plan.Price))
+		}
+		fmt.Printf("Plans: %s\n", strings.Join(names, ", "))
+		fmt.Print("Enter plan")
+		if actor.isOwner() {
+			fmt.Print(" (empty to enter days)")
+		}
+		fmt.Print(": ")
+		plan, _ := reader.ReadString('\n')
+		if plan = strings.TrimSpace(plan); plan != "" || !actor.isOwner() {
+			return plan, 0
+		}
+	}
+
+	fmt.Print(daysPrompt)
+	var days int
+	fmt.Scanf("%d", &days)
+	return "", days
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"./config"
+	"./protocols"
+)
+
+// stubAccounts stands in for the SSH, Dropbear, SSL, HTTP, Squid and UDP
+// managers. Methods listed in fail return errStub.
+type stubAccounts struct {
+	fail  map[string]bool
+	calls []string
+}
+
+var errStub = errors.New("stub failure")
+
+func (s *stubAccounts) call(name string) error {
+	s.calls = append(s.calls, name)
+	if s.fail[name] {
+		return errStub
+	}
+	return nil
+}
+
+func (s *stubAccounts) AddUser(username, password string) error { return s.call("AddUser") }
+func (s *stubAccounts) RemoveUser(username string) error        { return s.call("RemoveUser") }
+func (s *stubAccounts) LockUser(username string) error          { return s.call("LockUser") }
+func (s *stubAccounts) UnlockUser(username string) error        { return s.call("UnlockUser") }
+func (s *stubAccounts) SuspendUser(username string) error       { return s.call("SuspendUser") }
+func (s *stubAccounts) ResumeUser(username string) error        { return s.call("ResumeUser") }
+func (s *stubAccounts) PasswordHash(username string) (string, error) {
+	return "$6$stub$" + username, s.call("PasswordHash")
+}
+func (s *stubAccounts) RestoreUser(username, passwordHash string) error {
+	return s.call("RestoreUser")
+}
+func (s *stubAccounts) Password(username string) (string, error) {
+	return "secret1", s.call("Password")
+}
+func (s *stubAccounts) CertificateExpiry() (time.Time, error) {
+	return time.Unix(1900000000, 0), s.call("CertificateExpiry")
+}
+
+// stubNginx keeps the sites and routes it is given
+type stubNginx struct {
+	stubAccounts
+	sites  []protocols.NginxSite
+	routes []protocols.WebSocketRoute
+}
+
+func (s *stubNginx) AddSite(site protocols.NginxSite, routes []protocols.WebSocketRoute) error {
+	if err := s.call("AddSite"); err != nil {
+		return err
+	}
+	s.sites = append(s.sites, site)
+	s.routes = routes
+	return nil
+}
+func (s *stubNginx) RemoveSite(username string, routes []protocols.WebSocketRoute) error {
+	if err := s.call("RemoveSite"); err != nil {
+		return err
+	}
+	kept := s.sites[:0]
+	for _, site := range s.sites {
+		if site.Username != username {
+			kept = append(kept, site)
+		}
+	}
+	s.sites = kept
+	s.routes = routes
+	return nil
+}
+func (s *stubNginx) Apply(sites []protocols.NginxSite, routes []protocols.WebSocketRoute) (bool, error) {
+	if err := s.call("Apply"); err != nil {
+		return false, err
+	}
+	s.sites = sites
+	s.routes = routes
+	return true, nil
+}
+
+// stubXray records the inbound specs and routing policies it is given and
+// the users attached. RemoveUser returns removeErr if set, and Inbounds
+// returns inbounds.
+type stubXray struct {
+	stubAccounts
+	inbounds  []protocols.XrayInbound
+	specs     []protocols.InboundSpec
+	attached  []map[string]string
+	routing   []protocols.RoutingPolicy
+	removeErr error
+}
+
+func (s *stubXray) RemoveUser(username string) error {
+	if err := s.call("RemoveUser"); err != nil {
+		return err
+	}
+	return s.removeErr
+}
+
+func (s *stubXray) AddUser(username string) (string, error) {
+	return "00000000-0000-0000-0000-000000000001", s.call("AddUser")
+}
+func (s *stubXray) AddUserWithID(username, uuid string) error { return s.call("AddUserWithID") }
+
+// Inbounds is a read, so it is not recorded among the calls
+func (s *stubXray) Inbounds() ([]protocols.XrayInbound, error) {
+	if s.fail["Inbounds"] {
+		return nil, errStub
+	}
+	return s.inbounds, nil
+}
+func (s *stubXray) AddInbound(spec protocols.InboundSpec, users map[string]string) error {
+	s.specs = append(s.specs, spec)
+	s.attached = append(s.attached, users)
+	return s.call("AddInbound")
+}
+func (s *stubXray) UpdateInbound(spec protocols.InboundSpec) error {
+	s.specs = append(s.specs, spec)
+	return s.call("UpdateInbound")
+}
+func (s *stubXray) RemoveInbound(tag string) error { return s.call("RemoveInbound") }
+func (s *stubXray) SyncInbounds(specs []protocols.InboundSpec, users map[string]string) ([]string, error) {
+	s.specs = append(s.specs, specs...)
+	s.attached = append(s.attached, users)
+	return nil, s.call("SyncInbounds")
+}
+func (s *stubXray) ApplyRouting(policy protocols.RoutingPolicy) (bool, error) {
+	s.routing = append(s.routing, policy)
+	return true, s.call("ApplyRouting")
+}
+func (s *stubXray) ShareLinks(username, host string) ([]string, error) {
+	return []string{"vless://" + username + "@" + host}, s.call("ShareLinks")
+}
+
+// testManager bundles a VPSManager with the stubs it was built from
+type testManager struct {
+	*VPSManager
+	ssh   *stubAccounts
+	xray  *stubXray
+	nginx *stubNginx
+}
+
+func newTestManager(t *testing.T) *testManager {
+	t.Helper()
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Domain:    "example.com",
+		AuditPath: filepath.Join(dir, "audit.log"),
+		DbPath:    filepath.Join(dir, "users.json"),
+		Plans: []config.PlanConfig{
+			{Name: "monthly", Days: 30, Price: 10},
+			{Name: "weekly", Days: 7, Price: 3},
+		},
+	}
+
+	ssh := &stubAccounts{fail: map[string]bool{}}
+	xray := &stubXray{stubAccounts: stubAccounts{fail: map[string]bool{}}}
+	nginx := &stubNginx{stubAccounts: stubAccounts{fail: map[string]bool{}}}
+	vm := &VPSManager{
+		Users:       make([]User, 0),
+		Config:      cfg,
+		SSHMgr:      ssh,
+		XrayMgr:     xray,
+		NginxMgr:    nginx,
+		SSLMgr:      &stubAccounts{},
+		HTTPMgr:     &stubAccounts{},
+		SquidMgr:    &stubAccounts{},
+		UDPMgr:      &stubAccounts{},
+		DropbearMgr: &stubAccounts{},
+		Audit:       NewAuditLog(cfg.AuditPath),
+		Webhooks:    NewWebhookDispatcher(config.WebhooksConfig{}),
+		Admins:      NewAdminStore(filepath.Join(dir, "admins.json")),
+		Events:      NewEventBus(),
+	}
+	vm.subscribeBuiltins()
+	return &testManager{VPSManager: vm, ssh: ssh, xray: xray, nginx: nginx}
+}
+
+func TestValidateUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		days     int
+		ok       bool
+	}{
+		{"valid", "alice", "secret1", 30, true},
+		{"underscore and dash", "_a-b_c", "secret1", 1, true},
+		{"too short", "al", "secret1", 30, false},
+		{"too long", strings.Repeat("a", 33), "secret1", 30, false},
+		{"uppercase", "Alice", "secret1", 30, false},
+		{"leading digit", "1alice", "secret1", 30, false},
+		{"shell metachar", "al;ce", "secret1", 30, false},
+		{"short password", "alice", "12345", 30, false},
+		{"newline in password", "alice", "secret\n1", 30, false},
+		{"zero days", "alice", "secret1", 0, false},
+		{"too many days", "alice", "secret1", 3651, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateUser(tt.username, tt.password, tt.days)
+			if tt.ok && err != nil {
+				t.Fatalf("expected valid, got %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidInput) {
+				t.Fatalf("expected ErrInvalidInput, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAddUserRejectsDuplicate(t *testing.T) {
+	m := newTestManager(t)
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddUser("alice", "secret1", 30); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("expected ErrUserExists, got %v", err)
+	}
+}
+
+func TestSuspendFailureIsRetryable(t *testing.T) {
+	m := newTestManager(t)
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	m.ssh.fail["LockUser"] = true
+	if err := m.SuspendUser("alice"); err == nil {
+		t.Fatal("expected suspend to fail")
+	}
+	if user, _ := m.GetUser("alice"); user.Suspended {
+		t.Fatal("user marked suspended after failed suspension")
+	}
+
+	m.ssh.fail["LockUser"] = false
+	if err := m.SuspendUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := m.GetUser("alice"); !user.Suspended {
+		t.Fatal("user not marked suspended after retry")
+	}
+}
+
+func TestRolledBackRemovalKeepsUser(t *testing.T) {
+	m := newTestManager(t)
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	m.xray.removeErr = fmt.Errorf("%w: xray is not running after restart", protocols.ErrRolledBack)
+	if err := m.RemoveUser("alice"); err == nil {
+		t.Fatal("expected the removal to fail")
+	}
+	if _, err := m.GetUser("alice"); err != nil {
+		t.Fatalf("user dropped after a rolled back removal: %v", err)
+	}
+	for _, call := range m.ssh.calls {
+		if call == "RemoveUser" {
+			t.Fatal("SSH account removed although Xray kept the client")
+		}
+	}
+
+	m.xray.removeErr = nil
+	if err := m.RemoveUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetUser("alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestStoreReloadsChangesFromOtherProcess(t *testing.T) {
+	m := newTestManager(t)
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second manager on the same database stands in for the other process
+	other := newTestManager(t)
+	other.Config = m.Config
+	if err := other.AddUser("bobby", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.RenewUser("alice", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := other.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected both users to survive, got %+v", users)
+	}
+	for _, user := range users {
+		if user.Username == "alice" && user.ExpireDate.Before(time.Now().AddDate(0, 0, 34)) {
+			t.Fatalf("renewal lost: %v", user.ExpireDate)
+		}
+	}
+}
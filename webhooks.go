@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"./config"
+)
+
+// User lifecycle events delivered to webhooks
+const (
+	EventUserCreated            = "user.created"
+	EventUserRenewed            = "user.renewed"
+	EventUserSuspended          = "user.suspended"
+	EventUserResumed            = "user.resumed"
+	EventUserExpired            = "user.expired"
+	EventUserRemoved            = "user.removed"
+	EventUserProvisioningFailed = "user.provisioning_failed"
+)
+
+const (
+	webhookDefaultOutbox      = "/etc/vps_manager/outbox"
+	webhookDefaultMaxAttempts = 10
+	webhookPollInterval       = 5 * time.Second
+	webhookMaxBackoff         = time.Hour
+)
+
+// webhookUserData is the "data" object of a user event payload
+type webhookUserData struct {
+	Username   string     `json:"username"`
+	ExpireDate *time.Time `json:"expire_date,omitempty"`
+	Suspended  bool       `json:"suspended"`
+	Protocols  []string   `json:"protocols,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// webhookPayload is the JSON body POSTed to an endpoint
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookDelivery is one pending POST, stored as a file in its endpoint's
+// outbox so it survives restarts until it succeeds or runs out of attempts.
+// The secret is kept with the delivery so it is signed with the key that
+// was configured when the event happened.
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Secret      string          `json:"secret,omitempty"`
+	Event       string          `json:"event"`
+	Body        json.RawMessage `json:"body"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// WebhookDispatcher queues lifecycle events and delivers them with retries.
+// Every process may enqueue; only the one that called Start delivers, with
+// one worker per endpoint so a dead endpoint does not hold up the others.
+type WebhookDispatcher struct {
+	cfg    config.WebhooksConfig
+	client *http.Client
+	wake   map[string]chan struct{}
+
+	lock *os.File
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewWebhookDispatcher creates a dispatcher for the configured endpoints
+func NewWebhookDispatcher(cfg config.WebhooksConfig) *WebhookDispatcher {
+	if cfg.OutboxDir == "" {
+		cfg.OutboxDir = webhookDefaultOutbox
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = webhookDefaultMaxAttempts
+	}
+
+	wake := make(map[string]chan struct{})
+	for _, endpoint := range cfg.Endpoints {
+		wake[webhookQueue(endpoint.URL)] = make(chan struct{}, 1)
+	}
+
+	return &WebhookDispatcher{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 15 * time.Second},
+		wake:   wake,
+		stop:   make(chan struct{}),
+	}
+}
+
+func newWebhookUserData(user User) webhookUserData {
+	expireDate := user.ExpireDate
+	return webhookUserData{
+		Username:   user.Username,
+		ExpireDate: &expireDate,
+		Suspended:  user.Suspended,
+		Protocols:  user.Protocols,
+	}
+}
+
+// webhookEvents maps bus events to the webhook events they are delivered as
+var webhookEvents = map[EventKind]string{
+	UserAdded:           EventUserCreated,
+	UserProvisionFailed: EventUserProvisioningFailed,
+	UserRemoved:         EventUserRemoved,
+	UserRenewed:         EventUserRenewed,
+	UserSuspended:       EventUserSuspended,
+	UserResumed:         EventUserResumed,
+	UserExpired:         EventUserExpired,
+}
+
+// HandleEvent queues a webhook for a finished user operation. Operations
+// that failed without changing the account are not delivered, except for
+// provisioning failures, which have an event of their own.
+func (d *WebhookDispatcher) HandleEvent(ev Event) error {
+	event, ok := webhookEvents[ev.Kind]
+	if !ok {
+		return nil
+	}
+
+	if ev.Kind == UserProvisionFailed {
+		data := webhookUserData{Username: ev.Username}
+		if ev.Err != nil {
+			data.Error = ev.Err.Error()
+		}
+		d.Enqueue(event, data)
+		return nil
+	}
+	if ev.User == nil {
+		return nil
+	}
+
+	data := newWebhookUserData(*ev.User)
+	if ev.Err != nil {
+		data.Error = ev.Err.Error()
+	}
+	d.Enqueue(event, data)
+	return nil
+}
+
+// Start delivers queued events in the background, including any left in the
+// outbox by a previous run. An flock on the outbox keeps a second daemon
+// from delivering the same entries.
+func (d *WebhookDispatcher) Start() error {
+	if len(d.cfg.Endpoints) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(d.cfg.OutboxDir, 0700); err != nil {
+		return fmt.Errorf("failed to create webhook outbox: %v", err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(d.cfg.OutboxDir, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open webhook outbox lock: %v", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		return fmt.Errorf("webhook outbox is in use by another process: %v", err)
+	}
+	d.lock = lock
+
+	for queue, wake := range d.wake {
+		d.wg.Add(1)
+		go d.worker(queue, wake)
+	}
+	return nil
+}
+
+// Shutdown stops the workers after their current delivery
+func (d *WebhookDispatcher) Shutdown(ctx context.Context) error {
+	if d.lock == nil {
+		return nil
+	}
+	close(d.stop)
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	syscall.Flock(int(d.lock.Fd()), syscall.LOCK_UN)
+	return d.lock.Close()
+}
+
+func (d *WebhookDispatcher) worker(queue string, wake chan struct{}) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		d.deliverDue(queue)
+		select {
+		case <-ticker.C:
+		case <-wake:
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// Enqueue records an event for every endpoint subscribed to it
+func (d *WebhookDispatcher) Enqueue(event string, data interface{}) {
+	if d == nil || len(d.cfg.Endpoints) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, endpoint := range d.cfg.Endpoints {
+		if !subscribed(endpoint.Events, event) {
+			continue
+		}
+
+		id, err := randomToken()
+		if err != nil {
+			log.Printf("Failed to queue webhook %s: %v", event, err)
+			continue
+		}
+		id = id[:24]
+
+		body, err := json.Marshal(webhookPayload{ID: id, Event: event, Timestamp: now, Data: data})
+		if err != nil {
+			log.Printf("Failed to encode webhook %s: %v", event, err)
+			continue
+		}
+
+		delivery := &webhookDelivery{
+			ID:          id,
+			URL:         endpoint.URL,
+			Secret:      endpoint.Secret,
+			Event:       event,
+			Body:        body,
+			CreatedAt:   now,
+			NextAttempt: now,
+		}
+		if err := d.store(delivery); err != nil {
+			log.Printf("Failed to queue webhook %s: %v", event, err)
+			continue
+		}
+
+		select {
+		case d.wake[webhookQueue(endpoint.URL)] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deliverDue attempts every delivery in a queue whose retry time has come.
+// Entries are sent in order; a failure leaves later entries for the next
+// pass so one endpoint's events are not reordered.
+func (d *WebhookDispatcher) deliverDue(queue string) {
+	files, err := filepath.Glob(filepath.Join(d.cfg.OutboxDir, queue, "*.json"))
+	if err != nil {
+		log.Printf("Failed to read webhook outbox: %v", err)
+		return
+	}
+	sort.Strings(files)
+
+	now := time.Now()
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var delivery webhookDelivery
+		if err := json.Unmarshal(data, &delivery); err != nil {
+			log.Printf("Dropping corrupt webhook outbox entry %s: %v", file, err)
+			os.Remove(file)
+			continue
+		}
+		if delivery.NextAttempt.After(now) {
+			return
+		}
+
+		err = d.send(&delivery)
+		if err == nil {
+			os.Remove(file)
+			continue
+		}
+
+		delivery.Attempts++
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= d.cfg.MaxAttempts {
+			log.Printf("Giving up on webhook %s (%s) to %s after %d attempts: %v",
+				delivery.ID, delivery.Event, delivery.URL, delivery.Attempts, err)
+			os.Remove(file)
+			continue
+		}
+
+		delivery.NextAttempt = now.Add(webhookBackoff(delivery.Attempts))
+		if err := d.store(&delivery); err != nil {
+			log.Printf("Failed to update webhook outbox: %v", err)
+		}
+		return
+	}
+}
+
+// send POSTs a delivery with its HMAC signature
+func (d *WebhookDispatcher) send(delivery *webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "vps_manager-webhooks")
+	req.Header.Set("X-VPS-Event", delivery.Event)
+	req.Header.Set("X-VPS-Delivery", delivery.ID)
+	if delivery.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(delivery.Secret))
+		mac.Write(delivery.Body)
+		req.Header.Set("X-VPS-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// store writes a delivery to the outbox atomically
+func (d *WebhookDispatcher) store(delivery *webhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(d.cfg.OutboxDir, webhookQueue(delivery.URL))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// Name entries by creation time so they are delivered in order
+	name := fmt.Sprintf("%d-%s.json", delivery.CreatedAt.UnixNano(), delivery.ID)
+	path := filepath.Join(dir, name)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// webhookQueue names the outbox subdirectory holding an endpoint's deliveries
+func webhookQueue(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:8])
+}
+
+// webhookBackoff doubles the delay after each failed attempt, up to an hour
+func webhookBackoff(attempts int) time.Duration {
+	delay := 10 * time.Second
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxBackoff {
+		delay = webhookMaxBackoff
+	}
+	return delay
+}
+
+func subscribed(events []string, event string) bool {
+	if len(events) == 0 {
+		return true
+	}
+	for _, e := range events {
+		if e == event || e == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"./config"
+)
+
+// webhookReceiver records the requests an endpoint received
+type webhookReceiver struct {
+	status   int
+	requests chan *http.Request
+	bodies   chan []byte
+}
+
+func newWebhookReceiver(t *testing.T, status int) (*webhookReceiver, string) {
+	t.Helper()
+	rcv := &webhookReceiver{
+		status:   status,
+		requests: make(chan *http.Request, 10),
+		bodies:   make(chan []byte, 10),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rcv.requests <- r
+		rcv.bodies <- body
+		w.WriteHeader(rcv.status)
+	}))
+	t.Cleanup(server.Close)
+	return rcv, server.URL
+}
+
+func (rcv *webhookReceiver) next(t *testing.T) (*http.Request, []byte) {
+	t.Helper()
+	select {
+	case r := <-rcv.requests:
+		return r, <-rcv.bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+		return nil, nil
+	}
+}
+
+func queuedDeliveries(t *testing.T, d *WebhookDispatcher, url string) []webhookDelivery {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(d.cfg.OutboxDir, webhookQueue(url), "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deliveries []webhookDelivery
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var delivery webhookDelivery
+		if err := json.Unmarshal(data, &delivery); err != nil {
+			t.Fatal(err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries
+}
+
+func TestWebhookSignature(t *testing.T) {
+	rcv, url := newWebhookReceiver(t, http.StatusOK)
+	d := NewWebhookDispatcher(config.WebhooksConfig{
+		OutboxDir: t.TempDir(),
+		Endpoints: []config.WebhookEndpoint{{URL: url, Secret: "s3cret"}},
+	})
+
+	d.Enqueue(EventUserCreated, webhookUserData{Username: "alice"})
+	d.deliverDue(webhookQueue(url))
+
+	r, body := rcv.next(t)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get("X-VPS-Signature") != want {
+		t.Fatalf("signature %q, want %q", r.Header.Get("X-VPS-Signature"), want)
+	}
+	if r.Header.Get("X-VPS-Event") != EventUserCreated {
+		t.Fatalf("unexpected event header %q", r.Header.Get("X-VPS-Event"))
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil || payload.ID != r.Header.Get("X-VPS-Delivery") {
+		t.Fatalf("unexpected payload %s: %v", body, err)
+	}
+	if left := queuedDeliveries(t, d, url); len(left) != 0 {
+		t.Fatalf("delivered entry left in outbox: %+v", left)
+	}
+}
+
+func TestWebhookFailureIsRescheduled(t *testing.T) {
+	rcv, url := newWebhookReceiver(t, http.StatusInternalServerError)
+	d := NewWebhookDispatcher(config.WebhooksConfig{
+		OutboxDir: t.TempDir(),
+		Endpoints: []config.WebhookEndpoint{{URL: url}},
+	})
+
+	d.Enqueue(EventUserRemoved, webhookUserData{Username: "alice"})
+	d.deliverDue(webhookQueue(url))
+	rcv.next(t)
+
+	left := queuedDeliveries(t, d, url)
+	if len(left) != 1 || left[0].Attempts != 1 || left[0].LastError == "" {
+		t.Fatalf("expected one failed attempt to be kept, got %+v", left)
+	}
+	if wait := time.Until(left[0].NextAttempt); wait < 5*time.Second || wait > 10*time.Second {
+		t.Fatalf("expected retry in about 10s, got %v", wait)
+	}
+
+	// Not due yet, so nothing is sent
+	d.deliverDue(webhookQueue(url))
+	select {
+	case <-rcv.requests:
+		t.Fatal("delivery retried before its backoff expired")
+	default:
+	}
+}
+
+func TestWebhookOutboxReplayedAfterRestart(t *testing.T) {
+	rcv, url := newWebhookReceiver(t, http.StatusOK)
+	cfg := config.WebhooksConfig{
+		OutboxDir: t.TempDir(),
+		Endpoints: []config.WebhookEndpoint{{URL: url, Secret: "old"}},
+	}
+
+	// The first process queues the event and exits before delivering it
+	NewWebhookDispatcher(cfg).Enqueue(EventUserExpired, webhookUserData{Username: "alice"})
+
+	// The secret is rotated before the daemon starts; the queued entry keeps
+	// the one it was created with
+	cfg.Endpoints[0].Secret = "new"
+	d := NewWebhookDispatcher(cfg)
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown(context.Background())
+
+	r, body := rcv.next(t)
+	mac := hmac.New(sha256.New, []byte("old"))
+	mac.Write(body)
+	if r.Header.Get("X-VPS-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatal("replayed delivery not signed with its original secret")
+	}
+	if r.Header.Get("X-VPS-Event") != EventUserExpired {
+		t.Fatalf("unexpected event %q", r.Header.Get("X-VPS-Event"))
+	}
+
+	// A second daemon must not deliver the same outbox
+	if err := NewWebhookDispatcher(cfg).Start(); err == nil {
+		t.Fatal("expected second dispatcher to be refused the outbox")
+	}
+}
+
+func TestWebhookSubscribedFiltering(t *testing.T) {
+	created, createdURL := newWebhookReceiver(t, http.StatusOK)
+	_, removedURL := newWebhookReceiver(t, http.StatusOK)
+	d := NewWebhookDispatcher(config.WebhooksConfig{
+		OutboxDir: t.TempDir(),
+		Endpoints: []config.WebhookEndpoint{
+			{URL: createdURL, Events: []string{EventUserCreated}},
+			{URL: removedURL, Events: []string{EventUserRemoved}},
+		},
+	})
+
+	d.Enqueue(EventUserCreated, webhookUserData{Username: "alice"})
+	if n := len(queuedDeliveries(t, d, createdURL)); n != 1 {
+		t.Fatalf("expected 1 delivery for subscribed endpoint, got %d", n)
+	}
+	if n := len(queuedDeliveries(t, d, removedURL)); n != 0 {
+		t.Fatalf("expected no delivery for unsubscribed endpoint, got %d", n)
+	}
+
+	d.deliverDue(webhookQueue(createdURL))
+	created.next(t)
+
+	tests := []struct {
+		events []string
+		event  string
+		want   bool
+	}{
+		{nil, EventUserCreated, true},
+		{[]string{"*"}, EventUserRemoved, true},
+		{[]string{EventUserCreated, EventUserRenewed}, EventUserRenewed, true},
+		{[]string{EventUserCreated}, EventUserRemoved, false},
+	}
+	for _, tt := range tests {
+		if got := subscribed(tt.events, tt.event); got != tt.want {
+			t.Errorf("subscribed(%v, %q) = %v, want %v", tt.events, tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{6, 320 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{50, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
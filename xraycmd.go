@@ -0,0 +1,465 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"./config"
+	"./protocols"
+)
+
+const xrayUsage = `Usage: vps_manager xray <command>
+  list                                   list inbounds and their users
+  add -tag <tag> -protocol <protocol> [options]
+                                         create an inbound and attach existing users
+  update <tag> [options]                 change an inbound's port, transport or security
+  remove <tag>                           delete an inbound
+  sync                                   apply the inbounds declared in config.json
+  routing                                apply the routing policy in config.json
+  outbound <user> <name|block|direct>    route a user through an outbound profile
+
+Options:
+  -port <port>                           defaults to the Xray port
+  -network tcp|ws|grpc|httpupgrade       -path /path, or the gRPC service name
+  -security none|tls|reality             -sni name[,name]
+  -cert <file> -key <file>               TLS certificate, defaults to the SSL one
+  -dest host:port -short-ids <n>         REALITY target site and number of short IDs
+  -method <cipher>                       Shadowsocks cipher`
+
+// xrayUsers returns the Xray UUID of every user that should have a client
+// on this server's inbounds, by username
+func (vm *VPSManager) xrayUsers() (map[string]string, error) {
+	users, err := vm.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]string)
+	for _, user := range users {
+		if user.XrayUUID != "" && !user.Suspended && onLocalNode(user) {
+			ids[user.Username] = user.XrayUUID
+		}
+	}
+	return ids, nil
+}
+
+// inboundSpec converts a declared inbound, defaulting TLS to the server's
+// SSL certificate
+func (vm *VPSManager) inboundSpec(c config.XrayInboundConfig) protocols.InboundSpec {
+	spec := protocols.InboundSpec{
+		Tag:         c.Tag,
+		Protocol:    c.Protocol,
+		Port:        c.Port,
+		Network:     c.Network,
+		Path:        c.Path,
+		Security:    c.Security,
+		ServerName:  c.ServerName,
+		CertFile:    c.CertPath,
+		KeyFile:     c.KeyPath,
+		ALPN:        c.ALPN,
+		Method:      c.Method,
+		Dest:        c.Dest,
+		ServerNames: c.ServerNames,
+		ShortIDs:    c.ShortIDs,
+	}
+	for _, route := range c.Fallbacks {
+		spec.Fallbacks = append(spec.Fallbacks, protocols.Fallback{ALPN: route.ALPN, Path: route.Path, Dest: route.Dest})
+	}
+	if spec.Security == "tls" && spec.CertFile == "" && spec.KeyFile == "" {
+		spec.CertFile = vm.Config.Protocols.SSL.CertPath
+		spec.KeyFile = vm.Config.Protocols.SSL.KeyPath
+	}
+	return spec
+}
+
+// inboundConfig describes an existing inbound as it would be declared
+func inboundConfig(spec protocols.InboundSpec) config.XrayInboundConfig {
+	c := config.XrayInboundConfig{
+		Tag:         spec.Tag,
+		Protocol:    spec.Protocol,
+		Port:        spec.Port,
+		Network:     spec.Network,
+		Path:        spec.Path,
+		Security:    spec.Security,
+		ServerName:  spec.ServerName,
+		CertPath:    spec.CertFile,
+		KeyPath:     spec.KeyFile,
+		ALPN:        spec.ALPN,
+		Method:      spec.Method,
+		Dest:        spec.Dest,
+		ServerNames: spec.ServerNames,
+		ShortIDs:    spec.ShortIDs,
+	}
+	for _, fallback := range spec.Fallbacks {
+		c.Fallbacks = append(c.Fallbacks, config.XrayFallbackRoute{ALPN: fallback.ALPN, Path: fallback.Path, Dest: fallback.Dest})
+	}
+	return c
+}
+
+// declaredInbound returns the index of an inbound in config.json, or -1
+func (vm *VPSManager) declaredInbound(tag string) int {
+	for i, inbound := range vm.Config.Protocols.Xray.Inbounds {
+		if inbound.Tag == tag {
+			return i
+		}
+	}
+	return -1
+}
+
+// saveInbounds writes the declared inbounds back to config.json, so the
+// next sync keeps what was changed from the command line, and brings the
+// nginx routes to WebSocket inbounds up to date
+func (vm *VPSManager) saveInbounds() error {
+	if _, err := vm.SyncNginx(); err != nil {
+		return err
+	}
+	if vm.ConfigPath == "" {
+		return nil
+	}
+	return config.SaveConfig(vm.ConfigPath, vm.Config)
+}
+
+// fallbackConfig returns the fallback settings with defaults filled in
+func fallbackConfig(cfg *config.Config) config.XrayFallbackConfig {
+	fallback := cfg.Protocols.Xray.Fallback
+	if fallback.Tag == "" {
+		fallback.Tag = "vless-fallback"
+	}
+	if fallback.WebSocketPort == 0 {
+		fallback.WebSocketPort = 10080
+	}
+	return fallback
+}
+
+// fallbackInbound is the VLESS over TCP with TLS inbound that takes the Xray
+// port and falls back to nginx's WebSocket sites, which serve the
+// WebSocket paths and pass everything else on to the HTTP site. The
+// fallback cannot pick out the paths itself, as Xray only matches them
+// exactly and users each have their own.
+func (vm *VPSManager) fallbackInbound() config.XrayInboundConfig {
+	fallback := fallbackConfig(vm.Config)
+	return config.XrayInboundConfig{
+		Tag:      fallback.Tag,
+		Protocol: "vless",
+		Port:     vm.Config.Protocols.Xray.Port,
+		Network:  "tcp",
+		Security: "tls",
+		// nginx serves HTTP/1.1 only, so h2 is not offered
+		ALPN: []string{"http/1.1"},
+		Fallbacks: []config.XrayFallbackRoute{
+			{Dest: fmt.Sprintf("127.0.0.1:%d", fallback.WebSocketPort)},
+		},
+	}
+}
+
+// declaredInbounds returns the inbounds to keep in sync: those declared in
+// config.json and, if enabled, the fallback inbound
+func (vm *VPSManager) declaredInbounds() []config.XrayInboundConfig {
+	declared := vm.Config.Protocols.Xray.Inbounds
+	if vm.Config.Protocols.Xray.Fallback.Enabled {
+		declared = append(declared[:len(declared):len(declared)], vm.fallbackInbound())
+	}
+	return declared
+}
+
+// SyncXrayInbounds creates or updates the inbounds declared in config.json
+// and returns the tags that changed
+func (vm *VPSManager) SyncXrayInbounds() ([]string, error) {
+	declared := vm.declaredInbounds()
+	if len(declared) == 0 {
+		return nil, nil
+	}
+	users, err := vm.xrayUsers()
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]protocols.InboundSpec, 0, len(declared))
+	for _, c := range declared {
+		specs = append(specs, vm.inboundSpec(c))
+	}
+	changed, err := vm.XrayMgr.SyncInbounds(specs, users)
+	if err != nil || len(changed) == 0 {
+		return changed, err
+	}
+	_, err = vm.SyncNginx()
+	return changed, err
+}
+
+// AddXrayInbound creates an inbound, attaches the existing users to it and
+// declares it in config.json
+func (vm *VPSManager) AddXrayInbound(c config.XrayInboundConfig) error {
+	users, err := vm.xrayUsers()
+	if err != nil {
+		return err
+	}
+	if err := vm.XrayMgr.AddInbound(vm.inboundSpec(c), users); err != nil {
+		return err
+	}
+	if i := vm.declaredInbound(c.Tag); i >= 0 {
+		vm.Config.Protocols.Xray.Inbounds[i] = c
+	} else {
+		vm.Config.Protocols.Xray.Inbounds = append(vm.Config.Protocols.Xray.Inbounds, c)
+	}
+	return vm.saveInbounds()
+}
+
+// UpdateXrayInbound changes an inbound and its declaration in config.json
+func (vm *VPSManager) UpdateXrayInbound(c config.XrayInboundConfig) error {
+	if err := vm.XrayMgr.UpdateInbound(vm.inboundSpec(c)); err != nil {
+		return err
+	}
+	if i := vm.declaredInbound(c.Tag); i >= 0 {
+		vm.Config.Protocols.Xray.Inbounds[i] = c
+	} else {
+		vm.Config.Protocols.Xray.Inbounds = append(vm.Config.Protocols.Xray.Inbounds, c)
+	}
+	return vm.saveInbounds()
+}
+
+// RemoveXrayInbound deletes an inbound and its declaration in config.json
+func (vm *VPSManager) RemoveXrayInbound(tag string) error {
+	err := vm.XrayMgr.RemoveInbound(tag)
+	i := vm.declaredInbound(tag)
+	if err != nil && !(errors.Is(err, protocols.ErrInboundNotFound) && i >= 0) {
+		return err
+	}
+	if i >= 0 {
+		inbounds := vm.Config.Protocols.Xray.Inbounds
+		vm.Config.Protocols.Xray.Inbounds = append(inbounds[:i:i], inbounds[i+1:]...)
+	}
+	return vm.saveInbounds()
+}
+
+// routingPolicy builds the Xray routing policy from config.json and the
+// users' outbound assignments
+func (vm *VPSManager) routingPolicy() (protocols.RoutingPolicy, error) {
+	routing := vm.Config.Protocols.Xray.Routing
+	policy := protocols.RoutingPolicy{
+		BlockBitTorrent: routing.BlockBitTorrent,
+		BlockGeosite:    routing.BlockGeosite,
+		UserOutbounds:   make(map[string]string),
+	}
+	for _, outbound := range routing.Outbounds {
+		policy.Profiles = append(policy.Profiles, protocols.OutboundProfile{
+			Name:     outbound.Name,
+			Protocol: outbound.Protocol,
+			Settings: outbound.Settings,
+		})
+	}
+
+	users, err := vm.GetUsers()
+	if err != nil {
+		return policy, err
+	}
+	for _, user := range users {
+		if user.XrayOutbound != "" && onLocalNode(user) {
+			policy.UserOutbounds[user.Username] = user.XrayOutbound
+		}
+	}
+	return policy, nil
+}
+
+// ApplyXrayRouting writes the routing policy to the Xray config and reports
+// whether it changed
+func (vm *VPSManager) ApplyXrayRouting() (bool, error) {
+	policy, err := vm.routingPolicy()
+	if err != nil {
+		return false, err
+	}
+	return vm.XrayMgr.ApplyRouting(policy)
+}
+
+// SetUserOutbound routes a user's Xray traffic through an outbound profile
+// from config.json, the built-in "block" outbound, or with "direct" or an
+// empty name, the server's own connection
+func (vm *VPSManager) SetUserOutbound(username, outbound string) error {
+	if outbound == "direct" {
+		outbound = ""
+	}
+	known := outbound == "" || outbound == "block"
+	for _, profile := range vm.Config.Protocols.Xray.Routing.Outbounds {
+		known = known || profile.Name == outbound
+	}
+	if !known {
+		return fmt.Errorf("%w: unknown outbound %q", ErrInvalidInput, outbound)
+	}
+
+	var previous string
+	if err := vm.updateUser(username, func(u *User) {
+		previous = u.XrayOutbound
+		u.XrayOutbound = outbound
+	}); err != nil {
+		return err
+	}
+	if _, err := vm.ApplyXrayRouting(); err != nil {
+		vm.updateUser(username, func(u *User) { u.XrayOutbound = previous })
+		return err
+	}
+	return nil
+}
+
+// currentInbound returns the declaration of an inbound, or describes it
+// from the Xray config if it was never declared
+func (vm *VPSManager) currentInbound(tag string) (config.XrayInboundConfig, error) {
+	if i := vm.declaredInbound(tag); i >= 0 {
+		return vm.Config.Protocols.Xray.Inbounds[i], nil
+	}
+	inbounds, err := vm.XrayMgr.Inbounds()
+	if err != nil {
+		return config.XrayInboundConfig{}, err
+	}
+	for _, inbound := range inbounds {
+		if inbound.Tag == tag {
+			return inboundConfig(protocols.InboundSpecOf(inbound)), nil
+		}
+	}
+	return config.XrayInboundConfig{}, fmt.Errorf("%w: %s", protocols.ErrInboundNotFound, tag)
+}
+
+// parseInboundFlags applies the options in args to c. Options that are not
+// given keep their value in c.
+func parseInboundFlags(name string, c *config.XrayInboundConfig, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&c.Tag, "tag", c.Tag, "")
+	flags.StringVar(&c.Protocol, "protocol", c.Protocol, "")
+	flags.IntVar(&c.Port, "port", c.Port, "")
+	flags.StringVar(&c.Network, "network", c.Network, "")
+	flags.StringVar(&c.Path, "path", c.Path, "")
+	flags.StringVar(&c.Security, "security", c.Security, "")
+	flags.StringVar(&c.CertPath, "cert", c.CertPath, "")
+	flags.StringVar(&c.KeyPath, "key", c.KeyPath, "")
+	flags.StringVar(&c.Method, "method", c.Method, "")
+	flags.StringVar(&c.Dest, "dest", c.Dest, "")
+	flags.IntVar(&c.ShortIDs, "short-ids", c.ShortIDs, "")
+	sni := c.ServerName
+	if len(c.ServerNames) > 0 {
+		sni = strings.Join(c.ServerNames, ",")
+	}
+	flags.StringVar(&sni, "sni", sni, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return fmt.Errorf("%w\n%s", ErrInvalidInput, xrayUsage)
+	}
+
+	c.ServerName, c.ServerNames = "", nil
+	if c.Security == "reality" && sni != "" {
+		c.ServerNames = strings.Split(sni, ",")
+	} else if c.Security == "tls" {
+		c.ServerName = sni
+	}
+	return nil
+}
+
+// runXrayCommand manages the Xray inbounds
+func runXrayCommand(manager *VPSManager, actor *Actor, args []string) error {
+	if err := actor.require(RoleOwner); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%w\n%s", ErrInvalidInput, xrayUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		inbounds, err := manager.XrayMgr.Inbounds()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-16s %-12s %6s %-12s %-8s %-16s %5s\n", "Tag", "Protocol", "Port", "Transport", "Security", "Path", "Users")
+		for _, inbound := range inbounds {
+			spec := protocols.InboundSpecOf(inbound)
+			fmt.Printf("%-16s %-12s %6d %-12s %-8s %-16s %5d\n", spec.Tag, spec.Protocol, spec.Port,
+				spec.Network, spec.Security, spec.Path, len(inbound.Settings.Clients))
+		}
+
+	case "add":
+		var c config.XrayInboundConfig
+		if err := parseInboundFlags("xray add", &c, args[1:]); err != nil {
+			return err
+		}
+		if c.Tag == "" || c.Protocol == "" {
+			return fmt.Errorf("%w\n%s", ErrInvalidInput, xrayUsage)
+		}
+		err := manager.AddXrayInbound(c)
+		manager.audit(actor.Admin.Name, "xray.inbound.add", c.Tag, []string{"xray"}, err,
+			fmt.Sprintf("%s on port %d", c.Protocol, c.Port))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added inbound %s\n", c.Tag)
+
+	case "update":
+		if len(args) < 2 {
+			return fmt.Errorf("%w\n%s", ErrInvalidInput, xrayUsage)
+		}
+		c, err := manager.currentInbound(args[1])
+		if err != nil {
+			return err
+		}
+		if err := parseInboundFlags("xray update", &c, args[2:]); err != nil {
+			return err
+		}
+		if c.Tag != args[1] {
+			return fmt.Errorf("%w: the tag of an inbound cannot be changed", ErrInvalidInput)
+		}
+		err = manager.UpdateXrayInbound(c)
+		manager.audit(actor.Admin.Name, "xray.inbound.update", c.Tag, []string{"xray"}, err,
+			fmt.Sprintf("%s on port %d, %s/%s", c.Protocol, c.Port, c.Network, c.Security))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Updated inbound %s\n", c.Tag)
+
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf("%w\n%s", ErrInvalidInput, xrayUsage)
+		}
+		err := manager.RemoveXrayInbound(args[1])
+		manager.audit(actor.Admin.Name, "xray.inbound.remove", args[1], []string{"xray"}, err, "")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed inbound %s\n", args[1])
+
+	case "sync":
+		changed, err := manager.SyncXrayInbounds()
+		manager.audit(actor.Admin.Name, "xray.inbound.sync", "", []string{"xray"}, err, strings.Join(changed, ","))
+		if err != nil {
+			return err
+		}
+		if len(changed) == 0 {
+			fmt.Println("Inbounds are up to date")
+		} else {
+			fmt.Printf("Applied inbounds: %s\n", strings.Join(changed, ", "))
+		}
+
+	case "routing":
+		changed, err := manager.ApplyXrayRouting()
+		manager.audit(actor.Admin.Name, "xray.routing.apply", "", []string{"xray"}, err, "")
+		if err != nil {
+			return err
+		}
+		if changed {
+			fmt.Println("Applied the routing policy")
+		} else {
+			fmt.Println("Routing is up to date")
+		}
+
+	case "outbound":
+		if len(args) != 3 {
+			return fmt.Errorf("%w\n%s", ErrInvalidInput, xrayUsage)
+		}
+		err := manager.SetUserOutbound(args[1], args[2])
+		manager.audit(actor.Admin.Name, "xray.outbound.assign", args[1], []string{"xray"}, err, "outbound "+args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Routed %s through %s\n", args[1], args[2])
+
+	default:
+		return fmt.Errorf("%w\n%s", ErrInvalidInput, xrayUsage)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"./config"
+	"./protocols"
+)
+
+func TestAddXrayInboundAttachesActiveUsers(t *testing.T) {
+	m := newTestManager(t)
+	m.Config.Protocols.SSL.CertPath = "/etc/ssl/certs/vps.crt"
+	m.Config.Protocols.SSL.KeyPath = "/etc/ssl/private/vps.key"
+	m.ConfigPath = filepath.Join(t.TempDir(), "config.json")
+	for _, name := range []string{"alice", "bobby"} {
+		if err := m.AddUser(name, "secret1", 30); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.SuspendUser("bobby"); err != nil {
+		t.Fatal(err)
+	}
+
+	inbound := config.XrayInboundConfig{Tag: "trojan-ws", Protocol: "trojan", Network: "ws", Path: "/tj", Security: "tls"}
+	if err := m.AddXrayInbound(inbound); err != nil {
+		t.Fatal(err)
+	}
+	if users := m.xray.attached[0]; len(users) != 1 || users["alice"] != "00000000-0000-0000-0000-000000000001" {
+		t.Fatalf("unexpected users attached: %v", users)
+	}
+	if spec := m.xray.specs[0]; spec.CertFile != "/etc/ssl/certs/vps.crt" || spec.KeyFile != "/etc/ssl/private/vps.key" {
+		t.Fatalf("TLS did not default to the SSL certificate: %+v", spec)
+	}
+
+	saved, err := config.LoadConfig(m.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if declared := saved.Protocols.Xray.Inbounds; len(declared) != 1 || declared[0].Path != "/tj" || declared[0].CertPath != "" {
+		t.Fatalf("inbound not declared in config: %+v", declared)
+	}
+
+	// Inbounds already gone from Xray can still be dropped from the config
+	m.xray.fail["RemoveInbound"] = true
+	if err := m.RemoveXrayInbound("trojan-ws"); !errors.Is(err, errStub) {
+		t.Fatalf("expected the Xray error, got %v", err)
+	}
+	m.xray.fail["RemoveInbound"] = false
+	if err := m.RemoveXrayInbound("trojan-ws"); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Config.Protocols.Xray.Inbounds) != 0 {
+		t.Fatalf("inbound still declared: %+v", m.Config.Protocols.Xray.Inbounds)
+	}
+}
+
+func TestParseInboundFlagsKeepsUnsetOptions(t *testing.T) {
+	c := config.XrayInboundConfig{Tag: "vless-reality", Protocol: "vless", Port: 443, Security: "reality",
+		Dest: "www.example.org:443", ServerNames: []string{"www.example.org", "example.org"}}
+	if err := parseInboundFlags("xray update", &c, []string{"-port", "8443"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 8443 || c.Dest != "www.example.org:443" || len(c.ServerNames) != 2 {
+		t.Fatalf("unexpected config: %+v", c)
+	}
+
+	if err := parseInboundFlags("xray update", &c, []string{"-security", "tls", "-sni", "vpn.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerName != "vpn.example.com" || c.ServerNames != nil {
+		t.Fatalf("unexpected server names: %+v", c)
+	}
+	if err := parseInboundFlags("xray update", &c, []string{"extra"}); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput, got %v", err)
+	}
+}
+
+func TestSyncXrayInboundsSkipsWithoutDeclarations(t *testing.T) {
+	m := newTestManager(t)
+	if _, err := m.SyncXrayInbounds(); err != nil || len(m.xray.calls) != 0 {
+		t.Fatalf("unexpected sync: %v %v", err, m.xray.calls)
+	}
+	m.Config.Protocols.Xray.Inbounds = []config.XrayInboundConfig{{Tag: "vmess-in", Protocol: "vmess"}}
+	if _, err := m.SyncXrayInbounds(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.xray.specs) != 1 || !reflect.DeepEqual(m.xray.specs[0], protocols.InboundSpec{Tag: "vmess-in", Protocol: "vmess"}) {
+		t.Fatalf("unexpected specs: %+v", m.xray.specs)
+	}
+}
+
+func TestSetUserOutbound(t *testing.T) {
+	m := newTestManager(t)
+	m.Config.Protocols.Xray.Routing = config.XrayRoutingConfig{
+		BlockBitTorrent: true,
+		Outbounds:       []config.XrayOutboundConfig{{Name: "exit-de", Protocol: "socks"}},
+	}
+	if err := m.AddUser("alice", "secret1", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetUserOutbound("alice", "exit-us"); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput for an unknown outbound, got %v", err)
+	}
+	if err := m.SetUserOutbound("alice", "exit-de"); err != nil {
+		t.Fatal(err)
+	}
+	policy := m.xray.routing[len(m.xray.routing)-1]
+	if !policy.BlockBitTorrent || policy.UserOutbounds["alice"] != "exit-de" || policy.Profiles[0].Name != "exit-de" {
+		t.Fatalf("unexpected policy: %+v", policy)
+	}
+
+	// A failed apply leaves the assignment as it was
+	m.xray.fail["ApplyRouting"] = true
+	if err := m.SetUserOutbound("alice", "direct"); !errors.Is(err, errStub) {
+		t.Fatalf("expected the Xray error, got %v", err)
+	}
+	if user, _ := m.GetUser("alice"); user.XrayOutbound != "exit-de" {
+		t.Fatalf("assignment not restored: %q", user.XrayOutbound)
+	}
+}
+
+func TestFallbackInboundSynced(t *testing.T) {
+	m := newTestManager(t)
+	m.Config.Protocols.Xray.Port = 443
+	m.Config.Protocols.SSL.CertPath = "/etc/ssl/certs/vps.crt"
+	m.Config.Protocols.SSL.KeyPath = "/etc/ssl/private/vps.key"
+	m.Config.Protocols.Xray.Fallback.Enabled = true
+
+	if _, err := m.SyncXrayInbounds(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.xray.specs) != 1 {
+		t.Fatalf("expected the fallback inbound, got %+v", m.xray.specs)
+	}
+	spec := m.xray.specs[0]
+	want := []protocols.Fallback{{Dest: "127.0.0.1:10080"}}
+	if spec.Tag != "vless-fallback" || spec.Port != 443 || spec.Security != "tls" || spec.CertFile != "/etc/ssl/certs/vps.crt" ||
+		!reflect.DeepEqual(spec.Fallbacks, want) {
+		t.Fatalf("unexpected fallback inbound: %+v", spec)
+	}
+}